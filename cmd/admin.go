@@ -15,13 +15,17 @@
 package cmd
 
 import (
+	"bytes"
 	"database/sql"
 	"encoding/base64"
 	"encoding/json"
 	"flag"
 	"fmt"
+	"io/ioutil"
+	"net/http"
 	"net/url"
 	"os"
+	"time"
 
 	"github.com/gorhill/cronexpr"
 	"github.com/satori/go.uuid"
@@ -35,15 +39,19 @@ type adminService struct {
 
 func AdminParse(args []string, logger *zap.Logger) {
 	if len(args) == 0 {
-		logger.Fatal("Admin requires a subcommand. Available commands are: 'create-leaderboard'.")
+		logger.Fatal("Admin requires a subcommand. Available commands are: 'create-leaderboard', 'disable-user', 'enable-user'.")
 	}
 
 	var exec func([]string, *zap.Logger)
 	switch args[0] {
 	case "create-leaderboard":
 		exec = createLeaderboard
+	case "disable-user":
+		exec = disableUser
+	case "enable-user":
+		exec = enableUser
 	default:
-		logger.Fatal("Unrecognized admin subcommand. Available commands are: 'create-leaderboard'.")
+		logger.Fatal("Unrecognized admin subcommand. Available commands are: 'create-leaderboard', 'disable-user', 'enable-user'.")
 	}
 
 	exec(args[1:], logger)
@@ -57,6 +65,7 @@ func createLeaderboard(args []string, logger *zap.Logger) {
 	var sortOrder string
 	var resetSchedule string
 	var metadata string
+	var appID string
 
 	flags := flag.NewFlagSet("admin", flag.ExitOnError)
 	flags.StringVar(&dsns, "db", "root@localhost:26257", "CockroachDB JDBC connection details.")
@@ -65,6 +74,7 @@ func createLeaderboard(args []string, logger *zap.Logger) {
 	flags.StringVar(&sortOrder, "sort", "desc", "Leaderboard sort order, 'asc' or 'desc'.")
 	flags.StringVar(&resetSchedule, "reset", "", "Optional reset schedule in CRON format.")
 	flags.StringVar(&metadata, "metadata", "{}", "Optional additional metadata as a JSON string.")
+	flags.StringVar(&appID, "app", "", "Optional ID of the app the leaderboard belongs to, empty for the default app.")
 
 	if err := flags.Parse(args); err != nil {
 		logger.Fatal("Could not parse admin flags.")
@@ -74,8 +84,8 @@ func createLeaderboard(args []string, logger *zap.Logger) {
 		logger.Fatal("Database connection details are required.")
 	}
 
-	query := `INSERT INTO leaderboard (id, authoritative, sort_order, reset_schedule, metadata)
-	VALUES ($1, $2, $3, $4, $5)`
+	query := `INSERT INTO leaderboard (id, authoritative, sort_order, reset_schedule, metadata, app_id)
+	VALUES ($1, $2, $3, $4, $5, $6)`
 	params := []interface{}{}
 
 	// ID.
@@ -118,6 +128,9 @@ func createLeaderboard(args []string, logger *zap.Logger) {
 	}
 	params = append(params, metadataBytes)
 
+	// App.
+	params = append(params, appID)
+
 	rawurl := fmt.Sprintf("postgresql://%s?sslmode=disable", dsns)
 	url, err := url.Parse(rawurl)
 	if err != nil {
@@ -150,3 +163,96 @@ func createLeaderboard(args []string, logger *zap.Logger) {
 
 	logger.Info("Leaderboard created", zap.String("base64(id)", base64.StdEncoding.EncodeToString(params[0].([]byte))))
 }
+
+func disableUser(args []string, logger *zap.Logger) {
+	var ops string
+	var key string
+	var opsTLS bool
+	var id string
+	var reason string
+	var duration time.Duration
+
+	flags := flag.NewFlagSet("admin", flag.ExitOnError)
+	flags.StringVar(&ops, "ops", "127.0.0.1:7351", "Address of the ops port of a running server.")
+	flags.StringVar(&key, "key", "", "Ops key of the running server, as set in its ops_key config.")
+	flags.BoolVar(&opsTLS, "tls", false, "Connect to the ops port over TLS.")
+	flags.StringVar(&id, "id", "", "ID of the user to disable.")
+	flags.StringVar(&reason, "reason", "", "Optional reason shown to the user.")
+	flags.DurationVar(&duration, "duration", 0, "Optional duration, e.g. '72h'. The user is disabled indefinitely if not set.")
+
+	if err := flags.Parse(args); err != nil {
+		logger.Fatal("Could not parse admin flags.")
+	}
+
+	if _, err := uuid.FromString(id); err != nil {
+		logger.Fatal("A valid user ID is required.")
+	}
+	if duration < 0 {
+		logger.Fatal("Duration must not be negative.")
+	}
+
+	until := int64(0)
+	if duration > 0 {
+		until = time.Now().UTC().Add(duration).UnixNano() / int64(time.Millisecond)
+	}
+
+	// The running server updates the user and closes their live sessions.
+	opsRequest(logger, ops, key, opsTLS, "/v0/user/disable", map[string]interface{}{
+		"user_id": id,
+		"reason":  reason,
+		"until":   until,
+	})
+	logger.Info("User disabled", zap.String("id", id))
+}
+
+func enableUser(args []string, logger *zap.Logger) {
+	var ops string
+	var key string
+	var opsTLS bool
+	var id string
+
+	flags := flag.NewFlagSet("admin", flag.ExitOnError)
+	flags.StringVar(&ops, "ops", "127.0.0.1:7351", "Address of the ops port of a running server.")
+	flags.StringVar(&key, "key", "", "Ops key of the running server, as set in its ops_key config.")
+	flags.BoolVar(&opsTLS, "tls", false, "Connect to the ops port over TLS.")
+	flags.StringVar(&id, "id", "", "ID of the user to enable.")
+
+	if err := flags.Parse(args); err != nil {
+		logger.Fatal("Could not parse admin flags.")
+	}
+
+	if _, err := uuid.FromString(id); err != nil {
+		logger.Fatal("A valid user ID is required.")
+	}
+
+	opsRequest(logger, ops, key, opsTLS, "/v0/user/enable", map[string]interface{}{
+		"user_id": id,
+	})
+	logger.Info("User enabled", zap.String("id", id))
+}
+
+func opsRequest(logger *zap.Logger, ops string, key string, opsTLS bool, path string, body map[string]interface{}) {
+	scheme := "http"
+	if opsTLS {
+		scheme = "https"
+	}
+	bodyBytes, _ := json.Marshal(body)
+	req, err := http.NewRequest("POST", fmt.Sprintf("%s://%s%s", scheme, ops, path), bytes.NewReader(bodyBytes))
+	if err != nil {
+		logger.Fatal("Could not create request", zap.Error(err))
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+key)
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	res, err := client.Do(req)
+	if err != nil {
+		logger.Fatal("Could not reach server ops port", zap.Error(err))
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		resBody, _ := ioutil.ReadAll(res.Body)
+		logger.Fatal("Server rejected request", zap.Int("status", res.StatusCode), zap.String("response", string(resBody)))
+	}
+}
@@ -30,6 +30,7 @@ import (
 type config struct {
 	Host string
 	Port int
+	TLS  bool
 }
 
 type Doctor struct {
@@ -42,6 +43,7 @@ func DoctorParse(args []string) {
 	flags := flag.NewFlagSet("doctor", flag.ExitOnError)
 	flags.StringVar(&c.Host, "host", "127.0.0.1", "Nakama node IP/hostname to connect to")
 	flags.IntVar(&c.Port, "port", 7351, "Nakama node port number to connect to")
+	flags.BoolVar(&c.TLS, "tls", false, "Connect to the Nakama node over TLS")
 
 	if err := flags.Parse(args); err != nil {
 		log.Fatalln("Could not parse doctor flags")
@@ -58,11 +60,16 @@ func (d *Doctor) start() {
 	log.Printf("host: %s\n", d.config.Host)
 	log.Printf("port: %d\n", d.config.Port)
 
+	scheme := "http"
+	if d.config.TLS {
+		scheme = "https"
+	}
+
 	info := make(map[string]interface{})
-	request(d.client, fmt.Sprintf("http://%s:%d/v0/info", d.config.Host, d.config.Port), &info)
+	request(d.client, fmt.Sprintf("%s://%s:%d/v0/info", scheme, d.config.Host, d.config.Port), &info)
 
 	config := make(map[string]interface{})
-	request(d.client, fmt.Sprintf("http://%s:%d/v0/config", d.config.Host, d.config.Port), &config)
+	request(d.client, fmt.Sprintf("%s://%s:%d/v0/config", scheme, d.config.Host, d.config.Port), &config)
 
 	for k, v := range info {
 		fmt.Printf(k+": %v\n", v)
@@ -112,7 +119,8 @@ func request(client *http.Client, url string, to interface{}) {
 }
 
 func isProtected(key string) bool {
-	protected := []string{"Dsns", "ServerKey", "EncryptionKey", "Steam", "GossipJoin", "GossipBindAddr"}
+	// Keys are matched as they appear in the JSON config, in snake case.
+	protected := []string{"dsns", "server_key", "apps", "encryption_key", "signing_keys", "steam", "smtp", "gossip_join", "gossip_bind_addr", "gossip_secret_key"}
 	for _, p := range protected {
 		if key == p {
 			return true
@@ -93,14 +93,49 @@ func main() {
 	// Check migration status and log if the schema has diverged.
 	cmd.MigrationStartupCheck(multiLogger, db)
 
-	trackerService := server.NewTrackerService(config.GetName())
-	statsService := server.NewStatsService(jsonLogger, config, semver, trackerService, startedAt)
+	// Presences are shared with other nodes when gossip is configured.
+	var trackerService server.Tracker
+	var clusterTracker *server.ClusterTracker
+	var messageForwarder server.MessageForwarder
+	var matchForwarder server.MatchForwarder
+	if config.GetCluster().GossipBindAddr != "" {
+		var err error
+		if clusterTracker, err = server.NewClusterTracker(jsonLogger, config); err != nil {
+			multiLogger.Fatal("Failed initializing cluster", zap.Error(err))
+		}
+		trackerService = clusterTracker
+		messageForwarder = clusterTracker
+		matchForwarder = clusterTracker
+	} else {
+		trackerService = server.NewTrackerService(config.GetName())
+	}
+	authLimiter := server.NewAuthLimiter(config)
 	sessionRegistry := server.NewSessionRegistry(jsonLogger, config, trackerService)
-	messageRouter := server.NewMessageRouterService(sessionRegistry)
+	statsService := server.NewStatsService(jsonLogger, config, semver, trackerService, authLimiter, sessionRegistry, startedAt)
+	messageRouter := server.NewMessageRouterService(config.GetName(), sessionRegistry, messageForwarder)
 	presenceNotifier := server.NewPresenceNotifier(jsonLogger, config.GetName(), trackerService, messageRouter)
 	trackerService.AddDiffListener(presenceNotifier.HandleDiff)
-	authService := server.NewAuthenticationService(jsonLogger, config, db, statsService, sessionRegistry, trackerService, messageRouter)
-	opsService := server.NewOpsService(jsonLogger, multiLogger, semver, config, statsService)
+	matchRegistry := server.NewMatchRegistry(jsonLogger, config, trackerService, messageRouter, matchForwarder)
+	trackerService.AddDiffListener(matchRegistry.HandleDiff)
+	runtime, err := server.NewRuntime(jsonLogger, multiLogger, db, config, matchRegistry)
+	if err != nil {
+		multiLogger.Fatal("Failed initializing runtime modules", zap.Error(err))
+	}
+	mailSender, err := server.NewMailSender(jsonLogger, multiLogger, config)
+	if err != nil {
+		multiLogger.Fatal("Failed initializing mail sender", zap.Error(err))
+	}
+	keyring, err := server.NewSessionKeyring(config)
+	if err != nil {
+		multiLogger.Fatal("Failed loading session signing keys", zap.Error(err))
+	}
+	apps, err := server.NewAppRegistry(config)
+	if err != nil {
+		multiLogger.Fatal("Failed loading apps", zap.Error(err))
+	}
+	customIDVerifier := server.NewCustomIDVerifier(config)
+	authService := server.NewAuthenticationService(jsonLogger, config, db, statsService, sessionRegistry, trackerService, messageRouter, runtime, matchRegistry, mailSender, authLimiter, keyring, apps, customIDVerifier)
+	opsService := server.NewOpsService(jsonLogger, multiLogger, semver, config, db, statsService, sessionRegistry)
 
 	gaenabled := len(os.Getenv("NAKAMA_TELEMETRY")) < 1
 	cookie := newOrLoadCookie(config.GetDataDir())
@@ -109,6 +144,14 @@ func main() {
 		runTelemetry(jsonLogger, http.DefaultClient, gacode, cookie)
 	}
 
+	if clusterTracker != nil {
+		clusterTracker.SetMessageRouter(messageRouter)
+		clusterTracker.SetMatchRegistry(matchRegistry)
+		clusterTracker.Join()
+	}
+
+	authService.StartServer(multiLogger)
+
 	// Respect OS stop signals
 	c := make(chan os.Signal, 2)
 	signal.Notify(c, os.Interrupt, syscall.SIGINT, syscall.SIGTERM)
@@ -117,19 +160,25 @@ func main() {
 		<-c
 		multiLogger.Info("Shutting down")
 
-		trackerService.Stop()
+		// Requests in progress finish before matches and the database go away.
 		authService.Stop()
 		opsService.Stop()
+		matchRegistry.Stop()
+		trackerService.Stop()
+		authLimiter.Stop()
+
+		if err := db.Close(); err != nil {
+			multiLogger.Error("Could not close database connections", zap.Error(err))
+		}
 
 		if gaenabled {
 			ga.SendSessionStop(http.DefaultClient, gacode, cookie)
 		}
 
+		multiLogger.Info("Shutdown complete")
 		os.Exit(0)
 	}()
 
-	authService.StartServer(multiLogger)
-
 	multiLogger.Info("Startup done")
 	select {}
 }
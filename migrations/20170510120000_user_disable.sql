@@ -0,0 +1,24 @@
+/*
+ * Copyright 2017 The Nakama Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+-- +migrate Up
+ALTER TABLE users ADD COLUMN disabled_reason VARCHAR(255);
+-- 0 means disabled indefinitely, only relevant while disabled_at is set.
+ALTER TABLE users ADD COLUMN disabled_until INT DEFAULT 0 NOT NULL;
+
+-- +migrate Down
+ALTER TABLE users DROP COLUMN IF EXISTS disabled_until;
+ALTER TABLE users DROP COLUMN IF EXISTS disabled_reason;
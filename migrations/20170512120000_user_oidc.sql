@@ -0,0 +1,25 @@
+/*
+ * Copyright 2017 The Nakama Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+
+-- +migrate Up
+-- OpenID Connect identity, stored as the provider's issuer and the subject joined with a "|".
+ALTER TABLE users ADD COLUMN oidc_id VARCHAR(255);
+CREATE UNIQUE INDEX IF NOT EXISTS users_oidc_id_key ON users (oidc_id);
+
+-- +migrate Down
+DROP INDEX IF EXISTS users@users_oidc_id_key;
+ALTER TABLE users DROP COLUMN IF EXISTS oidc_id;
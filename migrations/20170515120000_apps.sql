@@ -0,0 +1,111 @@
+/*
+ * Copyright 2017 The Nakama Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+-- Storage is copied to a new table with the app in its primary key, which can't be done together with the copy in one
+-- transaction, so this runs without one.
+-- +migrate Up notransaction
+CREATE TABLE IF NOT EXISTS storage_app (
+    PRIMARY KEY (app_id, bucket, collection, user_id, record, deleted_at),
+    id         BYTEA       NOT NULL,
+    app_id     VARCHAR(64) DEFAULT '' NOT NULL, -- empty for the default app
+    user_id    BYTEA,
+    bucket     VARCHAR(70) NOT NULL,
+    collection VARCHAR(70) NOT NULL,
+    record     VARCHAR(70) NOT NULL,
+    -- FIXME replace with JSONB
+    value      BYTEA       DEFAULT '{}' CHECK (length(value) < 16000) NOT NULL,
+    version    BYTEA       NOT NULL,
+    read       SMALLINT    DEFAULT 1 CHECK (read >= 0) NOT NULL,
+    write      SMALLINT    DEFAULT 1 CHECK (write >= 0) NOT NULL,
+    created_at INT         CHECK (created_at > 0) NOT NULL,
+    updated_at INT         CHECK (updated_at > 0) NOT NULL,
+    -- FIXME replace with TTL support
+    expires_at INT         CHECK (expires_at >= 0) DEFAULT 0 NOT NULL,
+    deleted_at INT         CHECK (deleted_at >= 0) DEFAULT 0 NOT NULL
+);
+INSERT INTO storage_app (id, app_id, user_id, bucket, collection, record, value, version, read, write, created_at, updated_at, expires_at, deleted_at)
+SELECT id, '', user_id, bucket, collection, record, value, version, read, write, created_at, updated_at, expires_at, deleted_at
+FROM storage;
+DROP TABLE IF EXISTS storage;
+ALTER TABLE storage_app RENAME TO storage;
+CREATE INDEX IF NOT EXISTS read_idx ON storage (read);
+CREATE INDEX IF NOT EXISTS write_idx ON storage (write);
+CREATE INDEX IF NOT EXISTS version_idx ON storage (version);
+-- For sync fetch
+CREATE INDEX IF NOT EXISTS user_id_bucket_updated_at_idx ON storage (user_id, bucket, updated_at);
+-- For bulk deletes
+CREATE INDEX IF NOT EXISTS user_id_deleted_at_idx ON storage (user_id, deleted_at);
+CREATE INDEX IF NOT EXISTS user_id_bucket_deleted_at_idx ON storage (user_id, bucket, deleted_at);
+CREATE INDEX IF NOT EXISTS user_id_bucket_collection_deleted_at_idx ON storage (user_id, bucket, collection, deleted_at);
+
+ALTER TABLE leaderboard ADD COLUMN app_id VARCHAR(64) DEFAULT '' NOT NULL;
+
+-- Group names are unique within each app.
+ALTER TABLE groups ADD COLUMN app_id VARCHAR(64) DEFAULT '' NOT NULL;
+DROP INDEX IF EXISTS groups@groups_name_key CASCADE;
+CREATE UNIQUE INDEX IF NOT EXISTS groups_app_id_name_key ON groups (app_id, name);
+
+-- Only used to separate room history, other topics are scoped by their users or group.
+ALTER TABLE message ADD COLUMN app_id VARCHAR(64) DEFAULT '' NOT NULL;
+
+-- Data of apps other than the default one is removed.
+-- +migrate Down notransaction
+DELETE FROM message WHERE app_id <> '';
+ALTER TABLE message DROP COLUMN IF EXISTS app_id;
+
+DELETE FROM group_edge WHERE source_id IN (SELECT id FROM groups WHERE app_id <> '')
+OR destination_id IN (SELECT id FROM groups WHERE app_id <> '');
+DELETE FROM groups WHERE app_id <> '';
+DROP INDEX IF EXISTS groups@groups_app_id_name_key;
+CREATE UNIQUE INDEX IF NOT EXISTS groups_name_key ON groups (name);
+ALTER TABLE groups DROP COLUMN IF EXISTS app_id;
+
+DELETE FROM leaderboard_record WHERE leaderboard_id IN (SELECT id FROM leaderboard WHERE app_id <> '');
+DELETE FROM leaderboard WHERE app_id <> '';
+ALTER TABLE leaderboard DROP COLUMN IF EXISTS app_id;
+
+CREATE TABLE IF NOT EXISTS storage_default (
+    PRIMARY KEY (bucket, collection, user_id, record, deleted_at),
+    id         BYTEA       NOT NULL,
+    user_id    BYTEA,
+    bucket     VARCHAR(70) NOT NULL,
+    collection VARCHAR(70) NOT NULL,
+    record     VARCHAR(70) NOT NULL,
+    -- FIXME replace with JSONB
+    value      BYTEA       DEFAULT '{}' CHECK (length(value) < 16000) NOT NULL,
+    version    BYTEA       NOT NULL,
+    read       SMALLINT    DEFAULT 1 CHECK (read >= 0) NOT NULL,
+    write      SMALLINT    DEFAULT 1 CHECK (write >= 0) NOT NULL,
+    created_at INT         CHECK (created_at > 0) NOT NULL,
+    updated_at INT         CHECK (updated_at > 0) NOT NULL,
+    -- FIXME replace with TTL support
+    expires_at INT         CHECK (expires_at >= 0) DEFAULT 0 NOT NULL,
+    deleted_at INT         CHECK (deleted_at >= 0) DEFAULT 0 NOT NULL
+);
+INSERT INTO storage_default (id, user_id, bucket, collection, record, value, version, read, write, created_at, updated_at, expires_at, deleted_at)
+SELECT id, user_id, bucket, collection, record, value, version, read, write, created_at, updated_at, expires_at, deleted_at
+FROM storage WHERE app_id = '';
+DROP TABLE IF EXISTS storage;
+ALTER TABLE storage_default RENAME TO storage;
+CREATE INDEX IF NOT EXISTS read_idx ON storage (read);
+CREATE INDEX IF NOT EXISTS write_idx ON storage (write);
+CREATE INDEX IF NOT EXISTS version_idx ON storage (version);
+-- For sync fetch
+CREATE INDEX IF NOT EXISTS user_id_bucket_updated_at_idx ON storage (user_id, bucket, updated_at);
+-- For bulk deletes
+CREATE INDEX IF NOT EXISTS user_id_deleted_at_idx ON storage (user_id, deleted_at);
+CREATE INDEX IF NOT EXISTS user_id_bucket_deleted_at_idx ON storage (user_id, bucket, deleted_at);
+CREATE INDEX IF NOT EXISTS user_id_bucket_collection_deleted_at_idx ON storage (user_id, bucket, collection, deleted_at);
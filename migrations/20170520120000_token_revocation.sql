@@ -0,0 +1,29 @@
+/*
+ * Copyright 2017 The Nakama Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+-- +migrate Up
+-- Revoked session and refresh tokens, or whole token families, kept until the tokens would have expired anyway.
+CREATE TABLE IF NOT EXISTS token_revocation (
+    PRIMARY KEY (id),
+    id         VARCHAR(128) NOT NULL,
+    expires_at INT          CHECK (expires_at >= 0) NOT NULL,
+    revoked_at INT          CHECK (revoked_at >= 0) NOT NULL
+);
+CREATE INDEX IF NOT EXISTS expires_at_idx ON token_revocation (expires_at);
+CREATE INDEX IF NOT EXISTS revoked_at_idx ON token_revocation (revoked_at);
+
+-- +migrate Down
+DROP TABLE IF EXISTS token_revocation;
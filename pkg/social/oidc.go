@@ -0,0 +1,308 @@
+// Copyright 2017 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package social
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+const (
+	// Keys are refreshed at least this often, in case the provider has rotated them.
+	oidcKeysMaxAge = 1 * time.Hour
+	// Tokens signed with an unknown key cause a refresh, but no more often than this.
+	oidcKeysMinRefresh = 1 * time.Minute
+)
+
+// JWK is a single public key in a JSON Web Key Set, as described in RFC 7517. Only RSA and EC keys are supported.
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid,omitempty"`
+	Use string `json:"use,omitempty"`
+	Alg string `json:"alg,omitempty"`
+	// RSA modulus and exponent.
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty"`
+	// EC curve and point.
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+// JWKS is a JSON Web Key Set.
+type JWKS struct {
+	Keys []*JWK `json:"keys"`
+}
+
+// OIDCProfile holds the claims of a verified OpenID Connect ID token.
+type OIDCProfile struct {
+	Issuer        string
+	Subject       string
+	Email         string
+	EmailVerified bool
+	Name          string
+}
+
+// OIDCProvider verifies ID tokens from one OpenID Connect provider. Signing keys are loaded from the provider's JWKS URL
+// or a local JWKS file, and cached. This is thread-safe.
+type OIDCProvider struct {
+	sync.RWMutex
+	client    *Client
+	issuer    string
+	audience  string
+	jwksURL   string
+	jwksFile  string
+	keys      map[string]crypto.PublicKey
+	loadedAt  time.Time
+	attempted time.Time
+}
+
+// NewOIDCProvider creates a new OIDCProvider. Exactly one of jwksURL and jwksFile should be set.
+func (c *Client) NewOIDCProvider(issuer, audience, jwksURL, jwksFile string) *OIDCProvider {
+	return &OIDCProvider{
+		client:   c,
+		issuer:   issuer,
+		audience: audience,
+		jwksURL:  jwksURL,
+		jwksFile: jwksFile,
+		keys:     make(map[string]crypto.PublicKey),
+	}
+}
+
+// Verify checks an ID token's signature, issuer, audience and expiry, and returns its claims.
+func (p *OIDCProvider) Verify(idToken string) (*OIDCProfile, error) {
+	token, err := jwt.Parse(idToken, func(token *jwt.Token) (interface{}, error) {
+		switch token.Method.(type) {
+		case *jwt.SigningMethodRSA, *jwt.SigningMethodECDSA:
+		default:
+			return nil, fmt.Errorf("Unexpected signing method: %v", token.Header["alg"])
+		}
+		kid, _ := token.Header["kid"].(string)
+		return p.key(kid)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !token.Valid {
+		return nil, errors.New("ID token invalid")
+	}
+
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok {
+		return nil, errors.New("ID token claims invalid")
+	}
+	if !claims.VerifyIssuer(p.issuer, true) {
+		return nil, errors.New("ID token issuer mismatch")
+	}
+	if !verifyAudience(claims["aud"], p.audience) {
+		return nil, errors.New("ID token audience mismatch")
+	}
+	if _, ok := claims["exp"]; !ok {
+		return nil, errors.New("ID token has no expiry")
+	}
+
+	profile := &OIDCProfile{Issuer: p.issuer}
+	profile.Subject, _ = claims["sub"].(string)
+	profile.Email, _ = claims["email"].(string)
+	profile.Name, _ = claims["name"].(string)
+	// Some providers, including Apple, send email_verified as a string.
+	switch verified := claims["email_verified"].(type) {
+	case bool:
+		profile.EmailVerified = verified
+	case string:
+		profile.EmailVerified = verified == "true"
+	}
+	if profile.Subject == "" {
+		return nil, errors.New("ID token has no subject")
+	}
+	return profile, nil
+}
+
+// key finds the signing key with the given ID, loading keys again if they are stale or the ID is not known.
+func (p *OIDCProvider) key(kid string) (crypto.PublicKey, error) {
+	p.RLock()
+	key, found := p.keys[kid]
+	stale := time.Since(p.loadedAt) > oidcKeysMaxAge
+	p.RUnlock()
+	if found && !stale {
+		return key, nil
+	}
+
+	p.Lock()
+	defer p.Unlock()
+	if time.Since(p.attempted) >= oidcKeysMinRefresh {
+		p.attempted = time.Now()
+		keys, err := p.load()
+		if err != nil {
+			if !found {
+				return nil, err
+			}
+			// Keep using the cached keys until the provider is reachable again.
+			return key, nil
+		}
+		p.keys = keys
+		p.loadedAt = time.Now()
+	}
+
+	key, found = p.keys[kid]
+	if !found {
+		return nil, fmt.Errorf("Unknown signing key: %v", kid)
+	}
+	return key, nil
+}
+
+func (p *OIDCProvider) load() (map[string]crypto.PublicKey, error) {
+	var data []byte
+	var err error
+	if p.jwksFile != "" {
+		data, err = ioutil.ReadFile(p.jwksFile)
+	} else {
+		data, err = p.client.requestRaw("oidc keys", p.jwksURL, map[string]string{})
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var jwks JWKS
+	if err = json.Unmarshal(data, &jwks); err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]crypto.PublicKey, len(jwks.Keys))
+	for _, jwk := range jwks.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		// Providers may publish keys of other types alongside the ones in use, so keys that can't be used are skipped.
+		key, err := jwk.PublicKey()
+		if err != nil {
+			continue
+		}
+		keys[jwk.Kid] = key
+	}
+	return keys, nil
+}
+
+// NewJWK encodes an RSA or EC public key as a JWK for signature verification with the given algorithm.
+func NewJWK(kid string, alg string, key crypto.PublicKey) (*JWK, error) {
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		return &JWK{
+			Kty: "RSA",
+			Kid: kid,
+			Use: "sig",
+			Alg: alg,
+			N:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}, nil
+	case *ecdsa.PublicKey:
+		params := key.Curve.Params()
+		// Coordinates are padded to the full size of the curve, as RFC 7518 requires.
+		size := (params.BitSize + 7) / 8
+		return &JWK{
+			Kty: "EC",
+			Kid: kid,
+			Use: "sig",
+			Alg: alg,
+			Crv: params.Name,
+			X:   base64.RawURLEncoding.EncodeToString(padBytes(key.X.Bytes(), size)),
+			Y:   base64.RawURLEncoding.EncodeToString(padBytes(key.Y.Bytes(), size)),
+		}, nil
+	default:
+		return nil, errors.New("Unsupported public key type for JWK")
+	}
+}
+
+// PublicKey decodes the RSA or EC public key held in the JWK.
+func (k *JWK) PublicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, errors.New("Invalid RSA modulus in JWK")
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil || len(e) == 0 || len(e) > 4 {
+			return nil, errors.New("Invalid RSA exponent in JWK")
+		}
+		return &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("Unsupported EC curve in JWK: %v", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, errors.New("Invalid EC point in JWK")
+		}
+		y, err := base64.RawURLEncoding.DecodeString(k.Y)
+		if err != nil {
+			return nil, errors.New("Invalid EC point in JWK")
+		}
+		key := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !curve.IsOnCurve(key.X, key.Y) {
+			return nil, errors.New("Invalid EC point in JWK")
+		}
+		return key, nil
+	default:
+		return nil, fmt.Errorf("Unsupported key type in JWK: %v", k.Kty)
+	}
+}
+
+// verifyAudience checks the "aud" claim, which may be a single string or a list of strings.
+func verifyAudience(aud interface{}, audience string) bool {
+	switch aud := aud.(type) {
+	case string:
+		return aud == audience
+	case []interface{}:
+		for _, a := range aud {
+			if s, ok := a.(string); ok && s == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func padBytes(b []byte, size int) []byte {
+	if len(b) >= size {
+		return b
+	}
+	padded := make([]byte, size)
+	copy(padded[size-len(b):], b)
+	return padded
+}
@@ -0,0 +1,92 @@
+// Copyright 2017 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+var appIDRegex = regexp.MustCompile("^[a-zA-Z0-9_.-]{1,64}$")
+
+// AppRegistry maps server keys to the applications they belong to. The default app has an empty ID, and uses the
+// transport server key. This is read-only after creation, so it is thread-safe.
+type AppRegistry struct {
+	apps map[string]string
+}
+
+// NewAppRegistry creates a new AppRegistry from the transport configuration.
+func NewAppRegistry(config Config) (*AppRegistry, error) {
+	transportConfig := config.GetTransport()
+	r := &AppRegistry{
+		apps: map[string]string{transportConfig.ServerKey: ""},
+	}
+
+	ids := map[string]bool{"": true}
+	for _, appConfig := range transportConfig.Apps {
+		if !appIDRegex.MatchString(appConfig.ID) {
+			return nil, fmt.Errorf("Invalid app ID '%v', must be 1-64 letters, digits, '_', '.' or '-'", appConfig.ID)
+		}
+		if ids[appConfig.ID] {
+			return nil, fmt.Errorf("Duplicate app ID '%v'", appConfig.ID)
+		}
+		if appConfig.ServerKey == "" {
+			return nil, fmt.Errorf("App '%v' must have a server key", appConfig.ID)
+		}
+		if _, ok := r.apps[appConfig.ServerKey]; ok {
+			return nil, errors.New("Each app must have a different server key")
+		}
+		ids[appConfig.ID] = true
+		r.apps[appConfig.ServerKey] = appConfig.ID
+	}
+
+	return r, nil
+}
+
+// AppForServerKey gives the ID of the app the server key belongs to. Returns false if the key is unknown.
+func (r *AppRegistry) AppForServerKey(serverKey string) (string, bool) {
+	appID, ok := r.apps[serverKey]
+	return appID, ok
+}
+
+// Exists checks if the app is still configured, so sessions for removed apps can be rejected.
+func (r *AppRegistry) Exists(appID string) bool {
+	for _, id := range r.apps {
+		if id == appID {
+			return true
+		}
+	}
+	return false
+}
+
+// roomTrackerTopic gives the tracker topic for a chat room. App IDs cannot contain ':', and rooms of the default app
+// keep their original topic.
+func roomTrackerTopic(appID string, room []byte) string {
+	if appID == "" {
+		return "room:" + string(room)
+	}
+	return "app:" + appID + ":room:" + string(room)
+}
+
+// roomFromTrackerTopic gives the room name from the tracker topic of a room in any app.
+func roomFromTrackerTopic(topic string) []byte {
+	if strings.HasPrefix(topic, "app:") {
+		// App IDs cannot contain ':', so the room name follows the third separator.
+		return []byte(strings.SplitN(topic, ":", 4)[3])
+	}
+	return []byte(strings.TrimPrefix(topic, "room:"))
+}
@@ -0,0 +1,89 @@
+// Copyright 2017 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"testing"
+)
+
+func TestRoomTrackerTopic(t *testing.T) {
+	tests := []struct {
+		appID string
+		room  string
+		topic string
+	}{
+		{"", "lobby", "room:lobby"},
+		{"", "a:b", "room:a:b"},
+		{"game", "lobby", "app:game:room:lobby"},
+		{"game", "a:room:b", "app:game:room:a:room:b"},
+		{"game.v2-beta_1", "", "app:game.v2-beta_1:room:"},
+	}
+	for _, tt := range tests {
+		topic := roomTrackerTopic(tt.appID, []byte(tt.room))
+		if topic != tt.topic {
+			t.Errorf("roomTrackerTopic(%q, %q) = %q, expected %q", tt.appID, tt.room, topic, tt.topic)
+		}
+		if room := string(roomFromTrackerTopic(topic)); room != tt.room {
+			t.Errorf("roomFromTrackerTopic(%q) = %q, expected %q", topic, room, tt.room)
+		}
+	}
+}
+
+func TestNewAppRegistry(t *testing.T) {
+	tests := []struct {
+		name  string
+		apps  []*TransportConfigApp
+		valid bool
+	}{
+		{"no apps", nil, true},
+		{"apps", []*TransportConfigApp{{ID: "a", ServerKey: "keya"}, {ID: "b", ServerKey: "keyb"}}, true},
+		{"invalid ID", []*TransportConfigApp{{ID: "a:b", ServerKey: "keya"}}, false},
+		{"empty ID", []*TransportConfigApp{{ID: "", ServerKey: "keya"}}, false},
+		{"duplicate ID", []*TransportConfigApp{{ID: "a", ServerKey: "keya"}, {ID: "a", ServerKey: "keyb"}}, false},
+		{"missing server key", []*TransportConfigApp{{ID: "a"}}, false},
+		{"default server key", []*TransportConfigApp{{ID: "a", ServerKey: "defaultkey"}}, false},
+		{"shared server key", []*TransportConfigApp{{ID: "a", ServerKey: "keya"}, {ID: "b", ServerKey: "keya"}}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := NewConfig()
+			config.Transport.Apps = tt.apps
+			registry, err := NewAppRegistry(config)
+			if (err == nil) != tt.valid {
+				t.Fatalf("error %v, expected valid %v", err, tt.valid)
+			}
+			if !tt.valid {
+				return
+			}
+			if appID, ok := registry.AppForServerKey(config.Transport.ServerKey); !ok || appID != "" {
+				t.Errorf("default server key gives app %q, %v", appID, ok)
+			}
+			for _, app := range tt.apps {
+				if appID, ok := registry.AppForServerKey(app.ServerKey); !ok || appID != app.ID {
+					t.Errorf("server key %q gives app %q, %v", app.ServerKey, appID, ok)
+				}
+				if !registry.Exists(app.ID) {
+					t.Errorf("app %q does not exist", app.ID)
+				}
+			}
+			if _, ok := registry.AppForServerKey("unknown"); ok {
+				t.Error("unknown server key accepted")
+			}
+			if registry.Exists("unknown") {
+				t.Error("unknown app exists")
+			}
+		})
+	}
+}
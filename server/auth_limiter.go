@@ -0,0 +1,212 @@
+// Copyright 2017 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"sync"
+	"time"
+
+	"go.uber.org/atomic"
+)
+
+type authLimiterWindow struct {
+	count   int
+	startMs int64
+}
+
+type authLimiterLockout struct {
+	failures      int
+	lastFailureMs int64
+	lockedUntil   int64
+}
+
+// AuthLimiter rate limits authentication requests per source IP and per identifier, and locks out email accounts
+// after repeated failed password attempts. State is held in memory and only applies to this node. This is thread-safe.
+type AuthLimiter struct {
+	sync.Mutex
+	config      Config
+	ips         map[string]*authLimiterWindow
+	identifiers map[string]*authLimiterWindow
+	lockouts    map[string]*authLimiterLockout
+	stopCh      chan struct{}
+
+	ipLimited         *atomic.Int64
+	identifierLimited *atomic.Int64
+	lockoutsStarted   *atomic.Int64
+	lockoutRejected   *atomic.Int64
+}
+
+// NewAuthLimiter creates a new AuthLimiter
+func NewAuthLimiter(config Config) *AuthLimiter {
+	l := &AuthLimiter{
+		config:      config,
+		ips:         make(map[string]*authLimiterWindow),
+		identifiers: make(map[string]*authLimiterWindow),
+		lockouts:    make(map[string]*authLimiterLockout),
+		stopCh:      make(chan struct{}),
+
+		ipLimited:         atomic.NewInt64(0),
+		identifierLimited: atomic.NewInt64(0),
+		lockoutsStarted:   atomic.NewInt64(0),
+		lockoutRejected:   atomic.NewInt64(0),
+	}
+
+	go func() {
+		ticker := time.NewTicker(1 * time.Minute)
+		for {
+			select {
+			case <-l.stopCh:
+				ticker.Stop()
+				return
+			case <-ticker.C:
+				l.removeExpired()
+			}
+		}
+	}()
+
+	return l
+}
+
+// AllowIP counts a request from the given IP, and checks it is within the per-IP limit.
+func (l *AuthLimiter) AllowIP(ip string) bool {
+	if !l.allow(l.ips, ip, l.config.GetAuthRateLimit().IPRequestsPerMinute) {
+		l.ipLimited.Inc()
+		return false
+	}
+	return true
+}
+
+// AllowIdentifier counts a request for the given account identifier, and checks it is within the per-identifier limit.
+func (l *AuthLimiter) AllowIdentifier(identifier string) bool {
+	if !l.allow(l.identifiers, identifier, l.config.GetAuthRateLimit().IdentifierRequestsPerMinute) {
+		l.identifierLimited.Inc()
+		return false
+	}
+	return true
+}
+
+// IsLockedOut checks if too many failed password attempts have been made for the identifier recently.
+func (l *AuthLimiter) IsLockedOut(identifier string) bool {
+	l.Lock()
+	lockout := l.lockouts[identifier]
+	locked := lockout != nil && lockout.lockedUntil > nowMs()
+	l.Unlock()
+
+	if locked {
+		l.lockoutRejected.Inc()
+	}
+	return locked
+}
+
+// Fail records a failed password attempt, and starts a lockout once the configured number of attempts is reached.
+func (l *AuthLimiter) Fail(identifier string) {
+	limitConfig := l.config.GetAuthRateLimit()
+	if limitConfig.LockoutAttempts < 1 {
+		return
+	}
+
+	l.Lock()
+	lockout := l.lockouts[identifier]
+	if lockout == nil {
+		lockout = &authLimiterLockout{}
+		l.lockouts[identifier] = lockout
+	}
+	lockout.failures++
+	lockout.lastFailureMs = nowMs()
+	started := lockout.failures >= limitConfig.LockoutAttempts
+	if started {
+		lockout.failures = 0
+		lockout.lockedUntil = nowMs() + limitConfig.LockoutDurationMs
+	}
+	l.Unlock()
+
+	if started {
+		l.lockoutsStarted.Inc()
+	}
+}
+
+// Succeed clears failed password attempts after a successful login.
+func (l *AuthLimiter) Succeed(identifier string) {
+	l.Lock()
+	delete(l.lockouts, identifier)
+	l.Unlock()
+}
+
+// Stats reports how many requests have been rejected since startup, and how many lockouts are active.
+func (l *AuthLimiter) Stats() map[string]interface{} {
+	ts := nowMs()
+	active := 0
+	l.Lock()
+	for _, lockout := range l.lockouts {
+		if lockout.lockedUntil > ts {
+			active++
+		}
+	}
+	l.Unlock()
+
+	return map[string]interface{}{
+		"ip_limited":         l.ipLimited.Load(),
+		"identifier_limited": l.identifierLimited.Load(),
+		"lockouts_started":   l.lockoutsStarted.Load(),
+		"lockout_rejected":   l.lockoutRejected.Load(),
+		"lockouts_active":    active,
+	}
+}
+
+func (l *AuthLimiter) Stop() {
+	close(l.stopCh)
+}
+
+// allow implements a fixed one minute window counter. A limit below 1 disables limiting.
+func (l *AuthLimiter) allow(windows map[string]*authLimiterWindow, key string, limit int) bool {
+	if limit < 1 {
+		return true
+	}
+
+	ts := nowMs()
+	l.Lock()
+	defer l.Unlock()
+
+	window := windows[key]
+	if window == nil || ts-window.startMs >= 60000 {
+		window = &authLimiterWindow{startMs: ts}
+		windows[key] = window
+	}
+	window.count++
+	return window.count <= limit
+}
+
+func (l *AuthLimiter) removeExpired() {
+	ts := nowMs()
+	lockoutDurationMs := l.config.GetAuthRateLimit().LockoutDurationMs
+	l.Lock()
+	for key, window := range l.ips {
+		if ts-window.startMs >= 60000 {
+			delete(l.ips, key)
+		}
+	}
+	for key, window := range l.identifiers {
+		if ts-window.startMs >= 60000 {
+			delete(l.identifiers, key)
+		}
+	}
+	// Failed attempts are forgotten once no lockout is active and there were no failures for a lockout duration.
+	for key, lockout := range l.lockouts {
+		if lockout.lockedUntil < ts && ts-lockout.lastFailureMs >= lockoutDurationMs {
+			delete(l.lockouts, key)
+		}
+	}
+	l.Unlock()
+}
@@ -28,23 +28,41 @@ type Config interface {
 	GetDataDir() string
 	GetPort() int
 	GetOpsPort() int
+	GetOpsKey() string
 	GetDSNS() []string
 	GetSession() *SessionConfig
 	GetTransport() *TransportConfig
 	GetDatabase() *DatabaseConfig
 	GetSocial() *SocialConfig
+	GetRuntime() *RuntimeConfig
+	GetMatch() *MatchConfig
+	GetMail() *MailConfig
+	GetAuthRateLimit() *AuthRateLimitConfig
+	GetMerge() *MergeConfig
+	GetTLS() *TLSConfig
+	GetRequestRateLimit() *RequestRateLimitConfig
+	GetCluster() *ClusterConfig
 }
 
 type config struct {
-	Name      string           `yaml:"name" json:"name"`
-	Datadir   string           `yaml:"data_dir" json:"data_dir"`
-	Port      int              `yaml:"port" json:"port"`
-	OpsPort   int              `yaml:"ops_port" json:"ops_port"`
-	Dsns      []string         `yaml:"dsns" json:"dsns"`
-	Session   *SessionConfig   `yaml:"session" json:"session"`
-	Transport *TransportConfig `yaml:"transport" json:"transport"`
-	Database  *DatabaseConfig  `yaml:"database" json:"database"`
-	Social    *SocialConfig    `yaml:"social" json:"social"`
+	Name             string                  `yaml:"name" json:"name"`
+	Datadir          string                  `yaml:"data_dir" json:"data_dir"`
+	Port             int                     `yaml:"port" json:"port"`
+	OpsPort          int                     `yaml:"ops_port" json:"ops_port"`
+	OpsKey           string                  `yaml:"ops_key" json:"-"`
+	Dsns             []string                `yaml:"dsns" json:"dsns"`
+	Session          *SessionConfig          `yaml:"session" json:"session"`
+	Transport        *TransportConfig        `yaml:"transport" json:"transport"`
+	Database         *DatabaseConfig         `yaml:"database" json:"database"`
+	Social           *SocialConfig           `yaml:"social" json:"social"`
+	Runtime          *RuntimeConfig          `yaml:"runtime" json:"runtime"`
+	Match            *MatchConfig            `yaml:"match" json:"match"`
+	Mail             *MailConfig             `yaml:"mail" json:"mail"`
+	AuthRateLimit    *AuthRateLimitConfig    `yaml:"auth_rate_limit" json:"auth_rate_limit"`
+	Merge            *MergeConfig            `yaml:"merge" json:"merge"`
+	TLS              *TLSConfig              `yaml:"tls" json:"tls"`
+	RequestRateLimit *RequestRateLimitConfig `yaml:"request_rate_limit" json:"request_rate_limit"`
+	Cluster          *ClusterConfig          `yaml:"cluster" json:"cluster"`
 }
 
 // NewConfig constructs a Config struct which represents server settings.
@@ -53,15 +71,24 @@ func NewConfig() *config {
 	dataDirectory := filepath.FromSlash(cwd + "/data")
 	nodeName := "nakama-" + strings.Split(uuid.NewV4().String(), "-")[3]
 	return &config{
-		Name:      nodeName,
-		Datadir:   dataDirectory,
-		Port:      7350,
-		OpsPort:   7351,
-		Dsns:      []string{"root@localhost:26257"},
-		Session:   NewSessionConfig(),
-		Transport: NewTransportConfig(),
-		Database:  NewDatabaseConfig(),
-		Social:    NewSocialConfig(),
+		Name:             nodeName,
+		Datadir:          dataDirectory,
+		Port:             7350,
+		OpsPort:          7351,
+		OpsKey:           "",
+		Dsns:             []string{"root@localhost:26257"},
+		Session:          NewSessionConfig(),
+		Transport:        NewTransportConfig(),
+		Database:         NewDatabaseConfig(),
+		Social:           NewSocialConfig(),
+		Runtime:          NewRuntimeConfig(),
+		Match:            NewMatchConfig(),
+		Mail:             NewMailConfig(),
+		AuthRateLimit:    NewAuthRateLimitConfig(),
+		Merge:            NewMergeConfig(),
+		TLS:              NewTLSConfig(),
+		RequestRateLimit: NewRequestRateLimitConfig(),
+		Cluster:          NewClusterConfig(),
 	}
 }
 
@@ -81,6 +108,12 @@ func (c *config) GetOpsPort() int {
 	return c.OpsPort
 }
 
+// GetOpsKey gives the key required by ops requests that change data. It is left out of the config served by the ops
+// port, so it can't be read back from there.
+func (c *config) GetOpsKey() string {
+	return c.OpsKey
+}
+
 func (c *config) GetDSNS() []string {
 	return c.Dsns
 }
@@ -101,40 +134,132 @@ func (c *config) GetSocial() *SocialConfig {
 	return c.Social
 }
 
+func (c *config) GetRuntime() *RuntimeConfig {
+	return c.Runtime
+}
+
+func (c *config) GetMatch() *MatchConfig {
+	return c.Match
+}
+
+func (c *config) GetMail() *MailConfig {
+	return c.Mail
+}
+
+func (c *config) GetAuthRateLimit() *AuthRateLimitConfig {
+	return c.AuthRateLimit
+}
+
+func (c *config) GetMerge() *MergeConfig {
+	return c.Merge
+}
+
+func (c *config) GetTLS() *TLSConfig {
+	return c.TLS
+}
+
+func (c *config) GetRequestRateLimit() *RequestRateLimitConfig {
+	return c.RequestRateLimit
+}
+
+func (c *config) GetCluster() *ClusterConfig {
+	return c.Cluster
+}
+
 // SessionConfig is configuration relevant to the session
 type SessionConfig struct {
-	EncryptionKey string `yaml:"encryption_key" json:"encryption_key"`
-	TokenExpiryMs int64  `yaml:"token_expiry_ms" json:"token_expiry_ms"`
+	EncryptionKey        string `yaml:"encryption_key" json:"encryption_key"`
+	TokenExpiryMs        int64  `yaml:"token_expiry_ms" json:"token_expiry_ms"`
+	RefreshTokenExpiryMs int64  `yaml:"refresh_token_expiry_ms" json:"refresh_token_expiry_ms"`
+	// ID of the signing key used for new session and refresh tokens. When empty they are signed with the encryption key.
+	SigningKeyID string `yaml:"signing_key_id" json:"signing_key_id"`
+	// All keys accepted on session and refresh tokens. A replaced key should be kept until its tokens have expired.
+	SigningKeys []*SessionConfigSigningKey `yaml:"signing_keys" json:"signing_keys"`
+	// Stop accepting tokens signed with the encryption key, once they have expired after moving to a signing key.
+	DisableLegacyKey bool `yaml:"disable_legacy_key" json:"disable_legacy_key"`
+}
+
+// SessionConfigSigningKey is configuration relevant to a key that signs session tokens
+type SessionConfigSigningKey struct {
+	ID string `yaml:"id" json:"id"`
+	// Algorithm is one of "HS256", "RS256" or "ES256".
+	Algorithm string `yaml:"algorithm" json:"algorithm"`
+	// Secret is used by HS256 keys.
+	Secret string `yaml:"secret" json:"secret"`
+	// PEM encoded key files used by RS256 and ES256 keys. A key with only a public key file verifies tokens but cannot
+	// sign them.
+	PrivateKeyFile string `yaml:"private_key_file" json:"private_key_file"`
+	PublicKeyFile  string `yaml:"public_key_file" json:"public_key_file"`
 }
 
 // NewSessionConfig creates a new SessionConfig struct
 func NewSessionConfig() *SessionConfig {
 	return &SessionConfig{
-		EncryptionKey: "defaultencryptionkey",
-		TokenExpiryMs: 60000,
+		EncryptionKey:        "defaultencryptionkey",
+		TokenExpiryMs:        60000,
+		RefreshTokenExpiryMs: 604800000,
+		SigningKeyID:         "",
+		SigningKeys:          make([]*SessionConfigSigningKey, 0),
+		DisableLegacyKey:     false,
 	}
 }
 
 // TransportConfig is configuration relevant to the transport socket and protocol
 type TransportConfig struct {
-	ServerKey           string `yaml:"server_key" json:"server_key"`
-	MaxMessageSizeBytes int64  `yaml:"max_message_size_bytes" json:"max_message_size_bytes"`
-	WriteWaitMs         int    `yaml:"write_wait_ms" json:"write_wait_ms"`
-	PongWaitMs          int    `yaml:"pong_wait_ms" json:"pong_wait_ms"`
-	PingPeriodMs        int    `yaml:"ping_period_ms" json:"ping_period_ms"`
+	ServerKey           string                `yaml:"server_key" json:"server_key"`
+	Apps                []*TransportConfigApp `yaml:"apps" json:"apps"`
+	MaxMessageSizeBytes int64                 `yaml:"max_message_size_bytes" json:"max_message_size_bytes"`
+	WriteWaitMs         int                   `yaml:"write_wait_ms" json:"write_wait_ms"`
+	PongWaitMs          int                   `yaml:"pong_wait_ms" json:"pong_wait_ms"`
+	PingPeriodMs        int                   `yaml:"ping_period_ms" json:"ping_period_ms"`
+	// Messages waiting to be written to each realtime connection, at least 1.
+	OutgoingQueueSize int `yaml:"outgoing_queue_size" json:"outgoing_queue_size"`
+	// OutgoingQueueFullPolicy is "disconnect" or "drop_oldest", and decides what happens when a client does not read
+	// messages as fast as they are sent to it and its outgoing queue fills up.
+	OutgoingQueueFullPolicy string `yaml:"outgoing_queue_full_policy" json:"outgoing_queue_full_policy"`
+	// How long a session is held after its connection is lost, so the client can resume it without its presences
+	// leaving. Messages for the session are queued meanwhile. 0 disables resuming.
+	ResumeGraceMs int `yaml:"resume_grace_ms" json:"resume_grace_ms"`
+	// On shutdown, requests in progress are given this long to finish before connections are closed.
+	ShutdownGraceMs int `yaml:"shutdown_grace_ms" json:"shutdown_grace_ms"`
+	// Clients are told to reconnect after this long when the server shuts down.
+	ShutdownReconnectMs int `yaml:"shutdown_reconnect_ms" json:"shutdown_reconnect_ms"`
+	// Realtime requests each session can process at once. Match data is handled as it arrives, unless a match request
+	// sent before it is still waiting. With 0 every request is handled in order as it arrives. With more, related
+	// requests such as those for topics or storage are still handled in order, but responses to unrelated ones may
+	// come in any order and are matched to requests by collation ID.
+	RequestWorkers int `yaml:"request_workers" json:"request_workers"`
+	// Requests waiting for each worker in each session. The connection is not read while one of these is full.
+	RequestQueueSize int `yaml:"request_queue_size" json:"request_queue_size"`
 }
 
 // NewTransportConfig creates a new TransportConfig struct
 func NewTransportConfig() *TransportConfig {
 	return &TransportConfig{
-		ServerKey:           "defaultkey",
-		MaxMessageSizeBytes: 1024,
-		WriteWaitMs:         5000,
-		PongWaitMs:          10000,
-		PingPeriodMs:        8000,
+		ServerKey:               "defaultkey",
+		Apps:                    make([]*TransportConfigApp, 0),
+		MaxMessageSizeBytes:     1024,
+		WriteWaitMs:             5000,
+		PongWaitMs:              10000,
+		PingPeriodMs:            8000,
+		OutgoingQueueSize:       64,
+		OutgoingQueueFullPolicy: "disconnect",
+		ResumeGraceMs:           0,
+		ShutdownGraceMs:         5000,
+		ShutdownReconnectMs:     1000,
+		RequestWorkers:          0,
+		RequestQueueSize:        16,
 	}
 }
 
+// TransportConfigApp is an additional application served by this deployment. Clients using its server key get
+// sessions for the app, and see only its storage, leaderboards, groups and rooms. The server key above is the default
+// app, which has an empty ID.
+type TransportConfigApp struct {
+	ID        string `yaml:"id" json:"id"`
+	ServerKey string `yaml:"server_key" json:"server_key"`
+}
+
 // DatabaseConfig is configuration relevant to the Database storage
 type DatabaseConfig struct {
 	ConnMaxLifetimeMs int `yaml:"conn_max_lifetime_ms" json:"conn_max_lifetime_ms"`
@@ -153,7 +278,10 @@ func NewDatabaseConfig() *DatabaseConfig {
 
 // SocialConfig is configuration relevant to the Social providers
 type SocialConfig struct {
-	Steam *SocialConfigSteam `yaml:"steam" json:"steam"`
+	Steam  *SocialConfigSteam  `yaml:"steam" json:"steam"`
+	Custom *SocialConfigCustom `yaml:"custom" json:"custom"`
+	// OpenID Connect providers keyed by the name clients refer to them by, i.e. "apple".
+	OIDC map[string]*SocialConfigOIDC `yaml:"oidc" json:"oidc"`
 }
 
 // SocialConfigSteam is configuration relevant to Steam
@@ -162,6 +290,22 @@ type SocialConfigSteam struct {
 	AppID        int    `yaml:"app_id" json:"app_id"`
 }
 
+// SocialConfigCustom is configuration relevant to custom ID authentication
+type SocialConfigCustom struct {
+	// Client credentials are POSTed to this URL to be verified. When empty, custom IDs from clients are trusted.
+	VerifierURL string `yaml:"verifier_url" json:"verifier_url"`
+	TimeoutMs   int    `yaml:"timeout_ms" json:"timeout_ms"`
+}
+
+// SocialConfigOIDC is configuration relevant to an OpenID Connect provider
+type SocialConfigOIDC struct {
+	Issuer   string `yaml:"issuer" json:"issuer"`
+	Audience string `yaml:"audience" json:"audience"`
+	// Signing keys are read from the JWKS URL, or from the JWKS file when it is set instead.
+	JWKSURL  string `yaml:"jwks_url" json:"jwks_url"`
+	JWKSFile string `yaml:"jwks_file" json:"jwks_file"`
+}
+
 // NewSocialConfig creates a new SocialConfig struct
 func NewSocialConfig() *SocialConfig {
 	return &SocialConfig{
@@ -169,5 +313,197 @@ func NewSocialConfig() *SocialConfig {
 			PublisherKey: "",
 			AppID:        0,
 		},
+		Custom: &SocialConfigCustom{
+			VerifierURL: "",
+			TimeoutMs:   5000,
+		},
+		OIDC: make(map[string]*SocialConfigOIDC),
+	}
+}
+
+// RuntimeConfig is configuration relevant to the embedded Lua runtime
+type RuntimeConfig struct {
+	// Path to the Lua modules, defaults to "modules" inside the data directory when empty.
+	Path string `yaml:"path" json:"path"`
+	// Lua functions running longer than this are stopped with an error. 0 disables the limit.
+	CallTimeoutMs int `yaml:"call_timeout_ms" json:"call_timeout_ms"`
+	// Most after hooks running at once. Responses beyond this skip their after hook, which is logged.
+	AfterHookLimit int `yaml:"after_hook_limit" json:"after_hook_limit"`
+}
+
+// NewRuntimeConfig creates a new RuntimeConfig struct
+func NewRuntimeConfig() *RuntimeConfig {
+	return &RuntimeConfig{
+		Path:           "",
+		CallTimeoutMs:  5000,
+		AfterHookLimit: 128,
+	}
+}
+
+// MatchConfig is configuration relevant to authoritative realtime matches
+type MatchConfig struct {
+	DefaultTickRate      int `yaml:"default_tick_rate" json:"default_tick_rate"`
+	MaxTickRate          int `yaml:"max_tick_rate" json:"max_tick_rate"`
+	InputQueueSize       int `yaml:"input_queue_size" json:"input_queue_size"`
+	JoinAttemptTimeoutMs int `yaml:"join_attempt_timeout_ms" json:"join_attempt_timeout_ms"`
+}
+
+// NewMatchConfig creates a new MatchConfig struct
+func NewMatchConfig() *MatchConfig {
+	return &MatchConfig{
+		DefaultTickRate:      10,
+		MaxTickRate:          60,
+		InputQueueSize:       128,
+		JoinAttemptTimeoutMs: 5000,
+	}
+}
+
+// MailConfig is configuration relevant to emails sent to users
+type MailConfig struct {
+	// Sender is one of "log", "file" or "smtp". The log and file senders are meant for development.
+	Sender string          `yaml:"sender" json:"sender"`
+	From   string          `yaml:"from" json:"from"`
+	File   *MailConfigFile `yaml:"file" json:"file"`
+	SMTP   *MailConfigSMTP `yaml:"smtp" json:"smtp"`
+	// Base URL of this server as reachable by users, used to build links in emails.
+	PublicURL                  string `yaml:"public_url" json:"public_url"`
+	VerificationTokenExpiryMs  int64  `yaml:"verification_token_expiry_ms" json:"verification_token_expiry_ms"`
+	PasswordResetTokenExpiryMs int64  `yaml:"password_reset_token_expiry_ms" json:"password_reset_token_expiry_ms"`
+}
+
+// MailConfigFile is configuration relevant to the file mail sender
+type MailConfigFile struct {
+	Path string `yaml:"path" json:"path"`
+}
+
+// MailConfigSMTP is configuration relevant to the SMTP mail sender
+type MailConfigSMTP struct {
+	Host     string `yaml:"host" json:"host"`
+	Port     int    `yaml:"port" json:"port"`
+	Username string `yaml:"username" json:"username"`
+	Password string `yaml:"password" json:"password"`
+}
+
+// NewMailConfig creates a new MailConfig struct
+func NewMailConfig() *MailConfig {
+	return &MailConfig{
+		Sender: "log",
+		From:   "noreply@localhost",
+		File: &MailConfigFile{
+			Path: "",
+		},
+		SMTP: &MailConfigSMTP{
+			Host:     "",
+			Port:     587,
+			Username: "",
+			Password: "",
+		},
+		PublicURL:                  "http://127.0.0.1:7350",
+		VerificationTokenExpiryMs:  86400000,
+		PasswordResetTokenExpiryMs: 3600000,
+	}
+}
+
+// AuthRateLimitConfig is configuration relevant to rate limiting login and register requests
+type AuthRateLimitConfig struct {
+	// Limits of 0 disable the corresponding check.
+	IPRequestsPerMinute         int   `yaml:"ip_requests_per_minute" json:"ip_requests_per_minute"`
+	IdentifierRequestsPerMinute int   `yaml:"identifier_requests_per_minute" json:"identifier_requests_per_minute"`
+	LockoutAttempts             int   `yaml:"lockout_attempts" json:"lockout_attempts"`
+	LockoutDurationMs           int64 `yaml:"lockout_duration_ms" json:"lockout_duration_ms"`
+}
+
+// NewAuthRateLimitConfig creates a new AuthRateLimitConfig struct
+func NewAuthRateLimitConfig() *AuthRateLimitConfig {
+	return &AuthRateLimitConfig{
+		IPRequestsPerMinute:         60,
+		IdentifierRequestsPerMinute: 10,
+		LockoutAttempts:             5,
+		LockoutDurationMs:           900000,
+	}
+}
+
+// MergeConfig is configuration relevant to merging one user into another
+type MergeConfig struct {
+	// ConflictPolicy is "keep_target" or "keep_source", and decides which user's friend, group membership, storage
+	// record or leaderboard record is kept when both users have one for the same key.
+	ConflictPolicy string `yaml:"conflict_policy" json:"conflict_policy"`
+}
+
+// NewMergeConfig creates a new MergeConfig struct
+func NewMergeConfig() *MergeConfig {
+	return &MergeConfig{
+		ConflictPolicy: "keep_target",
+	}
+}
+
+// TLSConfig is configuration relevant to serving the client and ops listeners over TLS
+type TLSConfig struct {
+	Client *TLSConfigListener `yaml:"client" json:"client"`
+	Ops    *TLSConfigListener `yaml:"ops" json:"ops"`
+}
+
+// NewTLSConfig creates a new TLSConfig struct
+func NewTLSConfig() *TLSConfig {
+	return &TLSConfig{
+		Client: &TLSConfigListener{},
+		Ops:    &TLSConfigListener{},
+	}
+}
+
+// TLSConfigListener is the TLS certificate of one listener. The listener serves cleartext when no certificate is set.
+type TLSConfigListener struct {
+	CertFile string `yaml:"cert_file" json:"cert_file"`
+	KeyFile  string `yaml:"key_file" json:"key_file"`
+	// The files are checked for changes at this interval, and the certificate reloaded. 0 disables reloading.
+	ReloadIntervalMs int `yaml:"reload_interval_ms" json:"reload_interval_ms"`
+}
+
+// RequestRateLimitConfig is configuration relevant to rate limiting the realtime requests of each session
+type RequestRateLimitConfig struct {
+	// Limits by message type, named as for runtime hooks, for example "TopicMessageSend". Other types are not limited,
+	// and none are by default. Suggested starting points are TopicMessageSend at 5 per second, MatchDataSend at 60 per
+	// second and StorageWrite at 10 per second, each with a burst of twice that.
+	Limits map[string]*RequestRateLimitConfigLimit `yaml:"limits" json:"limits"`
+	// Sessions with more rate limited requests than this in a minute are disconnected. 0 disables disconnecting.
+	DisconnectRejectionsPerMinute int `yaml:"disconnect_rejections_per_minute" json:"disconnect_rejections_per_minute"`
+}
+
+// NewRequestRateLimitConfig creates a new RequestRateLimitConfig struct
+func NewRequestRateLimitConfig() *RequestRateLimitConfig {
+	return &RequestRateLimitConfig{
+		Limits:                        make(map[string]*RequestRateLimitConfigLimit),
+		DisconnectRejectionsPerMinute: 0,
+	}
+}
+
+// RequestRateLimitConfigLimit is a token bucket, refilled at the given rate up to the burst size.
+type RequestRateLimitConfigLimit struct {
+	RequestsPerSecond float64 `yaml:"requests_per_second" json:"requests_per_second"`
+	Burst             int     `yaml:"burst" json:"burst"`
+}
+
+// ClusterConfig is configuration relevant to running several nodes as a cluster that shares presences
+type ClusterConfig struct {
+	// Address in "host:port" form the node gossips with other nodes on, over both UDP and TCP. Empty runs a single node.
+	GossipBindAddr string `yaml:"gossip_bind_addr" json:"gossip_bind_addr"`
+	// Address in "host:port" form other nodes reach this node on, when it differs from the bind address.
+	GossipAdvertiseAddr string `yaml:"gossip_advertise_addr" json:"gossip_advertise_addr"`
+	// Gossip addresses of existing nodes to join on startup. Any one reachable node is enough.
+	GossipJoin []string `yaml:"gossip_join" json:"gossip_join"`
+	// Key shared by all nodes to encrypt and authenticate gossip, of 16, 24 or 32 bytes. Required to run a cluster.
+	GossipSecretKey string `yaml:"gossip_secret_key" json:"gossip_secret_key"`
+	// Interval of the full presence state exchange with a random node, which repairs any lost presence updates.
+	SyncIntervalMs int `yaml:"sync_interval_ms" json:"sync_interval_ms"`
+}
+
+// NewClusterConfig creates a new ClusterConfig struct
+func NewClusterConfig() *ClusterConfig {
+	return &ClusterConfig{
+		GossipBindAddr:      "",
+		GossipAdvertiseAddr: "",
+		GossipJoin:          []string{},
+		GossipSecretKey:     "",
+		SyncIntervalMs:      30000,
 	}
 }
@@ -0,0 +1,222 @@
+// Copyright 2017 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+
+	"github.com/gorhill/cronexpr"
+	"github.com/satori/go.uuid"
+	"go.uber.org/zap"
+)
+
+// NewLeaderboardRecordWrite builds a record write from an operator name, one of "incr", "decr", "set" or "best".
+func NewLeaderboardRecordWrite(leaderboardID []byte, op string, value int64, location, timezone string, metadata []byte) (*TLeaderboardRecordWrite, error) {
+	write := &TLeaderboardRecordWrite{
+		LeaderboardId: leaderboardID,
+		Location:      location,
+		Timezone:      timezone,
+		Metadata:      metadata,
+	}
+
+	switch op {
+	case "incr":
+		write.Op = &TLeaderboardRecordWrite_Incr{Incr: value}
+	case "decr":
+		write.Op = &TLeaderboardRecordWrite_Decr{Decr: value}
+	case "set":
+		write.Op = &TLeaderboardRecordWrite_Set{Set: value}
+	case "best":
+		write.Op = &TLeaderboardRecordWrite_Best{Best: value}
+	default:
+		return nil, errors.New("Unknown leaderboard record write operator")
+	}
+
+	return write, nil
+}
+
+// leaderboardRecordWrite writes a score for the given owner. Clients must not write to authoritative leaderboards, so
+// only server-side callers set authoritativeWrite. Writes are limited to leaderboards of the given app, unless anyApp is
+// set for operators who manage all apps. If handle is empty the owner's handle and lang are looked up.
+// The returned error message is safe to send to clients, the error code describes which kind of failure occurred.
+func leaderboardRecordWrite(ctx context.Context, logger *zap.Logger, db *sql.DB, ownerID uuid.UUID, handle, lang string, appID string, incoming *TLeaderboardRecordWrite, authoritativeWrite bool, anyApp bool) (*LeaderboardRecord, Error_Code, error) {
+	if len(incoming.LeaderboardId) == 0 {
+		return nil, BAD_INPUT, errors.New("Leaderboard ID must be present")
+	}
+
+	if len(incoming.Metadata) != 0 {
+		// Make this `var js interface{}` if we want to allow top-level JSON arrays.
+		var maybeJSON map[string]interface{}
+		if json.Unmarshal(incoming.Metadata, &maybeJSON) != nil {
+			return nil, BAD_INPUT, errors.New("Metadata must be a valid JSON object")
+		}
+	}
+
+	var authoritative bool
+	var sortOrder int64
+	var resetSchedule sql.NullString
+	var leaderboardAppID string
+	query := "SELECT authoritative, sort_order, reset_schedule, app_id FROM leaderboard WHERE id = $1"
+	logger.Debug("Leaderboard lookup", zap.String("query", query))
+	err := db.QueryRowContext(ctx, query, incoming.LeaderboardId).
+		Scan(&authoritative, &sortOrder, &resetSchedule, &leaderboardAppID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, BAD_INPUT, errors.New("Leaderboard not found")
+		}
+		logger.Error("Could not execute leaderboard record write metadata query", zap.Error(err))
+		return nil, RUNTIME_EXCEPTION, errors.New("Error writing leaderboard record")
+	}
+	if !anyApp && leaderboardAppID != appID {
+		return nil, BAD_INPUT, errors.New("Leaderboard not found")
+	}
+
+	now := now()
+	updatedAt := timeToMs(now)
+	expiresAt := int64(0)
+	if resetSchedule.Valid {
+		expr, err := cronexpr.Parse(resetSchedule.String)
+		if err != nil {
+			logger.Error("Could not parse leaderboard reset schedule query", zap.Error(err))
+			return nil, RUNTIME_EXCEPTION, errors.New("Error writing leaderboard record")
+		}
+		expiresAt = timeToMs(expr.Next(now))
+	}
+
+	if authoritative == true && !authoritativeWrite {
+		return nil, BAD_INPUT, errors.New("Cannot submit to authoritative leaderboard")
+	}
+
+	var scoreOpSql string
+	var scoreDelta int64
+	var scoreAbs int64
+	switch incoming.Op.(type) {
+	case *TLeaderboardRecordWrite_Incr:
+		scoreOpSql = "score = leaderboard_record.score + $17::BIGINT"
+		scoreDelta = incoming.GetIncr()
+		scoreAbs = incoming.GetIncr()
+	case *TLeaderboardRecordWrite_Decr:
+		scoreOpSql = "score = leaderboard_record.score - $17::BIGINT"
+		scoreDelta = incoming.GetDecr()
+		scoreAbs = 0 - incoming.GetDecr()
+	case *TLeaderboardRecordWrite_Set:
+		scoreOpSql = "score = $17::BIGINT"
+		scoreDelta = incoming.GetSet()
+		scoreAbs = incoming.GetSet()
+	case *TLeaderboardRecordWrite_Best:
+		if sortOrder == 0 {
+			// Lower score is better.
+			scoreOpSql = "score = (leaderboard_record.score + $17::BIGINT - abs(leaderboard_record.score - $17::BIGINT)) / 2"
+		} else {
+			// Higher score is better.
+			scoreOpSql = "score = (leaderboard_record.score + $17::BIGINT + abs(leaderboard_record.score - $17::BIGINT)) / 2"
+		}
+		scoreDelta = incoming.GetBest()
+		scoreAbs = incoming.GetBest()
+	case nil:
+		return nil, BAD_INPUT, errors.New("No leaderboard record write operator found")
+	default:
+		return nil, BAD_INPUT, errors.New("Unknown leaderboard record write operator")
+	}
+
+	if handle == "" {
+		query = "SELECT handle, lang FROM users WHERE id = $1"
+		logger.Debug("Leaderboard record owner lookup", zap.String("query", query))
+		if err = db.QueryRowContext(ctx, query, ownerID.Bytes()).Scan(&handle, &lang); err != nil {
+			if err == sql.ErrNoRows {
+				return nil, BAD_INPUT, errors.New("User not found")
+			}
+			logger.Error("Could not execute leaderboard record owner query", zap.Error(err))
+			return nil, RUNTIME_EXCEPTION, errors.New("Error writing leaderboard record")
+		}
+	}
+
+	params := []interface{}{uuid.NewV4().Bytes(), incoming.LeaderboardId, ownerID.Bytes(), handle, lang}
+	if incoming.Location != "" {
+		params = append(params, incoming.Location)
+	} else {
+		params = append(params, nil)
+	}
+	if incoming.Timezone != "" {
+		params = append(params, incoming.Timezone)
+	} else {
+		params = append(params, nil)
+	}
+	params = append(params, 0, scoreAbs, 1)
+	if len(incoming.Metadata) != 0 {
+		params = append(params, incoming.Metadata)
+	} else {
+		params = append(params, nil)
+	}
+	params = append(params, 0, updatedAt, invertMs(updatedAt), expiresAt, 0, scoreDelta)
+
+	query = `INSERT INTO leaderboard_record (id, leaderboard_id, owner_id, handle, lang, location, timezone,
+				rank_value, score, num_score, metadata, ranked_at, updated_at, updated_at_inverse, expires_at, banned_at)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, COALESCE($11, '{}'), $12, $13, $14, $15, $16)
+			ON CONFLICT (leaderboard_id, expires_at, owner_id)
+			DO UPDATE SET handle = $4, lang = $5, location = COALESCE($6, leaderboard_record.location),
+			  timezone = COALESCE($7, leaderboard_record.timezone), ` + scoreOpSql + `, num_score = leaderboard_record.num_score + 1,
+			  metadata = COALESCE($11, leaderboard_record.metadata), updated_at = $13`
+	logger.Debug("Leaderboard record write", zap.String("query", query))
+	res, err := db.ExecContext(ctx, query, params...)
+	if err != nil {
+		logger.Error("Could not execute leaderboard record write query", zap.Error(err))
+		return nil, RUNTIME_EXCEPTION, errors.New("Error writing leaderboard record")
+	}
+	if rowsAffected, _ := res.RowsAffected(); rowsAffected == 0 {
+		logger.Error("Unexpected row count from leaderboard record write query")
+		return nil, RUNTIME_EXCEPTION, errors.New("Error writing leaderboard record")
+	}
+
+	var location sql.NullString
+	var timezone sql.NullString
+	var rankValue int64
+	var score int64
+	var numScore int64
+	var metadata []byte
+	var rankedAt int64
+	var bannedAt int64
+	query = `SELECT location, timezone, rank_value, score, num_score, metadata, ranked_at, banned_at
+		FROM leaderboard_record
+		WHERE leaderboard_id = $1
+		AND expires_at = $2
+		AND owner_id = $3`
+	logger.Debug("Leaderboard record read", zap.String("query", query))
+	err = db.QueryRowContext(ctx, query, incoming.LeaderboardId, expiresAt, ownerID.Bytes()).
+		Scan(&location, &timezone, &rankValue, &score, &numScore, &metadata, &rankedAt, &bannedAt)
+	if err != nil {
+		logger.Error("Could not execute leaderboard record read query", zap.Error(err))
+		return nil, RUNTIME_EXCEPTION, errors.New("Error writing leaderboard record")
+	}
+
+	return &LeaderboardRecord{
+		LeaderboardId: incoming.LeaderboardId,
+		OwnerId:       ownerID.Bytes(),
+		Handle:        handle,
+		Lang:          lang,
+		Location:      location.String,
+		Timezone:      timezone.String,
+		Rank:          rankValue,
+		Score:         score,
+		NumScore:      numScore,
+		Metadata:      metadata,
+		RankedAt:      rankedAt,
+		UpdatedAt:     updatedAt,
+		ExpiresAt:     expiresAt,
+	}, 0, nil
+}
@@ -0,0 +1,379 @@
+// Copyright 2017 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/satori/go.uuid"
+	"go.uber.org/zap"
+)
+
+const (
+	mergeConflictKeepTarget = "keep_target"
+	mergeConflictKeepSource = "keep_source"
+)
+
+// Login identities moved by a merge when the target does not already have one of the same kind.
+var mergeIdentityColumns = []string{"facebook_id", "google_id", "gamecenter_id", "steam_id", "custom_id", "oidc_id"}
+
+// mergeUsers moves friends, group memberships, storage records, leaderboard records and devices from the source user
+// to the target user, along with any social, custom or email login the target does not already have. The source user
+// is then disabled. When both users have an edge to the same user or group, or a record with the same key, the
+// conflict policy decides which of the two is kept and the other is removed. Everything happens in one transaction.
+func mergeUsers(ctx context.Context, logger *zap.Logger, db *sql.DB, sourceID uuid.UUID, targetID uuid.UUID, policy string) (err error) {
+	if policy != mergeConflictKeepTarget && policy != mergeConflictKeepSource {
+		return fmt.Errorf("Unknown merge conflict policy '%v', must be '%v' or '%v'", policy, mergeConflictKeepTarget, mergeConflictKeepSource)
+	}
+	if sourceID == targetID {
+		return errors.New("Cannot merge a user into itself")
+	}
+	keepSource := policy == mergeConflictKeepSource
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			if txErr := tx.Rollback(); txErr != nil {
+				logger.Error("Could not rollback transaction", zap.Error(txErr))
+			}
+		} else {
+			err = tx.Commit()
+		}
+	}()
+
+	var handle string
+	var lang string
+	err = tx.QueryRowContext(ctx, "SELECT handle, lang FROM users WHERE id = $1", targetID.Bytes()).Scan(&handle, &lang)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			err = errUserNotFound
+		}
+		return
+	}
+
+	ts := nowMs()
+	if err = mergeUserEdges(ctx, tx, sourceID, targetID, keepSource, ts); err != nil {
+		return
+	}
+	if err = mergeGroupEdges(ctx, tx, sourceID, targetID, keepSource, ts); err != nil {
+		return
+	}
+	if err = mergeStorage(ctx, tx, sourceID, targetID, keepSource, ts); err != nil {
+		return
+	}
+	if err = mergeLeaderboardRecords(ctx, tx, sourceID, targetID, keepSource, handle, lang); err != nil {
+		return
+	}
+	if err = mergeIdentities(ctx, tx, sourceID, targetID); err != nil {
+		return
+	}
+
+	res, err := tx.ExecContext(ctx, "UPDATE users SET disabled_at = $2, disabled_reason = $3, disabled_until = 0, updated_at = $2 WHERE id = $1",
+		sourceID.Bytes(), ts, "Merged into "+targetID.String())
+	if err != nil {
+		return
+	}
+	if count, _ := res.RowsAffected(); count == 0 {
+		err = errUserNotFound
+		return
+	}
+
+	logger.Info("Merged users", zap.String("source", sourceID.String()), zap.String("target", targetID.String()), zap.String("policy", policy))
+	return
+}
+
+func mergeUserEdges(ctx context.Context, tx *sql.Tx, sourceID uuid.UUID, targetID uuid.UUID, keepSource bool, ts int64) error {
+	friendIDs, err := mergeQueryIDs(ctx, tx, "SELECT destination_id FROM user_edge WHERE source_id = $1", sourceID.Bytes())
+	if err != nil {
+		return err
+	}
+
+	for _, friendID := range friendIDs {
+		if uuid.FromBytesOrNil(friendID) == targetID {
+			// The two accounts' own relationship has no meaning once they are the same user.
+			if err = mergeDeleteEdgePair(ctx, tx, "user_edge", sourceID.Bytes(), friendID); err != nil {
+				return err
+			}
+			continue
+		}
+
+		var state int64
+		err = tx.QueryRowContext(ctx, "SELECT state FROM user_edge WHERE source_id = $1 AND destination_id = $2", targetID.Bytes(), friendID).Scan(&state)
+		if err != nil && err != sql.ErrNoRows {
+			return err
+		}
+		if err == nil {
+			if !keepSource {
+				if err = mergeDeleteEdgePair(ctx, tx, "user_edge", sourceID.Bytes(), friendID); err != nil {
+					return err
+				}
+				continue
+			}
+			if err = mergeDeleteEdgePair(ctx, tx, "user_edge", targetID.Bytes(), friendID); err != nil {
+				return err
+			}
+		}
+
+		if err = mergeMoveEdgePair(ctx, tx, "user_edge", sourceID.Bytes(), targetID.Bytes(), friendID, ts); err != nil {
+			return err
+		}
+	}
+
+	// Edge counts are recalculated rather than adjusted, as each of the cases above changes them differently.
+	for _, userID := range append(friendIDs, sourceID.Bytes(), targetID.Bytes()) {
+		var count int64
+		if err = tx.QueryRowContext(ctx, "SELECT count(*) FROM user_edge WHERE source_id = $1", userID).Scan(&count); err != nil {
+			return err
+		}
+		if _, err = tx.ExecContext(ctx, "UPDATE user_edge_metadata SET count = $2, updated_at = $3 WHERE source_id = $1", userID, count, ts); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func mergeGroupEdges(ctx context.Context, tx *sql.Tx, sourceID uuid.UUID, targetID uuid.UUID, keepSource bool, ts int64) error {
+	rows, err := tx.QueryContext(ctx, "SELECT destination_id, state FROM group_edge WHERE source_id = $1", sourceID.Bytes())
+	if err != nil {
+		return err
+	}
+	groupIDs := make([][]byte, 0)
+	sourceStates := make([]int64, 0)
+	for rows.Next() {
+		var groupID []byte
+		var state int64
+		if err = rows.Scan(&groupID, &state); err != nil {
+			rows.Close()
+			return err
+		}
+		groupIDs = append(groupIDs, groupID)
+		sourceStates = append(sourceStates, state)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	for i, groupID := range groupIDs {
+		var targetState int64
+		err = tx.QueryRowContext(ctx, "SELECT state FROM group_edge WHERE source_id = $1 AND destination_id = $2", targetID.Bytes(), groupID).Scan(&targetState)
+		if err != nil && err != sql.ErrNoRows {
+			return err
+		}
+		if err == nil {
+			removedUserID := sourceID.Bytes()
+			removedState := sourceStates[i]
+			if keepSource {
+				removedUserID = targetID.Bytes()
+				removedState = targetState
+			}
+			if err = mergeDeleteEdgePair(ctx, tx, "group_edge", removedUserID, groupID); err != nil {
+				return err
+			}
+			// Only admins and members count towards the group size, join requests do not.
+			if removedState == 0 || removedState == 1 {
+				if _, err = tx.ExecContext(ctx, "UPDATE groups SET count = count - 1, updated_at = $2 WHERE id = $1", groupID, ts); err != nil {
+					return err
+				}
+			}
+			if !keepSource {
+				continue
+			}
+		}
+
+		if err = mergeMoveEdgePair(ctx, tx, "group_edge", sourceID.Bytes(), targetID.Bytes(), groupID, ts); err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.ExecContext(ctx, "UPDATE groups SET creator_id = $2, updated_at = $3 WHERE creator_id = $1", sourceID.Bytes(), targetID.Bytes(), ts)
+	return err
+}
+
+func mergeStorage(ctx context.Context, tx *sql.Tx, sourceID uuid.UUID, targetID uuid.UUID, keepSource bool, ts int64) error {
+	rows, err := tx.QueryContext(ctx, `
+SELECT s.app_id, s.bucket, s.collection, s.record
+FROM storage s, storage t
+WHERE s.user_id = $1 AND t.user_id = $2 AND s.deleted_at = 0 AND t.deleted_at = 0
+AND s.app_id = t.app_id AND s.bucket = t.bucket AND s.collection = t.collection AND s.record = t.record`, sourceID.Bytes(), targetID.Bytes())
+	if err != nil {
+		return err
+	}
+	conflicts := make([][]string, 0)
+	for rows.Next() {
+		var appID, bucket, collection, record string
+		if err = rows.Scan(&appID, &bucket, &collection, &record); err != nil {
+			rows.Close()
+			return err
+		}
+		conflicts = append(conflicts, []string{appID, bucket, collection, record})
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	// Records that lose a conflict are deleted the same way clients delete them, and remain with their original owner.
+	removedUserID := sourceID.Bytes()
+	if keepSource {
+		removedUserID = targetID.Bytes()
+	}
+	for _, key := range conflicts {
+		_, err = tx.ExecContext(ctx, `
+UPDATE storage SET deleted_at = $1, updated_at = $1
+WHERE app_id = $2 AND bucket = $3 AND collection = $4 AND record = $5 AND user_id = $6 AND deleted_at = 0`,
+			ts, key[0], key[1], key[2], key[3], removedUserID)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.ExecContext(ctx, "UPDATE storage SET user_id = $2, updated_at = $3 WHERE user_id = $1 AND deleted_at = 0",
+		sourceID.Bytes(), targetID.Bytes(), ts)
+	return err
+}
+
+func mergeLeaderboardRecords(ctx context.Context, tx *sql.Tx, sourceID uuid.UUID, targetID uuid.UUID, keepSource bool, handle string, lang string) error {
+	rows, err := tx.QueryContext(ctx, `
+SELECT s.leaderboard_id, s.expires_at
+FROM leaderboard_record s, leaderboard_record t
+WHERE s.owner_id = $1 AND t.owner_id = $2
+AND s.leaderboard_id = t.leaderboard_id AND s.expires_at = t.expires_at`, sourceID.Bytes(), targetID.Bytes())
+	if err != nil {
+		return err
+	}
+	leaderboardIDs := make([][]byte, 0)
+	expiries := make([]int64, 0)
+	for rows.Next() {
+		var leaderboardID []byte
+		var expiresAt int64
+		if err = rows.Scan(&leaderboardID, &expiresAt); err != nil {
+			rows.Close()
+			return err
+		}
+		leaderboardIDs = append(leaderboardIDs, leaderboardID)
+		expiries = append(expiries, expiresAt)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	removedUserID := sourceID.Bytes()
+	if keepSource {
+		removedUserID = targetID.Bytes()
+	}
+	for i, leaderboardID := range leaderboardIDs {
+		_, err = tx.ExecContext(ctx, "DELETE FROM leaderboard_record WHERE leaderboard_id = $1 AND expires_at = $2 AND owner_id = $3",
+			leaderboardID, expiries[i], removedUserID)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.ExecContext(ctx, "UPDATE leaderboard_record SET owner_id = $2, handle = $3, lang = $4 WHERE owner_id = $1",
+		sourceID.Bytes(), targetID.Bytes(), handle, lang)
+	return err
+}
+
+func mergeIdentities(ctx context.Context, tx *sql.Tx, sourceID uuid.UUID, targetID uuid.UUID) error {
+	if _, err := tx.ExecContext(ctx, "UPDATE user_device SET user_id = $2 WHERE user_id = $1", sourceID.Bytes(), targetID.Bytes()); err != nil {
+		return err
+	}
+
+	// Each identity column is unique, so it is cleared on the source before it is set on the target.
+	for _, column := range mergeIdentityColumns {
+		var sourceValue sql.NullString
+		var targetValue sql.NullString
+		err := tx.QueryRowContext(ctx, "SELECT s."+column+", t."+column+" FROM users s, users t WHERE s.id = $1 AND t.id = $2",
+			sourceID.Bytes(), targetID.Bytes()).Scan(&sourceValue, &targetValue)
+		if err != nil {
+			return err
+		}
+		if !sourceValue.Valid || targetValue.Valid {
+			continue
+		}
+		if _, err = tx.ExecContext(ctx, "UPDATE users SET "+column+" = NULL WHERE id = $1", sourceID.Bytes()); err != nil {
+			return err
+		}
+		if _, err = tx.ExecContext(ctx, "UPDATE users SET "+column+" = $2 WHERE id = $1", targetID.Bytes(), sourceValue.String); err != nil {
+			return err
+		}
+	}
+
+	// An email login moves together with its password and verification state.
+	var email sql.NullString
+	var password []byte
+	var verifiedAt int64
+	var targetEmail sql.NullString
+	err := tx.QueryRowContext(ctx, "SELECT s.email, s.password, s.verified_at, t.email FROM users s, users t WHERE s.id = $1 AND t.id = $2",
+		sourceID.Bytes(), targetID.Bytes()).Scan(&email, &password, &verifiedAt, &targetEmail)
+	if err != nil {
+		return err
+	}
+	if !email.Valid || targetEmail.Valid {
+		return nil
+	}
+	if _, err = tx.ExecContext(ctx, "UPDATE users SET email = NULL, password = NULL, verified_at = 0 WHERE id = $1", sourceID.Bytes()); err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, "UPDATE users SET email = $2, password = $3, verified_at = $4 WHERE id = $1",
+		targetID.Bytes(), email.String, password, verifiedAt)
+	return err
+}
+
+func mergeQueryIDs(ctx context.Context, tx *sql.Tx, query string, args ...interface{}) ([][]byte, error) {
+	rows, err := tx.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := make([][]byte, 0)
+	for rows.Next() {
+		var id []byte
+		if err = rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// mergeDeleteEdgePair removes both directions of an edge in the user_edge or group_edge table.
+func mergeDeleteEdgePair(ctx context.Context, tx *sql.Tx, table string, userID []byte, otherID []byte) error {
+	_, err := tx.ExecContext(ctx, "DELETE FROM "+table+" WHERE (source_id = $1 AND destination_id = $2) OR (source_id = $2 AND destination_id = $1)",
+		userID, otherID)
+	return err
+}
+
+// mergeMoveEdgePair moves both directions of an edge in the user_edge or group_edge table from one user to another.
+func mergeMoveEdgePair(ctx context.Context, tx *sql.Tx, table string, fromID []byte, toID []byte, otherID []byte, ts int64) error {
+	_, err := tx.ExecContext(ctx, "UPDATE "+table+" SET source_id = $2, updated_at = $4 WHERE source_id = $1 AND destination_id = $3",
+		fromID, toID, otherID, ts)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, "UPDATE "+table+" SET destination_id = $2, updated_at = $4 WHERE source_id = $3 AND destination_id = $1",
+		fromID, toID, otherID, ts)
+	return err
+}
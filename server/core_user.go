@@ -0,0 +1,91 @@
+// Copyright 2017 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+
+	"github.com/satori/go.uuid"
+)
+
+var errUserNotFound = errors.New("User not found")
+
+// userDisabled checks if a user is currently disabled, and the reason given when they were.
+func userDisabled(db *sql.DB, userID uuid.UUID) (bool, string, error) {
+	var disabledAt int64
+	var disabledReason sql.NullString
+	var disabledUntil int64
+	err := db.QueryRow("SELECT disabled_at, disabled_reason, disabled_until FROM users WHERE id = $1", userID.Bytes()).
+		Scan(&disabledAt, &disabledReason, &disabledUntil)
+	if err != nil {
+		return false, "", err
+	}
+
+	return disabledNow(disabledAt, disabledUntil), disabledReason.String, nil
+}
+
+// userTokenStatus checks if a user is currently disabled, and gives the Unix time in milliseconds before which the
+// user's session and refresh tokens are rejected.
+func userTokenStatus(ctx context.Context, db *sql.DB, userID uuid.UUID) (bool, int64, error) {
+	var disabledAt int64
+	var disabledUntil int64
+	var tokensValidAfter int64
+	err := db.QueryRowContext(ctx, "SELECT disabled_at, disabled_until, tokens_valid_after FROM users WHERE id = $1", userID.Bytes()).
+		Scan(&disabledAt, &disabledUntil, &tokensValidAfter)
+	if err != nil {
+		return false, 0, err
+	}
+
+	return disabledNow(disabledAt, disabledUntil), tokensValidAfter, nil
+}
+
+// disabledNow checks if a user disabled at the given time, until the given time or indefinitely if it is 0, is still
+// disabled.
+func disabledNow(disabledAt int64, disabledUntil int64) bool {
+	return disabledAt != 0 && (disabledUntil == 0 || disabledUntil > nowMs())
+}
+
+// disableUser disables a user until the given time in milliseconds, or indefinitely if it is 0.
+func disableUser(db *sql.DB, userID uuid.UUID, reason string, until int64) error {
+	var disabledReason interface{}
+	if reason != "" {
+		disabledReason = reason
+	}
+
+	ts := nowMs()
+	res, err := db.Exec("UPDATE users SET disabled_at = $2, disabled_reason = $3, disabled_until = $4, updated_at = $2 WHERE id = $1",
+		userID.Bytes(), ts, disabledReason, until)
+	if err != nil {
+		return err
+	}
+	if count, _ := res.RowsAffected(); count == 0 {
+		return errUserNotFound
+	}
+	return nil
+}
+
+func enableUser(db *sql.DB, userID uuid.UUID) error {
+	res, err := db.Exec("UPDATE users SET disabled_at = 0, disabled_reason = NULL, disabled_until = 0, updated_at = $2 WHERE id = $1",
+		userID.Bytes(), nowMs())
+	if err != nil {
+		return err
+	}
+	if count, _ := res.RowsAffected(); count == 0 {
+		return errUserNotFound
+	}
+	return nil
+}
@@ -0,0 +1,125 @@
+// Copyright 2017 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+var errCustomIDRejected = errors.New("Custom ID credential rejected")
+
+// CustomIDProfile is the identity an external account system confirmed for a custom ID credential. Only the ID is
+// required, the other fields are used for the profile of newly registered users when set.
+type CustomIDProfile struct {
+	ID        string `json:"id"`
+	Handle    string `json:"handle"`
+	Fullname  string `json:"fullname"`
+	AvatarURL string `json:"avatar_url"`
+	Lang      string `json:"lang"`
+}
+
+// CustomIDVerifier checks the credential a client sends for custom ID login, register and link, and gives the
+// identity it belongs to. An error means the credential was rejected.
+type CustomIDVerifier interface {
+	Verify(credential string) (*CustomIDProfile, error)
+}
+
+// CustomIDVerifierFunc lets a Go function be used as a CustomIDVerifier.
+type CustomIDVerifierFunc func(credential string) (*CustomIDProfile, error)
+
+// Verify calls the function.
+func (f CustomIDVerifierFunc) Verify(credential string) (*CustomIDProfile, error) {
+	return f(credential)
+}
+
+// NewCustomIDVerifier creates the verifier set in the configuration. It returns nil if no verifier URL is set, in
+// which case custom IDs from clients are trusted as they are.
+func NewCustomIDVerifier(config Config) CustomIDVerifier {
+	customConfig := config.GetSocial().Custom
+	if customConfig.VerifierURL == "" {
+		return nil
+	}
+	return &httpCustomIDVerifier{
+		url:    customConfig.VerifierURL,
+		client: &http.Client{Timeout: time.Duration(customConfig.TimeoutMs) * time.Millisecond},
+	}
+}
+
+// httpCustomIDVerifier POSTs the credential as {"credential": "..."} and expects a CustomIDProfile as JSON in return.
+// Any status other than 200 rejects the credential.
+type httpCustomIDVerifier struct {
+	url    string
+	client *http.Client
+}
+
+func (v *httpCustomIDVerifier) Verify(credential string) (*CustomIDProfile, error) {
+	body, _ := json.Marshal(map[string]string{"credential": credential})
+	resp, err := v.client.Post(v.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("Custom ID verifier rejected credential with status %v", resp.StatusCode)
+	}
+
+	var profile CustomIDProfile
+	if err = json.Unmarshal(data, &profile); err != nil {
+		return nil, err
+	}
+	return &profile, nil
+}
+
+// verifyCustomID resolves a client-supplied custom ID credential to the custom ID to store. Without a verifier the
+// credential is the custom ID. Returns errCustomIDRejected if the verifier did not accept the credential, any other
+// error is a problem with the input. Error messages are safe to send to clients.
+func verifyCustomID(logger *zap.Logger, verifier CustomIDVerifier, credential string) (*CustomIDProfile, error) {
+	if credential == "" {
+		return nil, errors.New("Custom ID is required")
+	}
+
+	if verifier == nil {
+		if invalidCharsRegex.MatchString(credential) {
+			return nil, errors.New("Invalid custom ID, no spaces or control characters allowed")
+		} else if len(credential) < 10 || len(credential) > 64 {
+			return nil, errors.New("Invalid custom ID, must be 10-64 bytes")
+		}
+		return &CustomIDProfile{ID: credential}, nil
+	}
+
+	profile, err := verifier.Verify(credential)
+	if err != nil || profile == nil {
+		logger.Warn("Could not verify custom ID credential", zap.Error(err))
+		return nil, errCustomIDRejected
+	}
+	// IDs from the external account system are trusted, but must still fit the column.
+	if profile.ID == "" || invalidCharsRegex.MatchString(profile.ID) || len(profile.ID) > 64 {
+		logger.Warn("Custom ID verifier returned an invalid ID", zap.String("id", profile.ID))
+		return nil, errCustomIDRejected
+	}
+	return profile, nil
+}
@@ -0,0 +1,108 @@
+// Copyright 2017 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/satori/go.uuid"
+	"go.uber.org/zap"
+)
+
+// emailVerifier issues email verification tokens and confirms them.
+type emailVerifier struct {
+	logger         *zap.Logger
+	config         Config
+	db             *sql.DB
+	hmacSecretByte []byte
+	mailSender     MailSender
+}
+
+func newEmailVerifier(logger *zap.Logger, config Config, db *sql.DB, mailSender MailSender) *emailVerifier {
+	return &emailVerifier{
+		logger:         logger,
+		config:         config,
+		db:             db,
+		hmacSecretByte: []byte(config.GetSession().EncryptionKey),
+		mailSender:     mailSender,
+	}
+}
+
+// sendVerification mails a verification link for the user's email address. Delivery happens in the background.
+func (v *emailVerifier) sendVerification(userID uuid.UUID, email string) {
+	mailConfig := v.config.GetMail()
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"typ": tokenTypeEmailVerification,
+		"uid": userID.String(),
+		"eml": email,
+		"exp": time.Now().UTC().Add(time.Duration(mailConfig.VerificationTokenExpiryMs) * time.Millisecond).Unix(),
+	})
+	signedToken, _ := token.SignedString(v.hmacSecretByte)
+
+	link := strings.TrimSuffix(mailConfig.PublicURL, "/") + "/user/email/verify?token=" + url.QueryEscape(signedToken)
+	body := fmt.Sprintf("Please confirm your email address by opening the link below.\r\n\r\n%v\r\n", link)
+
+	go func() {
+		if err := v.mailSender.Send(email, "Verify your email address", body); err != nil {
+			v.logger.Error("Could not send email verification", zap.String("uid", userID.String()), zap.Error(err))
+		}
+	}()
+}
+
+// verify marks the email address a token was issued for as verified. The address is only updated while it is still
+// unverified and still linked to the user, so each token can be used once.
+func (v *emailVerifier) verify(tokenString string) error {
+	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("Unexpected signing method: %v", token.Header["alg"])
+		}
+		return v.hmacSecretByte, nil
+	})
+	if err != nil || !token.Valid {
+		v.logger.Debug("Email verification token invalid", zap.Error(err))
+		return errors.New("Verification link is invalid or has expired")
+	}
+
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok {
+		return errors.New("Verification link is invalid or has expired")
+	}
+	typ, _ := claims["typ"].(string)
+	uid, _ := claims["uid"].(string)
+	email, _ := claims["eml"].(string)
+	userID, err := uuid.FromString(uid)
+	if typ != tokenTypeEmailVerification || err != nil || email == "" {
+		return errors.New("Verification link is invalid or has expired")
+	}
+
+	res, err := v.db.Exec("UPDATE users SET verified_at = $3, updated_at = $3 WHERE id = $1 AND email = $2 AND verified_at = 0",
+		userID.Bytes(), email, nowMs())
+	if err != nil {
+		v.logger.Error("Could not verify email address", zap.Error(err))
+		return errors.New("Could not verify email address")
+	}
+	if count, _ := res.RowsAffected(); count == 0 {
+		return errors.New("Verification link has already been used")
+	}
+
+	v.logger.Info("Email address verified", zap.String("uid", userID.String()))
+	return nil
+}
@@ -0,0 +1,122 @@
+// Copyright 2017 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// MailSender delivers emails to users.
+type MailSender interface {
+	Send(to string, subject string, body string) error
+}
+
+// NewMailSender creates the MailSender selected in the configuration.
+func NewMailSender(logger *zap.Logger, multiLogger *zap.Logger, config Config) (MailSender, error) {
+	mailConfig := config.GetMail()
+
+	var sender MailSender
+	switch mailConfig.Sender {
+	case "log":
+		sender = &logMailSender{logger: logger}
+	case "file":
+		path := mailConfig.File.Path
+		if path == "" {
+			path = filepath.FromSlash(config.GetDataDir() + "/mail.log")
+		}
+		sender = &fileMailSender{from: mailConfig.From, path: path}
+	case "smtp":
+		if mailConfig.SMTP.Host == "" {
+			return nil, errors.New("SMTP mail sender requires a host")
+		}
+		var auth smtp.Auth
+		if mailConfig.SMTP.Username != "" {
+			auth = smtp.PlainAuth("", mailConfig.SMTP.Username, mailConfig.SMTP.Password, mailConfig.SMTP.Host)
+		}
+		sender = &smtpMailSender{
+			from: mailConfig.From,
+			addr: fmt.Sprintf("%v:%v", mailConfig.SMTP.Host, mailConfig.SMTP.Port),
+			auth: auth,
+		}
+	default:
+		return nil, fmt.Errorf("Unknown mail sender '%v', must be 'log', 'file' or 'smtp'", mailConfig.Sender)
+	}
+
+	multiLogger.Info("Mail", zap.String("sender", mailConfig.Sender))
+	return sender, nil
+}
+
+// logMailSender writes emails to the server log instead of delivering them.
+type logMailSender struct {
+	logger *zap.Logger
+}
+
+func (s *logMailSender) Send(to string, subject string, body string) error {
+	s.logger.Info("Mail", zap.String("to", to), zap.String("subject", subject), zap.String("body", body))
+	return nil
+}
+
+// fileMailSender appends emails to a file instead of delivering them.
+type fileMailSender struct {
+	sync.Mutex
+	from string
+	path string
+}
+
+func (s *fileMailSender) Send(to string, subject string, body string) error {
+	s.Lock()
+	defer s.Unlock()
+
+	f, err := os.OpenFile(s.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = f.Write(formatMail(s.from, to, subject, body))
+	return err
+}
+
+type smtpMailSender struct {
+	from string
+	addr string
+	auth smtp.Auth
+}
+
+func (s *smtpMailSender) Send(to string, subject string, body string) error {
+	return smtp.SendMail(s.addr, s.auth, s.from, []string{to}, formatMail(s.from, to, subject, body))
+}
+
+func formatMail(from string, to string, subject string, body string) []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From: %v\r\n", from)
+	fmt.Fprintf(&buf, "To: %v\r\n", to)
+	fmt.Fprintf(&buf, "Subject: %v\r\n", subject)
+	fmt.Fprintf(&buf, "Date: %v\r\n", time.Now().Format(time.RFC1123Z))
+	buf.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	buf.WriteString("\r\n")
+	buf.WriteString(body)
+	buf.WriteString("\r\n")
+	return buf.Bytes()
+}
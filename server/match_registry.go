@@ -0,0 +1,461 @@
+// Copyright 2017 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/satori/go.uuid"
+	"go.uber.org/atomic"
+	"go.uber.org/zap"
+)
+
+// MatchMessage is a single piece of client input queued for an authoritative match.
+type MatchMessage struct {
+	Presence Presence
+	OpCode   int64
+	Data     []byte
+}
+
+// MatchDispatcher lets match handlers send data to, and remove, match participants.
+type MatchDispatcher interface {
+	// Broadcast sends data to the given presences, or to all match participants if none are given.
+	Broadcast(opCode int64, data []byte, to []Presence)
+	// Kick removes the given presences from the match.
+	Kick(presences []Presence)
+}
+
+// MatchHandler owns the state of an authoritative match. All callbacks are invoked from the single goroutine that
+// runs the match, so handlers do not need to synchronise access to their state. Returning a nil state from any
+// callback ends the match.
+type MatchHandler interface {
+	// MatchInit sets up the initial match state and the number of times per second the match loop should run.
+	// A tick rate of 0 selects the configured default.
+	MatchInit(logger *zap.Logger, params map[string]interface{}) (interface{}, int, error)
+	// MatchJoinAttempt decides if a presence may join the match, with an optional reason if it may not.
+	MatchJoinAttempt(logger *zap.Logger, dispatcher MatchDispatcher, tick int64, state interface{}, presence Presence) (interface{}, bool, string)
+	MatchJoin(logger *zap.Logger, dispatcher MatchDispatcher, tick int64, state interface{}, presences []Presence) interface{}
+	MatchLeave(logger *zap.Logger, dispatcher MatchDispatcher, tick int64, state interface{}, presences []Presence) interface{}
+	// MatchLoop runs once per tick with all client messages received since the previous tick.
+	MatchLoop(logger *zap.Logger, dispatcher MatchDispatcher, tick int64, state interface{}, messages []*MatchMessage) interface{}
+	MatchTerminate(logger *zap.Logger, dispatcher MatchDispatcher, tick int64, state interface{})
+}
+
+// MatchForwarder passes requests for authoritative matches to the node of a cluster hosting them
+type MatchForwarder interface {
+	ForwardMatchJoinAttempt(node string, matchID uuid.UUID, presence Presence) (bool, string)
+	ForwardMatchInput(node string, matchID uuid.UUID, message *MatchMessage) error
+	ForwardMatchKick(node string, topic string, presences []Presence) error
+}
+
+// MatchHandlerFactory creates a handler instance for each new match.
+type MatchHandlerFactory func() (MatchHandler, error)
+
+// MatchRegistry tracks the authoritative matches running on this node. This is thread-safe.
+type MatchRegistry struct {
+	sync.RWMutex
+	logger        *zap.Logger
+	config        Config
+	tracker       Tracker
+	messageRouter MessageRouter
+	forwarder     MatchForwarder
+	handlers      map[string]MatchHandlerFactory
+	matches       map[uuid.UUID]*match
+}
+
+// NewMatchRegistry creates a new MatchRegistry. Matches hosted by other nodes are reached through the forwarder, which
+// is nil when running a single node.
+func NewMatchRegistry(logger *zap.Logger, config Config, tracker Tracker, messageRouter MessageRouter, forwarder MatchForwarder) *MatchRegistry {
+	return &MatchRegistry{
+		logger:        logger,
+		config:        config,
+		tracker:       tracker,
+		messageRouter: messageRouter,
+		forwarder:     forwarder,
+		handlers:      make(map[string]MatchHandlerFactory),
+		matches:       make(map[uuid.UUID]*match),
+	}
+}
+
+// RegisterHandler makes a match handler available under the given name.
+func (r *MatchRegistry) RegisterHandler(name string, factory MatchHandlerFactory) {
+	r.Lock()
+	r.handlers[name] = factory
+	r.Unlock()
+}
+
+// CreateMatch starts a new authoritative match using the named handler.
+func (r *MatchRegistry) CreateMatch(name string, params map[string]interface{}) (uuid.UUID, error) {
+	r.RLock()
+	factory := r.handlers[name]
+	r.RUnlock()
+	if factory == nil {
+		return uuid.Nil, errors.New("Match handler not found")
+	}
+
+	handler, err := factory()
+	if err != nil {
+		return uuid.Nil, err
+	}
+
+	matchID := uuid.NewV4()
+	matchLogger := r.logger.With(zap.String("mid", matchID.String()), zap.String("handler", name))
+	state, tickRate, err := handler.MatchInit(matchLogger, params)
+	if err != nil {
+		return uuid.Nil, err
+	}
+	if state == nil {
+		return uuid.Nil, errors.New("Match handler did not return an initial state")
+	}
+
+	matchConfig := r.config.GetMatch()
+	if tickRate == 0 {
+		tickRate = matchConfig.DefaultTickRate
+	} else if tickRate < 1 || tickRate > matchConfig.MaxTickRate {
+		return uuid.Nil, errors.New("Match tick rate out of range")
+	}
+
+	m := &match{
+		logger:        matchLogger,
+		id:            matchID,
+		topic:         "match:" + matchID.String(),
+		handler:       handler,
+		registry:      r,
+		state:         state,
+		ticker:        time.NewTicker(time.Second / time.Duration(tickRate)),
+		inputCh:       make(chan *MatchMessage, matchConfig.InputQueueSize),
+		joinAttemptCh: make(chan *matchJoinAttempt, 1),
+		terminateCh:   make(chan struct{}),
+		stopCh:        make(chan struct{}),
+		stopped:       atomic.NewBool(false),
+		joins:         make([]Presence, 0),
+		leaves:        make([]Presence, 0),
+	}
+
+	r.Lock()
+	r.matches[matchID] = m
+	r.Unlock()
+	if r.forwarder != nil {
+		// Other nodes find the node hosting the match through this presence.
+		r.tracker.Track(matchID, matchHostTopic(matchID), uuid.Nil, PresenceMeta{})
+	}
+
+	go m.run()
+
+	matchLogger.Info("Match created", zap.Int("tick_rate", tickRate))
+	return matchID, nil
+}
+
+// Get returns the authoritative match with the given ID, or nil if it is not an authoritative match on this node.
+func (r *MatchRegistry) Get(matchID uuid.UUID) *match {
+	r.RLock()
+	m := r.matches[matchID]
+	r.RUnlock()
+	return m
+}
+
+// JoinAttempt asks the authoritative match if the presence may join, on whichever node hosts the match. It returns
+// false for found if the match is not authoritative.
+func (r *MatchRegistry) JoinAttempt(matchID uuid.UUID, presence Presence) (found bool, allow bool, reason string) {
+	if m := r.Get(matchID); m != nil {
+		allow, reason = m.JoinAttempt(presence)
+		return true, allow, reason
+	}
+	node := r.hostNode(matchID)
+	if node == "" {
+		return false, false, ""
+	}
+	allow, reason = r.forwarder.ForwardMatchJoinAttempt(node, matchID, presence)
+	return true, allow, reason
+}
+
+// Input queues a client message for the authoritative match, on whichever node hosts the match. It returns false if
+// the match is not authoritative.
+func (r *MatchRegistry) Input(matchID uuid.UUID, message *MatchMessage) bool {
+	if m := r.Get(matchID); m != nil {
+		m.Input(message)
+		return true
+	}
+	node := r.hostNode(matchID)
+	if node == "" {
+		return false
+	}
+	if err := r.forwarder.ForwardMatchInput(node, matchID, message); err != nil {
+		r.logger.Warn("Could not forward match input", zap.String("mid", matchID.String()), zap.String("node", node), zap.Error(err))
+	}
+	return true
+}
+
+// HandleDiff forwards presence changes to the authoritative matches they belong to.
+func (r *MatchRegistry) HandleDiff(joins, leaves []Presence) {
+	for _, p := range joins {
+		if m := r.getByTopic(p.Topic); m != nil {
+			m.addPresences([]Presence{p}, nil)
+		}
+	}
+	for _, p := range leaves {
+		if m := r.getByTopic(p.Topic); m != nil {
+			m.addPresences(nil, []Presence{p})
+		}
+	}
+}
+
+// Stop terminates all running matches.
+func (r *MatchRegistry) Stop() {
+	r.RLock()
+	matches := make([]*match, 0, len(r.matches))
+	for _, m := range r.matches {
+		matches = append(matches, m)
+	}
+	r.RUnlock()
+
+	for _, m := range matches {
+		m.stop()
+	}
+}
+
+// hostNode gives the other node hosting the authoritative match, or an empty string if no other node does.
+func (r *MatchRegistry) hostNode(matchID uuid.UUID) string {
+	if r.forwarder == nil {
+		return ""
+	}
+	for _, p := range r.tracker.ListByTopic(matchHostTopic(matchID)) {
+		if p.ID.Node != r.config.GetName() {
+			return p.ID.Node
+		}
+	}
+	return ""
+}
+
+func (r *MatchRegistry) getByTopic(topic string) *match {
+	if !strings.HasPrefix(topic, "match:") {
+		return nil
+	}
+	matchID, err := uuid.FromString(topic[len("match:"):])
+	if err != nil {
+		return nil
+	}
+	return r.Get(matchID)
+}
+
+func (r *MatchRegistry) remove(matchID uuid.UUID) {
+	r.Lock()
+	delete(r.matches, matchID)
+	r.Unlock()
+}
+
+func matchHostTopic(matchID uuid.UUID) string {
+	return "matchhost:" + matchID.String()
+}
+
+type matchJoinAttempt struct {
+	presence Presence
+	resultCh chan *matchJoinResult
+}
+
+type matchJoinResult struct {
+	allow  bool
+	reason string
+}
+
+type match struct {
+	sync.Mutex
+	logger        *zap.Logger
+	id            uuid.UUID
+	topic         string
+	handler       MatchHandler
+	registry      *MatchRegistry
+	tick          int64
+	state         interface{}
+	ticker        *time.Ticker
+	inputCh       chan *MatchMessage
+	joinAttemptCh chan *matchJoinAttempt
+	terminateCh   chan struct{}
+	stopCh        chan struct{}
+	stopped       *atomic.Bool
+	joins         []Presence
+	leaves        []Presence
+}
+
+func (m *match) run() {
+	for {
+		select {
+		case <-m.terminateCh:
+			m.handler.MatchTerminate(m.logger, m, m.tick, m.state)
+			m.close()
+			return
+		case attempt := <-m.joinAttemptCh:
+			state, allow, reason := m.handler.MatchJoinAttempt(m.logger, m, m.tick, m.state, attempt.presence)
+			if !m.update(state) {
+				attempt.resultCh <- &matchJoinResult{allow: false, reason: "Match not found"}
+				return
+			}
+			attempt.resultCh <- &matchJoinResult{allow: allow, reason: reason}
+		case <-m.ticker.C:
+			if !m.loop() {
+				return
+			}
+		}
+	}
+}
+
+func (m *match) loop() bool {
+	m.Lock()
+	joins := m.joins
+	leaves := m.leaves
+	m.joins = make([]Presence, 0)
+	m.leaves = make([]Presence, 0)
+	m.Unlock()
+
+	if len(joins) != 0 {
+		if !m.update(m.handler.MatchJoin(m.logger, m, m.tick, m.state, joins)) {
+			return false
+		}
+	}
+	if len(leaves) != 0 {
+		if !m.update(m.handler.MatchLeave(m.logger, m, m.tick, m.state, leaves)) {
+			return false
+		}
+	}
+
+	// Only take the messages already queued, anything arriving now belongs to the next tick.
+	size := len(m.inputCh)
+	messages := make([]*MatchMessage, 0, size)
+	for i := 0; i < size; i++ {
+		messages = append(messages, <-m.inputCh)
+	}
+
+	if !m.update(m.handler.MatchLoop(m.logger, m, m.tick, m.state, messages)) {
+		return false
+	}
+	m.tick++
+	return true
+}
+
+// update stores the new match state, or ends the match if the handler returned no state.
+func (m *match) update(state interface{}) bool {
+	if state == nil {
+		m.logger.Info("Match handler ended the match")
+		m.close()
+		return false
+	}
+	m.state = state
+	return true
+}
+
+// stop asks the match goroutine to terminate the match, and waits until it has done so.
+func (m *match) stop() {
+	select {
+	case m.terminateCh <- struct{}{}:
+		<-m.stopCh
+	case <-m.stopCh:
+	}
+}
+
+// close ends the match, it must only be called from the match goroutine.
+func (m *match) close() {
+	if m.stopped.Swap(true) {
+		return
+	}
+	close(m.stopCh)
+	m.cleanup()
+}
+
+func (m *match) cleanup() {
+	m.ticker.Stop()
+	m.registry.remove(m.id)
+	if m.registry.forwarder != nil {
+		m.registry.tracker.Untrack(m.id, matchHostTopic(m.id), uuid.Nil)
+	}
+	m.Kick(m.registry.tracker.ListByTopic(m.topic))
+	m.logger.Info("Match ended")
+}
+
+// JoinAttempt asks the match handler if the presence may join.
+func (m *match) JoinAttempt(presence Presence) (bool, string) {
+	timeout := time.After(time.Duration(m.registry.config.GetMatch().JoinAttemptTimeoutMs) * time.Millisecond)
+	attempt := &matchJoinAttempt{presence: presence, resultCh: make(chan *matchJoinResult, 1)}
+
+	select {
+	case m.joinAttemptCh <- attempt:
+	case <-m.stopCh:
+		return false, "Match not found"
+	case <-timeout:
+		return false, "Match did not respond"
+	}
+
+	select {
+	case result := <-attempt.resultCh:
+		return result.allow, result.reason
+	case <-m.stopCh:
+		return false, "Match not found"
+	case <-timeout:
+		return false, "Match did not respond"
+	}
+}
+
+// Input queues a client message for the next tick, it is dropped if the match is not keeping up.
+func (m *match) Input(message *MatchMessage) {
+	select {
+	case m.inputCh <- message:
+	default:
+		m.logger.Warn("Match input queue full, dropping message", zap.String("sid", message.Presence.ID.SessionID.String()))
+	}
+}
+
+func (m *match) addPresences(joins, leaves []Presence) {
+	m.Lock()
+	m.joins = append(m.joins, joins...)
+	m.leaves = append(m.leaves, leaves...)
+	m.Unlock()
+}
+
+func (m *match) Broadcast(opCode int64, data []byte, to []Presence) {
+	if len(to) == 0 {
+		to = m.registry.tracker.ListByTopic(m.topic)
+	}
+
+	outgoing := &Envelope{
+		Payload: &Envelope_MatchData{
+			MatchData: &MatchData{
+				MatchId: m.id.Bytes(),
+				OpCode:  opCode,
+				Data:    data,
+			},
+		},
+	}
+
+	m.registry.messageRouter.Send(m.logger, to, outgoing)
+}
+
+func (m *match) Kick(presences []Presence) {
+	// Presences on other nodes are removed by the node they are on.
+	remote := make(map[string][]Presence)
+	for _, p := range presences {
+		if p.ID.Node != m.registry.config.GetName() && m.registry.forwarder != nil {
+			remote[p.ID.Node] = append(remote[p.ID.Node], p)
+			continue
+		}
+		m.registry.tracker.Untrack(p.ID.SessionID, m.topic, p.UserID)
+	}
+	for node, ps := range remote {
+		if err := m.registry.forwarder.ForwardMatchKick(node, m.topic, ps); err != nil {
+			m.logger.Warn("Could not kick match presences on another node", zap.String("node", node), zap.Error(err))
+		}
+	}
+}
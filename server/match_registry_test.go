@@ -0,0 +1,101 @@
+// Copyright 2017 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"testing"
+
+	"github.com/satori/go.uuid"
+	"go.uber.org/zap"
+)
+
+// testMatchHandler answers join attempts as configured, and otherwise keeps the match running unchanged.
+type testMatchHandler struct {
+	allow    bool
+	endMatch bool
+}
+
+func (h *testMatchHandler) MatchInit(logger *zap.Logger, params map[string]interface{}) (interface{}, int, error) {
+	return 0, 0, nil
+}
+
+func (h *testMatchHandler) MatchJoinAttempt(logger *zap.Logger, dispatcher MatchDispatcher, tick int64, state interface{}, presence Presence) (interface{}, bool, string) {
+	if h.endMatch {
+		return nil, h.allow, ""
+	}
+	reason := ""
+	if !h.allow {
+		reason = "Match full"
+	}
+	return state, h.allow, reason
+}
+
+func (h *testMatchHandler) MatchJoin(logger *zap.Logger, dispatcher MatchDispatcher, tick int64, state interface{}, presences []Presence) interface{} {
+	return state
+}
+
+func (h *testMatchHandler) MatchLeave(logger *zap.Logger, dispatcher MatchDispatcher, tick int64, state interface{}, presences []Presence) interface{} {
+	return state
+}
+
+func (h *testMatchHandler) MatchLoop(logger *zap.Logger, dispatcher MatchDispatcher, tick int64, state interface{}, messages []*MatchMessage) interface{} {
+	return state
+}
+
+func (h *testMatchHandler) MatchTerminate(logger *zap.Logger, dispatcher MatchDispatcher, tick int64, state interface{}) {
+}
+
+func TestMatchJoinAttempt(t *testing.T) {
+	tests := []struct {
+		name        string
+		handler     *testMatchHandler
+		allow       bool
+		reason      string
+		matchExists bool
+	}{
+		{"allowed", &testMatchHandler{allow: true}, true, "", true},
+		{"rejected", &testMatchHandler{allow: false}, false, "Match full", true},
+		{"allowed by a handler that ends the match", &testMatchHandler{allow: true, endMatch: true}, false, "Match not found", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := NewConfig()
+			tracker := NewTrackerService(config.GetName())
+			registry := NewMatchRegistry(zap.NewNop(), config, tracker, NewMessageRouterService(config.GetName(), nil, nil), nil)
+			registry.RegisterHandler("test", func() (MatchHandler, error) {
+				return tt.handler, nil
+			})
+			matchID, err := registry.CreateMatch("test", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer registry.Stop()
+
+			m := registry.Get(matchID)
+			presence := Presence{
+				ID:     PresenceID{Node: config.GetName(), SessionID: uuid.NewV4()},
+				Topic:  "match:" + matchID.String(),
+				UserID: uuid.NewV4(),
+			}
+			allow, reason := m.JoinAttempt(presence)
+			if allow != tt.allow || reason != tt.reason {
+				t.Fatalf("JoinAttempt() = %v, %q, expected %v, %q", allow, reason, tt.allow, tt.reason)
+			}
+			if exists := registry.Get(matchID) != nil; exists != tt.matchExists {
+				t.Fatalf("match exists %v, expected %v", exists, tt.matchExists)
+			}
+		})
+	}
+}
@@ -16,6 +16,7 @@ package server
 
 import (
 	"github.com/gogo/protobuf/proto"
+	"github.com/satori/go.uuid"
 	"go.uber.org/zap"
 )
 
@@ -24,13 +25,24 @@ type MessageRouter interface {
 	Send(*zap.Logger, []Presence, proto.Message)
 }
 
+// MessageForwarder sends messages to sessions connected to other nodes of a cluster
+type MessageForwarder interface {
+	Forward(node string, sessionIDs []uuid.UUID, msg proto.Message) error
+}
+
 type messageRouterService struct {
-	registry *SessionRegistry
+	name      string
+	registry  *SessionRegistry
+	forwarder MessageForwarder
 }
 
-func NewMessageRouterService(registry *SessionRegistry) *messageRouterService {
+// NewMessageRouterService creates a new MessageRouter. Presences on other nodes are sent to by the forwarder, which is
+// nil when running a single node.
+func NewMessageRouterService(name string, registry *SessionRegistry, forwarder MessageForwarder) *messageRouterService {
 	return &messageRouterService{
-		registry: registry,
+		name:      name,
+		registry:  registry,
+		forwarder: forwarder,
 	}
 }
 
@@ -39,15 +51,28 @@ func (m *messageRouterService) Send(logger *zap.Logger, ps []Presence, msg proto
 		return
 	}
 
-	payload, err := proto.Marshal(msg)
-	if err != nil {
-		logger.Error("Could not marshall message to byte[]", zap.Error(err))
-		return
-	}
+	// Encoded once for each session format in use.
+	payloads := make(map[string][]byte, 2)
+	// Sent once to each other node with all its sessions.
+	remote := make(map[string][]uuid.UUID)
 
 	for _, p := range ps {
+		if p.ID.Node != m.name && m.forwarder != nil {
+			remote[p.ID.Node] = append(remote[p.ID.Node], p.ID.SessionID)
+			continue
+		}
 		session := m.registry.Get(p.ID.SessionID)
 		if session != nil {
+			payload, ok := payloads[session.format]
+			if !ok {
+				var err error
+				payload, err = marshalSessionMessage(session.format, msg)
+				if err != nil {
+					logger.Error("Could not marshall message to byte[]", zap.Error(err))
+					return
+				}
+				payloads[session.format] = payload
+			}
 			err := session.SendBytes(payload)
 			if err != nil {
 				logger.Error("Failed to route to", zap.Any("p", p), zap.Error(err))
@@ -56,4 +81,9 @@ func (m *messageRouterService) Send(logger *zap.Logger, ps []Presence, msg proto
 			logger.Warn("No session to route to", zap.Any("p", p))
 		}
 	}
+	for node, sessionIDs := range remote {
+		if err := m.forwarder.Forward(node, sessionIDs, msg); err != nil {
+			logger.Error("Failed to route to node", zap.String("node", node), zap.Int("sessions", len(sessionIDs)), zap.Error(err))
+		}
+	}
 }
@@ -15,6 +15,10 @@
 package server
 
 import (
+	"context"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"net/http"
@@ -22,31 +26,69 @@ import (
 	"nakama/build/generated/dashboard"
 	"os"
 	"runtime"
+	"strings"
+	"time"
 
 	"github.com/elazarl/go-bindata-assetfs"
 	"github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
+	"github.com/satori/go.uuid"
 	"go.uber.org/zap"
 )
 
+// opsLeaderboardRecordWrite is the request body for server-side leaderboard record writes.
+type opsLeaderboardRecordWrite struct {
+	// LeaderboardID is base64 encoded, as printed by the create-leaderboard admin command.
+	LeaderboardID string          `json:"leaderboard_id"`
+	OwnerID       string          `json:"owner_id"`
+	Op            string          `json:"op"`
+	Value         int64           `json:"value"`
+	Location      string          `json:"location"`
+	Timezone      string          `json:"timezone"`
+	Metadata      json.RawMessage `json:"metadata"`
+}
+
+// opsUserDisable is the request body for disabling and enabling users.
+type opsUserDisable struct {
+	UserID string `json:"user_id"`
+	Reason string `json:"reason"`
+	// Until is a Unix time in milliseconds, 0 disables the user indefinitely.
+	Until int64 `json:"until"`
+}
+
+// opsUserMerge is the request body for merging one user into another.
+type opsUserMerge struct {
+	SourceID string `json:"source_id"`
+	TargetID string `json:"target_id"`
+	// ConflictPolicy overrides the configured merge conflict policy when set.
+	ConflictPolicy string `json:"conflict_policy"`
+}
+
 // opsService is responsible for serving the dashboard and all of its required resources
 type opsService struct {
 	logger              *zap.Logger
 	version             string
 	config              Config
+	db                  *sql.DB
 	statsService        StatsService
+	registry            *SessionRegistry
 	mux                 *mux.Router
+	opsKeyMux           *mux.Router
+	server              *http.Server
 	dashboardFilesystem http.FileSystem
 }
 
 // NewOpsService creates a new opsService
-func NewOpsService(logger *zap.Logger, multiLogger *zap.Logger, version string, config Config, statsService StatsService) *opsService {
+func NewOpsService(logger *zap.Logger, multiLogger *zap.Logger, version string, config Config, db *sql.DB, statsService StatsService, registry *SessionRegistry) *opsService {
 	service := &opsService{
 		logger:       logger,
 		version:      version,
 		config:       config,
+		db:           db,
 		statsService: statsService,
+		registry:     registry,
 		mux:          mux.NewRouter(),
+		opsKeyMux:    mux.NewRouter(),
 		dashboardFilesystem: &assetfs.AssetFS{
 			Asset:     dashboard.Asset,
 			AssetDir:  dashboard.AssetDir,
@@ -59,11 +101,20 @@ func NewOpsService(logger *zap.Logger, multiLogger *zap.Logger, version string,
 	service.mux.HandleFunc("/v0/info", service.infoHandler).Methods("GET")
 	service.mux.PathPrefix("/").Handler(http.FileServer(service.dashboardFilesystem)).Methods("GET") //needs to be last
 
+	// Requests that change data need the ops key, and are kept out of CORS so web pages can't make them.
+	service.opsKeyMux.HandleFunc("/v0/leaderboard/record", service.requireOpsKey(service.leaderboardRecordWriteHandler)).Methods("POST")
+	service.opsKeyMux.HandleFunc("/v0/user/disable", service.requireOpsKey(service.userDisableHandler)).Methods("POST")
+	service.opsKeyMux.HandleFunc("/v0/user/enable", service.requireOpsKey(service.userEnableHandler)).Methods("POST")
+	service.opsKeyMux.HandleFunc("/v0/user/merge", service.requireOpsKey(service.userMergeHandler)).Methods("POST")
+	service.opsKeyMux.PathPrefix("/").Handler(handlers.CORS(handlers.AllowedOrigins([]string{"*"}))(service.mux))
+
+	service.server = &http.Server{
+		Addr:    fmt.Sprintf(":%d", config.GetOpsPort()),
+		Handler: service.opsKeyMux,
+	}
 	go func() {
-		bindAddr := fmt.Sprintf(":%d", config.GetOpsPort())
-		handlerWithCORS := handlers.CORS(handlers.AllowedOrigins([]string{"*"}))(service.mux)
-		err := http.ListenAndServe(bindAddr, handlerWithCORS)
-		if err != nil {
+		err := listenAndServe(multiLogger, service.server, config.GetTLS().Ops)
+		if err != nil && err != http.ErrServerClosed {
 			multiLogger.Fatal("Ops listener failed", zap.Error(err))
 		}
 	}()
@@ -72,12 +123,23 @@ func NewOpsService(logger *zap.Logger, multiLogger *zap.Logger, version string,
 	if err != nil {
 		hostname = "127.0.0.1"
 	}
-	multiLogger.Info("Dashboard", zap.String("url", fmt.Sprintf("http://%s:%d", hostname, config.GetOpsPort())))
+	scheme := "http"
+	if config.GetTLS().Ops.CertFile != "" {
+		scheme = "https"
+	}
+	multiLogger.Info("Dashboard", zap.String("url", fmt.Sprintf("%s://%s:%d", scheme, hostname, config.GetOpsPort())))
 
 	return service
 }
 
-func (s *opsService) Stop() {}
+// Stop closes the ops listener once requests in progress have finished, or the shutdown grace period ends.
+func (s *opsService) Stop() {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(s.config.GetTransport().ShutdownGraceMs)*time.Millisecond)
+	defer cancel()
+	if err := s.server.Shutdown(ctx); err != nil {
+		s.logger.Warn("Ops requests still in progress at shutdown deadline", zap.Error(err))
+	}
+}
 
 func (s *opsService) statusHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
@@ -108,3 +170,195 @@ func (s *opsService) infoHandler(w http.ResponseWriter, r *http.Request) {
 	infoBytes, _ := json.Marshal(info)
 	w.Write(infoBytes)
 }
+
+// requireOpsKey only lets through requests carrying the configured ops key as a bearer token. Nothing is let through if
+// no ops key is configured.
+func (s *opsService) requireOpsKey(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		opsKey := s.config.GetOpsKey()
+		if opsKey == "" {
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			s.sendError(w, http.StatusForbidden, "Ops key not configured")
+			return
+		}
+		header := r.Header.Get("authorization")
+		if !strings.HasPrefix(header, "Bearer ") || subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(header, "Bearer ")), []byte(opsKey)) != 1 {
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			s.sendError(w, http.StatusUnauthorized, "Missing or invalid ops key")
+			return
+		}
+		handler(w, r)
+	}
+}
+
+func (s *opsService) leaderboardRecordWriteHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+
+	var body opsLeaderboardRecordWrite
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		s.sendError(w, http.StatusBadRequest, "Request body must be a valid JSON object")
+		return
+	}
+	leaderboardID, err := base64.StdEncoding.DecodeString(body.LeaderboardID)
+	if err != nil {
+		s.sendError(w, http.StatusBadRequest, "Leaderboard ID must be base64 encoded")
+		return
+	}
+	ownerID, err := uuid.FromString(body.OwnerID)
+	if err != nil {
+		s.sendError(w, http.StatusBadRequest, "Owner ID must be a valid user ID")
+		return
+	}
+
+	write, err := NewLeaderboardRecordWrite(leaderboardID, body.Op, body.Value, body.Location, body.Timezone, body.Metadata)
+	if err != nil {
+		s.sendError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	record, code, err := leaderboardRecordWrite(r.Context(), s.logger, s.db, ownerID, "", "", "", write, true, true)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if code == BAD_INPUT {
+			status = http.StatusBadRequest
+		}
+		s.sendError(w, status, err.Error())
+		return
+	}
+
+	var metadata interface{}
+	json.Unmarshal(record.Metadata, &metadata)
+	recordJSON, _ := json.Marshal(map[string]interface{}{
+		"leaderboard_id": base64.StdEncoding.EncodeToString(record.LeaderboardId),
+		"owner_id":       ownerID.String(),
+		"handle":         record.Handle,
+		"lang":           record.Lang,
+		"location":       record.Location,
+		"timezone":       record.Timezone,
+		"rank":           record.Rank,
+		"score":          record.Score,
+		"num_score":      record.NumScore,
+		"metadata":       metadata,
+		"ranked_at":      record.RankedAt,
+		"updated_at":     record.UpdatedAt,
+		"expires_at":     record.ExpiresAt,
+	})
+	w.Write(recordJSON)
+}
+
+func (s *opsService) userDisableHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+
+	var body opsUserDisable
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		s.sendError(w, http.StatusBadRequest, "Request body must be a valid JSON object")
+		return
+	}
+	userID, err := uuid.FromString(body.UserID)
+	if err != nil {
+		s.sendError(w, http.StatusBadRequest, "User ID must be a valid user ID")
+		return
+	}
+	if body.Until < 0 || (body.Until != 0 && body.Until <= nowMs()) {
+		s.sendError(w, http.StatusBadRequest, "Until must be 0 or a time in the future")
+		return
+	}
+	if len(body.Reason) > 255 {
+		s.sendError(w, http.StatusBadRequest, "Reason must be at most 255 bytes")
+		return
+	}
+
+	if err = disableUser(s.db, userID, body.Reason, body.Until); err == errUserNotFound {
+		s.sendError(w, http.StatusNotFound, err.Error())
+		return
+	} else if err != nil {
+		s.logger.Error("Could not disable user", zap.String("uid", userID.String()), zap.Error(err))
+		s.sendError(w, http.StatusInternalServerError, "Could not disable user")
+		return
+	}
+
+	reason := body.Reason
+	if reason == "" {
+		reason = "Account disabled"
+	}
+	s.registry.disconnectUser(userID, USER_DISABLED, reason)
+
+	s.logger.Info("User disabled", zap.String("uid", userID.String()), zap.String("reason", body.Reason), zap.Int64("until", body.Until))
+	w.Write([]byte("{}"))
+}
+
+func (s *opsService) userEnableHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+
+	var body opsUserDisable
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		s.sendError(w, http.StatusBadRequest, "Request body must be a valid JSON object")
+		return
+	}
+	userID, err := uuid.FromString(body.UserID)
+	if err != nil {
+		s.sendError(w, http.StatusBadRequest, "User ID must be a valid user ID")
+		return
+	}
+
+	if err = enableUser(s.db, userID); err == errUserNotFound {
+		s.sendError(w, http.StatusNotFound, err.Error())
+		return
+	} else if err != nil {
+		s.logger.Error("Could not enable user", zap.String("uid", userID.String()), zap.Error(err))
+		s.sendError(w, http.StatusInternalServerError, "Could not enable user")
+		return
+	}
+
+	s.logger.Info("User enabled", zap.String("uid", userID.String()))
+	w.Write([]byte("{}"))
+}
+
+func (s *opsService) userMergeHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+
+	var body opsUserMerge
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		s.sendError(w, http.StatusBadRequest, "Request body must be a valid JSON object")
+		return
+	}
+	sourceID, err := uuid.FromString(body.SourceID)
+	if err != nil {
+		s.sendError(w, http.StatusBadRequest, "Source ID must be a valid user ID")
+		return
+	}
+	targetID, err := uuid.FromString(body.TargetID)
+	if err != nil {
+		s.sendError(w, http.StatusBadRequest, "Target ID must be a valid user ID")
+		return
+	}
+	if sourceID == targetID {
+		s.sendError(w, http.StatusBadRequest, "Source and target must be different users")
+		return
+	}
+	policy := body.ConflictPolicy
+	if policy == "" {
+		policy = s.config.GetMerge().ConflictPolicy
+	} else if policy != mergeConflictKeepTarget && policy != mergeConflictKeepSource {
+		s.sendError(w, http.StatusBadRequest, "Conflict policy must be 'keep_target' or 'keep_source'")
+		return
+	}
+
+	if err = mergeUsers(r.Context(), s.logger, s.db, sourceID, targetID, policy); err == errUserNotFound {
+		s.sendError(w, http.StatusNotFound, err.Error())
+		return
+	} else if err != nil {
+		s.logger.Error("Could not merge users", zap.String("source", sourceID.String()), zap.String("target", targetID.String()), zap.Error(err))
+		s.sendError(w, http.StatusInternalServerError, "Could not merge users")
+		return
+	}
+
+	s.registry.disconnectUser(sourceID, USER_DISABLED, "Merged into another user")
+	w.Write([]byte("{}"))
+}
+
+func (s *opsService) sendError(w http.ResponseWriter, status int, message string) {
+	errorJSON, _ := json.Marshal(map[string]interface{}{"error": message})
+	w.WriteHeader(status)
+	w.Write(errorJSON)
+}
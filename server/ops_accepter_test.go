@@ -0,0 +1,56 @@
+// Copyright 2017 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+func TestOpsRequireOpsKey(t *testing.T) {
+	tests := []struct {
+		name          string
+		opsKey        string
+		authorization string
+		status        int
+	}{
+		{"valid key", "secret", "Bearer secret", http.StatusOK},
+		{"wrong key", "secret", "Bearer other", http.StatusUnauthorized},
+		{"missing key", "secret", "", http.StatusUnauthorized},
+		{"not a bearer token", "secret", "secret", http.StatusUnauthorized},
+		{"no key configured", "", "Bearer ", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := NewConfig()
+			config.OpsKey = tt.opsKey
+			s := &opsService{logger: zap.NewNop(), config: config}
+			handler := s.requireOpsKey(func(w http.ResponseWriter, r *http.Request) {})
+
+			r := httptest.NewRequest("POST", "/v0/leaderboard/record", nil)
+			if tt.authorization != "" {
+				r.Header.Set("Authorization", tt.authorization)
+			}
+			w := httptest.NewRecorder()
+			handler(w, r)
+			if w.Code != tt.status {
+				t.Fatalf("status %v, expected %v", w.Code, tt.status)
+			}
+		})
+	}
+}
@@ -28,21 +28,25 @@ type StatsService interface {
 }
 
 type statsService struct {
-	logger    *zap.Logger
-	version   string
-	config    Config
-	tracker   Tracker
-	startedAt int64
+	logger      *zap.Logger
+	version     string
+	config      Config
+	tracker     Tracker
+	authLimiter *AuthLimiter
+	registry    *SessionRegistry
+	startedAt   int64
 }
 
 // NewStatsService creates a new StatsService
-func NewStatsService(logger *zap.Logger, config Config, version string, tracker Tracker, startedAt int64) StatsService {
+func NewStatsService(logger *zap.Logger, config Config, version string, tracker Tracker, authLimiter *AuthLimiter, registry *SessionRegistry, startedAt int64) StatsService {
 	return &statsService{
-		logger:    logger,
-		version:   version,
-		config:    config,
-		tracker:   tracker,
-		startedAt: startedAt,
+		logger:      logger,
+		version:     version,
+		config:      config,
+		tracker:     tracker,
+		authLimiter: authLimiter,
+		registry:    registry,
+		startedAt:   startedAt,
 	}
 }
 
@@ -62,6 +66,8 @@ func (s *statsService) GetStats() []map[string]interface{} {
 	data["address"] = s.getLocalIP()
 	data["process_count"] = runtime.NumGoroutine()
 	data["presence_count"] = s.getPresenceCount()
+	data["auth_rate_limit"] = s.authLimiter.Stats()
+	data["sessions"] = s.registry.Stats()
 
 	stats := make([]map[string]interface{}, 1)
 	stats[0] = data
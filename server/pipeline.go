@@ -15,123 +15,194 @@
 package server
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
+	"time"
 
+	"github.com/gogo/protobuf/proto"
+	"github.com/satori/go.uuid"
 	"go.uber.org/zap"
 
 	"nakama/pkg/social"
 )
 
 type pipeline struct {
-	config          Config
-	db              *sql.DB
-	socialClient    *social.Client
-	tracker         Tracker
-	messageRouter   MessageRouter
-	sessionRegistry *SessionRegistry
+	config           Config
+	db               *sql.DB
+	socialClient     *social.Client
+	oidcProviders    map[string]*social.OIDCProvider
+	customIDVerifier CustomIDVerifier
+	tracker          Tracker
+	messageRouter    MessageRouter
+	sessionRegistry  *SessionRegistry
+	runtime          *Runtime
+	matchRegistry    *MatchRegistry
+	revocationStore  *TokenRevocationStore
+	authLimiter      *AuthLimiter
+	emailVerifier    *emailVerifier
+	// Checks session tokens other than the one the session was opened with, set by the authentication service.
+	authenticateToken func(context.Context, string) (*sessionToken, bool)
 }
 
 // NewPipeline creates a new Pipeline
-func NewPipeline(config Config, db *sql.DB, socialClient *social.Client, tracker Tracker, messageRouter MessageRouter, registry *SessionRegistry) *pipeline {
+func NewPipeline(config Config, db *sql.DB, socialClient *social.Client, oidcProviders map[string]*social.OIDCProvider, customIDVerifier CustomIDVerifier, tracker Tracker, messageRouter MessageRouter, registry *SessionRegistry, runtime *Runtime, matchRegistry *MatchRegistry, revocationStore *TokenRevocationStore, authLimiter *AuthLimiter, emailVerifier *emailVerifier) *pipeline {
 	return &pipeline{
-		config:          config,
-		db:              db,
-		socialClient:    socialClient,
-		tracker:         tracker,
-		messageRouter:   messageRouter,
-		sessionRegistry: registry,
+		config:           config,
+		db:               db,
+		socialClient:     socialClient,
+		oidcProviders:    oidcProviders,
+		customIDVerifier: customIDVerifier,
+		tracker:          tracker,
+		messageRouter:    messageRouter,
+		sessionRegistry:  registry,
+		runtime:          runtime,
+		matchRegistry:    matchRegistry,
+		revocationStore:  revocationStore,
+		authLimiter:      authLimiter,
+		emailVerifier:    emailVerifier,
 	}
 }
 
-func (p *pipeline) processRequest(logger *zap.Logger, session *session, envelope *Envelope) {
+func (p *pipeline) processRequest(ctx context.Context, logger *zap.Logger, session *session, envelope *Envelope) {
 	logger.Debug(fmt.Sprintf("Received %T message", envelope.Payload))
 
+	messageType := runtimeMessageType(envelope)
+	if session.rateLimiter != nil {
+		if allowed, disconnect := session.rateLimiter.allow(messageType); !allowed {
+			if disconnect {
+				logger.Warn("Disconnecting session that keeps exceeding request rate limits", zap.String("type", messageType))
+				p.sessionRegistry.remove(session)
+				session.kick(RATE_LIMITED, "Request rate limits exceeded too often")
+				return
+			}
+			logger.Debug("Request rate limited", zap.String("type", messageType))
+			session.Send(ErrorMessage(envelope.CollationId, RATE_LIMITED, "Too many requests, try again later"))
+			return
+		}
+	}
+
+	if p.runtime.HasBefore(messageType) {
+		result, err := p.runtime.InvokeBefore(ctx, logger, session, messageType, envelope)
+		if err != nil {
+			logger.Debug("Request rejected by before hook", zap.String("type", messageType), zap.Error(err))
+			session.Send(ErrorMessage(envelope.CollationId, RUNTIME_FUNCTION_EXCEPTION, err.Error()))
+			return
+		}
+		envelope = result
+	}
+
+	if p.runtime.HasAfter(messageType) {
+		// Give the request a unique collation ID so its responses can be told apart from any other message,
+		// then restore the client's own collation ID before the response is seen by the hook or the client.
+		collationID := envelope.CollationId
+		envelope.CollationId = uuid.NewV4().String()
+		release := session.interceptResponses(envelope.CollationId, func(response *Envelope) {
+			response.CollationId = collationID
+			// After hooks only observe the response, the copy is theirs to use once it has been sent.
+			p.runtime.QueueAfter(logger, session, messageType, proto.Clone(response).(*Envelope))
+		})
+		defer release()
+	}
+
 	switch envelope.Payload.(type) {
 	case *Envelope_Logout:
-		// TODO Store JWT into a blacklist until remaining JWT expiry.
+		p.revocationStore.Revoke(session.token.ID, session.token.ExpiresAt)
+		// The refresh token issued alongside this session shares its family, which stays revoked until any token in it
+		// would have expired.
+		if session.token.FamilyID != "" {
+			refreshExpiresAt := now().Add(time.Duration(p.config.GetSession().RefreshTokenExpiryMs) * time.Millisecond).Unix()
+			p.revocationStore.Revoke(session.token.FamilyID, refreshExpiresAt)
+		}
 		p.sessionRegistry.remove(session)
 		session.close()
 
 	case *Envelope_Link:
-		p.linkID(logger, session, envelope)
+		p.linkID(ctx, logger, session, envelope)
 	case *Envelope_Unlink:
-		p.unlinkID(logger, session, envelope)
+		p.unlinkID(ctx, logger, session, envelope)
+	case *Envelope_UserMerge:
+		p.userMerge(ctx, logger, session, envelope)
 
 	case *Envelope_SelfFetch:
-		p.selfFetch(logger, session, envelope)
+		p.selfFetch(ctx, logger, session, envelope)
 	case *Envelope_SelfUpdate:
-		p.selfUpdate(logger, session, envelope)
+		p.selfUpdate(ctx, logger, session, envelope)
+	case *Envelope_PasswordChange:
+		p.passwordChange(ctx, logger, session, envelope)
 	case *Envelope_UsersFetch:
-		p.usersFetch(logger, session, envelope)
+		p.usersFetch(ctx, logger, session, envelope)
 
 	case *Envelope_FriendAdd:
-		p.friendAdd(logger, session, envelope)
+		p.friendAdd(ctx, logger, session, envelope)
 	case *Envelope_FriendRemove:
-		p.friendRemove(logger, session, envelope)
+		p.friendRemove(ctx, logger, session, envelope)
 	case *Envelope_FriendBlock:
-		p.friendBlock(logger, session, envelope)
+		p.friendBlock(ctx, logger, session, envelope)
 	case *Envelope_FriendsList:
-		p.friendsList(logger, session, envelope)
+		p.friendsList(ctx, logger, session, envelope)
 
 	case *Envelope_GroupCreate:
-		p.groupCreate(logger, session, envelope)
+		p.groupCreate(ctx, logger, session, envelope)
 	case *Envelope_GroupUpdate:
-		p.groupUpdate(logger, session, envelope)
+		p.groupUpdate(ctx, logger, session, envelope)
 	case *Envelope_GroupRemove:
-		p.groupRemove(logger, session, envelope)
+		p.groupRemove(ctx, logger, session, envelope)
 	case *Envelope_GroupsFetch:
-		p.groupsFetch(logger, session, envelope)
+		p.groupsFetch(ctx, logger, session, envelope)
 	case *Envelope_GroupsList:
-		p.groupsList(logger, session, envelope)
+		p.groupsList(ctx, logger, session, envelope)
 	case *Envelope_GroupsSelfList:
-		p.groupsSelfList(logger, session, envelope)
+		p.groupsSelfList(ctx, logger, session, envelope)
 	case *Envelope_GroupUsersList:
-		p.groupUsersList(logger, session, envelope)
+		p.groupUsersList(ctx, logger, session, envelope)
 	case *Envelope_GroupJoin:
-		p.groupJoin(logger, session, envelope)
+		p.groupJoin(ctx, logger, session, envelope)
 	case *Envelope_GroupLeave:
-		p.groupLeave(logger, session, envelope)
+		p.groupLeave(ctx, logger, session, envelope)
 	case *Envelope_GroupUserAdd:
-		p.groupUserAdd(logger, session, envelope)
+		p.groupUserAdd(ctx, logger, session, envelope)
 	case *Envelope_GroupUserKick:
-		p.groupUserKick(logger, session, envelope)
+		p.groupUserKick(ctx, logger, session, envelope)
 	case *Envelope_GroupUserPromote:
-		p.groupUserPromote(logger, session, envelope)
+		p.groupUserPromote(ctx, logger, session, envelope)
 
 	case *Envelope_TopicJoin:
-		p.topicJoin(logger, session, envelope)
+		p.topicJoin(ctx, logger, session, envelope)
 	case *Envelope_TopicLeave:
-		p.topicLeave(logger, session, envelope)
+		p.topicLeave(ctx, logger, session, envelope)
 	case *Envelope_TopicMessageSend:
-		p.topicMessageSend(logger, session, envelope)
+		p.topicMessageSend(ctx, logger, session, envelope)
 	case *Envelope_TopicMessagesList:
-		p.topicMessagesList(logger, session, envelope)
+		p.topicMessagesList(ctx, logger, session, envelope)
 
 	case *Envelope_MatchCreate:
-		p.matchCreate(logger, session, envelope)
+		p.matchCreate(ctx, logger, session, envelope)
 	case *Envelope_MatchJoin:
-		p.matchJoin(logger, session, envelope)
+		p.matchJoin(ctx, logger, session, envelope)
 	case *Envelope_MatchLeave:
-		p.matchLeave(logger, session, envelope)
+		p.matchLeave(ctx, logger, session, envelope)
 	case *Envelope_MatchDataSend:
-		p.matchDataSend(logger, session, envelope)
+		p.matchDataSend(ctx, logger, session, envelope)
 
 	case *Envelope_StorageFetch:
-		p.storageFetch(logger, session, envelope)
+		p.storageFetch(ctx, logger, session, envelope)
 	case *Envelope_StorageWrite:
-		p.storageWrite(logger, session, envelope)
+		p.storageWrite(ctx, logger, session, envelope)
 	case *Envelope_StorageRemove:
-		p.storageRemove(logger, session, envelope)
+		p.storageRemove(ctx, logger, session, envelope)
 
 	case *Envelope_LeaderboardsList:
-		p.leaderboardsList(logger, session, envelope)
+		p.leaderboardsList(ctx, logger, session, envelope)
 	case *Envelope_LeaderboardRecordWrite:
-		p.leaderboardRecordWrite(logger, session, envelope)
+		p.leaderboardRecordWrite(ctx, logger, session, envelope)
 	case *Envelope_LeaderboardRecordsFetch:
-		p.leaderboardRecordsFetch(logger, session, envelope)
+		p.leaderboardRecordsFetch(ctx, logger, session, envelope)
 	case *Envelope_LeaderboardRecordsList:
-		p.leaderboardRecordsList(logger, session, envelope)
+		p.leaderboardRecordsList(ctx, logger, session, envelope)
+
+	case *Envelope_Rpc:
+		p.rpc(ctx, logger, session, envelope)
 
 	case nil:
 		session.Send(ErrorMessage(envelope.CollationId, MISSING_PAYLOAD, "No payload found"))
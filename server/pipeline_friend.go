@@ -15,6 +15,7 @@
 package server
 
 import (
+	"context"
 	"database/sql"
 	"errors"
 
@@ -23,7 +24,7 @@ import (
 	"go.uber.org/zap"
 )
 
-func (p *pipeline) querySocialGraph(logger *zap.Logger, filterQuery string, params []interface{}) ([]*User, error) {
+func (p *pipeline) querySocialGraph(ctx context.Context, logger *zap.Logger, filterQuery string, params []interface{}) ([]*User, error) {
 	users := []*User{}
 
 	query := `
@@ -32,7 +33,7 @@ SELECT id, handle, fullname, avatar_url,
 	created_at, users.updated_at, last_online_at
 FROM users ` + filterQuery
 
-	rows, err := p.db.Query(query, params...)
+	rows, err := p.db.QueryContext(ctx, query, params...)
 	if err != nil {
 		logger.Error("Could not execute social graph query", zap.String("query", query), zap.Error(err))
 		return nil, err
@@ -80,7 +81,7 @@ FROM users ` + filterQuery
 	return users, nil
 }
 
-func (p *pipeline) addFacebookFriends(logger *zap.Logger, userID []byte, accessToken string) {
+func (p *pipeline) addFacebookFriends(ctx context.Context, logger *zap.Logger, userID []byte, accessToken string) {
 	var tx *sql.Tx
 	var err error
 
@@ -110,7 +111,7 @@ func (p *pipeline) addFacebookFriends(logger *zap.Logger, userID []byte, accessT
 		return
 	}
 
-	tx, err = p.db.Begin()
+	tx, err = p.db.BeginTx(ctx, nil)
 	if err != nil {
 		return
 	}
@@ -118,13 +119,13 @@ func (p *pipeline) addFacebookFriends(logger *zap.Logger, userID []byte, accessT
 	friendAddedCounter := 0
 	for _, fbFriend := range fbFriends {
 		var friendID []byte
-		err = tx.QueryRow("SELECT id FROM users WHERE facebook_id = $1", fbFriend.ID).Scan(&friendID)
+		err = tx.QueryRowContext(ctx, "SELECT id FROM users WHERE facebook_id = $1", fbFriend.ID).Scan(&friendID)
 		if err != nil {
 			return
 		}
 
 		updatedAt := nowMs()
-		_, err = tx.Exec(`
+		_, err = tx.ExecContext(ctx, `
 INSERT INTO user_edge (source_id, position, updated_at, destination_id, state)
 VALUES ($1, $2, $2, $3, 0), ($3, $2, $2, $1, 0)`,
 			userID, updatedAt, friendID)
@@ -134,20 +135,20 @@ VALUES ($1, $2, $2, $3, 0), ($3, $2, $2, $1, 0)`,
 
 		friendAddedCounter++
 
-		_, err = tx.Exec(`UPDATE user_edge_metadata SET count = count + 1, updated_at = $1 WHERE source_id = $2`, updatedAt, friendID)
+		_, err = tx.ExecContext(ctx, `UPDATE user_edge_metadata SET count = count + 1, updated_at = $1 WHERE source_id = $2`, updatedAt, friendID)
 	}
 
-	_, err = tx.Exec(`UPDATE user_edge_metadata SET count = $1, updated_at = $2 WHERE source_id = $3`, friendAddedCounter, nowMs(), userID)
+	_, err = tx.ExecContext(ctx, `UPDATE user_edge_metadata SET count = $1, updated_at = $2 WHERE source_id = $3`, friendAddedCounter, nowMs(), userID)
 }
 
-func (p *pipeline) getFriends(filterQuery string, userID []byte) ([]*Friend, error) {
+func (p *pipeline) getFriends(ctx context.Context, filterQuery string, userID []byte) ([]*Friend, error) {
 	query := `
 SELECT id, handle, fullname, avatar_url,
 	lang, location, timezone, metadata,
 	created_at, users.updated_at, last_online_at, state
 FROM users, user_edge ` + filterQuery
 
-	rows, err := p.db.Query(query, userID)
+	rows, err := p.db.QueryContext(ctx, query, userID)
 	if err != nil {
 		return nil, err
 	}
@@ -195,7 +196,7 @@ FROM users, user_edge ` + filterQuery
 	return friends, nil
 }
 
-func (p *pipeline) friendAdd(l *zap.Logger, session *session, envelope *Envelope) {
+func (p *pipeline) friendAdd(ctx context.Context, l *zap.Logger, session *session, envelope *Envelope) {
 	addFriendRequest := envelope.GetFriendAdd()
 	if len(addFriendRequest.UserId) == 0 {
 		session.Send(ErrorMessageBadInput(envelope.CollationId, "User ID must be present"))
@@ -217,7 +218,7 @@ func (p *pipeline) friendAdd(l *zap.Logger, session *session, envelope *Envelope
 		return
 	}
 
-	tx, err := p.db.Begin()
+	tx, err := p.db.BeginTx(ctx, nil)
 	if err != nil {
 		logger.Error("Could not add friend", zap.Error(err))
 		session.Send(ErrorMessageRuntimeException(envelope.CollationId, "Failed to add friend"))
@@ -246,7 +247,7 @@ func (p *pipeline) friendAdd(l *zap.Logger, session *session, envelope *Envelope
 
 	updatedAt := nowMs()
 	// Mark an invite as accepted, if one was in place.
-	res, err := tx.Exec(`
+	res, err := tx.ExecContext(ctx, `
 UPDATE user_edge SET state = 0, updated_at = $3
 WHERE (source_id = $1 AND destination_id = $2 AND state = 2)
 OR (source_id = $2 AND destination_id = $1 AND state = 1)
@@ -260,7 +261,7 @@ OR (source_id = $2 AND destination_id = $1 AND state = 1)
 	}
 
 	// If no edge updates took place, it's a new invite being set up.
-	res, err = tx.Exec(`
+	res, err = tx.ExecContext(ctx, `
 INSERT INTO user_edge (source_id, destination_id, state, position, updated_at)
 SELECT source_id, destination_id, state, position, updated_at
 FROM (VALUES
@@ -280,7 +281,7 @@ WHERE EXISTS (SELECT id FROM users WHERE id = $2::BYTEA)
 	}
 
 	// Update the user edge metadata counts.
-	res, err = tx.Exec(`
+	res, err = tx.ExecContext(ctx, `
 UPDATE user_edge_metadata
 SET count = count + 1, updated_at = $1
 WHERE source_id = $2
@@ -296,7 +297,7 @@ OR source_id = $3`,
 	}
 }
 
-func (p *pipeline) friendRemove(l *zap.Logger, session *session, envelope *Envelope) {
+func (p *pipeline) friendRemove(ctx context.Context, l *zap.Logger, session *session, envelope *Envelope) {
 	removeFriendRequest := envelope.GetFriendRemove()
 	if len(removeFriendRequest.UserId) == 0 {
 		session.Send(ErrorMessageBadInput(envelope.CollationId, "User ID must be present"))
@@ -318,7 +319,7 @@ func (p *pipeline) friendRemove(l *zap.Logger, session *session, envelope *Envel
 		return
 	}
 
-	tx, err := p.db.Begin()
+	tx, err := p.db.BeginTx(ctx, nil)
 	if err != nil {
 		logger.Error("Could not remove friend", zap.Error(err))
 		session.Send(ErrorMessageRuntimeException(envelope.CollationId, "Failed to remove friend"))
@@ -347,24 +348,24 @@ func (p *pipeline) friendRemove(l *zap.Logger, session *session, envelope *Envel
 
 	updatedAt := nowMs()
 
-	res, err := tx.Exec("DELETE FROM user_edge WHERE source_id = $1 AND destination_id = $2", session.userID.Bytes(), friendIDBytes)
+	res, err := tx.ExecContext(ctx, "DELETE FROM user_edge WHERE source_id = $1 AND destination_id = $2", session.userID.Bytes(), friendIDBytes)
 	rowsAffected, _ := res.RowsAffected()
 	if err == nil && rowsAffected > 0 {
-		_, err = tx.Exec("UPDATE user_edge_metadata SET count = count - 1, updated_at = $2 WHERE source_id = $1", session.userID.Bytes(), updatedAt)
+		_, err = tx.ExecContext(ctx, "UPDATE user_edge_metadata SET count = count - 1, updated_at = $2 WHERE source_id = $1", session.userID.Bytes(), updatedAt)
 	}
 
 	if err != nil {
 		return
 	}
 
-	res, err = tx.Exec("DELETE FROM user_edge WHERE source_id = $1 AND destination_id = $2", friendIDBytes, session.userID.Bytes())
+	res, err = tx.ExecContext(ctx, "DELETE FROM user_edge WHERE source_id = $1 AND destination_id = $2", friendIDBytes, session.userID.Bytes())
 	rowsAffected, _ = res.RowsAffected()
 	if err == nil && rowsAffected > 0 {
-		_, err = tx.Exec("UPDATE user_edge_metadata SET count = count - 1, updated_at = $2 WHERE source_id = $1", friendIDBytes, updatedAt)
+		_, err = tx.ExecContext(ctx, "UPDATE user_edge_metadata SET count = count - 1, updated_at = $2 WHERE source_id = $1", friendIDBytes, updatedAt)
 	}
 }
 
-func (p *pipeline) friendBlock(l *zap.Logger, session *session, envelope *Envelope) {
+func (p *pipeline) friendBlock(ctx context.Context, l *zap.Logger, session *session, envelope *Envelope) {
 	blockUserRequest := envelope.GetFriendBlock()
 	if len(blockUserRequest.UserId) == 0 {
 		session.Send(ErrorMessageBadInput(envelope.CollationId, "User ID must be present"))
@@ -386,7 +387,7 @@ func (p *pipeline) friendBlock(l *zap.Logger, session *session, envelope *Envelo
 		return
 	}
 
-	tx, err := p.db.Begin()
+	tx, err := p.db.BeginTx(ctx, nil)
 	if err != nil {
 		logger.Error("Could not block user", zap.Error(err))
 		session.Send(ErrorMessageRuntimeException(envelope.CollationId, "Failed to block friend"))
@@ -417,7 +418,7 @@ func (p *pipeline) friendBlock(l *zap.Logger, session *session, envelope *Envelo
 		}
 	}()
 
-	res, err := tx.Exec("UPDATE user_edge SET state = 3, updated_at = $3 WHERE source_id = $1 AND destination_id = $2",
+	res, err := tx.ExecContext(ctx, "UPDATE user_edge SET state = 3, updated_at = $3 WHERE source_id = $1 AND destination_id = $2",
 		session.userID.Bytes(), userIDBytes, nowMs())
 
 	if err != nil {
@@ -430,7 +431,7 @@ func (p *pipeline) friendBlock(l *zap.Logger, session *session, envelope *Envelo
 	}
 
 	// Delete opposite relationship if user hasn't blocked you already
-	res, err = tx.Exec("DELETE FROM user_edge WHERE source_id = $1 AND destination_id = $2 AND state != 3",
+	res, err = tx.ExecContext(ctx, "DELETE FROM user_edge WHERE source_id = $1 AND destination_id = $2 AND state != 3",
 		userIDBytes, session.userID.Bytes())
 
 	if err != nil {
@@ -438,12 +439,12 @@ func (p *pipeline) friendBlock(l *zap.Logger, session *session, envelope *Envelo
 	}
 
 	if rowsAffected, _ := res.RowsAffected(); rowsAffected == 1 {
-		_, err = tx.Exec("UPDATE user_edge_metadata SET count = count - 1, updated_at = $2 WHERE source_id = $1", userIDBytes, nowMs())
+		_, err = tx.ExecContext(ctx, "UPDATE user_edge_metadata SET count = count - 1, updated_at = $2 WHERE source_id = $1", userIDBytes, nowMs())
 	}
 }
 
-func (p *pipeline) friendsList(logger *zap.Logger, session *session, envelope *Envelope) {
-	friends, err := p.getFriends("WHERE id = destination_id AND source_id = $1", session.userID.Bytes())
+func (p *pipeline) friendsList(ctx context.Context, logger *zap.Logger, session *session, envelope *Envelope) {
+	friends, err := p.getFriends(ctx, "WHERE id = destination_id AND source_id = $1", session.userID.Bytes())
 	if err != nil {
 		logger.Error("Could not get friends", zap.Error(err))
 		session.Send(ErrorMessageRuntimeException(envelope.CollationId, "Could not get friends"))
@@ -16,6 +16,7 @@ package server
 
 import (
 	"bytes"
+	"context"
 	"database/sql"
 	"encoding/gob"
 	"encoding/json"
@@ -89,7 +90,7 @@ func (p *pipeline) extractGroup(r scanner) (*Group, error) {
 	}, nil
 }
 
-func (p *pipeline) groupCreate(logger *zap.Logger, session *session, envelope *Envelope) {
+func (p *pipeline) groupCreate(ctx context.Context, logger *zap.Logger, session *session, envelope *Envelope) {
 	g := envelope.GetGroupCreate()
 
 	if g.Name == "" {
@@ -99,7 +100,7 @@ func (p *pipeline) groupCreate(logger *zap.Logger, session *session, envelope *E
 
 	var group *Group
 
-	tx, err := p.db.Begin()
+	tx, err := p.db.BeginTx(ctx, nil)
 	if err != nil {
 		logger.Error("Could not create group", zap.Error(err))
 		session.Send(ErrorMessageBadInput(envelope.CollationId, "Could not create group"))
@@ -115,7 +116,7 @@ func (p *pipeline) groupCreate(logger *zap.Logger, session *session, envelope *E
 					logger.Error("Could not rollback transaction", zap.Error(txErr))
 				}
 			}
-			if strings.HasSuffix(err.Error(), "violates unique constraint \"groups_name_key\"") {
+			if strings.HasSuffix(err.Error(), "violates unique constraint \"groups_app_id_name_key\"") {
 				session.Send(ErrorMessage(envelope.CollationId, GROUP_NAME_INUSE, "Name is in use"))
 			} else {
 				session.Send(ErrorMessageRuntimeException(envelope.CollationId, "Could not create group"))
@@ -137,9 +138,10 @@ func (p *pipeline) groupCreate(logger *zap.Logger, session *session, envelope *E
 		state = 1
 	}
 
-	columns := make([]string, 0)
-	params := make([]string, 0)
-	values := make([]interface{}, 5)
+	// Group names are unique within each app.
+	columns := []string{"app_id"}
+	params := []string{"$6"}
+	values := make([]interface{}, 6)
 
 	updatedAt := nowMs()
 
@@ -148,6 +150,7 @@ func (p *pipeline) groupCreate(logger *zap.Logger, session *session, envelope *E
 	values[2] = g.Name
 	values[3] = state
 	values[4] = updatedAt
+	values[5] = session.appID
 
 	if g.Description != "" {
 		columns = append(columns, "description")
@@ -180,7 +183,7 @@ func (p *pipeline) groupCreate(logger *zap.Logger, session *session, envelope *E
 		values = append(values, g.Metadata)
 	}
 
-	r := tx.QueryRow(`
+	r := tx.QueryRowContext(ctx, `
 INSERT INTO groups (id, creator_id, name, state, count, created_at, updated_at, `+strings.Join(columns, ", ")+")"+`
 VALUES ($1, $2, $3, $4, 1, $5, $5, `+strings.Join(params, ",")+")"+`
 RETURNING id, creator_id, name, description, avatar_url, lang, utc_offset_ms, metadata, state, count, created_at, updated_at
@@ -191,7 +194,7 @@ RETURNING id, creator_id, name, description, avatar_url, lang, utc_offset_ms, me
 		return
 	}
 
-	res, err := tx.Exec(`
+	res, err := tx.ExecContext(ctx, `
 INSERT INTO group_edge (source_id, position, updated_at, destination_id, state)
 VALUES ($1, $2, $2, $3, 0), ($3, $2, $2, $1, 0)`,
 		group.Id, updatedAt, session.userID.Bytes())
@@ -210,7 +213,7 @@ VALUES ($1, $2, $2, $3, 0), ($3, $2, $2, $1, 0)`,
 	}
 }
 
-func (p *pipeline) groupUpdate(l *zap.Logger, session *session, envelope *Envelope) {
+func (p *pipeline) groupUpdate(ctx context.Context, l *zap.Logger, session *session, envelope *Envelope) {
 	//TODO notify members that group has been updated.
 	g := envelope.GetGroupUpdate()
 	groupID, err := uuid.FromBytes(g.GroupId)
@@ -260,14 +263,15 @@ func (p *pipeline) groupUpdate(l *zap.Logger, session *session, envelope *Envelo
 		params = append(params, g.Name)
 	}
 
-	_, err = p.db.Exec(`
+	params = append(params, session.appID)
+	_, err = p.db.ExecContext(ctx, `
 UPDATE groups SET `+strings.Join(statements, ", ")+`
-WHERE id = $1 AND
+WHERE id = $1 AND app_id = $`+strconv.Itoa(len(params))+` AND
 EXISTS (SELECT source_id FROM group_edge WHERE source_id = $1 AND destination_id = $2 AND state = 0)`,
 		params...)
 
 	if err != nil {
-		if strings.HasSuffix(err.Error(), "violates unique constraint \"groups_name_key\"") {
+		if strings.HasSuffix(err.Error(), "violates unique constraint \"groups_app_id_name_key\"") {
 			session.Send(ErrorMessage(envelope.CollationId, GROUP_NAME_INUSE, "Name is in use"))
 		} else {
 			logger.Error("Could not update group", zap.Error(err))
@@ -280,7 +284,7 @@ EXISTS (SELECT source_id FROM group_edge WHERE source_id = $1 AND destination_id
 	session.Send(&Envelope{CollationId: envelope.CollationId})
 }
 
-func (p *pipeline) groupRemove(l *zap.Logger, session *session, envelope *Envelope) {
+func (p *pipeline) groupRemove(ctx context.Context, l *zap.Logger, session *session, envelope *Envelope) {
 	//TODO kick all users out
 	g := envelope.GetGroupRemove()
 
@@ -293,7 +297,7 @@ func (p *pipeline) groupRemove(l *zap.Logger, session *session, envelope *Envelo
 	logger := l.With(zap.String("group_id", groupID.String()))
 	failureReason := "Failed to remove group"
 
-	tx, err := p.db.Begin()
+	tx, err := p.db.BeginTx(ctx, nil)
 	if err != nil {
 		logger.Error("Could not remove group", zap.Error(err))
 		session.Send(ErrorMessageRuntimeException(envelope.CollationId, failureReason))
@@ -319,13 +323,15 @@ func (p *pipeline) groupRemove(l *zap.Logger, session *session, envelope *Envelo
 		}
 	}()
 
-	res, err := tx.Exec(`
+	res, err := tx.ExecContext(ctx, `
 DELETE FROM groups
 WHERE
 	id = $1
+AND
+	app_id = $3
 AND
 	EXISTS (SELECT source_id FROM group_edge WHERE source_id = $1 AND destination_id = $2 AND state = 0)
-	`, groupID.Bytes(), session.userID.Bytes())
+	`, groupID.Bytes(), session.userID.Bytes(), session.appID)
 
 	if err != nil {
 		return
@@ -341,10 +347,10 @@ AND
 		return
 	}
 
-	_, err = tx.Exec("DELETE FROM group_edge WHERE source_id = $1 OR destination_id = $1", groupID.Bytes())
+	_, err = tx.ExecContext(ctx, "DELETE FROM group_edge WHERE source_id = $1 OR destination_id = $1", groupID.Bytes())
 }
 
-func (p *pipeline) groupsFetch(logger *zap.Logger, session *session, envelope *Envelope) {
+func (p *pipeline) groupsFetch(ctx context.Context, logger *zap.Logger, session *session, envelope *Envelope) {
 	g := envelope.GetGroupsFetch()
 
 	statements := []string{}
@@ -377,9 +383,10 @@ func (p *pipeline) groupsFetch(logger *zap.Logger, session *session, envelope *E
 		return
 	}
 
-	rows, err := p.db.Query(
+	params = append(params, session.appID)
+	rows, err := p.db.QueryContext(ctx,
 		`SELECT id, creator_id, name, description, avatar_url, lang, utc_offset_ms, metadata, state, count, created_at, updated_at
-FROM groups WHERE disabled_at = 0 AND ( `+strings.Join(statements, " OR ")+" )",
+FROM groups WHERE disabled_at = 0 AND app_id = $`+strconv.Itoa(len(params))+` AND ( `+strings.Join(statements, " OR ")+" )",
 		params...)
 	if err != nil {
 		logger.Error("Could not get groups", zap.Error(err))
@@ -402,7 +409,7 @@ FROM groups WHERE disabled_at = 0 AND ( `+strings.Join(statements, " OR ")+" )",
 	session.Send(&Envelope{CollationId: envelope.CollationId, Payload: &Envelope_Groups{Groups: &TGroups{Groups: groups}}})
 }
 
-func (p *pipeline) groupsList(logger *zap.Logger, session *session, envelope *Envelope) {
+func (p *pipeline) groupsList(ctx context.Context, logger *zap.Logger, session *session, envelope *Envelope) {
 	incoming := envelope.GetGroupsList()
 	params := make([]interface{}, 0)
 
@@ -459,14 +466,17 @@ func (p *pipeline) groupsList(logger *zap.Logger, session *session, envelope *En
 		params = append(params, incoming.GetCount())
 	}
 
+	params = append(params, session.appID)
+	appQuery := "app_id = $" + strconv.Itoa(len(params)) + " AND"
+
 	params = append(params, limit+1)
 	query := `
 SELECT id, creator_id, name, description, avatar_url, lang, utc_offset_ms, metadata, state, count, created_at, updated_at
-FROM groups WHERE ` + cursorQuery + " " + filterQuery + " disabled_at = 0" + `
+FROM groups WHERE ` + cursorQuery + " " + filterQuery + " " + appQuery + " disabled_at = 0" + `
 ORDER BY count ` + orderBy + " " + `
 LIMIT $` + strconv.Itoa(len(params))
 
-	rows, err := p.db.Query(query, params...)
+	rows, err := p.db.QueryContext(ctx, query, params...)
 	if err != nil {
 		logger.Error("Could not list groups", zap.Error(err))
 		session.Send(ErrorMessageRuntimeException(envelope.CollationId, "Could not list groups"))
@@ -514,14 +524,14 @@ LIMIT $` + strconv.Itoa(len(params))
 	}}})
 }
 
-func (p *pipeline) groupsSelfList(logger *zap.Logger, session *session, envelope *Envelope) {
+func (p *pipeline) groupsSelfList(ctx context.Context, logger *zap.Logger, session *session, envelope *Envelope) {
 	envelope.GetGroupsSelfList()
-	rows, err := p.db.Query(`
+	rows, err := p.db.QueryContext(ctx, `
 SELECT id, creator_id, name, description, avatar_url, lang, utc_offset_ms, metadata, groups.state, count, created_at, groups.updated_at
 FROM groups
 JOIN group_edge ON (group_edge.source_id = id)
-WHERE group_edge.destination_id = $1 AND disabled_at = 0 AND (group_edge.state = 1 OR group_edge.state = 0)
-`, session.userID.Bytes())
+WHERE group_edge.destination_id = $1 AND app_id = $2 AND disabled_at = 0 AND (group_edge.state = 1 OR group_edge.state = 0)
+`, session.userID.Bytes(), session.appID)
 
 	if err != nil {
 		logger.Error("Could not list joined groups", zap.Error(err))
@@ -545,7 +555,7 @@ WHERE group_edge.destination_id = $1 AND disabled_at = 0 AND (group_edge.state =
 	session.Send(&Envelope{CollationId: envelope.CollationId, Payload: &Envelope_Groups{Groups: &TGroups{Groups: groups}}})
 }
 
-func (p *pipeline) groupUsersList(l *zap.Logger, session *session, envelope *Envelope) {
+func (p *pipeline) groupUsersList(ctx context.Context, l *zap.Logger, session *session, envelope *Envelope) {
 	g := envelope.GetGroupUsersList()
 
 	groupID, err := uuid.FromBytes(g.GroupId)
@@ -562,7 +572,7 @@ SELECT u.id, u.handle, u.fullname, u.avatar_url,
 	u.created_at, u.updated_at, u.last_online_at, ge.state
 FROM users u, group_edge ge
 WHERE u.id = ge.source_id AND ge.destination_id = $1`
-	rows, err := p.db.Query(query, groupID.Bytes())
+	rows, err := p.db.QueryContext(ctx, query, groupID.Bytes())
 	if err != nil {
 		logger.Error("Could not get group users", zap.Error(err))
 		session.Send(ErrorMessageRuntimeException(envelope.CollationId, "Could not get group users"))
@@ -614,7 +624,7 @@ WHERE u.id = ge.source_id AND ge.destination_id = $1`
 	session.Send(&Envelope{CollationId: envelope.CollationId, Payload: &Envelope_GroupUsers{GroupUsers: &TGroupUsers{Users: users}}})
 }
 
-func (p *pipeline) groupJoin(l *zap.Logger, session *session, envelope *Envelope) {
+func (p *pipeline) groupJoin(ctx context.Context, l *zap.Logger, session *session, envelope *Envelope) {
 	g := envelope.GetGroupJoin()
 
 	groupID, err := uuid.FromBytes(g.GroupId)
@@ -625,7 +635,7 @@ func (p *pipeline) groupJoin(l *zap.Logger, session *session, envelope *Envelope
 
 	logger := l.With(zap.String("group_id", groupID.String()))
 
-	tx, err := p.db.Begin()
+	tx, err := p.db.BeginTx(ctx, nil)
 	if err != nil {
 		logger.Error("Could not add user to group", zap.Error(err))
 		session.Send(ErrorMessageRuntimeException(envelope.CollationId, "Could not add user to group"))
@@ -649,7 +659,7 @@ func (p *pipeline) groupJoin(l *zap.Logger, session *session, envelope *Envelope
 				logger.Info("User joined group")
 				session.Send(&Envelope{CollationId: envelope.CollationId})
 
-				err = p.storeAndDeliverMessage(logger, session, &TopicId{Id: &TopicId_GroupId{GroupId: groupID.Bytes()}}, 1, []byte("{}"))
+				err = p.storeAndDeliverMessage(ctx, logger, session, &TopicId{Id: &TopicId_GroupId{GroupId: groupID.Bytes()}}, 1, []byte("{}"))
 				if err != nil {
 					logger.Error("Error handling group user join notification topic message", zap.Error(err))
 				}
@@ -658,7 +668,7 @@ func (p *pipeline) groupJoin(l *zap.Logger, session *session, envelope *Envelope
 	}()
 
 	var groupState sql.NullInt64
-	err = tx.QueryRow("SELECT state FROM groups WHERE id = $1 AND disabled_at = 0", groupID.Bytes()).Scan(&groupState)
+	err = tx.QueryRowContext(ctx, "SELECT state FROM groups WHERE id = $1 AND app_id = $2 AND disabled_at = 0", groupID.Bytes(), session.appID).Scan(&groupState)
 	if err != nil {
 		return
 	}
@@ -670,7 +680,7 @@ func (p *pipeline) groupJoin(l *zap.Logger, session *session, envelope *Envelope
 
 	updatedAt := nowMs()
 
-	res, err := tx.Exec(`
+	res, err := tx.ExecContext(ctx, `
 INSERT INTO group_edge (source_id, position, updated_at, destination_id, state)
 VALUES ($1, $2, $2, $3, $4), ($3, $2, $2, $1, $4)`,
 		groupID.Bytes(), updatedAt, session.userID.Bytes(), userState)
@@ -685,14 +695,14 @@ VALUES ($1, $2, $2, $3, $4), ($3, $2, $2, $1, $4)`,
 	}
 
 	if groupState.Int64 == 0 {
-		_, err = tx.Exec("UPDATE groups SET count = count + 1, updated_at = $2 WHERE id = $1", groupID.Bytes(), updatedAt)
+		_, err = tx.ExecContext(ctx, "UPDATE groups SET count = count + 1, updated_at = $2 WHERE id = $1", groupID.Bytes(), updatedAt)
 	}
 	if err != nil {
 		return
 	}
 }
 
-func (p *pipeline) groupLeave(l *zap.Logger, session *session, envelope *Envelope) {
+func (p *pipeline) groupLeave(ctx context.Context, l *zap.Logger, session *session, envelope *Envelope) {
 	g := envelope.GetGroupLeave()
 
 	groupID, err := uuid.FromBytes(g.GroupId)
@@ -704,7 +714,7 @@ func (p *pipeline) groupLeave(l *zap.Logger, session *session, envelope *Envelop
 	logger := l.With(zap.String("group_id", groupID.String()))
 
 	failureReason := "Could not leave group"
-	tx, err := p.db.Begin()
+	tx, err := p.db.BeginTx(ctx, nil)
 	if err != nil {
 		logger.Error("Could not leave group", zap.Error(err))
 		session.Send(ErrorMessageRuntimeException(envelope.CollationId, failureReason))
@@ -728,7 +738,7 @@ func (p *pipeline) groupLeave(l *zap.Logger, session *session, envelope *Envelop
 				logger.Info("User left group")
 				session.Send(&Envelope{CollationId: envelope.CollationId})
 
-				err = p.storeAndDeliverMessage(logger, session, &TopicId{Id: &TopicId_GroupId{GroupId: groupID.Bytes()}}, 3, []byte("{}"))
+				err = p.storeAndDeliverMessage(ctx, logger, session, &TopicId{Id: &TopicId_GroupId{GroupId: groupID.Bytes()}}, 3, []byte("{}"))
 				if err != nil {
 					logger.Error("Error handling group user leave notification topic message", zap.Error(err))
 				}
@@ -740,7 +750,7 @@ func (p *pipeline) groupLeave(l *zap.Logger, session *session, envelope *Envelop
 	// and if this wasn't an invitation then
 	// look to see if the user is an admin
 	// and remove the user from group and update group count
-	res, err := tx.Exec(`
+	res, err := tx.ExecContext(ctx, `
 DELETE FROM group_edge
 WHERE
 	(source_id = $1 AND destination_id = $2 AND state = 2)
@@ -758,7 +768,7 @@ OR
 	}
 
 	var adminCount sql.NullInt64
-	err = tx.QueryRow(`
+	err = tx.QueryRowContext(ctx, `
 SELECT COUNT(source_id)	FROM group_edge
 WHERE
 	source_id = $1 AND state = 0
@@ -778,7 +788,7 @@ AND
 		return
 	}
 
-	res, err = tx.Exec(`
+	res, err = tx.ExecContext(ctx, `
 DELETE FROM group_edge
 WHERE
 	(source_id = $1 AND destination_id = $2)
@@ -796,13 +806,13 @@ OR
 		return
 	}
 
-	_, err = tx.Exec(`UPDATE groups SET count = count - 1, updated_at = $1 WHERE id = $2`, nowMs(), groupID.Bytes())
+	_, err = tx.ExecContext(ctx, `UPDATE groups SET count = count - 1, updated_at = $1 WHERE id = $2`, nowMs(), groupID.Bytes())
 	if err != nil {
 		return
 	}
 }
 
-func (p *pipeline) groupUserAdd(l *zap.Logger, session *session, envelope *Envelope) {
+func (p *pipeline) groupUserAdd(ctx context.Context, l *zap.Logger, session *session, envelope *Envelope) {
 	g := envelope.GetGroupUserAdd()
 
 	groupID, err := uuid.FromBytes(g.GroupId)
@@ -820,7 +830,7 @@ func (p *pipeline) groupUserAdd(l *zap.Logger, session *session, envelope *Envel
 	logger := l.With(zap.String("group_id", groupID.String()), zap.String("user_id", userID.String()))
 	var handle string
 
-	tx, err := p.db.Begin()
+	tx, err := p.db.BeginTx(ctx, nil)
 	if err != nil {
 		logger.Error("Could not add user to group", zap.Error(err))
 		session.Send(ErrorMessageRuntimeException(envelope.CollationId, "Could not add user to group"))
@@ -849,7 +859,7 @@ func (p *pipeline) groupUserAdd(l *zap.Logger, session *session, envelope *Envel
 				session.Send(&Envelope{CollationId: envelope.CollationId})
 
 				data, _ := json.Marshal(map[string]string{"user_id": userID.String(), "handle": handle})
-				err = p.storeAndDeliverMessage(logger, session, &TopicId{Id: &TopicId_GroupId{GroupId: groupID.Bytes()}}, 2, data)
+				err = p.storeAndDeliverMessage(ctx, logger, session, &TopicId{Id: &TopicId_GroupId{GroupId: groupID.Bytes()}}, 2, data)
 				if err != nil {
 					logger.Error("Error handling group user added notification topic message", zap.Error(err))
 				}
@@ -858,12 +868,12 @@ func (p *pipeline) groupUserAdd(l *zap.Logger, session *session, envelope *Envel
 	}()
 
 	// Look up the user being added.
-	err = tx.QueryRow("SELECT handle FROM users WHERE id = $1 AND disabled_at = 0", userID.Bytes()).Scan(&handle)
+	err = tx.QueryRowContext(ctx, "SELECT handle FROM users WHERE id = $1 AND disabled_at = 0", userID.Bytes()).Scan(&handle)
 	if err != nil {
 		return
 	}
 
-	res, err := tx.Exec(`
+	res, err := tx.ExecContext(ctx, `
 INSERT INTO group_edge (source_id, position, updated_at, destination_id, state)
 SELECT data.id, data.position, data.updated_at, data.destination, data.state
 FROM (
@@ -888,13 +898,13 @@ DO UPDATE SET state = 1, updated_at = $2::INT`,
 		return
 	}
 
-	_, err = tx.Exec(`UPDATE groups SET count = count + 1, updated_at = $1 WHERE id = $2`, nowMs(), groupID.Bytes())
+	_, err = tx.ExecContext(ctx, `UPDATE groups SET count = count + 1, updated_at = $1 WHERE id = $2`, nowMs(), groupID.Bytes())
 	if err != nil {
 		return
 	}
 }
 
-func (p *pipeline) groupUserKick(l *zap.Logger, session *session, envelope *Envelope) {
+func (p *pipeline) groupUserKick(ctx context.Context, l *zap.Logger, session *session, envelope *Envelope) {
 	// TODO Force kick the user out.
 	g := envelope.GetGroupUserKick()
 
@@ -919,7 +929,7 @@ func (p *pipeline) groupUserKick(l *zap.Logger, session *session, envelope *Enve
 	var handle string
 
 	failureReason := "Could not kick user from group"
-	tx, err := p.db.Begin()
+	tx, err := p.db.BeginTx(ctx, nil)
 	if err != nil {
 		logger.Error("Could not kick user from group", zap.Error(err))
 		session.Send(ErrorMessageRuntimeException(envelope.CollationId, failureReason))
@@ -948,7 +958,7 @@ func (p *pipeline) groupUserKick(l *zap.Logger, session *session, envelope *Enve
 				session.Send(&Envelope{CollationId: envelope.CollationId})
 
 				data, _ := json.Marshal(map[string]string{"user_id": userID.String(), "handle": handle})
-				err = p.storeAndDeliverMessage(logger, session, &TopicId{Id: &TopicId_GroupId{GroupId: groupID.Bytes()}}, 4, data)
+				err = p.storeAndDeliverMessage(ctx, logger, session, &TopicId{Id: &TopicId_GroupId{GroupId: groupID.Bytes()}}, 4, data)
 				if err != nil {
 					logger.Error("Error handling group user kicked notification topic message", zap.Error(err))
 				}
@@ -958,9 +968,9 @@ func (p *pipeline) groupUserKick(l *zap.Logger, session *session, envelope *Enve
 
 	// Check the user's group_edge state. If it's a pending join request being rejected then no need to decrement the group count.
 	var userState int64
-	err = tx.QueryRow("SELECT state FROM group_edge WHERE source_id = $1 AND destination_id = $2", groupID.Bytes(), userID.Bytes()).Scan(&userState)
+	err = tx.QueryRowContext(ctx, "SELECT state FROM group_edge WHERE source_id = $1 AND destination_id = $2", groupID.Bytes(), userID.Bytes()).Scan(&userState)
 
-	res, err := tx.Exec(`
+	res, err := tx.ExecContext(ctx, `
 DELETE FROM group_edge
 WHERE
 	EXISTS (SELECT source_id FROM group_edge WHERE source_id = $1 AND destination_id = $3 AND state = 0)
@@ -985,20 +995,20 @@ AND
 
 	// Join requests aren't reflected in group count.
 	if userState != 2 {
-		_, err = tx.Exec(`UPDATE groups SET count = count - 1, updated_at = $1 WHERE id = $2`, nowMs(), groupID.Bytes())
+		_, err = tx.ExecContext(ctx, `UPDATE groups SET count = count - 1, updated_at = $1 WHERE id = $2`, nowMs(), groupID.Bytes())
 		if err != nil {
 			return
 		}
 	}
 
 	// Look up the user being kicked. Allow kicking disabled users.
-	err = tx.QueryRow("SELECT handle FROM users WHERE id = $1", userID.Bytes()).Scan(&handle)
+	err = tx.QueryRowContext(ctx, "SELECT handle FROM users WHERE id = $1", userID.Bytes()).Scan(&handle)
 	if err != nil {
 		return
 	}
 }
 
-func (p *pipeline) groupUserPromote(l *zap.Logger, session *session, envelope *Envelope) {
+func (p *pipeline) groupUserPromote(ctx context.Context, l *zap.Logger, session *session, envelope *Envelope) {
 	g := envelope.GetGroupUserPromote()
 
 	groupID, err := uuid.FromBytes(g.GroupId)
@@ -1020,7 +1030,7 @@ func (p *pipeline) groupUserPromote(l *zap.Logger, session *session, envelope *E
 
 	logger := l.With(zap.String("group_id", groupID.String()), zap.String("user_id", userID.String()))
 
-	res, err := p.db.Exec(`
+	res, err := p.db.ExecContext(ctx, `
 UPDATE group_edge SET state = 0, updated_at = $4
 WHERE
 	EXISTS (SELECT source_id FROM group_edge WHERE source_id = $1 AND destination_id = $3 AND state = 0)
@@ -1047,13 +1057,13 @@ AND
 
 	// Look up the user being promoted. Allow promoting disabled users as long as they're still part of the group.
 	var handle string
-	err = p.db.QueryRow("SELECT handle FROM users WHERE id = $1", userID.Bytes()).Scan(&handle)
+	err = p.db.QueryRowContext(ctx, "SELECT handle FROM users WHERE id = $1", userID.Bytes()).Scan(&handle)
 	if err != nil {
 		return
 	}
 
 	data, _ := json.Marshal(map[string]string{"user_id": userID.String(), "handle": handle})
-	err = p.storeAndDeliverMessage(logger, session, &TopicId{Id: &TopicId_GroupId{GroupId: groupID.Bytes()}}, 5, data)
+	err = p.storeAndDeliverMessage(ctx, logger, session, &TopicId{Id: &TopicId_GroupId{GroupId: groupID.Bytes()}}, 5, data)
 	if err != nil {
 		logger.Error("Error handling group user promoted notification topic message", zap.Error(err))
 	}
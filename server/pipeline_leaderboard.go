@@ -16,14 +16,13 @@ package server
 
 import (
 	"bytes"
+	"context"
 	"database/sql"
 	"encoding/gob"
-	"encoding/json"
 	"strconv"
 	"strings"
 
 	"github.com/gorhill/cronexpr"
-	"github.com/satori/go.uuid"
 	"go.uber.org/zap"
 )
 
@@ -42,7 +41,7 @@ type leaderboardRecordListCursor struct {
 	Id        []byte
 }
 
-func (p *pipeline) leaderboardsList(logger *zap.Logger, session *session, envelope *Envelope) {
+func (p *pipeline) leaderboardsList(ctx context.Context, logger *zap.Logger, session *session, envelope *Envelope) {
 	incoming := envelope.GetLeaderboardsList()
 
 	limit := incoming.Limit
@@ -53,8 +52,8 @@ func (p *pipeline) leaderboardsList(logger *zap.Logger, session *session, envelo
 		return
 	}
 
-	query := "SELECT id, authoritative, sort_order, count, reset_schedule, metadata, next_id, prev_id FROM leaderboard"
-	params := []interface{}{}
+	query := "SELECT id, authoritative, sort_order, count, reset_schedule, metadata, next_id, prev_id FROM leaderboard WHERE app_id = $1"
+	params := []interface{}{session.appID}
 
 	if len(incoming.Cursor) != 0 {
 		var incomingCursor leaderboardCursor
@@ -62,7 +61,7 @@ func (p *pipeline) leaderboardsList(logger *zap.Logger, session *session, envelo
 			session.Send(ErrorMessageBadInput(envelope.CollationId, "Invalid cursor data"))
 			return
 		}
-		query += " WHERE id > $1"
+		query += " AND id > $2"
 		params = append(params, incomingCursor.Id)
 	}
 
@@ -70,7 +69,7 @@ func (p *pipeline) leaderboardsList(logger *zap.Logger, session *session, envelo
 	query += " LIMIT $" + strconv.Itoa(len(params))
 
 	logger.Debug("Leaderboards list", zap.String("query", query))
-	rows, err := p.db.Query(query, params...)
+	rows, err := p.db.QueryContext(ctx, query, params...)
 	if err != nil {
 		logger.Error("Could not execute leaderboards list query", zap.Error(err))
 		session.Send(ErrorMessageRuntimeException(envelope.CollationId, "Could not list leaderboards"))
@@ -134,167 +133,18 @@ func (p *pipeline) leaderboardsList(logger *zap.Logger, session *session, envelo
 	}}})
 }
 
-func (p *pipeline) leaderboardRecordWrite(logger *zap.Logger, session *session, envelope *Envelope) {
+func (p *pipeline) leaderboardRecordWrite(ctx context.Context, logger *zap.Logger, session *session, envelope *Envelope) {
 	incoming := envelope.GetLeaderboardRecordWrite()
-	if len(incoming.LeaderboardId) == 0 {
-		session.Send(ErrorMessageBadInput(envelope.CollationId, "Leaderboard ID must be present"))
-		return
-	}
-
-	if len(incoming.Metadata) != 0 {
-		// Make this `var js interface{}` if we want to allow top-level JSON arrays.
-		var maybeJSON map[string]interface{}
-		if json.Unmarshal(incoming.Metadata, &maybeJSON) != nil {
-			session.Send(ErrorMessageBadInput(envelope.CollationId, "Metadata must be a valid JSON object"))
-			return
-		}
-	}
-
-	var authoritative bool
-	var sortOrder int64
-	var resetSchedule sql.NullString
-	query := "SELECT authoritative, sort_order, reset_schedule FROM leaderboard WHERE id = $1"
-	logger.Debug("Leaderboard lookup", zap.String("query", query))
-	err := p.db.QueryRow(query, incoming.LeaderboardId).
-		Scan(&authoritative, &sortOrder, &resetSchedule)
-	if err != nil {
-		logger.Error("Could not execute leaderboard record write metadata query", zap.Error(err))
-		session.Send(ErrorMessageRuntimeException(envelope.CollationId, "Error writing leaderboard record"))
-		return
-	}
-
-	now := now()
-	updatedAt := timeToMs(now)
-	expiresAt := int64(0)
-	if resetSchedule.Valid {
-		expr, err := cronexpr.Parse(resetSchedule.String)
-		if err != nil {
-			logger.Error("Could not parse leaderboard reset schedule query", zap.Error(err))
-			session.Send(ErrorMessageRuntimeException(envelope.CollationId, "Error writing leaderboard record"))
-			return
-		}
-		expiresAt = timeToMs(expr.Next(now))
-	}
-
-	if authoritative == true {
-		session.Send(ErrorMessageBadInput(envelope.CollationId, "Cannot submit to authoritative leaderboard"))
-		return
-	}
-
-	var scoreOpSql string
-	var scoreDelta int64
-	var scoreAbs int64
-	switch incoming.Op.(type) {
-	case *TLeaderboardRecordWrite_Incr:
-		scoreOpSql = "score = leaderboard_record.score + $17::BIGINT"
-		scoreDelta = incoming.GetIncr()
-		scoreAbs = incoming.GetIncr()
-	case *TLeaderboardRecordWrite_Decr:
-		scoreOpSql = "score = leaderboard_record.score - $17::BIGINT"
-		scoreDelta = incoming.GetDecr()
-		scoreAbs = 0 - incoming.GetDecr()
-	case *TLeaderboardRecordWrite_Set:
-		scoreOpSql = "score = $17::BIGINT"
-		scoreDelta = incoming.GetSet()
-		scoreAbs = incoming.GetSet()
-	case *TLeaderboardRecordWrite_Best:
-		if sortOrder == 0 {
-			// Lower score is better.
-			scoreOpSql = "score = (leaderboard_record.score + $17::BIGINT - abs(leaderboard_record.score - $17::BIGINT)) / 2"
-		} else {
-			// Higher score is better.
-			scoreOpSql = "score = (leaderboard_record.score + $17::BIGINT + abs(leaderboard_record.score - $17::BIGINT)) / 2"
-		}
-		scoreDelta = incoming.GetBest()
-		scoreAbs = incoming.GetBest()
-	case nil:
-		session.Send(ErrorMessageBadInput(envelope.CollationId, "No leaderboard record write operator found"))
-		return
-	default:
-		session.Send(ErrorMessageBadInput(envelope.CollationId, "Unknown leaderboard record write operator"))
-		return
-	}
-
-	handle := session.handle.Load()
-	params := []interface{}{uuid.NewV4().Bytes(), incoming.LeaderboardId, session.userID.Bytes(), handle, session.lang}
-	if incoming.Location != "" {
-		params = append(params, incoming.Location)
-	} else {
-		params = append(params, nil)
-	}
-	if incoming.Timezone != "" {
-		params = append(params, incoming.Timezone)
-	} else {
-		params = append(params, nil)
-	}
-	params = append(params, 0, scoreAbs, 1)
-	if len(incoming.Metadata) != 0 {
-		params = append(params, incoming.Metadata)
-	} else {
-		params = append(params, nil)
-	}
-	params = append(params, 0, updatedAt, invertMs(updatedAt), expiresAt, 0, scoreDelta)
-
-	query = `INSERT INTO leaderboard_record (id, leaderboard_id, owner_id, handle, lang, location, timezone,
-				rank_value, score, num_score, metadata, ranked_at, updated_at, updated_at_inverse, expires_at, banned_at)
-			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, COALESCE($11, '{}'), $12, $13, $14, $15, $16)
-			ON CONFLICT (leaderboard_id, expires_at, owner_id)
-			DO UPDATE SET handle = $4, lang = $5, location = COALESCE($6, leaderboard_record.location),
-			  timezone = COALESCE($7, leaderboard_record.timezone), ` + scoreOpSql + `, num_score = leaderboard_record.num_score + 1,
-			  metadata = COALESCE($11, leaderboard_record.metadata), updated_at = $13`
-	logger.Debug("Leaderboard record write", zap.String("query", query))
-	res, err := p.db.Exec(query, params...)
+	record, code, err := leaderboardRecordWrite(ctx, logger, p.db, session.userID, session.handle.Load(), session.lang, session.appID, incoming, false, false)
 	if err != nil {
-		logger.Error("Could not execute leaderboard record write query", zap.Error(err))
-		session.Send(ErrorMessageRuntimeException(envelope.CollationId, "Error writing leaderboard record"))
-		return
-	}
-	if rowsAffected, _ := res.RowsAffected(); rowsAffected == 0 {
-		logger.Error("Unexpected row count from leaderboard record write query")
-		session.Send(ErrorMessageRuntimeException(envelope.CollationId, "Error writing leaderboard record"))
+		session.Send(ErrorMessage(envelope.CollationId, code, err.Error()))
 		return
 	}
 
-	var location sql.NullString
-	var timezone sql.NullString
-	var rankValue int64
-	var score int64
-	var numScore int64
-	var metadata []byte
-	var rankedAt int64
-	var bannedAt int64
-	query = `SELECT location, timezone, rank_value, score, num_score, metadata, ranked_at, banned_at
-		FROM leaderboard_record
-		WHERE leaderboard_id = $1
-		AND expires_at = $2
-		AND owner_id = $3`
-	logger.Debug("Leaderboard record read", zap.String("query", query))
-	err = p.db.QueryRow(query, incoming.LeaderboardId, expiresAt, session.userID.Bytes()).
-		Scan(&location, &timezone, &rankValue, &score, &numScore, &metadata, &rankedAt, &bannedAt)
-	if err != nil {
-		logger.Error("Could not execute leaderboard record read query", zap.Error(err))
-		session.Send(ErrorMessageRuntimeException(envelope.CollationId, "Error writing leaderboard record"))
-		return
-	}
-
-	session.Send(&Envelope{CollationId: envelope.CollationId, Payload: &Envelope_LeaderboardRecord{LeaderboardRecord: &TLeaderboardRecord{Record: &LeaderboardRecord{
-		LeaderboardId: incoming.LeaderboardId,
-		OwnerId:       session.userID.Bytes(),
-		Handle:        handle,
-		Lang:          session.lang,
-		Location:      location.String,
-		Timezone:      timezone.String,
-		Rank:          rankValue,
-		Score:         score,
-		NumScore:      numScore,
-		Metadata:      metadata,
-		RankedAt:      rankedAt,
-		UpdatedAt:     updatedAt,
-		ExpiresAt:     expiresAt,
-	}}}})
+	session.Send(&Envelope{CollationId: envelope.CollationId, Payload: &Envelope_LeaderboardRecord{LeaderboardRecord: &TLeaderboardRecord{Record: record}}})
 }
 
-func (p *pipeline) leaderboardRecordsFetch(logger *zap.Logger, session *session, envelope *Envelope) {
+func (p *pipeline) leaderboardRecordsFetch(ctx context.Context, logger *zap.Logger, session *session, envelope *Envelope) {
 	incoming := envelope.GetLeaderboardRecordsFetch()
 	leaderboardIds := incoming.LeaderboardIds
 	if len(leaderboardIds) == 0 {
@@ -323,7 +173,7 @@ func (p *pipeline) leaderboardRecordsFetch(logger *zap.Logger, session *session,
 	// TODO special handling of banned records?
 
 	statements := []string{}
-	params := []interface{}{session.userID.Bytes()}
+	params := []interface{}{session.userID.Bytes(), session.appID}
 	for _, leaderboardId := range leaderboardIds {
 		params = append(params, leaderboardId)
 		statements = append(statements, "$"+strconv.Itoa(len(params)))
@@ -333,6 +183,7 @@ func (p *pipeline) leaderboardRecordsFetch(logger *zap.Logger, session *session,
 	  rank_value, score, num_score, metadata, ranked_at, updated_at, expires_at, banned_at
 	FROM leaderboard_record
 	WHERE owner_id = $1
+	AND leaderboard_id IN (SELECT id FROM leaderboard WHERE app_id = $2)
 	AND leaderboard_id IN (` + strings.Join(statements, ", ") + `)`
 
 	if incomingCursor != nil {
@@ -344,7 +195,7 @@ func (p *pipeline) leaderboardRecordsFetch(logger *zap.Logger, session *session,
 	query += " LIMIT $" + strconv.Itoa(len(params))
 
 	logger.Debug("Leaderboard records fetch", zap.String("query", query))
-	rows, err := p.db.Query(query, params...)
+	rows, err := p.db.QueryContext(ctx, query, params...)
 	if err != nil {
 		logger.Error("Could not execute leaderboard records fetch query", zap.Error(err))
 		session.Send(ErrorMessageRuntimeException(envelope.CollationId, "Error loading leaderboard records"))
@@ -421,7 +272,7 @@ func (p *pipeline) leaderboardRecordsFetch(logger *zap.Logger, session *session,
 	}}})
 }
 
-func (p *pipeline) leaderboardRecordsList(logger *zap.Logger, session *session, envelope *Envelope) {
+func (p *pipeline) leaderboardRecordsList(ctx context.Context, logger *zap.Logger, session *session, envelope *Envelope) {
 	incoming := envelope.GetLeaderboardRecordsList()
 
 	if len(incoming.LeaderboardId) == 0 {
@@ -448,11 +299,14 @@ func (p *pipeline) leaderboardRecordsList(logger *zap.Logger, session *session,
 
 	var sortOrder int64
 	var resetSchedule sql.NullString
-	query := "SELECT sort_order, reset_schedule FROM leaderboard WHERE id = $1"
+	query := "SELECT sort_order, reset_schedule FROM leaderboard WHERE id = $1 AND app_id = $2"
 	logger.Debug("Leaderboard lookup", zap.String("query", query))
-	err := p.db.QueryRow(query, incoming.LeaderboardId).
+	err := p.db.QueryRowContext(ctx, query, incoming.LeaderboardId, session.appID).
 		Scan(&sortOrder, &resetSchedule)
-	if err != nil {
+	if err == sql.ErrNoRows {
+		session.Send(ErrorMessageBadInput(envelope.CollationId, "Leaderboard not found"))
+		return
+	} else if err != nil {
 		logger.Error("Could not execute leaderboard records list metadata query", zap.Error(err))
 		session.Send(ErrorMessageRuntimeException(envelope.CollationId, "Error loading leaderboard records"))
 		return
@@ -484,7 +338,7 @@ func (p *pipeline) leaderboardRecordsList(logger *zap.Logger, session *session,
 			return
 		}
 		// Haystack queries are executed in a separate flow.
-		p.loadLeaderboardRecordsHaystack(logger, session, envelope, incoming.LeaderboardId, incoming.GetOwnerId(), currentExpiresAt, limit, sortOrder, query, params)
+		p.loadLeaderboardRecordsHaystack(ctx, logger, session, envelope, incoming.LeaderboardId, incoming.GetOwnerId(), currentExpiresAt, limit, sortOrder, query, params)
 		return
 	case *TLeaderboardRecordsList_OwnerIds:
 		if incomingCursor != nil {
@@ -549,7 +403,7 @@ func (p *pipeline) leaderboardRecordsList(logger *zap.Logger, session *session,
 	query += " LIMIT $" + strconv.Itoa(len(params))
 
 	logger.Debug("Leaderboard records list", zap.String("query", query))
-	rows, err := p.db.Query(query, params...)
+	rows, err := p.db.QueryContext(ctx, query, params...)
 	if err != nil {
 		logger.Error("Could not execute leaderboard records list query", zap.Error(err))
 		session.Send(ErrorMessageRuntimeException(envelope.CollationId, "Error loading leaderboard records"))
@@ -624,7 +478,7 @@ func (p *pipeline) leaderboardRecordsList(logger *zap.Logger, session *session,
 	p.normalizeAndSendLeaderboardRecords(logger, session, envelope, leaderboardRecords, outgoingCursor)
 }
 
-func (p *pipeline) loadLeaderboardRecordsHaystack(logger *zap.Logger, session *session, envelope *Envelope, leaderboardId, findOwnerId []byte, currentExpiresAt, limit, sortOrder int64, query string, params []interface{}) {
+func (p *pipeline) loadLeaderboardRecordsHaystack(ctx context.Context, logger *zap.Logger, session *session, envelope *Envelope, leaderboardId, findOwnerId []byte, currentExpiresAt, limit, sortOrder int64, query string, params []interface{}) {
 	// Find the owner's record.
 	var id []byte
 	var score int64
@@ -635,7 +489,7 @@ func (p *pipeline) loadLeaderboardRecordsHaystack(logger *zap.Logger, session *s
 		AND expires_at = $2
 		AND owner_id = $3`
 	logger.Debug("Leaderboard record find", zap.String("query", findQuery))
-	err := p.db.QueryRow(findQuery, leaderboardId, currentExpiresAt, findOwnerId).Scan(&id, &score, &updatedAt)
+	err := p.db.QueryRowContext(ctx, findQuery, leaderboardId, currentExpiresAt, findOwnerId).Scan(&id, &score, &updatedAt)
 	if err != nil {
 		// TODO handle errors other than record not found?
 		session.Send(&Envelope{CollationId: envelope.CollationId, Payload: &Envelope_LeaderboardRecords{LeaderboardRecords: &TLeaderboardRecords{
@@ -666,7 +520,7 @@ func (p *pipeline) loadLeaderboardRecordsHaystack(logger *zap.Logger, session *s
 	firstQuery += " LIMIT $" + strconv.Itoa(len(firstParams))
 
 	logger.Debug("Leaderboard records list", zap.String("query", firstQuery))
-	firstRows, err := p.db.Query(firstQuery, firstParams...)
+	firstRows, err := p.db.QueryContext(ctx, firstQuery, firstParams...)
 	if err != nil {
 		logger.Error("Could not execute leaderboard records list query", zap.Error(err))
 		session.Send(ErrorMessageRuntimeException(envelope.CollationId, "Error loading leaderboard records"))
@@ -743,7 +597,7 @@ func (p *pipeline) loadLeaderboardRecordsHaystack(logger *zap.Logger, session *s
 	secondQuery += " LIMIT $" + strconv.Itoa(len(secondParams))
 
 	logger.Debug("Leaderboard records list", zap.String("query", secondQuery))
-	secondRows, err := p.db.Query(secondQuery, secondParams...)
+	secondRows, err := p.db.QueryContext(ctx, secondQuery, secondParams...)
 	if err != nil {
 		logger.Error("Could not execute leaderboard records list query", zap.Error(err))
 		session.Send(ErrorMessageRuntimeException(envelope.CollationId, "Error loading leaderboard records"))
@@ -15,6 +15,7 @@
 package server
 
 import (
+	"context"
 	"strconv"
 
 	"strings"
@@ -23,23 +24,25 @@ import (
 	"golang.org/x/crypto/bcrypt"
 )
 
-func (p *pipeline) linkID(logger *zap.Logger, session *session, envelope *Envelope) {
+func (p *pipeline) linkID(ctx context.Context, logger *zap.Logger, session *session, envelope *Envelope) {
 	// Route to correct link handler
 	switch envelope.GetLink().Payload.(type) {
 	case *TLink_Device:
-		p.linkDevice(logger, session, envelope)
+		p.linkDevice(ctx, logger, session, envelope)
 	case *TLink_Facebook:
-		p.linkFacebook(logger, session, envelope)
+		p.linkFacebook(ctx, logger, session, envelope)
 	case *TLink_Google:
-		p.linkGoogle(logger, session, envelope)
+		p.linkGoogle(ctx, logger, session, envelope)
 	case *TLink_GameCenter:
-		p.linkGameCenter(logger, session, envelope)
+		p.linkGameCenter(ctx, logger, session, envelope)
 	case *TLink_Steam:
-		p.linkSteam(logger, session, envelope)
+		p.linkSteam(ctx, logger, session, envelope)
 	case *TLink_Email:
-		p.linkEmail(logger, session, envelope)
+		p.linkEmail(ctx, logger, session, envelope)
 	case *TLink_Custom:
-		p.linkCustom(logger, session, envelope)
+		p.linkCustom(ctx, logger, session, envelope)
+	case *TLink_Oidc:
+		p.linkOIDC(ctx, logger, session, envelope)
 	default:
 		logger.Error("Could not link", zap.String("error", "Invalid payload"))
 		session.Send(ErrorMessageBadInput(envelope.CollationId, "Invalid payload"))
@@ -47,7 +50,7 @@ func (p *pipeline) linkID(logger *zap.Logger, session *session, envelope *Envelo
 	}
 }
 
-func (p *pipeline) linkDevice(logger *zap.Logger, session *session, envelope *Envelope) {
+func (p *pipeline) linkDevice(ctx context.Context, logger *zap.Logger, session *session, envelope *Envelope) {
 	deviceID := envelope.GetLink().GetDevice()
 	if deviceID == "" {
 		session.Send(ErrorMessageBadInput(envelope.CollationId, "Device ID is required"))
@@ -60,13 +63,13 @@ func (p *pipeline) linkDevice(logger *zap.Logger, session *session, envelope *En
 		return
 	}
 
-	txn, err := p.db.Begin()
+	txn, err := p.db.BeginTx(ctx, nil)
 	if err != nil {
 		logger.Warn("Could not link, transaction begin error", zap.Error(err))
 		session.Send(ErrorMessageRuntimeException(envelope.CollationId, "Could not link"))
 		return
 	}
-	res, err := txn.Exec("INSERT INTO user_device (id, user_id) VALUES ($1, $2)", deviceID, session.userID.Bytes())
+	res, err := txn.ExecContext(ctx, "INSERT INTO user_device (id, user_id) VALUES ($1, $2)", deviceID, session.userID.Bytes())
 	if err != nil {
 		logger.Warn("Could not link, query error", zap.Error(err))
 		err = txn.Rollback()
@@ -84,7 +87,7 @@ func (p *pipeline) linkDevice(logger *zap.Logger, session *session, envelope *En
 		session.Send(ErrorMessageRuntimeException(envelope.CollationId, "Could not link"))
 		return
 	}
-	res, err = txn.Exec("UPDATE users SET updated_at = $1 WHERE id = $2", nowMs(), session.userID.Bytes())
+	res, err = txn.ExecContext(ctx, "UPDATE users SET updated_at = $1 WHERE id = $2", nowMs(), session.userID.Bytes())
 	if err != nil {
 		logger.Warn("Could not link, query error", zap.Error(err))
 		err = txn.Rollback()
@@ -112,7 +115,7 @@ func (p *pipeline) linkDevice(logger *zap.Logger, session *session, envelope *En
 	session.Send(&Envelope{CollationId: envelope.CollationId})
 }
 
-func (p *pipeline) linkFacebook(logger *zap.Logger, session *session, envelope *Envelope) {
+func (p *pipeline) linkFacebook(ctx context.Context, logger *zap.Logger, session *session, envelope *Envelope) {
 	accessToken := envelope.GetLink().GetFacebook()
 	if accessToken == "" {
 		session.Send(ErrorMessageBadInput(envelope.CollationId, "Access token is required"))
@@ -131,7 +134,7 @@ func (p *pipeline) linkFacebook(logger *zap.Logger, session *session, envelope *
 
 	userID := session.userID.Bytes()
 
-	res, err := p.db.Exec(`
+	res, err := p.db.ExecContext(ctx, `
 UPDATE users
 SET facebook_id = $2, updated_at = $3
 WHERE id = $1
@@ -150,12 +153,12 @@ AND NOT EXISTS
 		return
 	}
 
-	p.addFacebookFriends(logger, userID, accessToken)
+	p.addFacebookFriends(ctx, logger, userID, accessToken)
 
 	session.Send(&Envelope{CollationId: envelope.CollationId})
 }
 
-func (p *pipeline) linkGoogle(logger *zap.Logger, session *session, envelope *Envelope) {
+func (p *pipeline) linkGoogle(ctx context.Context, logger *zap.Logger, session *session, envelope *Envelope) {
 	accessToken := envelope.GetLink().GetGoogle()
 	if accessToken == "" {
 		session.Send(ErrorMessageBadInput(envelope.CollationId, "Access token is required"))
@@ -172,7 +175,7 @@ func (p *pipeline) linkGoogle(logger *zap.Logger, session *session, envelope *En
 		return
 	}
 
-	res, err := p.db.Exec(`
+	res, err := p.db.ExecContext(ctx, `
 UPDATE users
 SET google_id = $2, updated_at = $3
 WHERE id = $1
@@ -196,7 +199,7 @@ AND NOT EXISTS
 	session.Send(&Envelope{CollationId: envelope.CollationId})
 }
 
-func (p *pipeline) linkGameCenter(logger *zap.Logger, session *session, envelope *Envelope) {
+func (p *pipeline) linkGameCenter(ctx context.Context, logger *zap.Logger, session *session, envelope *Envelope) {
 	gc := envelope.GetLink().GetGameCenter()
 	if gc == nil || gc.PlayerId == "" || gc.BundleId == "" || gc.Timestamp == 0 || gc.Salt == "" || gc.Signature == "" || gc.PublicKeyUrl == "" {
 		session.Send(ErrorMessageBadInput(envelope.CollationId, "Game Center credentials required"))
@@ -210,7 +213,7 @@ func (p *pipeline) linkGameCenter(logger *zap.Logger, session *session, envelope
 		return
 	}
 
-	res, err := p.db.Exec(`
+	res, err := p.db.ExecContext(ctx, `
 UPDATE users
 SET gamecenter_id = $2, updated_at = $3
 WHERE id = $1
@@ -234,7 +237,7 @@ AND NOT EXISTS
 	session.Send(&Envelope{CollationId: envelope.CollationId})
 }
 
-func (p *pipeline) linkSteam(logger *zap.Logger, session *session, envelope *Envelope) {
+func (p *pipeline) linkSteam(ctx context.Context, logger *zap.Logger, session *session, envelope *Envelope) {
 	if p.config.GetSocial().Steam.PublisherKey == "" || p.config.GetSocial().Steam.AppID == 0 {
 		session.Send(ErrorMessage(envelope.CollationId, USER_LINK_PROVIDER_UNAVAILABLE, "Steam link not available"))
 		return
@@ -256,7 +259,7 @@ func (p *pipeline) linkSteam(logger *zap.Logger, session *session, envelope *Env
 		return
 	}
 
-	res, err := p.db.Exec(`
+	res, err := p.db.ExecContext(ctx, `
 UPDATE users
 SET steam_id = $2, updated_at = $3
 WHERE id = $1
@@ -280,7 +283,7 @@ AND NOT EXISTS
 	session.Send(&Envelope{CollationId: envelope.CollationId})
 }
 
-func (p *pipeline) linkEmail(logger *zap.Logger, session *session, envelope *Envelope) {
+func (p *pipeline) linkEmail(ctx context.Context, logger *zap.Logger, session *session, envelope *Envelope) {
 	email := envelope.GetLink().GetEmail()
 	if email == nil {
 		session.Send(ErrorMessageBadInput(envelope.CollationId, "Invalid payload"))
@@ -304,9 +307,9 @@ func (p *pipeline) linkEmail(logger *zap.Logger, session *session, envelope *Env
 
 	hashedPassword, _ := bcrypt.GenerateFromPassword([]byte(email.Password), bcrypt.DefaultCost)
 
-	res, err := p.db.Exec(`
+	res, err := p.db.ExecContext(ctx, `
 UPDATE users
-SET email = $2, password = $3, updated_at = $4
+SET email = $2, password = $3, updated_at = $4, verified_at = 0
 WHERE id = $1
 AND NOT EXISTS
     (SELECT id
@@ -326,23 +329,21 @@ AND NOT EXISTS
 		return
 	}
 
+	p.emailVerifier.sendVerification(session.userID, strings.ToLower(email.Email))
 	session.Send(&Envelope{CollationId: envelope.CollationId})
 }
 
-func (p *pipeline) linkCustom(logger *zap.Logger, session *session, envelope *Envelope) {
-	customID := envelope.GetLink().GetCustom()
-	if customID == "" {
-		session.Send(ErrorMessageBadInput(envelope.CollationId, "Custom ID is required"))
+func (p *pipeline) linkCustom(ctx context.Context, logger *zap.Logger, session *session, envelope *Envelope) {
+	profile, err := verifyCustomID(logger, p.customIDVerifier, envelope.GetLink().GetCustom())
+	if err == errCustomIDRejected {
+		session.Send(ErrorMessage(envelope.CollationId, USER_LINK_PROVIDER_UNAVAILABLE, "Could not verify custom ID"))
 		return
-	} else if invalidCharsRegex.MatchString(customID) {
-		session.Send(ErrorMessageBadInput(envelope.CollationId, "Invalid custom ID, no spaces or control characters allowed"))
-		return
-	} else if len(customID) < 10 || len(customID) > 64 {
-		session.Send(ErrorMessageBadInput(envelope.CollationId, "Invalid custom ID, must be 10-64 bytes"))
+	} else if err != nil {
+		session.Send(ErrorMessageBadInput(envelope.CollationId, err.Error()))
 		return
 	}
 
-	res, err := p.db.Exec(`
+	res, err := p.db.ExecContext(ctx, `
 UPDATE users
 SET custom_id = $2, updated_at = $3
 WHERE id = $1
@@ -351,7 +352,7 @@ AND NOT EXISTS
      FROM users
      WHERE custom_id = $2)`,
 		session.userID.Bytes(),
-		customID,
+		profile.ID,
 		nowMs())
 
 	if err != nil {
@@ -366,19 +367,69 @@ AND NOT EXISTS
 	session.Send(&Envelope{CollationId: envelope.CollationId})
 }
 
-func (p *pipeline) unlinkID(logger *zap.Logger, session *session, envelope *Envelope) {
+func (p *pipeline) linkOIDC(ctx context.Context, logger *zap.Logger, session *session, envelope *Envelope) {
+	oidc := envelope.GetLink().GetOidc()
+	if oidc == nil || oidc.Token == "" {
+		session.Send(ErrorMessageBadInput(envelope.CollationId, "ID token is required"))
+		return
+	}
+	provider, ok := p.oidcProviders[oidc.Provider]
+	if !ok {
+		session.Send(ErrorMessageBadInput(envelope.CollationId, "Unknown OpenID Connect provider"))
+		return
+	}
+
+	profile, err := provider.Verify(oidc.Token)
+	if err != nil {
+		logger.Warn("Could not verify OpenID Connect ID token", zap.String("provider", oidc.Provider), zap.Error(err))
+		session.Send(ErrorMessage(envelope.CollationId, USER_LINK_PROVIDER_UNAVAILABLE, "Could not verify OpenID Connect ID token"))
+		return
+	}
+	oidcID := oidcIdentity(profile)
+	if len(oidcID) > 255 {
+		session.Send(ErrorMessageBadInput(envelope.CollationId, "Invalid OpenID Connect identity, must be at most 255 bytes"))
+		return
+	}
+
+	// Only one OpenID Connect identity can be linked, it has to be unlinked before linking another.
+	res, err := p.db.ExecContext(ctx, `
+UPDATE users
+SET oidc_id = $2, updated_at = $3
+WHERE id = $1
+AND oidc_id IS NULL
+AND NOT EXISTS
+    (SELECT id
+     FROM users
+     WHERE oidc_id = $2)`,
+		session.userID.Bytes(),
+		oidcID,
+		nowMs())
+
+	if err != nil {
+		logger.Warn("Could not link", zap.Error(err))
+		session.Send(ErrorMessageRuntimeException(envelope.CollationId, "Could not link"))
+		return
+	} else if count, _ := res.RowsAffected(); count == 0 {
+		session.Send(ErrorMessage(envelope.CollationId, USER_LINK_INUSE, "OpenID Connect ID in use, or another one already linked"))
+		return
+	}
+
+	session.Send(&Envelope{CollationId: envelope.CollationId})
+}
+
+func (p *pipeline) unlinkID(ctx context.Context, logger *zap.Logger, session *session, envelope *Envelope) {
 	// Select correct unlink query
 	var query string
 	var param interface{}
 	switch envelope.GetUnlink().Payload.(type) {
 	case *TUnlink_Device:
-		txn, err := p.db.Begin()
+		txn, err := p.db.BeginTx(ctx, nil)
 		if err != nil {
 			logger.Warn("Could not unlink, transaction begin error", zap.Error(err))
 			session.Send(ErrorMessageRuntimeException(envelope.CollationId, "Could not unlink"))
 			return
 		}
-		res, err := txn.Exec(`
+		res, err := txn.ExecContext(ctx, `
 DELETE FROM user_device WHERE id = $2 AND user_id = $1
 AND (EXISTS (SELECT id FROM users WHERE id = $1 AND
       (facebook_id IS NOT NULL
@@ -386,7 +437,8 @@ AND (EXISTS (SELECT id FROM users WHERE id = $1 AND
        OR gamecenter_id IS NOT NULL
        OR steam_id IS NOT NULL
        OR email IS NOT NULL
-       OR custom_id IS NOT NULL))
+       OR custom_id IS NOT NULL
+       OR oidc_id IS NOT NULL))
      OR EXISTS (SELECT id FROM user_device WHERE user_id = $1 AND id <> $2))`,
 			session.userID.Bytes(),
 			envelope.GetUnlink().GetDevice())
@@ -407,7 +459,7 @@ AND (EXISTS (SELECT id FROM users WHERE id = $1 AND
 			session.Send(ErrorMessage(envelope.CollationId, USER_UNLINK_DISALLOWED, "Check profile exists and is not last link"))
 			return
 		}
-		res, err = txn.Exec("UPDATE users SET updated_at = $2 WHERE id = $1", session.userID.Bytes(), nowMs())
+		res, err = txn.ExecContext(ctx, "UPDATE users SET updated_at = $2 WHERE id = $1", session.userID.Bytes(), nowMs())
 		if err != nil {
 			logger.Warn("Could not unlink, query error", zap.Error(err))
 			err = txn.Rollback()
@@ -442,7 +494,8 @@ AND ((google_id IS NOT NULL
       OR gamecenter_id IS NOT NULL
       OR steam_id IS NOT NULL
       OR email IS NOT NULL
-      OR custom_id IS NOT NULL)
+      OR custom_id IS NOT NULL
+      OR oidc_id IS NOT NULL)
      OR
      EXISTS (SELECT id FROM user_device WHERE user_id = $1 LIMIT 1))`
 		param = envelope.GetUnlink().GetFacebook()
@@ -454,7 +507,8 @@ AND ((facebook_id IS NOT NULL
       OR gamecenter_id IS NOT NULL
       OR steam_id IS NOT NULL
       OR email IS NOT NULL
-      OR custom_id IS NOT NULL)
+      OR custom_id IS NOT NULL
+      OR oidc_id IS NOT NULL)
      OR
      EXISTS (SELECT id FROM user_device WHERE user_id = $1 LIMIT 1))`
 		param = envelope.GetUnlink().GetGoogle()
@@ -466,7 +520,8 @@ AND ((facebook_id IS NOT NULL
       OR google_id IS NOT NULL
       OR steam_id IS NOT NULL
       OR email IS NOT NULL
-      OR custom_id IS NOT NULL)
+      OR custom_id IS NOT NULL
+      OR oidc_id IS NOT NULL)
      OR
      EXISTS (SELECT id FROM user_device WHERE user_id = $1 LIMIT 1))`
 		param = envelope.GetUnlink().GetGameCenter()
@@ -478,19 +533,21 @@ AND ((facebook_id IS NOT NULL
       OR google_id IS NOT NULL
       OR gamecenter_id IS NOT NULL
       OR email IS NOT NULL
-      OR custom_id IS NOT NULL)
+      OR custom_id IS NOT NULL
+      OR oidc_id IS NOT NULL)
      OR
      EXISTS (SELECT id FROM user_device WHERE user_id = $1 LIMIT 1))`
 		param = envelope.GetUnlink().GetSteam()
 	case *TUnlink_Email:
-		query = `UPDATE users SET email = NULL, password = NULL, updated_at = $3
+		query = `UPDATE users SET email = NULL, password = NULL, verified_at = 0, updated_at = $3
 WHERE id = $1
 AND email = $2
 AND ((facebook_id IS NOT NULL
       OR google_id IS NOT NULL
       OR gamecenter_id IS NOT NULL
       OR steam_id IS NOT NULL
-      OR custom_id IS NOT NULL)
+      OR custom_id IS NOT NULL
+      OR oidc_id IS NOT NULL)
      OR
      EXISTS (SELECT id FROM user_device WHERE user_id = $1 LIMIT 1))`
 		param = strings.ToLower(envelope.GetUnlink().GetEmail())
@@ -502,17 +559,31 @@ AND ((facebook_id IS NOT NULL
       OR google_id IS NOT NULL
       OR gamecenter_id IS NOT NULL
       OR steam_id IS NOT NULL
-      OR email IS NOT NULL)
+      OR email IS NOT NULL
+      OR oidc_id IS NOT NULL)
      OR
      EXISTS (SELECT id FROM user_device WHERE user_id = $1 LIMIT 1))`
 		param = envelope.GetUnlink().GetCustom()
+	case *TUnlink_Oidc:
+		query = `UPDATE users SET oidc_id = NULL, updated_at = $3
+WHERE id = $1
+AND oidc_id = $2
+AND ((facebook_id IS NOT NULL
+      OR google_id IS NOT NULL
+      OR gamecenter_id IS NOT NULL
+      OR steam_id IS NOT NULL
+      OR email IS NOT NULL
+      OR custom_id IS NOT NULL)
+     OR
+     EXISTS (SELECT id FROM user_device WHERE user_id = $1 LIMIT 1))`
+		param = envelope.GetUnlink().GetOidc()
 	default:
 		logger.Error("Could not unlink", zap.String("error", "Invalid payload"))
 		session.Send(ErrorMessageBadInput(envelope.CollationId, "Invalid payload"))
 		return
 	}
 
-	res, err := p.db.Exec(query, session.userID.Bytes(), param, nowMs())
+	res, err := p.db.ExecContext(ctx, query, session.userID.Bytes(), param, nowMs())
 
 	if err != nil {
 		logger.Warn("Could not unlink", zap.Error(err))
@@ -525,3 +596,25 @@ AND ((facebook_id IS NOT NULL
 
 	session.Send(&Envelope{CollationId: envelope.CollationId})
 }
+
+func (p *pipeline) userMerge(ctx context.Context, logger *zap.Logger, session *session, envelope *Envelope) {
+	sourceToken, ok := p.authenticateToken(ctx, envelope.GetUserMerge().Token)
+	if !ok {
+		session.Send(ErrorMessage(envelope.CollationId, AUTH_ERROR, "Invalid or expired token for the user to merge"))
+		return
+	}
+	if sourceToken.UserID == session.userID {
+		session.Send(ErrorMessageBadInput(envelope.CollationId, "Cannot merge a user into itself"))
+		return
+	}
+
+	err := mergeUsers(ctx, logger, p.db, sourceToken.UserID, session.userID, p.config.GetMerge().ConflictPolicy)
+	if err != nil {
+		logger.Error("Could not merge users", zap.String("source", sourceToken.UserID.String()), zap.Error(err))
+		session.Send(ErrorMessageRuntimeException(envelope.CollationId, "Could not merge users"))
+		return
+	}
+
+	p.sessionRegistry.disconnectUser(sourceToken.UserID, USER_DISABLED, "Merged into another user")
+	session.Send(&Envelope{CollationId: envelope.CollationId})
+}
@@ -15,11 +15,13 @@
 package server
 
 import (
+	"context"
+
 	"github.com/satori/go.uuid"
 	"go.uber.org/zap"
 )
 
-func (p *pipeline) matchCreate(logger *zap.Logger, session *session, envelope *Envelope) {
+func (p *pipeline) matchCreate(ctx context.Context, logger *zap.Logger, session *session, envelope *Envelope) {
 	matchID := uuid.NewV4()
 
 	handle := session.handle.Load()
@@ -41,7 +43,7 @@ func (p *pipeline) matchCreate(logger *zap.Logger, session *session, envelope *E
 	}}})
 }
 
-func (p *pipeline) matchJoin(logger *zap.Logger, session *session, envelope *Envelope) {
+func (p *pipeline) matchJoin(ctx context.Context, logger *zap.Logger, session *session, envelope *Envelope) {
 	matchIDBytes := envelope.GetMatchJoin().MatchId
 	matchID, err := uuid.FromBytes(matchIDBytes)
 	if err != nil {
@@ -49,15 +51,29 @@ func (p *pipeline) matchJoin(logger *zap.Logger, session *session, envelope *Env
 		return
 	}
 	topic := "match:" + matchID.String()
+	handle := session.handle.Load()
+
+	// Authoritative matches decide for themselves who may join, whichever node they are hosted by.
+	authoritative, allow, reason := p.matchRegistry.JoinAttempt(matchID, Presence{
+		ID:     PresenceID{Node: p.config.GetName(), SessionID: session.id},
+		Topic:  topic,
+		UserID: session.userID,
+		Meta:   PresenceMeta{Handle: handle},
+	})
+	if authoritative && !allow {
+		if reason == "" {
+			reason = "Match join rejected"
+		}
+		session.Send(ErrorMessage(envelope.CollationId, MATCH_JOIN_REJECTED, reason))
+		return
+	}
 
 	ps := p.tracker.ListByTopic(topic)
-	if len(ps) == 0 {
+	if len(ps) == 0 && !authoritative {
 		session.Send(ErrorMessage(envelope.CollationId, MATCH_NOT_FOUND, "Match not found"))
 		return
 	}
 
-	handle := session.handle.Load()
-
 	p.tracker.Track(session.id, topic, session.userID, PresenceMeta{
 		Handle: handle,
 	})
@@ -85,7 +101,7 @@ func (p *pipeline) matchJoin(logger *zap.Logger, session *session, envelope *Env
 	}}})
 }
 
-func (p *pipeline) matchLeave(logger *zap.Logger, session *session, envelope *Envelope) {
+func (p *pipeline) matchLeave(ctx context.Context, logger *zap.Logger, session *session, envelope *Envelope) {
 	matchIDBytes := envelope.GetMatchLeave().MatchId
 	matchID, err := uuid.FromBytes(matchIDBytes)
 	if err != nil {
@@ -119,21 +135,38 @@ func (p *pipeline) matchLeave(logger *zap.Logger, session *session, envelope *En
 	session.Send(&Envelope{CollationId: envelope.CollationId})
 }
 
-func (p *pipeline) matchDataSend(logger *zap.Logger, session *session, envelope *Envelope) {
+func (p *pipeline) matchDataSend(ctx context.Context, logger *zap.Logger, session *session, envelope *Envelope) {
 	incoming := envelope.GetMatchDataSend()
 	matchIDBytes := incoming.MatchId
 	matchID, err := uuid.FromBytes(matchIDBytes)
 	if err != nil {
-		// TODO send an error to the client?
+		session.Send(ErrorMessageBadInput(envelope.CollationId, "Invalid match ID"))
 		return
 	}
 	topic := "match:" + matchID.String()
 
-	// TODO check membership before looking up all members.
+	if !p.tracker.CheckLocalByIDTopicUser(session.id, topic, session.userID) {
+		session.Send(ErrorMessage(envelope.CollationId, MATCH_NOT_FOUND, "Match not found"))
+		return
+	}
+
+	// Data sent to authoritative matches is input for the match handler, it is not relayed to other members.
+	if p.matchRegistry.Input(matchID, &MatchMessage{
+		Presence: Presence{
+			ID:     PresenceID{Node: p.config.GetName(), SessionID: session.id},
+			Topic:  topic,
+			UserID: session.userID,
+			Meta:   PresenceMeta{Handle: session.handle.Load()},
+		},
+		OpCode: incoming.OpCode,
+		Data:   incoming.Data,
+	}) {
+		return
+	}
 
 	ps := p.tracker.ListByTopic(topic)
 	if len(ps) == 0 {
-		// TODO send an error to the client?
+		session.Send(ErrorMessage(envelope.CollationId, MATCH_NOT_FOUND, "Match not found"))
 		return
 	}
 
@@ -150,7 +183,7 @@ func (p *pipeline) matchDataSend(logger *zap.Logger, session *session, envelope
 
 	// If sender wasn't in the presences for this match, they're not a member.
 	if !found {
-		// TODO send an error to the client?
+		session.Send(ErrorMessage(envelope.CollationId, MATCH_NOT_FOUND, "Match not found"))
 		return
 	}
 
@@ -0,0 +1,46 @@
+// Copyright 2017 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+func (p *pipeline) rpc(ctx context.Context, logger *zap.Logger, session *session, envelope *Envelope) {
+	rpcMessage := envelope.GetRpc()
+	if rpcMessage.Id == "" {
+		session.Send(ErrorMessageBadInput(envelope.CollationId, "RPC ID must be set"))
+		return
+	}
+
+	id := strings.ToLower(rpcMessage.Id)
+	if !p.runtime.HasRPC(id) {
+		session.Send(ErrorMessage(envelope.CollationId, RUNTIME_FUNCTION_NOT_FOUND, "RPC function not found"))
+		return
+	}
+
+	result, err := p.runtime.InvokeRPC(logger, newRuntimeContext(ctx, session), id, rpcMessage.Payload)
+	if err != nil {
+		// The error may hold details of the server code, so it is only logged.
+		logger.Error("RPC function failed", zap.String("id", id), zap.Error(err))
+		session.Send(ErrorMessage(envelope.CollationId, RUNTIME_FUNCTION_EXCEPTION, "RPC function failed"))
+		return
+	}
+
+	session.Send(&Envelope{CollationId: envelope.CollationId, Payload: &Envelope_Rpc{Rpc: &TRpc{Id: rpcMessage.Id, Payload: result}}})
+}
@@ -0,0 +1,69 @@
+// Copyright 2017 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+func TestPipelineRpc(t *testing.T) {
+	module := `
+local nakama = require("nakama")
+nakama.register_rpc(function(context, payload) return "echo:" .. payload end, "echo")
+nakama.register_rpc(function(context, payload) error("secret detail") end, "fail")
+`
+	p := &pipeline{runtime: newTestRuntime(t, module, 1000)}
+
+	tests := []struct {
+		name    string
+		id      string
+		payload string
+		code    Error_Code
+		message string
+	}{
+		{"result", "echo", "hi", 0, ""},
+		{"case insensitive id", "ECHO", "hi", 0, ""},
+		{"not found", "missing", "", RUNTIME_FUNCTION_NOT_FOUND, "RPC function not found"},
+		{"lua error is not exposed", "fail", "", RUNTIME_FUNCTION_EXCEPTION, "RPC function failed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var response *Envelope
+			session := newTestSession(NewConfig())
+			defer session.interceptResponses("cid", func(envelope *Envelope) {
+				response = envelope
+			})()
+			envelope := &Envelope{CollationId: "cid", Payload: &Envelope_Rpc{Rpc: &TRpc{Id: tt.id, Payload: []byte(tt.payload)}}}
+			p.rpc(context.Background(), zap.NewNop(), session, envelope)
+
+			if response == nil {
+				t.Fatal("no response")
+			}
+			if tt.message != "" {
+				e := response.GetError()
+				if e == nil || e.Code != int32(tt.code) || e.Message != tt.message {
+					t.Fatalf("response %v, expected error %v %q", response, tt.code, tt.message)
+				}
+				return
+			}
+			if rpc := response.GetRpc(); rpc == nil || string(rpc.Payload) != "echo:"+tt.payload {
+				t.Fatalf("response %v, expected payload %q", response, "echo:"+tt.payload)
+			}
+		})
+	}
+}
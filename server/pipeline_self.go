@@ -15,15 +15,17 @@
 package server
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
 	"strconv"
 	"strings"
 
 	"go.uber.org/zap"
+	"golang.org/x/crypto/bcrypt"
 )
 
-func (p *pipeline) selfFetch(logger *zap.Logger, session *session, envelope *Envelope) {
+func (p *pipeline) selfFetch(ctx context.Context, logger *zap.Logger, session *session, envelope *Envelope) {
 	var fullname sql.NullString
 	var handle sql.NullString
 	var email sql.NullString
@@ -32,6 +34,7 @@ func (p *pipeline) selfFetch(logger *zap.Logger, session *session, envelope *Env
 	var gamecenter sql.NullString
 	var steam sql.NullString
 	var customID sql.NullString
+	var oidcID sql.NullString
 	var timezone sql.NullString
 	var location sql.NullString
 	var lang sql.NullString
@@ -44,9 +47,9 @@ func (p *pipeline) selfFetch(logger *zap.Logger, session *session, envelope *Env
 
 	deviceIDs := make([]string, 0)
 
-	rows, err := p.db.Query(`
+	rows, err := p.db.QueryContext(ctx, `
 SELECT u.handle, u.fullname, u.avatar_url, u.lang, u.location, u.timezone, u.metadata,
-	u.email, u.facebook_id, u.google_id, u.gamecenter_id, u.steam_id, u.custom_id,
+	u.email, u.facebook_id, u.google_id, u.gamecenter_id, u.steam_id, u.custom_id, u.oidc_id,
 	u.created_at, u.updated_at, u.verified_at, u.last_online_at,
 	ud.id
 FROM users u
@@ -63,7 +66,7 @@ WHERE u.id = $1`,
 	for rows.Next() {
 		var deviceID sql.NullString
 		err = rows.Scan(&handle, &fullname, &avatarURL, &lang, &location, &timezone, &metadata,
-			&email, &facebook, &google, &gamecenter, &steam, &customID,
+			&email, &facebook, &google, &gamecenter, &steam, &customID, &oidcID,
 			&createdAt, &updatedAt, &verifiedAt, &lastOnlineAt, &deviceID)
 		if err != nil {
 			logger.Error("Error reading user profile", zap.Error(err))
@@ -101,13 +104,14 @@ WHERE u.id = $1`,
 		GamecenterId: gamecenter.String,
 		SteamId:      steam.String,
 		CustomId:     customID.String,
+		OidcId:       oidcID.String,
 		Verified:     verifiedAt.Int64 > 0,
 	}
 
 	session.Send(&Envelope{CollationId: envelope.CollationId, Payload: &Envelope_Self{Self: &TSelf{Self: s}}})
 }
 
-func (p *pipeline) selfUpdate(logger *zap.Logger, session *session, envelope *Envelope) {
+func (p *pipeline) selfUpdate(ctx context.Context, logger *zap.Logger, session *session, envelope *Envelope) {
 	update := envelope.GetSelfUpdate()
 	index := 1
 	statements := make([]string, 0)
@@ -162,7 +166,7 @@ func (p *pipeline) selfUpdate(logger *zap.Logger, session *session, envelope *En
 
 	params = append(params, nowMs(), session.userID.Bytes())
 
-	res, err := p.db.Exec(
+	res, err := p.db.ExecContext(ctx,
 		"UPDATE users SET updated_at = $"+strconv.Itoa(index)+", "+strings.Join(statements, ", ")+" WHERE id = $"+strconv.Itoa(index+1),
 		params...)
 
@@ -186,3 +190,59 @@ func (p *pipeline) selfUpdate(logger *zap.Logger, session *session, envelope *En
 
 	session.Send(&Envelope{CollationId: envelope.CollationId})
 }
+
+func (p *pipeline) passwordChange(ctx context.Context, logger *zap.Logger, session *session, envelope *Envelope) {
+	incoming := envelope.GetPasswordChange()
+	if incoming.CurrentPassword == "" {
+		session.Send(ErrorMessageBadInput(envelope.CollationId, "Current password is required"))
+		return
+	} else if len(incoming.Password) < 8 {
+		session.Send(ErrorMessageBadInput(envelope.CollationId, "Password must be longer than 8 characters"))
+		return
+	}
+
+	var email sql.NullString
+	var currentPassword []byte
+	err := p.db.QueryRowContext(ctx, "SELECT email, password FROM users WHERE id = $1", session.userID.Bytes()).
+		Scan(&email, &currentPassword)
+	if err != nil {
+		logger.Error("Could not look up current password", zap.Error(err))
+		session.Send(ErrorMessageRuntimeException(envelope.CollationId, "Could not change password"))
+		return
+	}
+	if len(currentPassword) == 0 {
+		session.Send(ErrorMessageBadInput(envelope.CollationId, "No email account linked"))
+		return
+	}
+
+	// Guesses count towards the same lockout as email logins.
+	identifier := "email:" + email.String
+	if p.authLimiter.IsLockedOut(identifier) {
+		session.Send(ErrorMessage(envelope.CollationId, AUTH_ERROR, "Account temporarily locked after too many failed login attempts"))
+		return
+	}
+	if bcrypt.CompareHashAndPassword(currentPassword, []byte(incoming.CurrentPassword)) != nil {
+		p.authLimiter.Fail(identifier)
+		session.Send(ErrorMessage(envelope.CollationId, AUTH_ERROR, "Current password is incorrect"))
+		return
+	}
+	p.authLimiter.Succeed(identifier)
+
+	hashedPassword, _ := bcrypt.GenerateFromPassword([]byte(incoming.Password), bcrypt.DefaultCost)
+	// Tokens issued until now are rejected from now on, so other devices have to log in with the new password.
+	res, err := p.db.ExecContext(ctx, "UPDATE users SET password = $2, updated_at = $3, tokens_valid_after = $3 WHERE id = $1 AND password = $4",
+		session.userID.Bytes(), hashedPassword, nowMs(), currentPassword)
+	if err != nil {
+		logger.Error("Could not change password", zap.Error(err))
+		session.Send(ErrorMessageRuntimeException(envelope.CollationId, "Could not change password"))
+		return
+	} else if count, _ := res.RowsAffected(); count == 0 {
+		// The password was changed by another request since it was checked.
+		session.Send(ErrorMessage(envelope.CollationId, AUTH_ERROR, "Current password is incorrect"))
+		return
+	}
+
+	// Connected clients, this one included, have to log in again with the new password.
+	session.Send(&Envelope{CollationId: envelope.CollationId})
+	p.sessionRegistry.disconnectUser(session.userID, AUTH_ERROR, "Password changed")
+}
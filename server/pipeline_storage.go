@@ -16,6 +16,7 @@ package server
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha256"
 	"database/sql"
 	"errors"
@@ -61,7 +62,7 @@ func (p *pipeline) fetchStorageData(r scanner) (*TStorageData_StorageData, error
 	}, nil
 }
 
-func (p *pipeline) storageFetch(logger *zap.Logger, session *session, envelope *Envelope) {
+func (p *pipeline) storageFetch(ctx context.Context, logger *zap.Logger, session *session, envelope *Envelope) {
 	incoming := envelope.GetStorageFetch()
 	storageData := make([]*TStorageData_StorageData, 0)
 
@@ -93,16 +94,16 @@ SELECT user_id, bucket, collection, record,
 	value, version, read, write,
 	created_at, updated_at, expires_at
 FROM storage
-WHERE bucket = $1 AND collection = $2 AND record = $4 AND user_id IS NULL AND deleted_at = 0 AND read = 1`
-			row = p.db.QueryRow(query, key.Bucket, key.Collection, key.Record)
+WHERE app_id = $4 AND bucket = $1 AND collection = $2 AND record = $3 AND user_id IS NULL AND deleted_at = 0 AND read = 1`
+			row = p.db.QueryRowContext(ctx, query, key.Bucket, key.Collection, key.Record, session.appID)
 		} else {
 			query := `
 SELECT user_id, bucket, collection, record,
 	value, version, read, write,
 	created_at, updated_at, expires_at
 FROM storage
-WHERE bucket = $1 AND collection = $2 AND user_id = $3 AND record = $4 AND deleted_at = 0 AND read = 1`
-			row = p.db.QueryRow(query, key.Bucket, key.Collection, session.userID.Bytes(), key.Record)
+WHERE app_id = $5 AND bucket = $1 AND collection = $2 AND user_id = $3 AND record = $4 AND deleted_at = 0 AND read = 1`
+			row = p.db.QueryRowContext(ctx, query, key.Bucket, key.Collection, session.userID.Bytes(), key.Record, session.appID)
 		}
 
 		data, err := p.fetchStorageData(row)
@@ -120,10 +121,10 @@ WHERE bucket = $1 AND collection = $2 AND user_id = $3 AND record = $4 AND delet
 	session.Send(&Envelope{CollationId: envelope.CollationId, Payload: &Envelope_StorageData{StorageData: &TStorageData{Data: storageData}}})
 }
 
-func (p *pipeline) storageWrite(logger *zap.Logger, session *session, envelope *Envelope) {
+func (p *pipeline) storageWrite(ctx context.Context, logger *zap.Logger, session *session, envelope *Envelope) {
 	incoming := envelope.GetStorageWrite()
 
-	tx, err := p.db.Begin()
+	tx, err := p.db.BeginTx(ctx, nil)
 	if err != nil {
 		logger.Error("Could not store data", zap.Error(err))
 		session.Send(ErrorMessageRuntimeException(envelope.CollationId, "Could not store data"))
@@ -182,37 +183,37 @@ func (p *pipeline) storageWrite(logger *zap.Logger, session *session, envelope *
 
 		if len(data.Version) == 0 {
 			query = `
-INSERT INTO storage (id, user_id, bucket, collection, record, value, version, created_at, updated_at, deleted_at)
-SELECT $1, $2, $3, $4, $5, $6, $7, $8, $8, 0
-WHERE NOT EXISTS (SELECT record FROM storage WHERE user_id = $2 AND bucket = $3 AND collection = $4 AND record = $5 AND deleted_at = 0 AND write = 0)
-ON CONFLICT (bucket, collection, user_id, record, deleted_at)
+INSERT INTO storage (id, app_id, user_id, bucket, collection, record, value, version, created_at, updated_at, deleted_at)
+SELECT $1, $9, $2, $3, $4, $5, $6, $7, $8, $8, 0
+WHERE NOT EXISTS (SELECT record FROM storage WHERE app_id = $9 AND user_id = $2 AND bucket = $3 AND collection = $4 AND record = $5 AND deleted_at = 0 AND write = 0)
+ON CONFLICT (app_id, bucket, collection, user_id, record, deleted_at)
 DO UPDATE SET value = $6, version = $7, updated_at = $8
 `
-			params = []interface{}{recordID, session.userID.Bytes(), data.Bucket, data.Collection, data.Record, data.Value, version, updatedAt}
+			params = []interface{}{recordID, session.userID.Bytes(), data.Bucket, data.Collection, data.Record, data.Value, version, updatedAt, session.appID}
 			errorMessage = "Could not store data"
 		} else if bytes.Equal(data.Version, []byte("*")) {
 			// if-none-match
 			query = `
-INSERT INTO storage (id, user_id, bucket, collection, record, value, version, created_at, updated_at, deleted_at)
-SELECT $1, $2, $3, $4, $5, $6, $7, $8, $8, 0
-WHERE NOT EXISTS (SELECT record FROM storage WHERE user_id = $2 AND bucket = $3 AND collection = $4 AND record = $5 AND deleted_at = 0)
+INSERT INTO storage (id, app_id, user_id, bucket, collection, record, value, version, created_at, updated_at, deleted_at)
+SELECT $1, $9, $2, $3, $4, $5, $6, $7, $8, $8, 0
+WHERE NOT EXISTS (SELECT record FROM storage WHERE app_id = $9 AND user_id = $2 AND bucket = $3 AND collection = $4 AND record = $5 AND deleted_at = 0)
 `
-			params = []interface{}{recordID, session.userID.Bytes(), data.Bucket, data.Collection, data.Record, data.Value, version, updatedAt}
+			params = []interface{}{recordID, session.userID.Bytes(), data.Bucket, data.Collection, data.Record, data.Value, version, updatedAt, session.appID}
 			errorMessage = "Could not store data. This could be caused by failure of if-none-match version check"
 		} else {
 			// if-match
 			query = `
-INSERT INTO storage (id, user_id, bucket, collection, record, value, version, created_at, updated_at, deleted_at)
-SELECT $1, $2, $3, $4, $5, $6, $7, $8, $8, 0
-WHERE EXISTS (SELECT record FROM storage WHERE user_id = $2 AND bucket = $3 AND collection = $4 and record = $5 AND version = $9 AND deleted_at = 0 AND write = 1)
-ON CONFLICT (bucket, collection, user_id, record, deleted_at)
+INSERT INTO storage (id, app_id, user_id, bucket, collection, record, value, version, created_at, updated_at, deleted_at)
+SELECT $1, $10, $2, $3, $4, $5, $6, $7, $8, $8, 0
+WHERE EXISTS (SELECT record FROM storage WHERE app_id = $10 AND user_id = $2 AND bucket = $3 AND collection = $4 and record = $5 AND version = $9 AND deleted_at = 0 AND write = 1)
+ON CONFLICT (app_id, bucket, collection, user_id, record, deleted_at)
 DO UPDATE SET value = $6, version = $7, updated_at = $8
 `
-			params = []interface{}{recordID, session.userID.Bytes(), data.Bucket, data.Collection, data.Record, data.Value, version, updatedAt, data.Version}
+			params = []interface{}{recordID, session.userID.Bytes(), data.Bucket, data.Collection, data.Record, data.Value, version, updatedAt, data.Version, session.appID}
 			errorMessage = "Could not store data. This could be caused by failure of if-match version check"
 		}
 
-		_, err = tx.Exec(query, params...)
+		_, err = tx.ExecContext(ctx, query, params...)
 		if err != nil {
 			return
 		}
@@ -226,10 +227,10 @@ DO UPDATE SET value = $6, version = $7, updated_at = $8
 	}
 }
 
-func (p *pipeline) storageRemove(logger *zap.Logger, session *session, envelope *Envelope) {
+func (p *pipeline) storageRemove(ctx context.Context, logger *zap.Logger, session *session, envelope *Envelope) {
 	incoming := envelope.GetStorageRemove()
 
-	tx, err := p.db.Begin()
+	tx, err := p.db.BeginTx(ctx, nil)
 	if err != nil {
 		logger.Error("Could not remove data", zap.Error(err))
 		session.Send(ErrorMessageRuntimeException(envelope.CollationId, "Could not remove data"))
@@ -281,13 +282,13 @@ func (p *pipeline) storageRemove(logger *zap.Logger, session *session, envelope
 		if key.Version != nil {
 			query := `
 UPDATE storage SET deleted_at = $1, updated_at = $1
-WHERE bucket = $2 AND collection = $3 AND record = $4 AND user_id = $5 AND version = $6 AND deleted_at = 0 AND write = 1`
-			res, err = tx.Exec(query, updatedAt, key.Bucket, key.Collection, key.Record, session.userID.Bytes(), key.Version)
+WHERE app_id = $7 AND bucket = $2 AND collection = $3 AND record = $4 AND user_id = $5 AND version = $6 AND deleted_at = 0 AND write = 1`
+			res, err = tx.ExecContext(ctx, query, updatedAt, key.Bucket, key.Collection, key.Record, session.userID.Bytes(), key.Version, session.appID)
 		} else {
 			query := `
 UPDATE storage SET deleted_at = $1, updated_at = $1
-WHERE bucket = $2 AND collection = $3 AND record = $4 AND user_id = $5 AND deleted_at = 0 AND write = 1`
-			res, err = tx.Exec(query, updatedAt, key.Bucket, key.Collection, key.Record, session.userID.Bytes())
+WHERE app_id = $6 AND bucket = $2 AND collection = $3 AND record = $4 AND user_id = $5 AND deleted_at = 0 AND write = 1`
+			res, err = tx.ExecContext(ctx, query, updatedAt, key.Bucket, key.Collection, key.Record, session.userID.Bytes(), session.appID)
 		}
 
 		if err != nil {
@@ -16,10 +16,12 @@ package server
 
 import (
 	"bytes"
+	"context"
 	"database/sql"
 	"encoding/gob"
 	"encoding/json"
 	"regexp"
+	"strconv"
 	"unicode/utf8"
 
 	"github.com/satori/go.uuid"
@@ -34,7 +36,7 @@ type messageCursor struct {
 
 var invalidRoomRegex = regexp.MustCompilePOSIX("[[:cntrl:]]+")
 
-func (p *pipeline) topicJoin(logger *zap.Logger, session *session, envelope *Envelope) {
+func (p *pipeline) topicJoin(ctx context.Context, logger *zap.Logger, session *session, envelope *Envelope) {
 	id := envelope.GetTopicJoin()
 	var topic *TopicId
 	var trackerTopic string
@@ -55,7 +57,7 @@ func (p *pipeline) topicJoin(logger *zap.Logger, session *session, envelope *Env
 		}
 
 		// Check the user exists and does not block the requester.
-		existsAndDoesNotBlock, err := p.userExistsAndDoesNotBlock(otherUserIDBytes, session.userID.Bytes())
+		existsAndDoesNotBlock, err := p.userExistsAndDoesNotBlock(ctx, otherUserIDBytes, session.userID.Bytes())
 		if err != nil {
 			logger.Error("Could not check if user exists", zap.Error(err))
 			session.Send(ErrorMessageRuntimeException(envelope.CollationId, "Failed to look up user ID"))
@@ -91,7 +93,7 @@ func (p *pipeline) topicJoin(logger *zap.Logger, session *session, envelope *Env
 		}
 
 		topic = &TopicId{Id: &TopicId_Room{Room: room}}
-		trackerTopic = "room:" + string(room)
+		trackerTopic = roomTrackerTopic(session.appID, room)
 	case *TTopicJoin_GroupId:
 		// Check input is valid ID.
 		groupIDBytes := id.GetGroupId()
@@ -102,7 +104,7 @@ func (p *pipeline) topicJoin(logger *zap.Logger, session *session, envelope *Env
 		}
 
 		// Check if group exists and user is a member.
-		member, err := p.isGroupMember(session.userID, groupIDBytes)
+		member, err := p.isGroupMember(ctx, session.userID, groupIDBytes)
 		if err != nil {
 			logger.Error("Could not check if user is group member", zap.Error(err))
 			session.Send(ErrorMessageRuntimeException(envelope.CollationId, "Failed to look up group membership"))
@@ -150,7 +152,7 @@ func (p *pipeline) topicJoin(logger *zap.Logger, session *session, envelope *Env
 	}}})
 }
 
-func (p *pipeline) topicLeave(logger *zap.Logger, session *session, envelope *Envelope) {
+func (p *pipeline) topicLeave(ctx context.Context, logger *zap.Logger, session *session, envelope *Envelope) {
 	topic := envelope.GetTopicLeave().Topic
 	var trackerTopic string
 	switch topic.Id.(type) {
@@ -213,7 +215,7 @@ func (p *pipeline) topicLeave(logger *zap.Logger, session *session, envelope *En
 			return
 		}
 
-		trackerTopic = "room:" + string(room)
+		trackerTopic = roomTrackerTopic(session.appID, room)
 	case *TopicId_GroupId:
 		// Check input is valid ID.
 		groupIDBytes := topic.GetGroupId()
@@ -238,7 +240,7 @@ func (p *pipeline) topicLeave(logger *zap.Logger, session *session, envelope *En
 	session.Send(&Envelope{CollationId: envelope.CollationId})
 }
 
-func (p *pipeline) topicMessageSend(logger *zap.Logger, session *session, envelope *Envelope) {
+func (p *pipeline) topicMessageSend(ctx context.Context, logger *zap.Logger, session *session, envelope *Envelope) {
 	topic := envelope.GetTopicMessageSend().Topic
 	if topic == nil {
 		session.Send(ErrorMessageBadInput(envelope.CollationId, "Topic ID is required"))
@@ -317,7 +319,7 @@ func (p *pipeline) topicMessageSend(logger *zap.Logger, session *session, envelo
 			return
 		}
 
-		trackerTopic = "room:" + string(room)
+		trackerTopic = roomTrackerTopic(session.appID, room)
 	case *TopicId_GroupId:
 		// Check input is valid ID.
 		groupIDBytes := topic.GetGroupId()
@@ -342,7 +344,7 @@ func (p *pipeline) topicMessageSend(logger *zap.Logger, session *session, envelo
 	}
 
 	// Store message to history.
-	messageID, handle, createdAt, expiresAt, err := p.storeMessage(logger, session, topic, 0, data)
+	messageID, handle, createdAt, expiresAt, err := p.storeMessage(ctx, logger, session, topic, 0, data)
 	if err != nil {
 		session.Send(ErrorMessageRuntimeException(envelope.CollationId, "Could not store message"))
 		return
@@ -361,7 +363,7 @@ func (p *pipeline) topicMessageSend(logger *zap.Logger, session *session, envelo
 	p.deliverMessage(logger, session, topic, 0, data, messageID, handle, createdAt, expiresAt)
 }
 
-func (p *pipeline) topicMessagesList(logger *zap.Logger, session *session, envelope *Envelope) {
+func (p *pipeline) topicMessagesList(ctx context.Context, logger *zap.Logger, session *session, envelope *Envelope) {
 	input := envelope.GetTopicMessagesList()
 	if input.Id == nil {
 		session.Send(ErrorMessageBadInput(envelope.CollationId, "Topic ID is required"))
@@ -433,7 +435,7 @@ func (p *pipeline) topicMessagesList(logger *zap.Logger, session *session, envel
 		}
 
 		// Check if group exists and user is a member.
-		member, err := p.isGroupMember(session.userID, groupIDBytes)
+		member, err := p.isGroupMember(ctx, session.userID, groupIDBytes)
 		if err != nil {
 			logger.Error("Could not check if user is group member", zap.Error(err))
 			session.Send(ErrorMessageRuntimeException(envelope.CollationId, "Failed to look up group membership"))
@@ -472,6 +474,12 @@ func (p *pipeline) topicMessagesList(logger *zap.Logger, session *session, envel
 		params = append(params, c.CreatedAt, c.MessageID, c.UserID)
 	}
 
+	// Rooms are separate for each app, other topics are already scoped by their users or group.
+	if topicType == 1 {
+		params = append(params, session.appID)
+		query += " AND app_id = $" + strconv.Itoa(len(params))
+	}
+
 	if input.Forward {
 		query += " ORDER BY created_at ASC"
 	} else {
@@ -479,7 +487,7 @@ func (p *pipeline) topicMessagesList(logger *zap.Logger, session *session, envel
 	}
 	query += " LIMIT $1"
 
-	rows, err := p.db.Query(query, params...)
+	rows, err := p.db.QueryContext(ctx, query, params...)
 	if err != nil {
 		logger.Error("Could not get topic messages list", zap.Error(err))
 		session.Send(ErrorMessageRuntimeException(envelope.CollationId, "Could not get topic messages list"))
@@ -534,9 +542,9 @@ func (p *pipeline) topicMessagesList(logger *zap.Logger, session *session, envel
 	session.Send(&Envelope{CollationId: envelope.CollationId, Payload: &Envelope_TopicMessages{TopicMessages: &TTopicMessages{Messages: messages, Cursor: cursor}}})
 }
 
-func (p *pipeline) isGroupMember(userID uuid.UUID, groupID []byte) (bool, error) {
+func (p *pipeline) isGroupMember(ctx context.Context, userID uuid.UUID, groupID []byte) (bool, error) {
 	var state int64
-	err := p.db.QueryRow("SELECT state FROM group_edge WHERE source_id = $1 AND destination_id = $2", userID.Bytes(), groupID).Scan(&state)
+	err := p.db.QueryRowContext(ctx, "SELECT state FROM group_edge WHERE source_id = $1 AND destination_id = $2", userID.Bytes(), groupID).Scan(&state)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return false, nil
@@ -547,9 +555,9 @@ func (p *pipeline) isGroupMember(userID uuid.UUID, groupID []byte) (bool, error)
 	return state == 0 || state == 1, nil
 }
 
-func (p *pipeline) userExistsAndDoesNotBlock(checkUserID []byte, blocksUserID []byte) (bool, error) {
+func (p *pipeline) userExistsAndDoesNotBlock(ctx context.Context, checkUserID []byte, blocksUserID []byte) (bool, error) {
 	var count int64
-	err := p.db.QueryRow(`
+	err := p.db.QueryRowContext(ctx, `
 SELECT COUNT(id) FROM users
 WHERE id = $1 AND NOT EXISTS (
 	SELECT state FROM user_edge
@@ -561,7 +569,7 @@ WHERE id = $1 AND NOT EXISTS (
 }
 
 // Assumes `topic` has already been validated, or was constructed internally.
-func (p *pipeline) storeMessage(logger *zap.Logger, session *session, topic *TopicId, msgType int64, data []byte) ([]byte, string, int64, int64, error) {
+func (p *pipeline) storeMessage(ctx context.Context, logger *zap.Logger, session *session, topic *TopicId, msgType int64, data []byte) ([]byte, string, int64, int64, error) {
 	var topicBytes []byte
 	var topicType int64
 	switch topic.Id.(type) {
@@ -579,10 +587,10 @@ func (p *pipeline) storeMessage(logger *zap.Logger, session *session, topic *Top
 	messageID := uuid.NewV4().Bytes()
 	expiresAt := int64(0)
 	handle := session.handle.Load()
-	_, err := p.db.Exec(`
-INSERT INTO message (topic, topic_type, message_id, user_id, created_at, expires_at, handle, type, data)
-VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`,
-		topicBytes, topicType, messageID, session.userID.Bytes(), createdAt, expiresAt, handle, msgType, data)
+	_, err := p.db.ExecContext(ctx, `
+INSERT INTO message (topic, topic_type, message_id, user_id, created_at, expires_at, handle, type, data, app_id)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)`,
+		topicBytes, topicType, messageID, session.userID.Bytes(), createdAt, expiresAt, handle, msgType, data, session.appID)
 	if err != nil {
 		logger.Error("Failed to insert new message", zap.Error(err))
 		return nil, "", 0, 0, err
@@ -601,7 +609,7 @@ func (p *pipeline) deliverMessage(logger *zap.Logger, session *session, topic *T
 
 		trackerTopic = "dm:" + userID1.String() + ":" + userID2.String()
 	case *TopicId_Room:
-		trackerTopic = "room:" + string(topic.GetRoom())
+		trackerTopic = roomTrackerTopic(session.appID, topic.GetRoom())
 	case *TopicId_GroupId:
 		trackerTopic = "group:" + uuid.FromBytesOrNil(topic.GetGroupId()).String()
 	}
@@ -625,8 +633,8 @@ func (p *pipeline) deliverMessage(logger *zap.Logger, session *session, topic *T
 	p.messageRouter.Send(logger, presences, outgoing)
 }
 
-func (p *pipeline) storeAndDeliverMessage(logger *zap.Logger, session *session, topic *TopicId, msgType int64, data []byte) error {
-	messageID, handle, createdAt, expiresAt, err := p.storeMessage(logger, session, topic, msgType, data)
+func (p *pipeline) storeAndDeliverMessage(ctx context.Context, logger *zap.Logger, session *session, topic *TopicId, msgType int64, data []byte) error {
+	messageID, handle, createdAt, expiresAt, err := p.storeMessage(ctx, logger, session, topic, msgType, data)
 	if err != nil {
 		return err
 	}
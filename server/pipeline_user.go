@@ -15,6 +15,7 @@
 package server
 
 import (
+	"context"
 	"strconv"
 	"strings"
 
@@ -22,7 +23,7 @@ import (
 	"go.uber.org/zap"
 )
 
-func (p *pipeline) usersFetch(logger *zap.Logger, session *session, envelope *Envelope) {
+func (p *pipeline) usersFetch(ctx context.Context, logger *zap.Logger, session *session, envelope *Envelope) {
 	userIds := envelope.GetUsersFetch().UserIds
 	if len(userIds) == 0 {
 		session.Send(ErrorMessageBadInput(envelope.CollationId, "List must contain at least one user ID"))
@@ -49,7 +50,7 @@ func (p *pipeline) usersFetch(logger *zap.Logger, session *session, envelope *En
 	}
 
 	query := "WHERE users.id IN (" + strings.Join(statements, ", ") + ")"
-	users, err := p.querySocialGraph(logger, query, params)
+	users, err := p.querySocialGraph(ctx, logger, query, params)
 	if err != nil {
 		session.Send(ErrorMessageRuntimeException(envelope.CollationId, "Could not retrieve users"))
 		return
@@ -97,8 +97,8 @@ func (pn *presenceNotifier) HandleDiff(joins, leaves []Presence) {
 			} else {
 				pn.handleDiffTopic(t, to, tjs, nil)
 			}
-		case "room":
-			t := &TopicId{Id: &TopicId_Room{Room: []byte(splitTopic[1])}}
+		case "room", "app":
+			t := &TopicId{Id: &TopicId_Room{Room: roomFromTrackerTopic(topic)}}
 			if tls, ok := topicLeaves[topic]; ok {
 				// Make sure leaves aren't also processed separately if we were able to pair them here.
 				delete(topicLeaves, topic)
@@ -115,6 +115,8 @@ func (pn *presenceNotifier) HandleDiff(joins, leaves []Presence) {
 			} else {
 				pn.handleDiffTopic(t, to, tjs, nil)
 			}
+		case "matchhost":
+			// Only marks the node hosting an authoritative match, no session is in it.
 		default:
 			pn.logger.Warn("Skipping presence notifications for unknown topic", zap.Any("topic", topic))
 		}
@@ -143,12 +145,14 @@ func (pn *presenceNotifier) HandleDiff(joins, leaves []Presence) {
 			userID2 := uuid.FromStringOrNil(users[1]).Bytes()
 			t := &TopicId{Id: &TopicId_Dm{Dm: append(userID1, userID2...)}}
 			pn.handleDiffTopic(t, to, nil, tls)
-		case "room":
-			t := &TopicId{Id: &TopicId_Room{Room: []byte(splitTopic[1])}}
+		case "room", "app":
+			t := &TopicId{Id: &TopicId_Room{Room: roomFromTrackerTopic(topic)}}
 			pn.handleDiffTopic(t, to, nil, tls)
 		case "group":
 			t := &TopicId{Id: &TopicId_GroupId{GroupId: uuid.FromStringOrNil(splitTopic[1]).Bytes()}}
 			pn.handleDiffTopic(t, to, nil, tls)
+		case "matchhost":
+			// Only marks the node hosting an authoritative match, no session is in it.
 		default:
 			pn.logger.Warn("Skipping presence notifications for unknown topic", zap.Any("topic", topic))
 		}
@@ -0,0 +1,596 @@
+// Copyright 2017 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gogo/protobuf/jsonpb"
+	"github.com/satori/go.uuid"
+	"github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/parse"
+	"go.uber.org/zap"
+)
+
+const (
+	runtimeModuleExtension = ".lua"
+)
+
+// errSessionVarsRejected is returned when the session variables function deliberately rejects an authentication.
+var errSessionVarsRejected = errors.New("Authentication rejected")
+
+// RuntimeContext describes the user and session a runtime function is invoked for.
+type RuntimeContext struct {
+	UserID    uuid.UUID
+	Handle    string
+	SessionID uuid.UUID
+	Lang      string
+	AppID     string
+	Vars      map[string]string
+	ctx       context.Context
+}
+
+// Context returns the context of the request the runtime was invoked for. Database calls made with it abort when the
+// request or its session ends.
+func (c *RuntimeContext) Context() context.Context {
+	if c == nil || c.ctx == nil {
+		return context.Background()
+	}
+	return c.ctx
+}
+
+// RuntimeRPCFunction is a server function registered from Go code which clients can call by ID.
+type RuntimeRPCFunction func(logger *zap.Logger, ctx *RuntimeContext, payload []byte) ([]byte, error)
+
+type runtimeModule struct {
+	name  string
+	path  string
+	proto *lua.FunctionProto
+}
+
+// runtimeVM is a single Lua state with all modules loaded, it must only be used by one goroutine at a time.
+type runtimeVM struct {
+	state       *lua.LState
+	beforeHooks map[string]*lua.LFunction
+	afterHooks  map[string]*lua.LFunction
+	rpcs        map[string]*lua.LFunction
+	matches     map[string]*lua.LTable
+	timeout     time.Duration
+	sessionVars *lua.LFunction
+	context     *RuntimeContext
+}
+
+// Runtime loads Lua modules from disk and invokes the hooks they register.
+type Runtime struct {
+	logger            *zap.Logger
+	db                *sql.DB
+	matchRegistry     *MatchRegistry
+	modules           []*runtimeModule
+	beforeHooks       map[string]bool
+	afterHooks        map[string]bool
+	rpcs              map[string]bool
+	sessionVars       bool
+	goRPCsMu          sync.RWMutex
+	goRPCs            map[string]RuntimeRPCFunction
+	callTimeout       time.Duration
+	afterSlots        chan struct{}
+	vmPool            *sync.Pool
+	jsonpbMarshaler   *jsonpb.Marshaler
+	jsonpbUnmarshaler *jsonpb.Unmarshaler
+}
+
+// NewRuntime compiles all modules found in the runtime path and checks they load cleanly.
+func NewRuntime(logger *zap.Logger, multiLogger *zap.Logger, db *sql.DB, config Config, matchRegistry *MatchRegistry) (*Runtime, error) {
+	path := config.GetRuntime().Path
+	if path == "" {
+		path = filepath.FromSlash(config.GetDataDir() + "/modules")
+	}
+	if err := os.MkdirAll(path, 0755); err != nil {
+		return nil, err
+	}
+
+	// Walk visits files in lexical order, which keeps module load order stable.
+	modules := make([]*runtimeModule, 0)
+	err := filepath.Walk(path, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || filepath.Ext(filePath) != runtimeModuleExtension {
+			return nil
+		}
+
+		relPath, _ := filepath.Rel(path, filePath)
+		name := strings.TrimSuffix(relPath, runtimeModuleExtension)
+		name = strings.Replace(filepath.ToSlash(name), "/", ".", -1)
+
+		content, err := ioutil.ReadFile(filePath)
+		if err != nil {
+			return err
+		}
+		chunk, err := parse.Parse(bytes.NewReader(content), relPath)
+		if err != nil {
+			return err
+		}
+		proto, err := lua.Compile(chunk, relPath)
+		if err != nil {
+			return err
+		}
+
+		modules = append(modules, &runtimeModule{name: name, path: filePath, proto: proto})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	r := &Runtime{
+		logger:        logger,
+		db:            db,
+		matchRegistry: matchRegistry,
+		modules:       modules,
+		beforeHooks:   make(map[string]bool),
+		afterHooks:    make(map[string]bool),
+		rpcs:          make(map[string]bool),
+		goRPCs:        make(map[string]RuntimeRPCFunction),
+		callTimeout:   time.Duration(config.GetRuntime().CallTimeoutMs) * time.Millisecond,
+		afterSlots:    make(chan struct{}, config.GetRuntime().AfterHookLimit),
+		jsonpbMarshaler: &jsonpb.Marshaler{
+			EnumsAsInts:  true,
+			EmitDefaults: false,
+			Indent:       "",
+			OrigName:     true,
+		},
+		jsonpbUnmarshaler: &jsonpb.Unmarshaler{
+			AllowUnknownFields: false,
+		},
+	}
+
+	// Load one VM up front to surface module errors at startup, and to learn which hooks exist.
+	vm, err := r.newVM()
+	if err != nil {
+		return nil, err
+	}
+	for messageType := range vm.beforeHooks {
+		r.beforeHooks[messageType] = true
+	}
+	for messageType := range vm.afterHooks {
+		r.afterHooks[messageType] = true
+	}
+	for id := range vm.rpcs {
+		r.rpcs[id] = true
+	}
+	r.sessionVars = vm.sessionVars != nil
+	for name := range vm.matches {
+		name := name
+		matchRegistry.RegisterHandler(name, func() (MatchHandler, error) {
+			return r.newLuaMatchHandler(name)
+		})
+	}
+
+	r.vmPool = &sync.Pool{
+		New: func() interface{} {
+			vm, err := r.newVM()
+			if err != nil {
+				r.logger.Error("Could not create runtime VM", zap.Error(err))
+				return nil
+			}
+			return vm
+		},
+	}
+	r.vmPool.Put(vm)
+
+	multiLogger.Info("Runtime modules", zap.String("path", path), zap.Int("count", len(modules)))
+	return r, nil
+}
+
+func (r *Runtime) newVM() (*runtimeVM, error) {
+	l := lua.NewState(lua.Options{SkipOpenLibs: true})
+	for _, lib := range []struct {
+		name string
+		fn   lua.LGFunction
+	}{
+		{lua.LoadLibName, lua.OpenPackage}, // Must be first.
+		{lua.BaseLibName, lua.OpenBase},
+		{lua.TabLibName, lua.OpenTable},
+		{lua.StringLibName, lua.OpenString},
+		{lua.MathLibName, lua.OpenMath},
+	} {
+		if err := l.CallByParam(lua.P{Fn: l.NewFunction(lib.fn), NRet: 0, Protect: true}, lua.LString(lib.name)); err != nil {
+			l.Close()
+			return nil, err
+		}
+	}
+
+	vm := &runtimeVM{
+		state:       l,
+		beforeHooks: make(map[string]*lua.LFunction),
+		afterHooks:  make(map[string]*lua.LFunction),
+		rpcs:        make(map[string]*lua.LFunction),
+		matches:     make(map[string]*lua.LTable),
+		timeout:     r.callTimeout,
+	}
+
+	nakamaModule := NewNakamaModule(r.logger, r.db, vm, r.matchRegistry)
+	l.PreloadModule("nakama", nakamaModule.Loader)
+
+	// Modules are preloaded first so they can require each other regardless of load order.
+	for _, m := range r.modules {
+		proto := m.proto
+		l.PreloadModule(m.name, func(l *lua.LState) int {
+			l.Push(l.NewFunctionFromProto(proto))
+			l.Call(0, 1)
+			return 1
+		})
+	}
+	for _, m := range r.modules {
+		if err := l.CallByParam(lua.P{Fn: l.GetGlobal("require"), NRet: 0, Protect: true}, lua.LString(m.name)); err != nil {
+			l.Close()
+			return nil, fmt.Errorf("Could not load module %v: %v", m.path, err.Error())
+		}
+	}
+
+	return vm, nil
+}
+
+func (r *Runtime) getVM() (*runtimeVM, error) {
+	vm, ok := r.vmPool.Get().(*runtimeVM)
+	if !ok || vm == nil {
+		return nil, errors.New("Runtime unavailable")
+	}
+	return vm, nil
+}
+
+func (r *Runtime) putVM(vm *runtimeVM) {
+	vm.state.SetTop(0)
+	r.vmPool.Put(vm)
+}
+
+// HasBefore checks if any module registered a before hook for the given message type.
+func (r *Runtime) HasBefore(messageType string) bool {
+	return r.beforeHooks[messageType]
+}
+
+// HasAfter checks if any module registered an after hook for the given message type.
+func (r *Runtime) HasAfter(messageType string) bool {
+	return r.afterHooks[messageType]
+}
+
+// RegisterRPC makes a Go function callable by clients under the given ID. Go functions take precedence over Lua
+// functions registered with the same ID.
+func (r *Runtime) RegisterRPC(id string, fn RuntimeRPCFunction) {
+	id = strings.ToLower(id)
+	if r.rpcs[id] {
+		r.logger.Warn("RPC function registered from Go replaces the Lua function with the same ID", zap.String("id", id))
+	}
+
+	r.goRPCsMu.Lock()
+	r.goRPCs[id] = fn
+	r.goRPCsMu.Unlock()
+}
+
+// HasRPC checks if a Go or Lua RPC function exists with the given ID.
+func (r *Runtime) HasRPC(id string) bool {
+	r.goRPCsMu.RLock()
+	_, ok := r.goRPCs[id]
+	r.goRPCsMu.RUnlock()
+	return ok || r.rpcs[id]
+}
+
+// InvokeRPC runs the RPC function registered with the given ID and returns its result payload.
+func (r *Runtime) InvokeRPC(logger *zap.Logger, ctx *RuntimeContext, id string, payload []byte) ([]byte, error) {
+	r.goRPCsMu.RLock()
+	fn := r.goRPCs[id]
+	r.goRPCsMu.RUnlock()
+	if fn != nil {
+		return fn(logger, ctx, payload)
+	}
+
+	vm, err := r.getVM()
+	if err != nil {
+		return nil, err
+	}
+	defer r.putVM(vm)
+
+	result, err := vm.call(vm.rpcs[id], ctx, lua.LString(payload))
+	if err != nil {
+		return nil, err
+	}
+
+	switch result := result.(type) {
+	case *lua.LNilType:
+		return nil, nil
+	case lua.LString:
+		return []byte(result), nil
+	default:
+		logger.Error("RPC function returned an invalid value", zap.String("id", id), zap.String("value", result.Type().String()))
+		return nil, errors.New("RPC function returned an invalid value")
+	}
+}
+
+// LeaderboardRecordWrite writes a leaderboard record on behalf of the given user. Unlike client writes this is allowed
+// for authoritative leaderboards, so RPC functions and hooks can submit scores the server has validated. Only
+// leaderboards of the context's app can be written to.
+func (r *Runtime) LeaderboardRecordWrite(logger *zap.Logger, ctx *RuntimeContext, ownerID uuid.UUID, write *TLeaderboardRecordWrite) (*LeaderboardRecord, error) {
+	record, _, err := leaderboardRecordWrite(ctx.Context(), logger, r.db, ownerID, "", "", ctx.AppID, write, true, false)
+	return record, err
+}
+
+// HasSessionVars checks if a module registered a function to set session variables on authentication.
+func (r *Runtime) HasSessionVars() bool {
+	return r.sessionVars
+}
+
+// InvokeSessionVars gives the session variables to embed in a user's new tokens, starting from the ones in the
+// authenticate request. Any error means authentication must not continue, but only errSessionVarsRejected is meant
+// for the client.
+func (r *Runtime) InvokeSessionVars(logger *zap.Logger, ctx *RuntimeContext, vars map[string]string) (map[string]string, error) {
+	vm, err := r.getVM()
+	if err != nil {
+		return nil, err
+	}
+	defer r.putVM(vm)
+
+	varsTable := vm.state.CreateTable(0, len(vars))
+	for k, v := range vars {
+		varsTable.RawSetString(k, lua.LString(v))
+	}
+
+	result, err := vm.call(vm.sessionVars, ctx, varsTable)
+	if err != nil {
+		logger.Error("Session variables function failed", zap.Error(err))
+		return nil, errors.New("Could not process request")
+	}
+	if result == lua.LNil {
+		return nil, errSessionVarsRejected
+	}
+	resultTable, ok := result.(*lua.LTable)
+	if !ok {
+		logger.Error("Session variables function returned an invalid value", zap.String("value", result.Type().String()))
+		return nil, errors.New("Could not process request")
+	}
+
+	out := make(map[string]string)
+	resultTable.ForEach(func(k lua.LValue, v lua.LValue) {
+		if k.Type() == lua.LTString && v.Type() == lua.LTString {
+			out[k.String()] = v.String()
+		}
+	})
+	return out, nil
+}
+
+// InvokeBefore runs the before hook for a message type. The returned envelope replaces the incoming one, an error
+// means the request was rejected and must not be processed further.
+func (r *Runtime) InvokeBefore(ctx context.Context, logger *zap.Logger, session *session, messageType string, envelope *Envelope) (*Envelope, error) {
+	vm, err := r.getVM()
+	if err != nil {
+		return nil, err
+	}
+	defer r.putVM(vm)
+
+	envelopeTable, err := r.envelopeToLua(vm.state, envelope)
+	if err != nil {
+		logger.Error("Could not convert envelope for runtime", zap.Error(err))
+		return nil, errors.New("Could not process request")
+	}
+
+	result, err := vm.call(vm.beforeHooks[messageType], newRuntimeContext(ctx, session), envelopeTable)
+	if err != nil {
+		logger.Error("Before hook failed", zap.String("type", messageType), zap.Error(err))
+		return nil, errors.New("Could not process request")
+	}
+	if result == lua.LNil {
+		return nil, errors.New("Request rejected")
+	}
+	resultTable, ok := result.(*lua.LTable)
+	if !ok {
+		logger.Error("Before hook returned an invalid value", zap.String("type", messageType), zap.String("value", result.Type().String()))
+		return nil, errors.New("Could not process request")
+	}
+
+	out := &Envelope{}
+	if err = r.luaToEnvelope(resultTable, out); err != nil {
+		logger.Error("Could not convert before hook result", zap.String("type", messageType), zap.Error(err))
+		return nil, errors.New("Could not process request")
+	}
+	if fmt.Sprintf("%T", out.Payload) != fmt.Sprintf("%T", envelope.Payload) {
+		logger.Error("Before hook changed the message type", zap.String("type", messageType))
+		return nil, errors.New("Could not process request")
+	}
+
+	return out, nil
+}
+
+// QueueAfter runs the after hook for a message type in the background, so the client does not wait for it. The hook
+// is skipped if the after hook limit is reached.
+func (r *Runtime) QueueAfter(logger *zap.Logger, session *session, messageType string, envelope *Envelope) {
+	select {
+	case r.afterSlots <- struct{}{}:
+	default:
+		logger.Warn("Too many after hooks running, skipping after hook", zap.String("type", messageType))
+		return
+	}
+	go func() {
+		defer func() { <-r.afterSlots }()
+		r.InvokeAfter(logger, session, messageType, envelope)
+	}()
+}
+
+// InvokeAfter runs the after hook for a message type with the response sent to the client.
+func (r *Runtime) InvokeAfter(logger *zap.Logger, session *session, messageType string, envelope *Envelope) {
+	vm, err := r.getVM()
+	if err != nil {
+		logger.Error("Could not run after hook", zap.String("type", messageType), zap.Error(err))
+		return
+	}
+	defer r.putVM(vm)
+
+	envelopeTable, err := r.envelopeToLua(vm.state, envelope)
+	if err != nil {
+		logger.Error("Could not convert envelope for runtime", zap.Error(err))
+		return
+	}
+
+	// The hook runs after the request is done, so it is not tied to the request's context.
+	if _, err = vm.call(vm.afterHooks[messageType], newRuntimeContext(context.Background(), session), envelopeTable); err != nil {
+		logger.Warn("After hook failed", zap.String("type", messageType), zap.Error(err))
+	}
+}
+
+func newRuntimeContext(ctx context.Context, session *session) *RuntimeContext {
+	return &RuntimeContext{
+		UserID:    session.userID,
+		Handle:    session.handle.Load(),
+		SessionID: session.id,
+		Lang:      session.lang,
+		AppID:     session.appID,
+		Vars:      session.vars,
+		ctx:       ctx,
+	}
+}
+
+func (vm *runtimeVM) newContext(ctx *RuntimeContext) *lua.LTable {
+	l := vm.state
+	vars := l.CreateTable(0, len(ctx.Vars))
+	for k, v := range ctx.Vars {
+		vars.RawSetString(k, lua.LString(v))
+	}
+
+	table := l.CreateTable(0, 6)
+	table.RawSetString("user_id", lua.LString(ctx.UserID.String()))
+	table.RawSetString("handle", lua.LString(ctx.Handle))
+	table.RawSetString("session_id", lua.LString(ctx.SessionID.String()))
+	table.RawSetString("lang", lua.LString(ctx.Lang))
+	table.RawSetString("app_id", lua.LString(ctx.AppID))
+	table.RawSetString("vars", vars)
+	return table
+}
+
+func (r *Runtime) envelopeToLua(l *lua.LState, envelope *Envelope) (*lua.LTable, error) {
+	payload, err := r.jsonpbMarshaler.MarshalToString(envelope)
+	if err != nil {
+		return nil, err
+	}
+	var data map[string]interface{}
+	if err = json.Unmarshal([]byte(payload), &data); err != nil {
+		return nil, err
+	}
+	return convertValue(l, data).(*lua.LTable), nil
+}
+
+func (r *Runtime) luaToEnvelope(table *lua.LTable, envelope *Envelope) error {
+	payload, err := json.Marshal(convertLuaValue(table))
+	if err != nil {
+		return err
+	}
+	return r.jsonpbUnmarshaler.Unmarshal(bytes.NewReader(payload), envelope)
+}
+
+// call runs a hook or function with the context as its first argument. Nakama module functions it uses act within
+// the same context.
+func (vm *runtimeVM) call(fn *lua.LFunction, ctx *RuntimeContext, args ...lua.LValue) (lua.LValue, error) {
+	vm.context = ctx
+	defer func() { vm.context = nil }()
+	err := vm.callByParam(lua.P{Fn: fn, NRet: 1, Protect: true}, append([]lua.LValue{vm.newContext(ctx)}, args...)...)
+	if err != nil {
+		return lua.LNil, err
+	}
+	result := vm.state.Get(-1)
+	vm.state.Pop(1)
+	return result, nil
+}
+
+// callByParam runs a Lua function, which is stopped with an error if it runs for longer than the call timeout.
+func (vm *runtimeVM) callByParam(p lua.P, args ...lua.LValue) error {
+	if vm.timeout > 0 {
+		ctx, cancel := context.WithTimeout(context.Background(), vm.timeout)
+		vm.state.SetContext(ctx)
+		defer func() {
+			vm.state.RemoveContext()
+			cancel()
+		}()
+	}
+	return vm.state.CallByParam(p, args...)
+}
+
+// runtimeMessageType gives the name hooks are registered under, i.e. "groupcreate" for an Envelope_GroupCreate.
+func runtimeMessageType(envelope *Envelope) string {
+	return strings.ToLower(strings.TrimPrefix(fmt.Sprintf("%T", envelope.Payload), "*server.Envelope_"))
+}
+
+// convertValue turns decoded JSON data into the equivalent Lua value.
+func convertValue(l *lua.LState, v interface{}) lua.LValue {
+	switch v := v.(type) {
+	case nil:
+		return lua.LNil
+	case bool:
+		return lua.LBool(v)
+	case string:
+		return lua.LString(v)
+	case float64:
+		return lua.LNumber(v)
+	case []interface{}:
+		table := l.CreateTable(len(v), 0)
+		for i, e := range v {
+			table.RawSetInt(i+1, convertValue(l, e))
+		}
+		return table
+	case map[string]interface{}:
+		table := l.CreateTable(0, len(v))
+		for k, e := range v {
+			table.RawSetString(k, convertValue(l, e))
+		}
+		return table
+	default:
+		return lua.LNil
+	}
+}
+
+// convertLuaValue turns a Lua value into data that can be encoded as JSON. Tables with a sequence part are arrays.
+func convertLuaValue(lv lua.LValue) interface{} {
+	switch v := lv.(type) {
+	case lua.LBool:
+		return bool(v)
+	case lua.LString:
+		return string(v)
+	case lua.LNumber:
+		return float64(v)
+	case *lua.LTable:
+		if maxn := v.MaxN(); maxn > 0 {
+			array := make([]interface{}, 0, maxn)
+			for i := 1; i <= maxn; i++ {
+				array = append(array, convertLuaValue(v.RawGetInt(i)))
+			}
+			return array
+		}
+		data := make(map[string]interface{})
+		v.ForEach(func(k, e lua.LValue) {
+			data[k.String()] = convertLuaValue(e)
+		})
+		return data
+	default:
+		return nil
+	}
+}
@@ -0,0 +1,247 @@
+// Copyright 2017 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"errors"
+
+	"github.com/satori/go.uuid"
+	"github.com/yuin/gopher-lua"
+	"go.uber.org/zap"
+)
+
+// luaMatchHandlerFunctions must all be present in a table passed to `nakama.register_match`.
+var luaMatchHandlerFunctions = []string{
+	"match_init",
+	"match_join_attempt",
+	"match_join",
+	"match_leave",
+	"match_loop",
+	"match_terminate",
+}
+
+// luaMatchHandler adapts a match handler table registered from Lua. Each match gets a VM of its own which is only used
+// by the match goroutine, so match state never leaves the VM it was created in.
+type luaMatchHandler struct {
+	name       string
+	vm         *runtimeVM
+	table      *lua.LTable
+	dispatcher MatchDispatcher
+	dispatch   *lua.LTable
+}
+
+func (r *Runtime) newLuaMatchHandler(name string) (MatchHandler, error) {
+	vm, err := r.newVM()
+	if err != nil {
+		return nil, err
+	}
+	table, ok := vm.matches[name]
+	if !ok {
+		vm.state.Close()
+		return nil, errors.New("Match handler not found")
+	}
+
+	return &luaMatchHandler{
+		name:  name,
+		vm:    vm,
+		table: table,
+	}, nil
+}
+
+func (h *luaMatchHandler) MatchInit(logger *zap.Logger, params map[string]interface{}) (interface{}, int, error) {
+	results, err := h.call("match_init", 2, convertValue(h.vm.state, params))
+	if err != nil {
+		h.vm.state.Close()
+		return nil, 0, err
+	}
+
+	tickRate, ok := results[1].(lua.LNumber)
+	if !ok && results[1] != lua.LNil {
+		h.vm.state.Close()
+		return nil, 0, errors.New("Match handler returned an invalid tick rate")
+	}
+
+	state := luaMatchState(results[0])
+	if state == nil {
+		h.vm.state.Close()
+	}
+	return state, int(tickRate), nil
+}
+
+func (h *luaMatchHandler) MatchJoinAttempt(logger *zap.Logger, dispatcher MatchDispatcher, tick int64, state interface{}, presence Presence) (interface{}, bool, string) {
+	results, err := h.call("match_join_attempt", 3, h.dispatcherTable(dispatcher), lua.LNumber(tick), state.(lua.LValue), h.presenceTable(presence))
+	if err != nil {
+		logger.Error("Match handler failed", zap.String("function", "match_join_attempt"), zap.Error(err))
+		// Keep the match running with its existing state, but do not let the presence in.
+		return state, false, ""
+	}
+
+	reason := ""
+	if r, ok := results[2].(lua.LString); ok {
+		reason = string(r)
+	}
+	state = luaMatchState(results[0])
+	if state == nil {
+		h.vm.state.Close()
+	}
+	return state, lua.LVAsBool(results[1]), reason
+}
+
+func (h *luaMatchHandler) MatchJoin(logger *zap.Logger, dispatcher MatchDispatcher, tick int64, state interface{}, presences []Presence) interface{} {
+	return h.update(logger, "match_join", h.dispatcherTable(dispatcher), lua.LNumber(tick), state.(lua.LValue), h.presencesTable(presences))
+}
+
+func (h *luaMatchHandler) MatchLeave(logger *zap.Logger, dispatcher MatchDispatcher, tick int64, state interface{}, presences []Presence) interface{} {
+	return h.update(logger, "match_leave", h.dispatcherTable(dispatcher), lua.LNumber(tick), state.(lua.LValue), h.presencesTable(presences))
+}
+
+func (h *luaMatchHandler) MatchLoop(logger *zap.Logger, dispatcher MatchDispatcher, tick int64, state interface{}, messages []*MatchMessage) interface{} {
+	l := h.vm.state
+	messagesTable := l.CreateTable(len(messages), 0)
+	for i, m := range messages {
+		messageTable := l.CreateTable(0, 3)
+		messageTable.RawSetString("sender", h.presenceTable(m.Presence))
+		messageTable.RawSetString("op_code", lua.LNumber(m.OpCode))
+		messageTable.RawSetString("data", lua.LString(m.Data))
+		messagesTable.RawSetInt(i+1, messageTable)
+	}
+
+	return h.update(logger, "match_loop", h.dispatcherTable(dispatcher), lua.LNumber(tick), state.(lua.LValue), messagesTable)
+}
+
+func (h *luaMatchHandler) MatchTerminate(logger *zap.Logger, dispatcher MatchDispatcher, tick int64, state interface{}) {
+	if _, err := h.call("match_terminate", 0, h.dispatcherTable(dispatcher), lua.LNumber(tick), state.(lua.LValue)); err != nil {
+		logger.Error("Match handler failed", zap.String("function", "match_terminate"), zap.Error(err))
+	}
+	h.vm.state.Close()
+}
+
+// update runs a callback which returns the new match state. A failing callback ends the match, as its state can no
+// longer be trusted.
+func (h *luaMatchHandler) update(logger *zap.Logger, fn string, args ...lua.LValue) interface{} {
+	results, err := h.call(fn, 1, args...)
+	if err != nil {
+		logger.Error("Match handler failed", zap.String("function", fn), zap.Error(err))
+		h.vm.state.Close()
+		return nil
+	}
+
+	state := luaMatchState(results[0])
+	if state == nil {
+		h.vm.state.Close()
+	}
+	return state
+}
+
+func (h *luaMatchHandler) call(fn string, nret int, args ...lua.LValue) ([]lua.LValue, error) {
+	l := h.vm.state
+	if err := h.vm.callByParam(lua.P{Fn: h.table.RawGetString(fn), NRet: nret, Protect: true}, args...); err != nil {
+		return nil, err
+	}
+
+	results := make([]lua.LValue, nret)
+	for i := 0; i < nret; i++ {
+		results[i] = l.Get(i - nret)
+	}
+	l.Pop(nret)
+	return results, nil
+}
+
+// dispatcherTable gives Lua access to the match dispatcher. The dispatcher never changes for the lifetime of a match
+// so the table is only built once.
+func (h *luaMatchHandler) dispatcherTable(dispatcher MatchDispatcher) *lua.LTable {
+	if h.dispatch != nil && h.dispatcher == dispatcher {
+		return h.dispatch
+	}
+
+	h.dispatcher = dispatcher
+	h.dispatch = h.vm.state.SetFuncs(h.vm.state.NewTable(), map[string]lua.LGFunction{
+		"broadcast_message": func(l *lua.LState) int {
+			opCode := l.CheckInt64(1)
+			data := l.OptString(2, "")
+			presences, err := h.luaPresences(l.OptTable(3, l.NewTable()))
+			if err != nil {
+				l.ArgError(3, err.Error())
+				return 0
+			}
+
+			dispatcher.Broadcast(opCode, []byte(data), presences)
+			return 0
+		},
+		"match_kick": func(l *lua.LState) int {
+			presences, err := h.luaPresences(l.CheckTable(1))
+			if err != nil {
+				l.ArgError(1, err.Error())
+				return 0
+			}
+
+			dispatcher.Kick(presences)
+			return 0
+		},
+	})
+	return h.dispatch
+}
+
+func (h *luaMatchHandler) presencesTable(presences []Presence) *lua.LTable {
+	table := h.vm.state.CreateTable(len(presences), 0)
+	for i, p := range presences {
+		table.RawSetInt(i+1, h.presenceTable(p))
+	}
+	return table
+}
+
+func (h *luaMatchHandler) presenceTable(presence Presence) *lua.LTable {
+	table := h.vm.state.CreateTable(0, 5)
+	table.RawSetString("user_id", lua.LString(presence.UserID.String()))
+	table.RawSetString("session_id", lua.LString(presence.ID.SessionID.String()))
+	table.RawSetString("node", lua.LString(presence.ID.Node))
+	table.RawSetString("topic", lua.LString(presence.Topic))
+	table.RawSetString("handle", lua.LString(presence.Meta.Handle))
+	return table
+}
+
+func (h *luaMatchHandler) luaPresences(table *lua.LTable) ([]Presence, error) {
+	presences := make([]Presence, 0, table.MaxN())
+	for i := 1; i <= table.MaxN(); i++ {
+		p, ok := table.RawGetInt(i).(*lua.LTable)
+		if !ok {
+			return nil, errors.New("expects a list of presences")
+		}
+		userID, err := uuid.FromString(lua.LVAsString(p.RawGetString("user_id")))
+		if err != nil {
+			return nil, errors.New("expects presences to have a valid user_id")
+		}
+		sessionID, err := uuid.FromString(lua.LVAsString(p.RawGetString("session_id")))
+		if err != nil {
+			return nil, errors.New("expects presences to have a valid session_id")
+		}
+
+		presences = append(presences, Presence{
+			ID:     PresenceID{Node: lua.LVAsString(p.RawGetString("node")), SessionID: sessionID},
+			Topic:  lua.LVAsString(p.RawGetString("topic")),
+			UserID: userID,
+			Meta:   PresenceMeta{Handle: lua.LVAsString(p.RawGetString("handle"))},
+		})
+	}
+	return presences, nil
+}
+
+// luaMatchState keeps Lua state values opaque to the match registry, mapping Lua nil to Go nil to end the match.
+func luaMatchState(state lua.LValue) interface{} {
+	if state == lua.LNil {
+		return nil
+	}
+	return state
+}
@@ -0,0 +1,247 @@
+// Copyright 2017 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"database/sql"
+	"encoding/json"
+	"strings"
+
+	"github.com/satori/go.uuid"
+	"github.com/yuin/gopher-lua"
+	"go.uber.org/zap"
+)
+
+// NakamaModule is the "nakama" Lua module available to all runtime modules through `require("nakama")`.
+type NakamaModule struct {
+	logger        *zap.Logger
+	db            *sql.DB
+	vm            *runtimeVM
+	matchRegistry *MatchRegistry
+}
+
+// NewNakamaModule creates a new NakamaModule bound to a single runtime VM
+func NewNakamaModule(logger *zap.Logger, db *sql.DB, vm *runtimeVM, matchRegistry *MatchRegistry) *NakamaModule {
+	return &NakamaModule{
+		logger:        logger,
+		db:            db,
+		vm:            vm,
+		matchRegistry: matchRegistry,
+	}
+}
+
+func (n *NakamaModule) Loader(l *lua.LState) int {
+	mod := l.SetFuncs(l.NewTable(), map[string]lua.LGFunction{
+		"register_before":          n.registerBefore,
+		"register_after":           n.registerAfter,
+		"register_rpc":             n.registerRPC,
+		"register_match":           n.registerMatch,
+		"register_session_vars":    n.registerSessionVars,
+		"match_create":             n.matchCreate,
+		"leaderboard_record_write": n.leaderboardRecordWrite,
+		"logger_info":              n.loggerInfo,
+		"logger_warn":              n.loggerWarn,
+		"logger_error":             n.loggerError,
+		"json_encode":              n.jsonEncode,
+		"json_decode":              n.jsonDecode,
+		"uuid_v4":                  n.uuidV4,
+	})
+
+	l.Push(mod)
+	return 1
+}
+
+func (n *NakamaModule) registerBefore(l *lua.LState) int {
+	fn := l.CheckFunction(1)
+	messageType := strings.ToLower(l.CheckString(2))
+	if messageType == "" {
+		l.ArgError(2, "expects message type")
+		return 0
+	}
+
+	n.vm.beforeHooks[messageType] = fn
+	return 0
+}
+
+func (n *NakamaModule) registerAfter(l *lua.LState) int {
+	fn := l.CheckFunction(1)
+	messageType := strings.ToLower(l.CheckString(2))
+	if messageType == "" {
+		l.ArgError(2, "expects message type")
+		return 0
+	}
+
+	n.vm.afterHooks[messageType] = fn
+	return 0
+}
+
+func (n *NakamaModule) registerRPC(l *lua.LState) int {
+	fn := l.CheckFunction(1)
+	id := strings.ToLower(l.CheckString(2))
+	if id == "" {
+		l.ArgError(2, "expects RPC ID")
+		return 0
+	}
+
+	n.vm.rpcs[id] = fn
+	return 0
+}
+
+// registerSessionVars sets the function called on each authentication with the context and the session variables the
+// client sent. It returns the variables to embed in the user's tokens, or nil to reject the authentication.
+func (n *NakamaModule) registerSessionVars(l *lua.LState) int {
+	n.vm.sessionVars = l.CheckFunction(1)
+	return 0
+}
+
+func (n *NakamaModule) registerMatch(l *lua.LState) int {
+	name := l.CheckString(1)
+	if name == "" {
+		l.ArgError(1, "expects match handler name")
+		return 0
+	}
+	handler := l.CheckTable(2)
+	for _, fn := range luaMatchHandlerFunctions {
+		if _, ok := handler.RawGetString(fn).(*lua.LFunction); !ok {
+			l.ArgError(2, "expects match handler function "+fn)
+			return 0
+		}
+	}
+
+	n.vm.matches[name] = handler
+	return 0
+}
+
+func (n *NakamaModule) matchCreate(l *lua.LState) int {
+	name := l.CheckString(1)
+	params, ok := convertLuaValue(l.OptTable(2, l.NewTable())).(map[string]interface{})
+	if !ok {
+		l.ArgError(2, "expects params to be a table with string keys")
+		return 0
+	}
+
+	matchID, err := n.matchRegistry.CreateMatch(name, params)
+	if err != nil {
+		l.RaiseError("Could not create match: %v", err.Error())
+		return 0
+	}
+
+	l.Push(lua.LString(matchID.String()))
+	return 1
+}
+
+// leaderboardRecordWrite submits a score from the server, which is also allowed for authoritative leaderboards.
+// Arguments are leaderboard ID, owner user ID, operator ("incr", "decr", "set" or "best"), value, and optionally a
+// metadata table, location and timezone.
+func (n *NakamaModule) leaderboardRecordWrite(l *lua.LState) int {
+	leaderboardID := l.CheckString(1)
+	ownerID, err := uuid.FromString(l.CheckString(2))
+	if err != nil {
+		l.ArgError(2, "expects a valid owner ID")
+		return 0
+	}
+	op := l.CheckString(3)
+	value := l.CheckInt64(4)
+
+	var metadata []byte
+	if metadataTable := l.OptTable(5, nil); metadataTable != nil {
+		metadata, err = json.Marshal(convertLuaValue(metadataTable))
+		if err != nil {
+			l.ArgError(5, "expects metadata to be encodable as JSON")
+			return 0
+		}
+	}
+
+	write, err := NewLeaderboardRecordWrite([]byte(leaderboardID), op, value, l.OptString(6, ""), l.OptString(7, ""), metadata)
+	if err != nil {
+		l.ArgError(3, err.Error())
+		return 0
+	}
+
+	// Writes are limited to the app of the hook or function making them. Match handlers are not called within any
+	// app's context, so they can only write to leaderboards that don't belong to one.
+	appID := ""
+	if n.vm.context != nil {
+		appID = n.vm.context.AppID
+	}
+	record, _, err := leaderboardRecordWrite(n.vm.context.Context(), n.logger, n.db, ownerID, "", "", appID, write, true, false)
+	if err != nil {
+		l.RaiseError("Could not write leaderboard record: %v", err.Error())
+		return 0
+	}
+
+	var recordMetadata interface{}
+	json.Unmarshal(record.Metadata, &recordMetadata)
+
+	table := l.CreateTable(0, 13)
+	table.RawSetString("leaderboard_id", lua.LString(record.LeaderboardId))
+	table.RawSetString("owner_id", lua.LString(ownerID.String()))
+	table.RawSetString("handle", lua.LString(record.Handle))
+	table.RawSetString("lang", lua.LString(record.Lang))
+	table.RawSetString("location", lua.LString(record.Location))
+	table.RawSetString("timezone", lua.LString(record.Timezone))
+	table.RawSetString("rank", lua.LNumber(record.Rank))
+	table.RawSetString("score", lua.LNumber(record.Score))
+	table.RawSetString("num_score", lua.LNumber(record.NumScore))
+	table.RawSetString("metadata", convertValue(l, recordMetadata))
+	table.RawSetString("ranked_at", lua.LNumber(record.RankedAt))
+	table.RawSetString("updated_at", lua.LNumber(record.UpdatedAt))
+	table.RawSetString("expires_at", lua.LNumber(record.ExpiresAt))
+
+	l.Push(table)
+	return 1
+}
+
+func (n *NakamaModule) loggerInfo(l *lua.LState) int {
+	n.logger.Info(l.CheckString(1), zap.String("source", "runtime"))
+	return 0
+}
+
+func (n *NakamaModule) loggerWarn(l *lua.LState) int {
+	n.logger.Warn(l.CheckString(1), zap.String("source", "runtime"))
+	return 0
+}
+
+func (n *NakamaModule) loggerError(l *lua.LState) int {
+	n.logger.Error(l.CheckString(1), zap.String("source", "runtime"))
+	return 0
+}
+
+func (n *NakamaModule) jsonEncode(l *lua.LState) int {
+	data, err := json.Marshal(convertLuaValue(l.CheckAny(1)))
+	if err != nil {
+		l.RaiseError("Could not encode JSON: %v", err.Error())
+		return 0
+	}
+
+	l.Push(lua.LString(data))
+	return 1
+}
+
+func (n *NakamaModule) jsonDecode(l *lua.LState) int {
+	var data interface{}
+	if err := json.Unmarshal([]byte(l.CheckString(1)), &data); err != nil {
+		l.RaiseError("Could not decode JSON: %v", err.Error())
+		return 0
+	}
+
+	l.Push(convertValue(l, data))
+	return 1
+}
+
+func (n *NakamaModule) uuidV4(l *lua.LState) int {
+	l.Push(lua.LString(uuid.NewV4().String()))
+	return 1
+}
@@ -0,0 +1,152 @@
+// Copyright 2017 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/satori/go.uuid"
+	"go.uber.org/zap"
+)
+
+func newTestRuntime(t *testing.T, module string, callTimeoutMs int) *Runtime {
+	dir, err := ioutil.TempDir("", "nakama-runtime")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Modules are compiled when the runtime is created, so they are not needed afterwards.
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "test.lua"), []byte(module), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	config := NewConfig()
+	config.Runtime.Path = dir
+	config.Runtime.CallTimeoutMs = callTimeoutMs
+	logger := zap.NewNop()
+	matchRegistry := NewMatchRegistry(logger, config, NewTrackerService(config.GetName()), nil, nil)
+	runtime, err := NewRuntime(logger, logger, nil, config, matchRegistry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return runtime
+}
+
+func newTestSession(config Config) *session {
+	token := &sessionToken{ID: "token", UserID: uuid.NewV4(), Handle: "handle"}
+	session := NewSession(zap.NewNop(), config, token, "en", sessionFormatProtobuf, nil, newSessionQueueMetrics(), func(*session) {})
+	// Responses are only seen by interceptors, there is no connection to write them to.
+	session.stopped = true
+	return session
+}
+
+func TestRuntimeInvokeBefore(t *testing.T) {
+	module := `
+local nakama = require("nakama")
+nakama.register_before(function(context, envelope) return envelope end, "SelfFetch")
+nakama.register_before(function(context, envelope) return nil end, "SelfUpdate")
+nakama.register_before(function(context, envelope) error("secret detail") end, "UsersFetch")
+nakama.register_before(function(context, envelope) while true do end end, "FriendsList")
+`
+	runtime := newTestRuntime(t, module, 100)
+	session := newTestSession(NewConfig())
+
+	tests := []struct {
+		name     string
+		envelope *Envelope
+		err      string
+	}{
+		{"allowed", &Envelope{CollationId: "1", Payload: &Envelope_SelfFetch{SelfFetch: &TSelfFetch{}}}, ""},
+		{"rejected", &Envelope{CollationId: "2", Payload: &Envelope_SelfUpdate{SelfUpdate: &TSelfUpdate{}}}, "Request rejected"},
+		{"lua error is not exposed", &Envelope{CollationId: "3", Payload: &Envelope_UsersFetch{UsersFetch: &TUsersFetch{}}}, "Could not process request"},
+		{"timeout", &Envelope{CollationId: "4", Payload: &Envelope_FriendsList{FriendsList: &TFriendsList{}}}, "Could not process request"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			messageType := runtimeMessageType(tt.envelope)
+			if !runtime.HasBefore(messageType) {
+				t.Fatalf("no before hook for %v", messageType)
+			}
+			result, err := runtime.InvokeBefore(context.Background(), zap.NewNop(), session, messageType, tt.envelope)
+			if tt.err == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if result.CollationId != tt.envelope.CollationId {
+					t.Fatalf("collation ID %q, expected %q", result.CollationId, tt.envelope.CollationId)
+				}
+				return
+			}
+			if err == nil || err.Error() != tt.err {
+				t.Fatalf("error %v, expected %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestRuntimeMessageType(t *testing.T) {
+	tests := []struct {
+		envelope *Envelope
+		expected string
+	}{
+		{&Envelope{Payload: &Envelope_TopicMessageSend{}}, "topicmessagesend"},
+		{&Envelope{Payload: &Envelope_Logout{}}, "logout"},
+		{&Envelope{}, "<nil>"},
+	}
+	for _, tt := range tests {
+		if messageType := runtimeMessageType(tt.envelope); messageType != tt.expected {
+			t.Errorf("runtimeMessageType() = %q, expected %q", messageType, tt.expected)
+		}
+	}
+}
+
+func TestRuntimeInvokeSessionVars(t *testing.T) {
+	tests := []struct {
+		name     string
+		function string
+		vars     map[string]string
+		err      error
+	}{
+		{"vars set", `function(context, vars) vars.tier = "gold" return vars end`, map[string]string{"region": "eu", "tier": "gold"}, nil},
+		{"rejected", `function(context, vars) return nil end`, nil, errSessionVarsRejected},
+		{"lua error is not exposed", `function(context, vars) error("secret detail") end`, nil, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			module := "local nakama = require(\"nakama\")\nnakama.register_session_vars(" + tt.function + ")\n"
+			runtime := newTestRuntime(t, module, 100)
+			vars, err := runtime.InvokeSessionVars(zap.NewNop(), &RuntimeContext{UserID: uuid.NewV4()}, map[string]string{"region": "eu"})
+			if tt.vars != nil {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if len(vars) != len(tt.vars) || vars["region"] != tt.vars["region"] || vars["tier"] != tt.vars["tier"] {
+					t.Fatalf("vars %v, expected %v", vars, tt.vars)
+				}
+				return
+			}
+			if tt.err != nil && err != tt.err {
+				t.Fatalf("error %v, expected %v", err, tt.err)
+			}
+			if tt.err == nil && (err == nil || err == errSessionVarsRejected || err.Error() != "Could not process request") {
+				t.Fatalf("error %v, expected a generic error", err)
+			}
+		})
+	}
+}
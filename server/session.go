@@ -15,11 +15,19 @@
 package server
 
 import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"hash/fnv"
+	"strings"
 	"sync"
 	"time"
 
 	"fmt"
 
+	"github.com/gogo/protobuf/jsonpb"
 	"github.com/gogo/protobuf/proto"
 	"github.com/gorilla/websocket"
 	"github.com/satori/go.uuid"
@@ -28,58 +36,208 @@ import (
 	"go.uber.org/zap"
 )
 
+const (
+	sessionFormatProtobuf = "protobuf"
+	sessionFormatJSON     = "json"
+
+	sessionQueueFullDropOldest = "drop_oldest"
+)
+
+var errOutgoingQueueFull = errors.New("Outgoing queue full")
+
+var (
+	sessionJSONMarshaler = &jsonpb.Marshaler{
+		EnumsAsInts:  true,
+		EmitDefaults: false,
+		Indent:       "",
+		OrigName:     false,
+	}
+	sessionJSONUnmarshaler = &jsonpb.Unmarshaler{
+		AllowUnknownFields: false,
+	}
+)
+
 type session struct {
 	sync.Mutex
-	logger           *zap.Logger
-	config           Config
-	id               uuid.UUID
-	userID           uuid.UUID
-	handle           *atomic.String
-	lang             string
-	stopped          bool
-	conn             *websocket.Conn
-	pingTicker       *time.Ticker
-	pingTickerStopCh chan (bool)
-	unregister       func(s *session)
+	logger         *zap.Logger
+	config         Config
+	id             uuid.UUID
+	token          *sessionToken
+	userID         uuid.UUID
+	handle         *atomic.String
+	lang           string
+	format         string
+	appID          string
+	vars           map[string]string
+	stopped        bool
+	conn           *websocket.Conn
+	unregister     func(s *session)
+	interceptorsMu sync.Mutex
+	interceptors   map[string]func(*Envelope)
+	// Cancelled when the session stops, so requests still in progress are abandoned.
+	ctx    context.Context
+	cancel context.CancelFunc
+	// Requests being processed, and writer goroutines still running, so shutdown can wait for them.
+	inFlight sync.WaitGroup
+	writers  sync.WaitGroup
+	// Set when the server is shutting down. New requests are refused with this reason.
+	drainReason string
+	// Requests waiting for each request worker. Nil if requests are handled as they arrive.
+	requestChs   []chan *sessionRequest
+	startWorkers sync.Once
+	// Match requests queued or being handled by a worker. Match data only skips the queue when there are none.
+	pendingMatchRequests *atomic.Int32
+	// Nil if requests are not rate limited.
+	rateLimiter *requestRateLimiter
+	// Messages waiting for the writer goroutine, which is the only one writing to the connection.
+	outgoingCh   chan []byte
+	queueMetrics *sessionQueueMetrics
+	// Closed when the current connection should end, so its writer goroutine closes it.
+	stopCh chan struct{}
+	// Written after flushing queued messages when the session is closed by the server. Nil if the connection failed.
+	closeMessage []byte
+	// Empty if sessions cannot be resumed. While detached the connection has been lost, and the session keeps its
+	// presences and queues messages until it is resumed or graceTimer ends it.
+	resumeToken string
+	detached    bool
+	graceTimer  *time.Timer
+	// Receives every outgoing envelope instead of the connection, for sessions that serve a single HTTP request.
+	responseFn func(*Envelope)
 }
 
 // NewSession creates a new session which encapsulates a socket connection
-func NewSession(logger *zap.Logger, config Config, userID uuid.UUID, handle string, lang string, websocketConn *websocket.Conn, unregister func(s *session)) *session {
+func NewSession(logger *zap.Logger, config Config, token *sessionToken, lang string, format string, websocketConn *websocket.Conn, queueMetrics *sessionQueueMetrics, unregister func(s *session)) *session {
 	sessionID := uuid.NewV4()
-	sessionLogger := logger.With(zap.String("uid", userID.String()), zap.String("sid", sessionID.String()))
+	sessionLogger := logger.With(zap.String("uid", token.UserID.String()), zap.String("sid", sessionID.String()))
+	if token.AppID != "" {
+		sessionLogger = sessionLogger.With(zap.String("app", token.AppID))
+	}
+	if len(token.Vars) != 0 {
+		sessionLogger = sessionLogger.With(zap.Any("vars", token.Vars))
+	}
 
 	sessionLogger.Info("New session connected")
 
+	queueSize := config.GetTransport().OutgoingQueueSize
+	if queueSize < 1 {
+		queueSize = 1
+	}
+
+	resumeToken := ""
+	if config.GetTransport().ResumeGraceMs > 0 {
+		resumeToken = newResumeToken()
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	var requestChs []chan *sessionRequest
+	if config.GetTransport().RequestWorkers > 0 {
+		requestChs = make([]chan *sessionRequest, config.GetTransport().RequestWorkers)
+		for i := range requestChs {
+			requestChs[i] = make(chan *sessionRequest, config.GetTransport().RequestQueueSize)
+		}
+	}
+
+	return &session{
+		logger:               sessionLogger,
+		config:               config,
+		id:                   sessionID,
+		token:                token,
+		userID:               token.UserID,
+		handle:               atomic.NewString(token.Handle),
+		lang:                 lang,
+		format:               format,
+		appID:                token.AppID,
+		vars:                 token.Vars,
+		conn:                 websocketConn,
+		stopped:              false,
+		unregister:           unregister,
+		ctx:                  ctx,
+		cancel:               cancel,
+		requestChs:           requestChs,
+		pendingMatchRequests: atomic.NewInt32(0),
+		interceptors:         make(map[string]func(*Envelope)),
+		outgoingCh:           make(chan []byte, queueSize),
+		queueMetrics:         queueMetrics,
+		stopCh:               make(chan struct{}),
+		resumeToken:          resumeToken,
+		rateLimiter:          newRequestRateLimiter(config.GetRequestRateLimit()),
+	}
+}
+
+// newRequestSession creates a session for a single HTTP request, which has no connection and is never registered.
+// Every envelope sent to it is passed to responseFn. The rate limiter is shared by the user's requests, and may be nil.
+func newRequestSession(logger *zap.Logger, config Config, token *sessionToken, lang string, rateLimiter *requestRateLimiter, responseFn func(*Envelope)) *session {
+	sessionID := uuid.NewV4()
+	sessionLogger := logger.With(zap.String("uid", token.UserID.String()), zap.String("sid", sessionID.String()))
+	if token.AppID != "" {
+		sessionLogger = sessionLogger.With(zap.String("app", token.AppID))
+	}
+
 	return &session{
-		logger:           sessionLogger,
-		config:           config,
-		id:               sessionID,
-		userID:           userID,
-		handle:           atomic.NewString(handle),
-		lang:             lang,
-		conn:             websocketConn,
-		stopped:          false,
-		pingTicker:       time.NewTicker(time.Duration(config.GetTransport().PingPeriodMs) * time.Millisecond),
-		pingTickerStopCh: make(chan bool),
-		unregister:       unregister,
-	}
-}
-
-func (s *session) Consume(processRequest func(logger *zap.Logger, session *session, envelope *Envelope)) {
-	defer s.cleanupClosedConnection()
-	s.conn.SetReadLimit(s.config.GetTransport().MaxMessageSizeBytes)
-	s.conn.SetReadDeadline(time.Now().Add(time.Duration(s.config.GetTransport().PongWaitMs) * time.Millisecond))
-	s.conn.SetPongHandler(func(string) error {
-		s.conn.SetReadDeadline(time.Now().Add(time.Duration(s.config.GetTransport().PongWaitMs) * time.Millisecond))
+		logger:       sessionLogger,
+		config:       config,
+		id:           sessionID,
+		token:        token,
+		userID:       token.UserID,
+		handle:       atomic.NewString(token.Handle),
+		lang:         lang,
+		format:       sessionFormatProtobuf,
+		appID:        token.AppID,
+		vars:         token.Vars,
+		stopped:      true,
+		unregister:   func(s *session) {},
+		rateLimiter:  rateLimiter,
+		interceptors: make(map[string]func(*Envelope)),
+		responseFn:   responseFn,
+	}
+}
+
+// Consume reads requests from the current connection until it closes. The client is first told how to resume the
+// session, and whether this connection resumed an earlier one.
+func (s *session) Consume(resumed bool, processRequest func(ctx context.Context, logger *zap.Logger, session *session, envelope *Envelope)) {
+	s.Lock()
+	conn := s.conn
+	stopCh := s.stopCh
+	s.Unlock()
+
+	defer s.cleanupClosedConnection(conn)
+	conn.SetReadLimit(s.config.GetTransport().MaxMessageSizeBytes)
+	conn.SetReadDeadline(time.Now().Add(time.Duration(s.config.GetTransport().PongWaitMs) * time.Millisecond))
+	conn.SetPongHandler(func(string) error {
+		conn.SetReadDeadline(time.Now().Add(time.Duration(s.config.GetTransport().PongWaitMs) * time.Millisecond))
 		return nil
 	})
 
-	// Send an initial ping immediately, then at intervals.
-	s.pingNow()
-	go s.pingPeriodically()
+	var resumeMessage []byte
+	if s.resumeToken != "" {
+		var err error
+		resumeMessage, err = marshalSessionMessage(s.format, &Envelope{Payload: &Envelope_SessionResume{SessionResume: &SessionResume{
+			SessionId:   s.id.Bytes(),
+			ResumeToken: s.resumeToken,
+			Resumed:     resumed,
+		}}})
+		if err != nil {
+			s.logger.Warn("Could not marshall session resume message", zap.Error(err))
+		}
+	}
+	s.writers.Add(1)
+	go func() {
+		s.processOutgoing(conn, stopCh, resumeMessage)
+		s.writers.Done()
+	}()
+
+	// Workers outlive connections, a resumed session keeps the ones it started with.
+	if s.requestChs != nil {
+		s.startWorkers.Do(func() {
+			for _, requestCh := range s.requestChs {
+				go s.processRequests(requestCh, processRequest)
+			}
+		})
+	}
 
 	for {
-		_, data, err := s.conn.ReadMessage()
+		_, data, err := conn.ReadMessage()
 		if err != nil {
 			if websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway, websocket.CloseNoStatusReceived) {
 				s.logger.Warn("Error reading message from client", zap.Error(err))
@@ -88,60 +246,236 @@ func (s *session) Consume(processRequest func(logger *zap.Logger, session *sessi
 		}
 
 		request := &Envelope{}
-		err = proto.Unmarshal(data, request)
+		if s.format == sessionFormatJSON {
+			err = sessionJSONUnmarshaler.Unmarshal(bytes.NewReader(data), request)
+		} else {
+			err = proto.Unmarshal(data, request)
+		}
 		if err != nil {
 			s.logger.Warn("Received malformed payload", zap.Any("data", data))
 			s.Send(ErrorMessage(request.CollationId, UNRECOGNIZED_PAYLOAD, "Unrecognized payload"))
 		} else {
-			// TODO Add session-global context here to cancel in-progress operations when the session is closed.
+			s.Lock()
+			drainReason := s.drainReason
+			if drainReason == "" {
+				s.inFlight.Add(1)
+			}
+			s.Unlock()
+			if drainReason != "" {
+				s.Send(ErrorMessage(request.CollationId, SERVER_SHUTDOWN, drainReason))
+				continue
+			}
+
 			requestLogger := s.logger.With(zap.String("cid", request.CollationId))
-			processRequest(requestLogger, s, request)
+			if s.requestChs == nil || s.bypassWorkers(request) {
+				processRequest(s.ctx, requestLogger, s, request)
+				s.inFlight.Done()
+				continue
+			}
+			// Requests in the same group always go to the same worker, so they are handled in the order they arrive.
+			group := sessionRequestGroup(request)
+			if group == "match" {
+				s.pendingMatchRequests.Inc()
+			}
+			requestCh := s.requestChs[sessionRequestWorker(request, len(s.requestChs))]
+			select {
+			case requestCh <- &sessionRequest{logger: requestLogger, envelope: request, group: group}:
+			case <-s.ctx.Done():
+				s.requestDone(group)
+			}
 		}
 	}
 }
 
-func (s *session) pingPeriodically() {
+// sessionRequest is a request waiting for one of the session's request workers.
+type sessionRequest struct {
+	logger   *zap.Logger
+	envelope *Envelope
+	group    string
+}
+
+// processRequests is a request worker. It runs until the session stops, and requests still queued then are dropped.
+func (s *session) processRequests(requestCh chan *sessionRequest, processRequest func(ctx context.Context, logger *zap.Logger, session *session, envelope *Envelope)) {
 	for {
 		select {
-		case <-s.pingTicker.C:
-			if !s.pingNow() {
-				// If ping fails the session will be stopped, clean up the loop.
-				return
+		case request := <-requestCh:
+			processRequest(s.ctx, request.logger, s, request.envelope)
+			s.requestDone(request.group)
+		case <-s.ctx.Done():
+			for {
+				select {
+				case request := <-requestCh:
+					s.requestDone(request.group)
+				default:
+					return
+				}
 			}
-		case <-s.pingTickerStopCh:
+		}
+	}
+}
+
+// requestDone records that a request given to a worker has been handled or dropped.
+func (s *session) requestDone(group string) {
+	if group == "match" {
+		s.pendingMatchRequests.Dec()
+	}
+	s.inFlight.Done()
+}
+
+// sessionRequestGroups are message type prefixes of requests that depend on each other, such as joining a topic and
+// then sending a message to it. Requests of other types all belong to the user's account, and form one more group.
+var sessionRequestGroups = []string{"friend", "group", "topic", "match", "storage", "leaderboard", "rpc"}
+
+// sessionRequestGroup gives the group of requests this one has to stay in order with.
+func sessionRequestGroup(envelope *Envelope) string {
+	messageType := runtimeMessageType(envelope)
+	for _, prefix := range sessionRequestGroups {
+		if strings.HasPrefix(messageType, prefix) {
+			return prefix
+		}
+	}
+	return "account"
+}
+
+// sessionRequestWorker gives the index of the worker that handles all requests in the same group as this one.
+func sessionRequestWorker(envelope *Envelope, workers int) int {
+	h := fnv.New32a()
+	h.Write([]byte(sessionRequestGroup(envelope)))
+	return int(h.Sum32() % uint32(workers))
+}
+
+// bypassWorkers checks if a request is latency-sensitive, so it is handled as soon as it arrives rather than waiting
+// behind slower requests for a worker. Match data still waits while a match request from the session is pending,
+// so it can't reach a match before the join it follows.
+func (s *session) bypassWorkers(envelope *Envelope) bool {
+	switch envelope.Payload.(type) {
+	case *Envelope_Heartbeat:
+		return true
+	case *Envelope_MatchDataSend:
+		return s.pendingMatchRequests.Load() == 0
+	}
+	return false
+}
+
+// processOutgoing writes queued messages and pings to a connection until stopCh is closed, then closes the
+// connection. It runs in its own goroutine so a slow client never blocks the goroutines sending to it. The first
+// message, if set, is written before any queued ones.
+func (s *session) processOutgoing(conn *websocket.Conn, stopCh chan struct{}, first []byte) {
+	pingTicker := time.NewTicker(time.Duration(s.config.GetTransport().PingPeriodMs) * time.Millisecond)
+	defer pingTicker.Stop()
+
+	// Send an initial ping immediately, then at intervals.
+	if !s.pingNow(conn) {
+		return
+	}
+	if first != nil && !s.write(conn, first) {
+		return
+	}
+
+	for {
+		// An ended connection takes priority, so no queued message is taken to be written to it.
+		select {
+		case <-stopCh:
+			s.flushAndClose(conn)
 			return
+		default:
+		}
+
+		select {
+		case <-stopCh:
+			s.flushAndClose(conn)
+			return
+		case <-pingTicker.C:
+			if !s.pingNow(conn) {
+				return
+			}
+		case payload := <-s.outgoingCh:
+			if !s.write(conn, payload) {
+				return
+			}
 		}
 	}
 }
 
-func (s *session) pingNow() bool {
-	s.Lock()
-	if s.stopped {
-		s.Unlock()
+// write sends one message on the connection. If that fails the connection is closed and the session cleaned up.
+func (s *session) write(conn *websocket.Conn, payload []byte) bool {
+	conn.SetWriteDeadline(time.Now().Add(time.Duration(s.config.GetTransport().WriteWaitMs) * time.Millisecond))
+	if err := conn.WriteMessage(s.messageType(), payload); err != nil {
+		s.logger.Warn("Could not write message. Closing channel", zap.String("remoteAddress", conn.RemoteAddr().String()), zap.Error(err))
+		s.cleanupClosedConnection(conn) // The connection has already failed
+		conn.Close()
 		return false
 	}
-	s.conn.SetWriteDeadline(time.Now().Add(time.Duration(s.config.GetTransport().WriteWaitMs) * time.Millisecond))
-	err := s.conn.WriteMessage(websocket.PingMessage, []byte{})
-	s.Unlock()
+	return true
+}
+
+func (s *session) pingNow(conn *websocket.Conn) bool {
+	conn.SetWriteDeadline(time.Now().Add(time.Duration(s.config.GetTransport().WriteWaitMs) * time.Millisecond))
+	err := conn.WriteMessage(websocket.PingMessage, []byte{})
 	if err != nil {
-		s.logger.Warn("Could not send ping. Closing channel", zap.String("remoteAddress", s.conn.RemoteAddr().String()), zap.Error(err))
-		s.cleanupClosedConnection() // The connection has already failed
+		s.logger.Warn("Could not send ping. Closing channel", zap.String("remoteAddress", conn.RemoteAddr().String()), zap.Error(err))
+		s.cleanupClosedConnection(conn) // The connection has already failed
+		conn.Close()
 		return false
 	}
 
 	// Server heartbeat.
 	err = s.Send(&Envelope{Payload: &Envelope_Heartbeat{&Heartbeat{Timestamp: nowMs()}}})
 	if err != nil {
-		s.logger.Warn("Could not send heartbeat", zap.String("remoteAddress", s.conn.RemoteAddr().String()), zap.Error(err))
+		s.logger.Warn("Could not send heartbeat", zap.String("remoteAddress", conn.RemoteAddr().String()), zap.Error(err))
 	}
 
 	return true
 }
 
+// flushAndClose writes the messages still queued and the close message when the server closed the session, so clients
+// receive responses and kick reasons sent just before. All of it shares one write deadline.
+func (s *session) flushAndClose(conn *websocket.Conn) {
+	s.Lock()
+	closeMessage := s.closeMessage
+	s.Unlock()
+
+	if closeMessage != nil {
+		deadline := time.Now().Add(time.Duration(s.config.GetTransport().WriteWaitMs) * time.Millisecond)
+		conn.SetWriteDeadline(deadline)
+	flush:
+		for {
+			select {
+			case payload := <-s.outgoingCh:
+				if err := conn.WriteMessage(s.messageType(), payload); err != nil {
+					break flush
+				}
+			default:
+				break flush
+			}
+		}
+		if err := conn.WriteControl(websocket.CloseMessage, closeMessage, deadline); err != nil {
+			s.logger.Warn("Could not send close message. Closing prematurely.", zap.String("remoteAddress", conn.RemoteAddr().String()), zap.Error(err))
+		}
+	}
+
+	conn.Close()
+	s.logger.Info("Closed client connection")
+}
+
 func (s *session) Send(envelope *Envelope) error {
+	if envelope.CollationId != "" {
+		s.interceptorsMu.Lock()
+		interceptor := s.interceptors[envelope.CollationId]
+		s.interceptorsMu.Unlock()
+		if interceptor != nil {
+			interceptor(envelope)
+		}
+	}
+
 	s.logger.Debug(fmt.Sprintf("Sending %T message", envelope.Payload), zap.String("collation_id", envelope.CollationId))
 
-	payload, err := proto.Marshal(envelope)
+	if s.responseFn != nil {
+		s.responseFn(envelope)
+		return nil
+	}
+
+	payload, err := marshalSessionMessage(s.format, envelope)
 
 	if err != nil {
 		s.logger.Warn("Could not marshall Response to byte[]", zap.Error(err))
@@ -151,56 +485,213 @@ func (s *session) Send(envelope *Envelope) error {
 	return s.SendBytes(payload)
 }
 
+// interceptResponses passes every envelope sent with the given collation ID to fn before it is written out.
+// The interceptor can modify the envelope in place. Call the returned function to remove the interceptor.
+func (s *session) interceptResponses(collationID string, fn func(*Envelope)) func() {
+	s.interceptorsMu.Lock()
+	s.interceptors[collationID] = fn
+	s.interceptorsMu.Unlock()
+
+	return func() {
+		s.interceptorsMu.Lock()
+		delete(s.interceptors, collationID)
+		s.interceptorsMu.Unlock()
+	}
+}
+
+// SendBytes queues an encoded message for the writer goroutine. When the queue is full the configured policy either
+// drops the oldest queued message, or disconnects the client as too slow and returns errOutgoingQueueFull.
 func (s *session) SendBytes(payload []byte) error {
-	// TODO Improve on mutex usage here.
 	s.Lock()
-	defer s.Unlock()
 	if s.stopped {
+		s.Unlock()
 		return nil
 	}
 
-	s.conn.SetWriteDeadline(time.Now().Add(time.Duration(s.config.GetTransport().WriteWaitMs) * time.Millisecond))
-	err := s.conn.WriteMessage(websocket.BinaryMessage, payload)
-	if err != nil {
-		s.logger.Warn("Could not write message", zap.Error(err))
-		//TODO investigate whether we need to cleanupClosedConnection if write fails
+	select {
+	case s.outgoingCh <- payload:
+		s.Unlock()
+		return nil
+	default:
+	}
+
+	if s.config.GetTransport().OutgoingQueueFullPolicy == sessionQueueFullDropOldest {
+		// Other senders wait on the session lock, and the writer only takes from the queue, so there is room after this.
+		select {
+		case <-s.outgoingCh:
+			s.queueMetrics.dropped.Inc()
+		default:
+		}
+		s.outgoingCh <- payload
+		s.Unlock()
+		return nil
+	}
+	// The connection is replaced when the session is resumed.
+	conn := s.conn
+	s.Unlock()
+
+	if s.closeWithMessage(websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "Outgoing queue full")) {
+		s.queueMetrics.disconnected.Inc()
+		s.logger.Warn("Outgoing queue full, disconnecting slow client", zap.String("remoteAddress", conn.RemoteAddr().String()), zap.Int("size", cap(s.outgoingCh)))
+		s.unregister(s)
 	}
+	return errOutgoingQueueFull
+}
 
-	return err
+// queueLength is the number of messages waiting to be written to the connection.
+func (s *session) queueLength() int {
+	return len(s.outgoingCh)
 }
 
-func (s *session) cleanupClosedConnection() {
+func (s *session) messageType() int {
+	if s.format == sessionFormatJSON {
+		return websocket.TextMessage
+	}
+	return websocket.BinaryMessage
+}
+
+// marshalSessionMessage encodes a message in the wire format of a session, either Protobuf or jsonpb.
+func marshalSessionMessage(format string, msg proto.Message) ([]byte, error) {
+	if format == sessionFormatJSON {
+		var buf bytes.Buffer
+		if err := sessionJSONMarshaler.Marshal(&buf, msg); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+	return proto.Marshal(msg)
+}
+
+// cleanupClosedConnection handles a connection that has failed or been closed by the client. If sessions can be
+// resumed the session is detached for the grace period, otherwise it is stopped. Connections the session has already
+// moved on from are ignored.
+func (s *session) cleanupClosedConnection(conn *websocket.Conn) {
 	s.Lock()
-	if s.stopped {
+	if s.stopped || s.detached || s.conn != conn {
+		s.Unlock()
+		return
+	}
+	close(s.stopCh)
+	if s.resumeToken != "" {
+		s.detached = true
+		s.graceTimer = time.AfterFunc(time.Duration(s.config.GetTransport().ResumeGraceMs)*time.Millisecond, s.expireDetached)
 		s.Unlock()
+		s.logger.Info("Client connection lost, holding session for resume", zap.String("remoteAddress", conn.RemoteAddr().String()))
 		return
 	}
 	s.stopped = true
 	s.Unlock()
+	s.cancel()
 
-	s.logger.Info("Cleaning up closed client connection", zap.String("remoteAddress", s.conn.RemoteAddr().String()))
+	s.logger.Info("Cleaning up closed client connection", zap.String("remoteAddress", conn.RemoteAddr().String()))
+	s.unregister(s)
+}
+
+// expireDetached stops a session that was not resumed within the grace period, which drops its presences.
+func (s *session) expireDetached() {
+	s.Lock()
+	if s.stopped || !s.detached {
+		s.Unlock()
+		return
+	}
+	s.stopped = true
+	s.Unlock()
+	s.cancel()
+
+	s.logger.Info("Session was not resumed within the grace period")
 	s.unregister(s)
-	s.pingTicker.Stop()
-	s.pingTickerStopCh <- true
-	s.conn.Close()
-	s.logger.Info("Closed client connection")
+}
+
+// resume attaches a new connection to the session. Messages queued while detached are written to it. A client may
+// reconnect before its previous connection is found to be lost, in which case that connection is closed and replaced.
+// Returns false if the session has stopped.
+func (s *session) resume(token *sessionToken, conn *websocket.Conn) bool {
+	s.Lock()
+	defer s.Unlock()
+	if s.stopped {
+		return false
+	}
+	if s.detached {
+		s.graceTimer.Stop()
+		s.detached = false
+	} else {
+		// The writer of the previous connection closes it, and its reader then finds the session has moved on.
+		close(s.stopCh)
+	}
+	s.token = token
+	s.conn = conn
+	s.stopCh = make(chan struct{})
+	s.closeMessage = nil
+	return true
+}
+
+// isDetached checks if the session is waiting for the client to resume it.
+func (s *session) isDetached() bool {
+	s.Lock()
+	defer s.Unlock()
+	return s.detached
+}
+
+// kick sends the reason for the disconnect to the client as an error, then closes the connection with it.
+func (s *session) kick(code Error_Code, reason string) {
+	s.Send(ErrorMessage("", code, reason))
+
+	// Close frame reasons are limited to 123 bytes.
+	if len(reason) > 123 {
+		reason = reason[:123]
+	}
+	s.closeWithMessage(websocket.FormatCloseMessage(websocket.ClosePolicyViolation, reason))
+}
+
+// drain tells the client the server is shutting down, and refuses any further requests with the same reason. Requests
+// already in progress are not affected.
+func (s *session) drain(reason string) {
+	s.Lock()
+	s.drainReason = reason
+	s.Unlock()
+	s.Send(ErrorMessage("", SERVER_SHUTDOWN, reason))
 }
 
 func (s *session) close() {
+	s.closeWithMessage([]byte{})
+}
+
+// closeWithMessage stops the session, and has the writer goroutine send the close message once queued messages are
+// written. A detached session has no connection, and is only stopped. Returns false if the session was already stopped.
+func (s *session) closeWithMessage(closeMessage []byte) bool {
 	s.Lock()
 	if s.stopped {
 		s.Unlock()
-		return
+		return false
 	}
 	s.stopped = true
+	if s.detached {
+		s.graceTimer.Stop()
+	} else {
+		s.closeMessage = closeMessage
+		close(s.stopCh)
+	}
 	s.Unlock()
+	s.cancel()
+	return true
+}
 
-	s.pingTicker.Stop()
-	s.pingTickerStopCh <- true
-	err := s.conn.WriteControl(websocket.CloseMessage, []byte{}, time.Now().Add(time.Duration(s.config.GetTransport().WriteWaitMs)*time.Millisecond))
-	if err != nil {
-		s.logger.Warn("Could not send close message. Closing prematurely.", zap.String("remoteAddress", s.conn.RemoteAddr().String()), zap.Error(err))
+// sessionQueueMetrics counts outgoing queue overflows across all sessions.
+type sessionQueueMetrics struct {
+	dropped      *atomic.Int64
+	disconnected *atomic.Int64
+}
+
+func newSessionQueueMetrics() *sessionQueueMetrics {
+	return &sessionQueueMetrics{
+		dropped:      atomic.NewInt64(0),
+		disconnected: atomic.NewInt64(0),
 	}
-	s.conn.Close()
-	s.logger.Info("Closed client connection")
+}
+
+// newResumeToken creates a random token that lets the client resume its session.
+func newResumeToken() string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
 }
@@ -15,10 +15,14 @@
 package server
 
 import (
+	"context"
 	"database/sql"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"math/rand"
+	"net"
 	"net/http"
 	"regexp"
 	"strconv"
@@ -49,6 +53,10 @@ const (
 	errorCouldNotLogin         = "Could not login"
 	errorCouldNotRegister      = "Could not register"
 	errorIDAlreadyInUse        = "ID already in use"
+
+	sessionVarsMaxCount      = 16
+	sessionVarsMaxKeyBytes   = 32
+	sessionVarsMaxValueBytes = 128
 )
 
 var (
@@ -62,35 +70,59 @@ type authenticationService struct {
 	db                *sql.DB
 	statsService      StatsService
 	registry          *SessionRegistry
+	revocationStore   *TokenRevocationStore
+	emailVerifier     *emailVerifier
+	mailSender        MailSender
+	authLimiter       *AuthLimiter
+	gatewayLimiters   *requestRateLimiters
+	runtime           *Runtime
+	keyring           *SessionKeyring
+	apps              *AppRegistry
 	pipeline          *pipeline
 	mux               *mux.Router
+	server            *http.Server
 	hmacSecretByte    []byte
 	upgrader          *websocket.Upgrader
 	socialClient      *social.Client
+	oidcProviders     map[string]*social.OIDCProvider
+	customIDVerifier  CustomIDVerifier
 	random            *rand.Rand
 	jsonpbMarshaler   *jsonpb.Marshaler
 	jsonpbUnmarshaler *jsonpb.Unmarshaler
 }
 
 // NewAuthenticationService creates a new AuthenticationService
-func NewAuthenticationService(logger *zap.Logger, config Config, db *sql.DB, statService StatsService, registry *SessionRegistry, tracker Tracker, messageRouter MessageRouter) *authenticationService {
+func NewAuthenticationService(logger *zap.Logger, config Config, db *sql.DB, statService StatsService, registry *SessionRegistry, tracker Tracker, messageRouter MessageRouter, runtime *Runtime, matchRegistry *MatchRegistry, mailSender MailSender, authLimiter *AuthLimiter, keyring *SessionKeyring, apps *AppRegistry, customIDVerifier CustomIDVerifier) *authenticationService {
 	s := social.NewClient(5 * time.Second)
-	p := NewPipeline(config, db, s, tracker, messageRouter, registry)
+	revocationStore := NewTokenRevocationStore(logger, db)
+	emailVerifier := newEmailVerifier(logger, config, db, mailSender)
+	oidcProviders := newOIDCProviders(logger, config, s)
+	p := NewPipeline(config, db, s, oidcProviders, customIDVerifier, tracker, messageRouter, registry, runtime, matchRegistry, revocationStore, authLimiter, emailVerifier)
 	a := &authenticationService{
-		logger:         logger,
-		config:         config,
-		db:             db,
-		statsService:   statService,
-		registry:       registry,
-		pipeline:       p,
-		hmacSecretByte: []byte(config.GetSession().EncryptionKey),
+		logger:          logger,
+		config:          config,
+		db:              db,
+		statsService:    statService,
+		registry:        registry,
+		revocationStore: revocationStore,
+		emailVerifier:   emailVerifier,
+		mailSender:      mailSender,
+		authLimiter:     authLimiter,
+		gatewayLimiters: newRequestRateLimiters(config.GetRequestRateLimit()),
+		runtime:         runtime,
+		keyring:         keyring,
+		apps:            apps,
+		pipeline:        p,
+		hmacSecretByte:  []byte(config.GetSession().EncryptionKey),
 		upgrader: &websocket.Upgrader{
 			ReadBufferSize:  1024,
 			WriteBufferSize: 1024,
 			CheckOrigin:     func(r *http.Request) bool { return true },
 		},
-		socialClient: s,
-		random:       rand.New(rand.NewSource(time.Now().UnixNano())),
+		socialClient:     s,
+		oidcProviders:    oidcProviders,
+		customIDVerifier: customIDVerifier,
+		random:           rand.New(rand.NewSource(time.Now().UnixNano())),
 		jsonpbMarshaler: &jsonpb.Marshaler{
 			EnumsAsInts:  true,
 			EmitDefaults: false,
@@ -101,6 +133,7 @@ func NewAuthenticationService(logger *zap.Logger, config Config, db *sql.DB, sta
 			AllowUnknownFields: false,
 		},
 	}
+	p.authenticateToken = a.authenticateToken
 
 	a.configure()
 	return a
@@ -133,13 +166,54 @@ func (a *authenticationService) configure() {
 		a.handleAuth(w, r, a.register)
 	}).Methods("POST", "OPTIONS")
 
+	a.mux.HandleFunc("/user/refresh", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "OPTIONS" {
+			return
+		}
+		a.handleAuth(w, r, func(authReq *AuthenticateRequest) ([]byte, string, string, int) {
+			// The server key was already checked by handleAuth.
+			username, _, _ := r.BasicAuth()
+			appID, _ := a.apps.AppForServerKey(username)
+			return a.refresh(r.Context(), appID, authReq)
+		})
+	}).Methods("POST", "OPTIONS")
+
+	a.mux.HandleFunc("/user/password/reset/request", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "OPTIONS" {
+			return
+		}
+		a.handlePasswordResetRequest(w, r)
+	}).Methods("POST", "OPTIONS")
+
+	a.mux.HandleFunc("/user/password/reset", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "OPTIONS" {
+			return
+		}
+		a.handlePasswordReset(w, r)
+	}).Methods("POST", "OPTIONS")
+
+	a.mux.HandleFunc("/user/email/verify", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		if err := a.emailVerifier.verify(r.URL.Query().Get("token")); err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		w.Write([]byte("Email address verified"))
+	}).Methods("GET")
+
+	a.mux.HandleFunc("/.well-known/jwks.json", func(w http.ResponseWriter, r *http.Request) {
+		jwks, _ := json.Marshal(a.keyring.JWKS())
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.Write(jwks)
+	}).Methods("GET")
+
 	a.mux.HandleFunc("/api", func(w http.ResponseWriter, r *http.Request) {
 		if r.Method == "OPTIONS" {
 			return
 		}
 
 		token := r.URL.Query().Get("token")
-		uid, handle, auth := a.authenticateToken(token)
+		authToken, auth := a.authenticateToken(r.Context(), token)
 		if !auth {
 			http.Error(w, "Missing or invalid token", 401)
 			return
@@ -151,6 +225,14 @@ func (a *authenticationService) configure() {
 			lang = "en"
 		}
 
+		format := r.URL.Query().Get("format")
+		if format == "" {
+			format = sessionFormatProtobuf
+		} else if format != sessionFormatProtobuf && format != sessionFormatJSON {
+			http.Error(w, "Invalid format, must be 'protobuf' or 'json'", 400)
+			return
+		}
+
 		conn, err := a.upgrader.Upgrade(w, r, nil)
 		if err != nil {
 			// http.Error is invoked automatically from within the Upgrade func
@@ -158,18 +240,28 @@ func (a *authenticationService) configure() {
 			return
 		}
 
-		a.registry.add(uid, handle, lang, conn, a.pipeline.processRequest)
+		a.registry.add(authToken, lang, format, r.URL.Query().Get("resume"), conn, a.pipeline.processRequest)
 	}).Methods("GET", "OPTIONS")
+
+	a.mux.HandleFunc("/api/{message}", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "OPTIONS" {
+			return
+		}
+		a.handleGateway(w, r, mux.Vars(r)["message"])
+	}).Methods("POST", "OPTIONS")
 }
 
 func (a *authenticationService) StartServer(logger *zap.Logger) {
-	go func() {
-		CORSHeaders := handlers.AllowedHeaders([]string{"Authorization", "Content-Type"})
-		CORSOrigins := handlers.AllowedOrigins([]string{"*"})
+	CORSHeaders := handlers.AllowedHeaders([]string{"Authorization", "Content-Type"})
+	CORSOrigins := handlers.AllowedOrigins([]string{"*"})
 
-		handlerWithCORS := handlers.CORS(CORSHeaders, CORSOrigins)(a.mux)
-		err := http.ListenAndServe(fmt.Sprintf(":%d", a.config.GetPort()), handlerWithCORS)
-		if err != nil {
+	a.server = &http.Server{
+		Addr:    fmt.Sprintf(":%d", a.config.GetPort()),
+		Handler: handlers.CORS(CORSHeaders, CORSOrigins)(a.mux),
+	}
+	go func() {
+		err := listenAndServe(logger, a.server, a.config.GetTLS().Client)
+		if err != nil && err != http.ErrServerClosed {
 			logger.Fatal("Client listener failed", zap.Error(err))
 		}
 	}()
@@ -181,20 +273,236 @@ func (a *authenticationService) handleAuth(w http.ResponseWriter, r *http.Reques
 
 	w.Header().Set("Content-Type", "application/octet-stream")
 
+	if !a.authLimiter.AllowIP(remoteIP(r)) {
+		a.sendAuthError(w, r, "Too many requests, try again later", 429, nil)
+		return
+	}
+
+	authReq := &AuthenticateRequest{}
+	appID, ok := a.decodeRequest(w, r, authReq)
+	if !ok {
+		return
+	}
+
+	if identifier := authRequestIdentifier(authReq); identifier != "" && !a.authLimiter.AllowIdentifier(identifier) {
+		a.sendAuthError(w, r, "Too many requests for this account, try again later", 429, authReq)
+		return
+	}
+
+	if errString := validateSessionVars(authReq.Vars); errString != "" {
+		a.sendAuthError(w, r, errString, 400, authReq)
+		return
+	}
+
+	userID, handle, errString, errCode := retrieveUserID(authReq)
+	if errString != "" {
+		a.logger.Debug("Could not retrieve user ID", zap.String("error", errString), zap.Int("code", errCode))
+		a.sendAuthError(w, r, errString, errCode, authReq)
+		return
+	}
+
+	uid, _ := uuid.FromBytes(userID)
+
+	vars := authReq.Vars
+	if a.runtime.HasSessionVars() {
+		var err error
+		vars, err = a.runtime.InvokeSessionVars(a.logger, &RuntimeContext{UserID: uid, Handle: handle, AppID: appID, Vars: vars, ctx: r.Context()}, vars)
+		if err == errSessionVarsRejected {
+			a.logger.Debug("Session variables rejected by runtime", zap.String("uid", uid.String()))
+			a.sendAuthError(w, r, err.Error(), 401, authReq)
+			return
+		} else if err != nil {
+			a.logger.Error("Could not set session variables", zap.String("uid", uid.String()), zap.Error(err))
+			a.sendAuthError(w, r, errorCouldNotLogin, 500, authReq)
+			return
+		}
+		if errString := validateSessionVars(vars); errString != "" {
+			a.logger.Error("Invalid session variables from runtime", zap.String("error", errString))
+			a.sendAuthError(w, r, errorCouldNotLogin, 500, authReq)
+			return
+		}
+	}
+
+	// The session and refresh token share a family so logging out revokes both.
+	familyID := uuid.NewV4().String()
+	signedToken := a.generateToken(uid, handle, appID, vars, familyID, tokenTypeSession, a.config.GetSession().TokenExpiryMs)
+	refreshToken := a.generateToken(uid, handle, appID, vars, familyID, tokenTypeRefresh, a.config.GetSession().RefreshTokenExpiryMs)
+
+	authResponse := &AuthenticateResponse{CollationId: authReq.CollationId, Payload: &AuthenticateResponse_Session_{&AuthenticateResponse_Session{Token: signedToken, RefreshToken: refreshToken}}}
+	a.sendAuthResponse(w, r, 200, authResponse)
+}
+
+func (a *authenticationService) handlePasswordResetRequest(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/octet-stream")
+
+	if !a.authLimiter.AllowIP(remoteIP(r)) {
+		a.sendAuthError(w, r, "Too many requests, try again later", 429, nil)
+		return
+	}
+
+	resetReq := &PasswordResetRequest{}
+	if _, ok := a.decodeRequest(w, r, resetReq); !ok {
+		return
+	}
+
+	email := strings.ToLower(resetReq.Email)
+	if email == "" {
+		a.sendRequestError(w, r, resetReq.CollationId, "Email address is required", 400)
+		return
+	} else if !emailRegex.MatchString(email) {
+		a.sendRequestError(w, r, resetReq.CollationId, "Invalid email address format", 400)
+		return
+	}
+
+	if !a.authLimiter.AllowIdentifier("email:" + email) {
+		a.sendRequestError(w, r, resetReq.CollationId, "Too many requests for this account, try again later", 429)
+		return
+	}
+
+	var userID []byte
+	var password []byte
+	err := a.db.QueryRow("SELECT id, password FROM users WHERE email = $1 AND disabled_at = 0", email).
+		Scan(&userID, &password)
+	if err == nil {
+		token := a.generatePasswordResetToken(uuid.FromBytesOrNil(userID), password)
+		body := fmt.Sprintf("A password reset was requested for your account. Use the code below to choose a new password, it expires in %v minutes.\r\n\r\n%v\r\n",
+			a.config.GetMail().PasswordResetTokenExpiryMs/60000, token)
+		go func() {
+			if err := a.mailSender.Send(email, "Reset your password", body); err != nil {
+				a.logger.Error("Could not send password reset", zap.Error(err))
+			}
+		}()
+	} else if err != sql.ErrNoRows {
+		a.logger.Error("Could not look up password reset email", zap.Error(err))
+	}
+
+	// Always report success, so this can't be used to find out which email addresses have accounts.
+	a.sendAuthResponse(w, r, 200, &AuthenticateResponse{CollationId: resetReq.CollationId})
+}
+
+func (a *authenticationService) handlePasswordReset(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/octet-stream")
+
+	if !a.authLimiter.AllowIP(remoteIP(r)) {
+		a.sendAuthError(w, r, "Too many requests, try again later", 429, nil)
+		return
+	}
+
+	resetReq := &PasswordReset{}
+	if _, ok := a.decodeRequest(w, r, resetReq); !ok {
+		return
+	}
+
+	if resetReq.Token == "" {
+		a.sendRequestError(w, r, resetReq.CollationId, "Password reset token is required", 400)
+		return
+	} else if len(resetReq.Password) < 8 {
+		a.sendRequestError(w, r, resetReq.CollationId, "Password must be longer than 8 characters", 400)
+		return
+	}
+
+	userID, currentPassword, ok := a.parsePasswordResetToken(resetReq.Token)
+	if !ok {
+		a.sendRequestError(w, r, resetReq.CollationId, "Password reset token is invalid or has expired", 401)
+		return
+	}
+
+	if !a.authLimiter.AllowIdentifier("uid:" + userID.String()) {
+		a.sendRequestError(w, r, resetReq.CollationId, "Too many requests for this account, try again later", 429)
+		return
+	}
+
+	hashedPassword, _ := bcrypt.GenerateFromPassword([]byte(resetReq.Password), bcrypt.DefaultCost)
+	res, err := a.db.Exec("UPDATE users SET password = $2, updated_at = $3, tokens_valid_after = $3 WHERE id = $1 AND password = $4",
+		userID.Bytes(), hashedPassword, nowMs(), currentPassword)
+	if err != nil {
+		a.logger.Error("Could not reset password", zap.Error(err))
+		a.sendRequestError(w, r, resetReq.CollationId, "Could not reset password", 500)
+		return
+	} else if count, _ := res.RowsAffected(); count == 0 {
+		a.sendRequestError(w, r, resetReq.CollationId, "Password reset token is invalid or has expired", 401)
+		return
+	}
+
+	// Existing tokens were rejected by the update, connected clients have to log in again too.
+	a.registry.disconnectUser(userID, AUTH_ERROR, "Password changed")
+	a.logger.Info("Password reset", zap.String("uid", userID.String()))
+	a.sendAuthResponse(w, r, 200, &AuthenticateResponse{CollationId: resetReq.CollationId})
+}
+
+// generatePasswordResetToken signs the token with the user's current password hash as part of the key, so it stops
+// working as soon as the password changes.
+func (a *authenticationService) generatePasswordResetToken(userID uuid.UUID, password []byte) string {
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"typ": tokenTypePasswordReset,
+		"uid": userID.String(),
+		"exp": time.Now().UTC().Add(time.Duration(a.config.GetMail().PasswordResetTokenExpiryMs) * time.Millisecond).Unix(),
+	})
+	signedToken, _ := token.SignedString(append(append([]byte{}, a.hmacSecretByte...), password...))
+	return signedToken
+}
+
+func (a *authenticationService) parsePasswordResetToken(tokenString string) (uuid.UUID, []byte, bool) {
+	var userID uuid.UUID
+	var password []byte
+	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("Unexpected signing method: %v", token.Header["alg"])
+		}
+		claims, ok := token.Claims.(jwt.MapClaims)
+		if !ok {
+			return nil, errors.New("Unexpected claims")
+		}
+		if typ, _ := claims["typ"].(string); typ != tokenTypePasswordReset {
+			return nil, errors.New("Unexpected token type")
+		}
+		uid, _ := claims["uid"].(string)
+		var err error
+		if userID, err = uuid.FromString(uid); err != nil {
+			return nil, err
+		}
+		if err = a.db.QueryRow("SELECT password FROM users WHERE id = $1 AND disabled_at = 0", userID.Bytes()).Scan(&password); err != nil {
+			return nil, err
+		}
+		return append(append([]byte{}, a.hmacSecretByte...), password...), nil
+	})
+	if err != nil || !token.Valid {
+		a.logger.Debug("Password reset token invalid", zap.Error(err))
+		return uuid.Nil, nil, false
+	}
+
+	return userID, password, true
+}
+
+// decodeRequest checks the server key and decodes a Protobuf or JSON request body. Returns the ID of the app the
+// server key belongs to. Errors are sent to the client.
+func (a *authenticationService) decodeRequest(w http.ResponseWriter, r *http.Request, request proto.Message) (string, bool) {
 	username, _, ok := r.BasicAuth()
 	if !ok {
 		a.sendAuthError(w, r, "Missing or invalid authentication header", 400, nil)
-		return
-	} else if username != a.config.GetTransport().ServerKey {
+		return "", false
+	}
+	appID, ok := a.apps.AppForServerKey(username)
+	if !ok {
 		a.sendAuthError(w, r, "Invalid server key", 401, nil)
-		return
+		return "", false
+	}
+
+	if errString := a.decodeBody(w, r, request); errString != "" {
+		a.sendAuthError(w, r, errString, 400, nil)
+		return "", false
 	}
 
+	return appID, true
+}
+
+// decodeBody decodes a Protobuf or JSON request body, depending on its content type. Returns an error message safe to
+// send to clients if it could not.
+func (a *authenticationService) decodeBody(w http.ResponseWriter, r *http.Request, request proto.Message) string {
 	data, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, a.config.GetTransport().MaxMessageSizeBytes))
 	if err != nil {
 		a.logger.Warn("Could not read body", zap.Error(err))
-		a.sendAuthError(w, r, "Could not read request body", 400, nil)
-		return
+		return "Could not read request body"
 	}
 
 	contentType := r.Header.Get("content-type")
@@ -204,41 +512,21 @@ func (a *authenticationService) handleAuth(w http.ResponseWriter, r *http.Reques
 	mediaType, _, err := mime.ParseMediaType(contentType)
 	if err != nil {
 		a.logger.Warn("Could not decode content type header", zap.Error(err))
-		a.sendAuthError(w, r, "Could not decode content type header", 400, nil)
-		return
+		return "Could not decode content type header"
 	}
 
-	authReq := &AuthenticateRequest{}
 	switch mediaType {
 	case "application/json":
-		err = a.jsonpbUnmarshaler.Unmarshal(bytes.NewReader(data), authReq)
+		err = a.jsonpbUnmarshaler.Unmarshal(bytes.NewReader(data), request)
 	default:
-		err = proto.Unmarshal(data, authReq)
+		err = proto.Unmarshal(data, request)
 	}
 	if err != nil {
 		a.logger.Warn("Could not decode body", zap.Error(err))
-		a.sendAuthError(w, r, "Could not decode body", 400, nil)
-		return
-	}
-
-	userID, handle, errString, errCode := retrieveUserID(authReq)
-	if errString != "" {
-		a.logger.Debug("Could not retrieve user ID", zap.String("error", errString), zap.Int("code", errCode))
-		a.sendAuthError(w, r, errString, errCode, authReq)
-		return
+		return "Could not decode body"
 	}
 
-	uid, _ := uuid.FromBytes(userID)
-
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-		"uid": uid.String(),
-		"exp": time.Now().UTC().Add(time.Duration(a.config.GetSession().TokenExpiryMs) * time.Millisecond).Unix(),
-		"han": handle,
-	})
-	signedToken, _ := token.SignedString(a.hmacSecretByte)
-
-	authResponse := &AuthenticateResponse{CollationId: authReq.CollationId, Payload: &AuthenticateResponse_Session_{&AuthenticateResponse_Session{Token: signedToken}}}
-	a.sendAuthResponse(w, r, 200, authResponse)
+	return ""
 }
 
 func (a *authenticationService) sendAuthError(w http.ResponseWriter, r *http.Request, error string, errorCode int, authRequest *AuthenticateRequest) {
@@ -254,7 +542,20 @@ func (a *authenticationService) sendAuthError(w http.ResponseWriter, r *http.Req
 	a.sendAuthResponse(w, r, errorCode, authResponse)
 }
 
+func (a *authenticationService) sendRequestError(w http.ResponseWriter, r *http.Request, collationID string, error string, errorCode int) {
+	authResponse := &AuthenticateResponse{CollationId: collationID, Payload: &AuthenticateResponse_Error_{&AuthenticateResponse_Error{
+		Code:    int32(AUTH_ERROR),
+		Message: error,
+	}}}
+	a.sendAuthResponse(w, r, errorCode, authResponse)
+}
+
 func (a *authenticationService) sendAuthResponse(w http.ResponseWriter, r *http.Request, code int, response *AuthenticateResponse) {
+	a.sendResponse(w, r, code, response)
+}
+
+// sendResponse writes a Protobuf or JSON response, depending on the accept header of the request.
+func (a *authenticationService) sendResponse(w http.ResponseWriter, r *http.Request, code int, response proto.Message) {
 	accept := r.Header.Get("accept")
 	if accept == "" {
 		accept = "application/octet-stream"
@@ -277,7 +578,7 @@ func (a *authenticationService) sendAuthResponse(w http.ResponseWriter, r *http.
 		payload, err = proto.Marshal(response)
 	}
 	if err != nil {
-		a.logger.Error("Could not marshal AuthenticateResponse", zap.Error(err))
+		a.logger.Error("Could not marshal response", zap.Error(err))
 		return
 	}
 
@@ -286,6 +587,48 @@ func (a *authenticationService) sendAuthResponse(w http.ResponseWriter, r *http.
 	w.Write(payload)
 }
 
+// refresh exchanges a refresh token for a new session. Tokens can only be refreshed through the app they were issued for.
+func (a *authenticationService) refresh(ctx context.Context, appID string, authReq *AuthenticateRequest) ([]byte, string, string, int) {
+	refreshToken := authReq.GetRefresh()
+	if refreshToken == "" {
+		return nil, "", "Refresh token is required", 400
+	}
+
+	token, ok := a.parseToken(ctx, refreshToken, tokenTypeRefresh)
+	if !ok || token.AppID != appID {
+		return nil, "", "Refresh token invalid", 401
+	}
+
+	var handle string
+	var disabledAt int64
+	var tokensValidAfter int64
+	err := a.db.QueryRowContext(ctx, "SELECT handle, disabled_at, tokens_valid_after FROM users WHERE id = $1", token.UserID.Bytes()).
+		Scan(&handle, &disabledAt, &tokensValidAfter)
+	if err != nil {
+		a.logger.Warn(errorCouldNotLogin, zap.Error(err))
+		return nil, "", errorIDNotFound, 401
+	}
+	if disabledAt != 0 {
+		if message := a.disabledMessage(token.UserID); message != "" {
+			return nil, "", message, 401
+		}
+	}
+	if token.IssuedAt < tokensValidAfter {
+		return nil, "", "Refresh token invalid", 401
+	}
+
+	if len(authReq.Vars) == 0 {
+		authReq.Vars = token.Vars
+	}
+
+	// Refresh tokens are single use, a new one is issued alongside the new session token.
+	if !a.revocationStore.Revoke(token.ID, token.ExpiresAt) {
+		return nil, "", "Refresh token invalid", 401
+	}
+
+	return token.UserID.Bytes(), handle, "", 200
+}
+
 func (a *authenticationService) login(authReq *AuthenticateRequest) ([]byte, string, string, int) {
 	// Route to correct login handler
 	var loginFunc func(authReq *AuthenticateRequest) ([]byte, string, int64, string, int)
@@ -304,6 +647,8 @@ func (a *authenticationService) login(authReq *AuthenticateRequest) ([]byte, str
 		loginFunc = a.loginEmail
 	case *AuthenticateRequest_Custom:
 		loginFunc = a.loginCustom
+	case *AuthenticateRequest_Oidc:
+		loginFunc = a.loginOIDC
 	default:
 		return nil, "", errorInvalidPayload, 400
 	}
@@ -311,7 +656,10 @@ func (a *authenticationService) login(authReq *AuthenticateRequest) ([]byte, str
 	userID, handle, disabledAt, message, status := loginFunc(authReq)
 
 	if disabledAt != 0 {
-		return nil, "", "ID disabled", 401
+		// The user may have been disabled only until a time that has now passed.
+		if message := a.disabledMessage(uuid.FromBytesOrNil(userID)); message != "" {
+			return nil, "", message, 401
+		}
 	}
 
 	return userID, handle, message, status
@@ -469,6 +817,11 @@ func (a *authenticationService) loginEmail(authReq *AuthenticateRequest) ([]byte
 		return nil, "", 0, "Invalid email address, must be 10-255 bytes", 400
 	}
 
+	identifier := authRequestIdentifier(authReq)
+	if a.authLimiter.IsLockedOut(identifier) {
+		return nil, "", 0, "Account temporarily locked after too many failed login attempts", 403
+	}
+
 	var userID []byte
 	var handle string
 	var hashedPassword []byte
@@ -484,27 +837,27 @@ func (a *authenticationService) loginEmail(authReq *AuthenticateRequest) ([]byte
 	err = bcrypt.CompareHashAndPassword(hashedPassword, []byte(email.Password))
 	if err != nil {
 		a.logger.Warn("Invalid credentials", zap.Error(err))
+		a.authLimiter.Fail(identifier)
 		return nil, "", 0, "Invalid credentials", 401
 	}
+	a.authLimiter.Succeed(identifier)
 
 	return userID, handle, disabledAt, "", 200
 }
 
 func (a *authenticationService) loginCustom(authReq *AuthenticateRequest) ([]byte, string, int64, string, int) {
-	customID := authReq.GetCustom()
-	if customID == "" {
-		return nil, "", 0, "Custom ID is required", 400
-	} else if invalidCharsRegex.MatchString(customID) {
-		return nil, "", 0, "Invalid custom ID, no spaces or control characters allowed", 400
-	} else if len(customID) < 10 || len(customID) > 64 {
-		return nil, "", 0, "Invalid custom ID, must be 10-64 bytes", 400
+	profile, err := verifyCustomID(a.logger, a.customIDVerifier, authReq.GetCustom())
+	if err == errCustomIDRejected {
+		return nil, "", 0, errorCouldNotLogin, 401
+	} else if err != nil {
+		return nil, "", 0, err.Error(), 400
 	}
 
 	var userID []byte
 	var handle string
 	var disabledAt int64
-	err := a.db.QueryRow("SELECT id, handle, disabled_at FROM users WHERE custom_id = $1",
-		customID).
+	err = a.db.QueryRow("SELECT id, handle, disabled_at FROM users WHERE custom_id = $1",
+		profile.ID).
 		Scan(&userID, &handle, &disabledAt)
 	if err != nil {
 		a.logger.Warn(errorCouldNotLogin, zap.Error(err))
@@ -514,6 +867,36 @@ func (a *authenticationService) loginCustom(authReq *AuthenticateRequest) ([]byt
 	return userID, handle, disabledAt, "", 200
 }
 
+func (a *authenticationService) loginOIDC(authReq *AuthenticateRequest) ([]byte, string, int64, string, int) {
+	oidc := authReq.GetOidc()
+	if oidc == nil || oidc.Token == "" {
+		return nil, "", 0, "ID token is required", 400
+	}
+	provider, ok := a.oidcProviders[oidc.Provider]
+	if !ok {
+		return nil, "", 0, "Unknown OpenID Connect provider", 400
+	}
+
+	profile, err := provider.Verify(oidc.Token)
+	if err != nil {
+		a.logger.Warn("Could not verify OpenID Connect ID token", zap.String("provider", oidc.Provider), zap.Error(err))
+		return nil, "", 0, errorCouldNotLogin, 401
+	}
+
+	var userID []byte
+	var handle string
+	var disabledAt int64
+	err = a.db.QueryRow("SELECT id, handle, disabled_at FROM users WHERE oidc_id = $1",
+		oidcIdentity(profile)).
+		Scan(&userID, &handle, &disabledAt)
+	if err != nil {
+		a.logger.Warn("Could not login with OpenID Connect profile", zap.Error(err))
+		return nil, "", 0, errorIDNotFound, 401
+	}
+
+	return userID, handle, disabledAt, "", 200
+}
+
 func (a *authenticationService) register(authReq *AuthenticateRequest) ([]byte, string, string, int) {
 	// Route to correct register handler
 	var registerFunc func(tx *sql.Tx, authReq *AuthenticateRequest) ([]byte, string, string, int)
@@ -533,6 +916,8 @@ func (a *authenticationService) register(authReq *AuthenticateRequest) ([]byte,
 		registerFunc = a.registerEmail
 	case *AuthenticateRequest_Custom:
 		registerFunc = a.registerCustom
+	case *AuthenticateRequest_Oidc:
+		registerFunc = a.registerOIDC
 	default:
 		return nil, "", errorInvalidPayload, 400
 	}
@@ -562,6 +947,9 @@ func (a *authenticationService) register(authReq *AuthenticateRequest) ([]byte,
 	}
 
 	a.logger.Info("Registration complete", zap.String("uid", uuid.FromBytesOrNil(userID).String()))
+	if email := authReq.GetEmail(); email != nil {
+		a.emailVerifier.sendVerification(uuid.FromBytesOrNil(userID), strings.ToLower(email.Email))
+	}
 	return userID, handle, errorMessage, errorCode
 }
 
@@ -660,7 +1048,7 @@ WHERE NOT EXISTS
 	}
 
 	l := a.logger.With(zap.String("user_id", uuid.FromBytesOrNil(userID).String()))
-	a.pipeline.addFacebookFriends(l, userID, accessToken)
+	a.pipeline.addFacebookFriends(context.Background(), l, userID, accessToken)
 
 	err = a.addUserEdgeMetadata(tx, userID, updatedAt)
 	if err != nil {
@@ -879,23 +1267,48 @@ WHERE NOT EXISTS
 }
 
 func (a *authenticationService) registerCustom(tx *sql.Tx, authReq *AuthenticateRequest) ([]byte, string, string, int) {
-	customID := authReq.GetCustom()
-	if customID == "" {
-		return nil, "", "Custom ID is required", 400
-	} else if invalidCharsRegex.MatchString(customID) {
-		return nil, "", "Invalid custom ID, no spaces or control characters allowed", 400
-	} else if len(customID) < 10 || len(customID) > 64 {
-		return nil, "", "Invalid custom ID, must be 10-64 bytes", 400
+	profile, err := verifyCustomID(a.logger, a.customIDVerifier, authReq.GetCustom())
+	if err == errCustomIDRejected {
+		return nil, "", errorCouldNotRegister, 401
+	} else if err != nil {
+		return nil, "", err.Error(), 400
+	}
+
+	// Profile fields from a custom ID verifier are used when they are valid, and the handle is still available.
+	handle := a.generateHandle()
+	if profile.Handle != "" && len(profile.Handle) <= 20 && !invalidCharsRegex.MatchString(profile.Handle) {
+		var exists int
+		err = tx.QueryRow("SELECT 1 FROM users WHERE handle = $1", profile.Handle).Scan(&exists)
+		if err == sql.ErrNoRows {
+			handle = profile.Handle
+		} else if err != nil {
+			a.logger.Warn("Could not register new custom profile, handle query error", zap.Error(err))
+			return nil, "", errorCouldNotRegister, 401
+		}
+	}
+	var fullname interface{}
+	if profile.Fullname != "" && len(profile.Fullname) <= 70 {
+		fullname = profile.Fullname
+	}
+	var avatarURL interface{}
+	if profile.AvatarURL != "" && len(profile.AvatarURL) <= 255 {
+		avatarURL = profile.AvatarURL
+	}
+	lang := "en"
+	if profile.Lang != "" && len(profile.Lang) <= 18 {
+		lang = profile.Lang
 	}
 
 	updatedAt := nowMs()
 	userID := uuid.NewV4().Bytes()
-	handle := a.generateHandle()
 	res, err := tx.Exec(`
-INSERT INTO users (id, handle, custom_id, created_at, updated_at)
+INSERT INTO users (id, handle, custom_id, fullname, avatar_url, lang, created_at, updated_at)
 SELECT $1 AS id,
 	 $2 AS handle,
 	 $3 AS custom_id,
+	 $5 AS fullname,
+	 $6 AS avatar_url,
+	 $7 AS lang,
 	 $4 AS created_at,
 	 $4 AS updated_at
 WHERE NOT EXISTS
@@ -904,8 +1317,11 @@ WHERE NOT EXISTS
  WHERE custom_id = $3)`,
 		userID,
 		handle,
-		customID,
-		updatedAt)
+		profile.ID,
+		updatedAt,
+		fullname,
+		avatarURL,
+		lang)
 
 	if err != nil {
 		a.logger.Warn("Could not register new custom profile, query error", zap.Error(err))
@@ -924,6 +1340,121 @@ WHERE NOT EXISTS
 	return userID, handle, "", 200
 }
 
+func (a *authenticationService) registerOIDC(tx *sql.Tx, authReq *AuthenticateRequest) ([]byte, string, string, int) {
+	oidc := authReq.GetOidc()
+	if oidc == nil || oidc.Token == "" {
+		return nil, "", "ID token is required", 400
+	}
+	provider, ok := a.oidcProviders[oidc.Provider]
+	if !ok {
+		return nil, "", "Unknown OpenID Connect provider", 400
+	}
+
+	profile, err := provider.Verify(oidc.Token)
+	if err != nil {
+		a.logger.Warn("Could not verify OpenID Connect ID token", zap.String("provider", oidc.Provider), zap.Error(err))
+		return nil, "", errorCouldNotRegister, 401
+	}
+	oidcID := oidcIdentity(profile)
+	if len(oidcID) > 255 {
+		return nil, "", "Invalid OpenID Connect identity, must be at most 255 bytes", 400
+	}
+
+	updatedAt := nowMs()
+	userID := uuid.NewV4().Bytes()
+	handle := a.generateHandle()
+	res, err := tx.Exec(`
+INSERT INTO users (id, handle, oidc_id, created_at, updated_at)
+SELECT $1 AS id,
+	 $2 AS handle,
+	 $3 AS oidc_id,
+	 $4 AS created_at,
+	 $4 AS updated_at
+WHERE NOT EXISTS
+(SELECT id
+ FROM users
+ WHERE oidc_id = $3)`,
+		userID,
+		handle,
+		oidcID,
+		updatedAt)
+
+	if err != nil {
+		a.logger.Warn("Could not register new OpenID Connect profile, query error", zap.Error(err))
+		return nil, "", errorCouldNotRegister, 401
+	}
+	if rowsAffected, _ := res.RowsAffected(); rowsAffected == 0 {
+		a.logger.Warn("Could not register new OpenID Connect profile, rows affected error")
+		return nil, "", errorIDAlreadyInUse, 401
+	}
+
+	err = a.addUserEdgeMetadata(tx, userID, updatedAt)
+	if err != nil {
+		return nil, "", errorCouldNotRegister, 401
+	}
+
+	return userID, handle, "", 200
+}
+
+// authRequestIdentifier gives the account identifier used for per-identifier rate limits. Social provider tokens
+// are not included, they are verified by the provider and don't reveal which accounts exist.
+func authRequestIdentifier(authReq *AuthenticateRequest) string {
+	switch authReq.Payload.(type) {
+	case *AuthenticateRequest_Email_:
+		return "email:" + strings.ToLower(authReq.GetEmail().GetEmail())
+	case *AuthenticateRequest_Device:
+		return "device:" + authReq.GetDevice()
+	case *AuthenticateRequest_Custom:
+		return "custom:" + authReq.GetCustom()
+	case *AuthenticateRequest_GameCenter_:
+		return "gamecenter:" + authReq.GetGameCenter().GetPlayerId()
+	}
+	return ""
+}
+
+// newOIDCProviders sets up the OpenID Connect providers in the configuration, skipping any that are incomplete.
+func newOIDCProviders(logger *zap.Logger, config Config, socialClient *social.Client) map[string]*social.OIDCProvider {
+	providers := make(map[string]*social.OIDCProvider)
+	for name, c := range config.GetSocial().OIDC {
+		if c == nil || c.Issuer == "" || c.Audience == "" || (c.JWKSURL == "") == (c.JWKSFile == "") {
+			logger.Error("Ignoring OpenID Connect provider, an issuer, an audience and either a JWKS URL or file are required", zap.String("provider", name))
+			continue
+		}
+		providers[name] = socialClient.NewOIDCProvider(c.Issuer, c.Audience, c.JWKSURL, c.JWKSFile)
+	}
+	return providers
+}
+
+// oidcIdentity gives the value stored in the oidc_id column. Subjects are only unique per issuer, so both are kept.
+func oidcIdentity(profile *social.OIDCProfile) string {
+	return profile.Issuer + "|" + profile.Subject
+}
+
+// validateSessionVars checks session variables are within the size limits, as they are carried in every token.
+func validateSessionVars(vars map[string]string) string {
+	if len(vars) > sessionVarsMaxCount {
+		return fmt.Sprintf("Too many session variables, at most %v are allowed", sessionVarsMaxCount)
+	}
+	for k, v := range vars {
+		if k == "" || len(k) > sessionVarsMaxKeyBytes {
+			return fmt.Sprintf("Invalid session variable name, must be 1-%v bytes", sessionVarsMaxKeyBytes)
+		}
+		if len(v) > sessionVarsMaxValueBytes {
+			return fmt.Sprintf("Invalid session variable value, must be at most %v bytes", sessionVarsMaxValueBytes)
+		}
+	}
+	return ""
+}
+
+// remoteIP gives the source address of a request without the port.
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
 func (a *authenticationService) generateHandle() string {
 	b := make([]byte, 10)
 	for i := range b {
@@ -932,37 +1463,149 @@ func (a *authenticationService) generateHandle() string {
 	return string(b)
 }
 
-func (a *authenticationService) authenticateToken(tokenString string) (uuid.UUID, string, bool) {
+func (a *authenticationService) generateToken(userID uuid.UUID, handle string, appID string, vars map[string]string, familyID string, tokenType string, expiryMs int64) string {
+	ts := now()
+	claims := jwt.MapClaims{
+		"jti": uuid.NewV4().String(),
+		"fam": familyID,
+		"typ": tokenType,
+		"uid": userID.String(),
+		// Seconds with millisecond precision, so a token issued right after a password change is still accepted.
+		"iat": float64(timeToMs(ts)) / 1000,
+		"exp": ts.Add(time.Duration(expiryMs) * time.Millisecond).Unix(),
+		"han": handle,
+	}
+	if appID != "" {
+		claims["app"] = appID
+	}
+	if len(vars) != 0 {
+		claims["vrs"] = vars
+	}
+	signedToken, err := a.keyring.Sign(claims)
+	if err != nil {
+		a.logger.Error("Could not sign token", zap.Error(err))
+	}
+	return signedToken
+}
+
+// authenticateToken verifies a session token, and checks the user is not disabled and the token was issued after the
+// user's tokens were last invalidated.
+func (a *authenticationService) authenticateToken(ctx context.Context, tokenString string) (*sessionToken, bool) {
+	token, ok := a.parseToken(ctx, tokenString, tokenTypeSession)
+	if !ok {
+		return nil, false
+	}
+	if !a.apps.Exists(token.AppID) {
+		a.logger.Warn("Token rejected, app no longer configured", zap.String("app", token.AppID))
+		return nil, false
+	}
+
+	// Tokens issued before a user was disabled remain valid until they expire, so the user is checked every time.
+	disabled, tokensValidAfter, err := userTokenStatus(ctx, a.db, token.UserID)
+	if err != nil {
+		a.logger.Warn("Could not check token against user", zap.String("uid", token.UserID.String()), zap.Error(err))
+		return nil, false
+	}
+	if disabled {
+		a.logger.Warn("Token rejected, user disabled", zap.String("uid", token.UserID.String()))
+		return nil, false
+	}
+	if token.IssuedAt < tokensValidAfter {
+		a.logger.Warn("Token issued before the user's tokens were invalidated", zap.String("uid", token.UserID.String()))
+		return nil, false
+	}
+	return token, true
+}
+
+// disabledMessage gives the login error for a user who is currently disabled, or an empty string if they are not.
+func (a *authenticationService) disabledMessage(userID uuid.UUID) string {
+	disabled, reason, err := userDisabled(a.db, userID)
+	if err != nil {
+		a.logger.Warn("Could not check if user is disabled", zap.Error(err))
+		return errorCouldNotLogin
+	}
+	if !disabled {
+		return ""
+	}
+	if reason != "" {
+		return "ID disabled: " + reason
+	}
+	return "ID disabled"
+}
+
+// parseToken verifies a token of the given type, and checks it has not been revoked.
+func (a *authenticationService) parseToken(ctx context.Context, tokenString string, tokenType string) (*sessionToken, bool) {
 	if tokenString == "" {
 		a.logger.Warn("Token missing")
-		return uuid.Nil, "", false
+		return nil, false
 	}
 
-	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("Unexpected signing method: %v", token.Header["alg"])
-		}
-		return a.hmacSecretByte, nil
-	})
+	token, err := a.keyring.Parse(tokenString)
 
 	if err == nil {
 		if claims, ok := token.Claims.(jwt.MapClaims); ok && token.Valid {
+			// Tokens issued before refresh tokens existed have no type, and are session tokens.
+			if typ, _ := claims["typ"].(string); typ != tokenType && !(typ == "" && tokenType == tokenTypeSession) {
+				a.logger.Warn("Unexpected token type", zap.String("token", tokenString), zap.String("type", typ))
+				return nil, false
+			}
 			uid, uerr := uuid.FromString(claims["uid"].(string))
 			if uerr != nil {
 				a.logger.Warn("Invalid user ID in token", zap.String("token", tokenString), zap.Error(uerr))
-				return uuid.Nil, "", false
+				return nil, false
+			}
+			jti, _ := claims["jti"].(string)
+			fam, _ := claims["fam"].(string)
+			if (jti != "" && a.revocationStore.IsRevoked(ctx, jti)) || (fam != "" && a.revocationStore.IsRevoked(ctx, fam)) {
+				a.logger.Warn("Token revoked", zap.String("token", tokenString))
+				return nil, false
+			}
+			exp, _ := claims["exp"].(float64)
+			iat, _ := claims["iat"].(float64)
+			appID, _ := claims["app"].(string)
+			var vars map[string]string
+			if vrs, ok := claims["vrs"].(map[string]interface{}); ok {
+				vars = make(map[string]string, len(vrs))
+				for k, v := range vrs {
+					vars[k], _ = v.(string)
+				}
 			}
-			return uid, claims["han"].(string), true
+			return &sessionToken{
+				ID:        jti,
+				UserID:    uid,
+				Handle:    claims["han"].(string),
+				ExpiresAt: int64(exp),
+				IssuedAt:  int64(iat*1000 + 0.5),
+				AppID:     appID,
+				Vars:      vars,
+				FamilyID:  fam,
+			}, true
 		}
 	}
 
 	a.logger.Warn("Token invalid", zap.String("token", tokenString), zap.Error(err))
-	return uuid.Nil, "", false
+	return nil, false
 }
 
+// Stop refuses new connections and requests, and gives those in progress until the shutdown grace period ends to
+// finish. Realtime clients are told to reconnect elsewhere, then their sessions are closed.
 func (a *authenticationService) Stop() {
-	// TODO stop incoming net connections
-	a.registry.stop()
+	deadline := time.Now().Add(time.Duration(a.config.GetTransport().ShutdownGraceMs) * time.Millisecond)
+
+	shutdownDone := make(chan struct{})
+	go func() {
+		ctx, cancel := context.WithDeadline(context.Background(), deadline)
+		defer cancel()
+		if err := a.server.Shutdown(ctx); err != nil {
+			a.logger.Warn("HTTP requests still in progress at shutdown deadline", zap.Error(err))
+		}
+		close(shutdownDone)
+	}()
+
+	a.registry.stop(deadline)
+	<-shutdownDone
+	a.revocationStore.Stop()
+	a.gatewayLimiters.Stop()
 }
 
 func now() time.Time {
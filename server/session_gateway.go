@@ -0,0 +1,195 @@
+// Copyright 2017 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gogo/protobuf/proto"
+	"go.uber.org/zap"
+)
+
+// handleGateway runs one request message over HTTP, as if it was sent on a realtime connection. The request path names
+// the message as in the Envelope, for example "/api/storage_fetch", and the body is that message. The response is the
+// Envelope the pipeline replies with, so errors are sent the same way as on the realtime socket.
+func (a *authenticationService) handleGateway(w http.ResponseWriter, r *http.Request, message string) {
+	w.Header().Set("Content-Type", "application/octet-stream")
+
+	token := r.URL.Query().Get("token")
+	if header := r.Header.Get("authorization"); strings.HasPrefix(header, "Bearer ") {
+		token = strings.TrimPrefix(header, "Bearer ")
+	}
+	authToken, auth := a.authenticateToken(r.Context(), token)
+	if !auth {
+		a.sendResponse(w, r, 401, ErrorMessage("", AUTH_ERROR, "Missing or invalid token"))
+		return
+	}
+
+	envelope, request := newGatewayEnvelope(message)
+	if envelope == nil {
+		a.sendResponse(w, r, 404, ErrorMessage("", UNRECOGNIZED_PAYLOAD, "Unrecognized message, or not available over HTTP"))
+		return
+	}
+	if errString := a.decodeBody(w, r, request); errString != "" {
+		a.sendResponse(w, r, 400, ErrorMessageBadInput("", errString))
+		return
+	}
+	envelope.CollationId = r.URL.Query().Get("collation_id")
+
+	lang := r.URL.Query().Get("lang")
+	if lang == "" {
+		lang = "en"
+	}
+
+	// Handlers reply before they return. Only the first reply is used, later ones are never expected.
+	var response *Envelope
+	session := newRequestSession(a.logger, a.config, authToken, lang, a.gatewayLimiters.get(authToken.UserID), func(envelope *Envelope) {
+		if response == nil {
+			response = envelope
+		}
+	})
+	a.pipeline.processRequest(r.Context(), session.logger.With(zap.String("cid", envelope.CollationId)), session, envelope)
+
+	if response == nil {
+		a.logger.Error("No response to HTTP request", zap.String("message", message))
+		a.sendResponse(w, r, 500, ErrorMessageRuntimeException(envelope.CollationId, "No response"))
+		return
+	}
+
+	code := 200
+	if e := response.GetError(); e != nil {
+		code = 400
+		if e.Code == int32(RUNTIME_EXCEPTION) || e.Code == int32(RUNTIME_FUNCTION_EXCEPTION) {
+			code = 500
+		} else if e.Code == int32(RATE_LIMITED) {
+			code = 429
+		}
+	}
+	a.sendResponse(w, r, code, response)
+}
+
+// newGatewayEnvelope creates an Envelope holding an empty message of the named type, and returns the message so the
+// request body can be decoded into it. Messages that need a realtime connection, such as topic joins and matches, are
+// not available and give nil.
+func newGatewayEnvelope(message string) (*Envelope, proto.Message) {
+	switch message {
+	case "link":
+		m := &TLink{}
+		return &Envelope{Payload: &Envelope_Link{Link: m}}, m
+	case "unlink":
+		m := &TUnlink{}
+		return &Envelope{Payload: &Envelope_Unlink{Unlink: m}}, m
+	case "user_merge":
+		m := &TUserMerge{}
+		return &Envelope{Payload: &Envelope_UserMerge{UserMerge: m}}, m
+
+	case "self_fetch":
+		m := &TSelfFetch{}
+		return &Envelope{Payload: &Envelope_SelfFetch{SelfFetch: m}}, m
+	case "self_update":
+		m := &TSelfUpdate{}
+		return &Envelope{Payload: &Envelope_SelfUpdate{SelfUpdate: m}}, m
+	case "password_change":
+		m := &TPasswordChange{}
+		return &Envelope{Payload: &Envelope_PasswordChange{PasswordChange: m}}, m
+	case "users_fetch":
+		m := &TUsersFetch{}
+		return &Envelope{Payload: &Envelope_UsersFetch{UsersFetch: m}}, m
+
+	case "friend_add":
+		m := &TFriendAdd{}
+		return &Envelope{Payload: &Envelope_FriendAdd{FriendAdd: m}}, m
+	case "friend_remove":
+		m := &TFriendRemove{}
+		return &Envelope{Payload: &Envelope_FriendRemove{FriendRemove: m}}, m
+	case "friend_block":
+		m := &TFriendBlock{}
+		return &Envelope{Payload: &Envelope_FriendBlock{FriendBlock: m}}, m
+	case "friends_list":
+		m := &TFriendsList{}
+		return &Envelope{Payload: &Envelope_FriendsList{FriendsList: m}}, m
+
+	case "group_create":
+		m := &TGroupCreate{}
+		return &Envelope{Payload: &Envelope_GroupCreate{GroupCreate: m}}, m
+	case "group_update":
+		m := &TGroupUpdate{}
+		return &Envelope{Payload: &Envelope_GroupUpdate{GroupUpdate: m}}, m
+	case "group_remove":
+		m := &TGroupRemove{}
+		return &Envelope{Payload: &Envelope_GroupRemove{GroupRemove: m}}, m
+	case "groups_fetch":
+		m := &TGroupsFetch{}
+		return &Envelope{Payload: &Envelope_GroupsFetch{GroupsFetch: m}}, m
+	case "groups_list":
+		m := &TGroupsList{}
+		return &Envelope{Payload: &Envelope_GroupsList{GroupsList: m}}, m
+	case "groups_self_list":
+		m := &TGroupsSelfList{}
+		return &Envelope{Payload: &Envelope_GroupsSelfList{GroupsSelfList: m}}, m
+	case "group_users_list":
+		m := &TGroupUsersList{}
+		return &Envelope{Payload: &Envelope_GroupUsersList{GroupUsersList: m}}, m
+	case "group_join":
+		m := &TGroupJoin{}
+		return &Envelope{Payload: &Envelope_GroupJoin{GroupJoin: m}}, m
+	case "group_leave":
+		m := &TGroupLeave{}
+		return &Envelope{Payload: &Envelope_GroupLeave{GroupLeave: m}}, m
+	case "group_user_add":
+		m := &TGroupUserAdd{}
+		return &Envelope{Payload: &Envelope_GroupUserAdd{GroupUserAdd: m}}, m
+	case "group_user_kick":
+		m := &TGroupUserKick{}
+		return &Envelope{Payload: &Envelope_GroupUserKick{GroupUserKick: m}}, m
+	case "group_user_promote":
+		m := &TGroupUserPromote{}
+		return &Envelope{Payload: &Envelope_GroupUserPromote{GroupUserPromote: m}}, m
+
+	case "topic_messages_list":
+		m := &TTopicMessagesList{}
+		return &Envelope{Payload: &Envelope_TopicMessagesList{TopicMessagesList: m}}, m
+
+	case "storage_fetch":
+		m := &TStorageFetch{}
+		return &Envelope{Payload: &Envelope_StorageFetch{StorageFetch: m}}, m
+	case "storage_write":
+		m := &TStorageWrite{}
+		return &Envelope{Payload: &Envelope_StorageWrite{StorageWrite: m}}, m
+	case "storage_remove":
+		m := &TStorageRemove{}
+		return &Envelope{Payload: &Envelope_StorageRemove{StorageRemove: m}}, m
+
+	case "leaderboards_list":
+		m := &TLeaderboardsList{}
+		return &Envelope{Payload: &Envelope_LeaderboardsList{LeaderboardsList: m}}, m
+	case "leaderboard_record_write":
+		m := &TLeaderboardRecordWrite{}
+		return &Envelope{Payload: &Envelope_LeaderboardRecordWrite{LeaderboardRecordWrite: m}}, m
+	case "leaderboard_records_fetch":
+		m := &TLeaderboardRecordsFetch{}
+		return &Envelope{Payload: &Envelope_LeaderboardRecordsFetch{LeaderboardRecordsFetch: m}}, m
+	case "leaderboard_records_list":
+		m := &TLeaderboardRecordsList{}
+		return &Envelope{Payload: &Envelope_LeaderboardRecordsList{LeaderboardRecordsList: m}}, m
+
+	case "rpc":
+		m := &TRpc{}
+		return &Envelope{Payload: &Envelope_Rpc{Rpc: m}}, m
+	}
+
+	return nil, nil
+}
@@ -0,0 +1,186 @@
+// Copyright 2017 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/dgrijalva/jwt-go"
+
+	"nakama/pkg/social"
+)
+
+type sessionSigningKey struct {
+	id        string
+	method    jwt.SigningMethod
+	signKey   interface{}
+	verifyKey interface{}
+}
+
+// SessionKeyring signs session and refresh tokens, and verifies them with any of the configured keys. Each token names
+// its key in the "kid" header. Tokens without one were signed with the encryption key, which is accepted unless
+// disabled in the configuration.
+type SessionKeyring struct {
+	signing *sessionSigningKey
+	keys    map[string]*sessionSigningKey
+}
+
+// NewSessionKeyring creates a new SessionKeyring from the session configuration.
+func NewSessionKeyring(config Config) (*SessionKeyring, error) {
+	sessionConfig := config.GetSession()
+	legacy := &sessionSigningKey{
+		method:    jwt.SigningMethodHS256,
+		signKey:   []byte(sessionConfig.EncryptionKey),
+		verifyKey: []byte(sessionConfig.EncryptionKey),
+	}
+	k := &SessionKeyring{
+		signing: legacy,
+		keys:    map[string]*sessionSigningKey{"": legacy},
+	}
+	if sessionConfig.DisableLegacyKey {
+		if sessionConfig.SigningKeyID == "" {
+			return nil, errors.New("A session signing key ID is required when the legacy key is disabled")
+		}
+		delete(k.keys, "")
+	}
+
+	for _, keyConfig := range sessionConfig.SigningKeys {
+		if keyConfig.ID == "" {
+			return nil, errors.New("Session signing keys must have an ID")
+		}
+		if _, ok := k.keys[keyConfig.ID]; ok {
+			return nil, fmt.Errorf("Duplicate session signing key ID '%v'", keyConfig.ID)
+		}
+		key, err := loadSessionSigningKey(keyConfig)
+		if err != nil {
+			return nil, fmt.Errorf("Session signing key '%v': %v", keyConfig.ID, err)
+		}
+		k.keys[key.id] = key
+	}
+
+	if sessionConfig.SigningKeyID != "" {
+		key, ok := k.keys[sessionConfig.SigningKeyID]
+		if !ok {
+			return nil, fmt.Errorf("Session signing key '%v' not found", sessionConfig.SigningKeyID)
+		}
+		if key.signKey == nil {
+			return nil, fmt.Errorf("Session signing key '%v' has no private key", sessionConfig.SigningKeyID)
+		}
+		k.signing = key
+	}
+
+	return k, nil
+}
+
+// Sign creates a token with the given claims using the current signing key.
+func (k *SessionKeyring) Sign(claims jwt.MapClaims) (string, error) {
+	token := jwt.NewWithClaims(k.signing.method, claims)
+	if k.signing.id != "" {
+		token.Header["kid"] = k.signing.id
+	}
+	return token.SignedString(k.signing.signKey)
+}
+
+// Parse verifies a token against the key named in its header. The token's algorithm must match the key's.
+func (k *SessionKeyring) Parse(tokenString string) (*jwt.Token, error) {
+	return jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		key, ok := k.keys[kid]
+		if !ok {
+			return nil, fmt.Errorf("Unknown signing key: %v", kid)
+		}
+		if token.Method.Alg() != key.method.Alg() {
+			return nil, fmt.Errorf("Unexpected signing method: %v", token.Header["alg"])
+		}
+		return key.verifyKey, nil
+	})
+}
+
+// JWKS lists the public keys other services can verify session tokens with. Shared secrets are never included.
+func (k *SessionKeyring) JWKS() *social.JWKS {
+	jwks := &social.JWKS{Keys: make([]*social.JWK, 0)}
+	for _, key := range k.keys {
+		if _, shared := key.verifyKey.([]byte); shared {
+			continue
+		}
+		if jwk, err := social.NewJWK(key.id, key.method.Alg(), key.verifyKey); err == nil {
+			jwks.Keys = append(jwks.Keys, jwk)
+		}
+	}
+	return jwks
+}
+
+func loadSessionSigningKey(keyConfig *SessionConfigSigningKey) (*sessionSigningKey, error) {
+	key := &sessionSigningKey{id: keyConfig.ID}
+
+	switch keyConfig.Algorithm {
+	case "HS256":
+		if keyConfig.Secret == "" {
+			return nil, errors.New("HS256 keys require a secret")
+		}
+		key.method = jwt.SigningMethodHS256
+		key.signKey = []byte(keyConfig.Secret)
+		key.verifyKey = []byte(keyConfig.Secret)
+		return key, nil
+	case "RS256":
+		key.method = jwt.SigningMethodRS256
+	case "ES256":
+		key.method = jwt.SigningMethodES256
+	default:
+		return nil, fmt.Errorf("Unknown algorithm '%v', must be 'HS256', 'RS256' or 'ES256'", keyConfig.Algorithm)
+	}
+
+	if keyConfig.PrivateKeyFile != "" {
+		data, err := ioutil.ReadFile(keyConfig.PrivateKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		if key.method == jwt.SigningMethodRS256 {
+			privateKey, err := jwt.ParseRSAPrivateKeyFromPEM(data)
+			if err != nil {
+				return nil, err
+			}
+			key.signKey = privateKey
+			key.verifyKey = &privateKey.PublicKey
+		} else {
+			privateKey, err := jwt.ParseECPrivateKeyFromPEM(data)
+			if err != nil {
+				return nil, err
+			}
+			key.signKey = privateKey
+			key.verifyKey = &privateKey.PublicKey
+		}
+		return key, nil
+	}
+
+	if keyConfig.PublicKeyFile == "" {
+		return nil, errors.New("RS256 and ES256 keys require a private or public key file")
+	}
+	data, err := ioutil.ReadFile(keyConfig.PublicKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	if key.method == jwt.SigningMethodRS256 {
+		key.verifyKey, err = jwt.ParseRSAPublicKeyFromPEM(data)
+	} else {
+		key.verifyKey, err = jwt.ParseECPublicKeyFromPEM(data)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return key, nil
+}
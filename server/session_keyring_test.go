@@ -0,0 +1,219 @@
+// Copyright 2017 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+func writeTestKeys(t *testing.T, dir string) (string, string) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaFile := filepath.Join(dir, "rsa.pem")
+	rsaPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)})
+	if err := ioutil.WriteFile(rsaFile, rsaPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecBytes, err := x509.MarshalECPrivateKey(ecKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecFile := filepath.Join(dir, "ec.pem")
+	if err := ioutil.WriteFile(ecFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: ecBytes}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return rsaFile, ecFile
+}
+
+func newTestKeyring(t *testing.T, signingKeyID string, disableLegacyKey bool, rsaFile, ecFile string) *SessionKeyring {
+	config := NewConfig()
+	config.Session.SigningKeyID = signingKeyID
+	config.Session.DisableLegacyKey = disableLegacyKey
+	config.Session.SigningKeys = []*SessionConfigSigningKey{
+		{ID: "hs", Algorithm: "HS256", Secret: "secret"},
+		{ID: "rs", Algorithm: "RS256", PrivateKeyFile: rsaFile},
+		{ID: "es", Algorithm: "ES256", PrivateKeyFile: ecFile},
+	}
+	keyring, err := NewSessionKeyring(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keyring
+}
+
+func TestSessionKeyringSignParse(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nakama-keyring")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	rsaFile, ecFile := writeTestKeys(t, dir)
+
+	legacy := newTestKeyring(t, "", false, rsaFile, ecFile)
+	legacyToken, err := legacy.Sign(jwt.MapClaims{"uid": "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name             string
+		signingKeyID     string
+		disableLegacyKey bool
+		alg              string
+	}{
+		{"legacy", "", false, "HS256"},
+		{"HS256", "hs", false, "HS256"},
+		{"RS256", "rs", false, "RS256"},
+		{"ES256", "es", true, "ES256"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keyring := newTestKeyring(t, tt.signingKeyID, tt.disableLegacyKey, rsaFile, ecFile)
+			tokenString, err := keyring.Sign(jwt.MapClaims{"uid": "a"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			token, err := keyring.Parse(tokenString)
+			if err != nil || !token.Valid {
+				t.Fatalf("token rejected: %v", err)
+			}
+			if kid, _ := token.Header["kid"].(string); kid != tt.signingKeyID {
+				t.Errorf("kid %q, expected %q", kid, tt.signingKeyID)
+			}
+			if token.Method.Alg() != tt.alg {
+				t.Errorf("algorithm %v, expected %v", token.Method.Alg(), tt.alg)
+			}
+			if claims := token.Claims.(jwt.MapClaims); claims["uid"] != "a" {
+				t.Errorf("claims %v", claims)
+			}
+
+			// Tokens signed with the legacy key are accepted unless it is disabled.
+			if _, err := keyring.Parse(legacyToken); (err == nil) == tt.disableLegacyKey {
+				t.Errorf("legacy token error %v, with legacy key disabled %v", err, tt.disableLegacyKey)
+			}
+		})
+	}
+}
+
+func TestSessionKeyringParseRejected(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nakama-keyring")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	rsaFile, ecFile := writeTestKeys(t, dir)
+	keyring := newTestKeyring(t, "rs", false, rsaFile, ecFile)
+
+	unknownKid := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"uid": "a"})
+	unknownKid.Header["kid"] = "unknown"
+	wrongAlg := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"uid": "a"})
+	wrongAlg.Header["kid"] = "rs"
+	wrongSecret := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"uid": "a"})
+	wrongSecret.Header["kid"] = "hs"
+
+	tests := []struct {
+		name  string
+		token *jwt.Token
+		key   []byte
+	}{
+		{"unknown kid", unknownKid, []byte("secret")},
+		{"algorithm does not match key", wrongAlg, []byte("secret")},
+		{"wrong secret", wrongSecret, []byte("other")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tokenString, err := tt.token.SignedString(tt.key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := keyring.Parse(tokenString); err == nil {
+				t.Error("token accepted")
+			}
+		})
+	}
+}
+
+func TestSessionKeyringJWKS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nakama-keyring")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	rsaFile, ecFile := writeTestKeys(t, dir)
+	keyring := newTestKeyring(t, "rs", false, rsaFile, ecFile)
+
+	// Only the public keys are published, shared secrets never are.
+	expected := map[string]string{"rs": "RSA", "es": "EC"}
+	jwks := keyring.JWKS()
+	if len(jwks.Keys) != len(expected) {
+		t.Fatalf("%v keys, expected %v", len(jwks.Keys), len(expected))
+	}
+	for _, jwk := range jwks.Keys {
+		if kty, ok := expected[jwk.Kid]; !ok || jwk.Kty != kty {
+			t.Errorf("unexpected key %q of type %v", jwk.Kid, jwk.Kty)
+			continue
+		}
+		if _, err := jwk.PublicKey(); err != nil {
+			t.Errorf("key %q can't be decoded: %v", jwk.Kid, err)
+		}
+	}
+}
+
+func TestSessionKeyringConfig(t *testing.T) {
+	tests := []struct {
+		name             string
+		signingKeyID     string
+		disableLegacyKey bool
+		keys             []*SessionConfigSigningKey
+	}{
+		{"legacy key disabled without a signing key", "", true, nil},
+		{"unknown signing key", "missing", false, nil},
+		{"key without ID", "", false, []*SessionConfigSigningKey{{Algorithm: "HS256", Secret: "secret"}}},
+		{"duplicate key ID", "", false, []*SessionConfigSigningKey{{ID: "a", Algorithm: "HS256", Secret: "secret"}, {ID: "a", Algorithm: "HS256", Secret: "secret"}}},
+		{"unknown algorithm", "", false, []*SessionConfigSigningKey{{ID: "a", Algorithm: "none"}}},
+		{"signing key without private key", "a", false, []*SessionConfigSigningKey{{ID: "a", Algorithm: "RS256", PublicKeyFile: "missing.pem"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := NewConfig()
+			config.Session.SigningKeyID = tt.signingKeyID
+			config.Session.DisableLegacyKey = tt.disableLegacyKey
+			if tt.keys != nil {
+				config.Session.SigningKeys = tt.keys
+			}
+			if _, err := NewSessionKeyring(config); err == nil {
+				t.Error("configuration accepted")
+			}
+		})
+	}
+}
@@ -0,0 +1,168 @@
+// Copyright 2017 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/satori/go.uuid"
+)
+
+type requestRateLimiterBucket struct {
+	limit     *RequestRateLimitConfigLimit
+	tokens    float64
+	updatedMs int64
+}
+
+// requestRateLimiter holds a token bucket for each rate limited message type of one session, and counts rejected
+// requests so sessions that keep exceeding the limits can be disconnected. This is thread-safe.
+type requestRateLimiter struct {
+	sync.Mutex
+	disconnectLimit int
+	buckets         map[string]*requestRateLimiterBucket
+	rejections      authLimiterWindow
+}
+
+func newRequestRateLimiter(config *RequestRateLimitConfig) *requestRateLimiter {
+	l := &requestRateLimiter{
+		disconnectLimit: config.DisconnectRejectionsPerMinute,
+		buckets:         make(map[string]*requestRateLimiterBucket, len(config.Limits)),
+	}
+	ts := nowMs()
+	for messageType, limit := range config.Limits {
+		if limit == nil {
+			continue
+		}
+		// Message types are matched the same way as runtime hooks.
+		l.buckets[strings.ToLower(messageType)] = &requestRateLimiterBucket{
+			limit:     limit,
+			tokens:    float64(limit.Burst),
+			updatedMs: ts,
+		}
+	}
+	return l
+}
+
+// allow takes a token for a request of the message type. Returns false if the request is over the limit, and true
+// for disconnect if the session has been rate limited too often within the current minute.
+func (l *requestRateLimiter) allow(messageType string) (allowed bool, disconnect bool) {
+	bucket := l.buckets[messageType]
+	if bucket == nil {
+		return true, false
+	}
+
+	ts := nowMs()
+	l.Lock()
+	defer l.Unlock()
+
+	bucket.tokens += float64(ts-bucket.updatedMs) / 1000 * bucket.limit.RequestsPerSecond
+	if bucket.tokens > float64(bucket.limit.Burst) {
+		bucket.tokens = float64(bucket.limit.Burst)
+	}
+	bucket.updatedMs = ts
+	if bucket.tokens >= 1 {
+		bucket.tokens--
+		return true, false
+	}
+
+	if l.disconnectLimit < 1 {
+		return false, false
+	}
+	if ts-l.rejections.startMs >= 60000 {
+		l.rejections = authLimiterWindow{startMs: ts}
+	}
+	l.rejections.count++
+	return false, l.rejections.count > l.disconnectLimit
+}
+
+// idle checks if the limiter's buckets have refilled and its rejections window has ended, so replacing it with a new
+// limiter would change nothing.
+func (l *requestRateLimiter) idle(ts int64) bool {
+	l.Lock()
+	defer l.Unlock()
+	if l.rejections.count != 0 && ts-l.rejections.startMs < 60000 {
+		return false
+	}
+	for _, bucket := range l.buckets {
+		if bucket.tokens+float64(ts-bucket.updatedMs)/1000*bucket.limit.RequestsPerSecond < float64(bucket.limit.Burst) {
+			return false
+		}
+	}
+	return true
+}
+
+// requestRateLimiters keeps a rate limiter for each user making requests over HTTP, since those have no session to
+// hold one between requests. Limiters are removed once idle. This is thread-safe.
+type requestRateLimiters struct {
+	sync.Mutex
+	config   *RequestRateLimitConfig
+	limiters map[uuid.UUID]*requestRateLimiter
+	stopCh   chan struct{}
+}
+
+func newRequestRateLimiters(config *RequestRateLimitConfig) *requestRateLimiters {
+	r := &requestRateLimiters{
+		config:   config,
+		limiters: make(map[uuid.UUID]*requestRateLimiter),
+		stopCh:   make(chan struct{}),
+	}
+
+	go func() {
+		ticker := time.NewTicker(1 * time.Minute)
+		for {
+			select {
+			case <-r.stopCh:
+				ticker.Stop()
+				return
+			case <-ticker.C:
+				r.removeIdle()
+			}
+		}
+	}()
+
+	return r
+}
+
+// get gives the user's rate limiter, creating it if needed. Returns nil if no request types are rate limited.
+func (r *requestRateLimiters) get(userID uuid.UUID) *requestRateLimiter {
+	if len(r.config.Limits) == 0 {
+		return nil
+	}
+	r.Lock()
+	defer r.Unlock()
+	l := r.limiters[userID]
+	if l == nil {
+		l = newRequestRateLimiter(r.config)
+		r.limiters[userID] = l
+	}
+	return l
+}
+
+func (r *requestRateLimiters) Stop() {
+	close(r.stopCh)
+}
+
+func (r *requestRateLimiters) removeIdle() {
+	ts := nowMs()
+	r.Lock()
+	for userID, l := range r.limiters {
+		if l.idle(ts) {
+			delete(r.limiters, userID)
+		}
+	}
+	r.Unlock()
+}
@@ -0,0 +1,127 @@
+// Copyright 2017 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"testing"
+
+	"github.com/satori/go.uuid"
+)
+
+func TestRequestRateLimiterAllow(t *testing.T) {
+	config := &RequestRateLimitConfig{
+		Limits: map[string]*RequestRateLimitConfigLimit{
+			"TopicMessageSend": {RequestsPerSecond: 1, Burst: 2},
+		},
+		DisconnectRejectionsPerMinute: 2,
+	}
+	l := newRequestRateLimiter(config)
+
+	// Requests follow each other quickly enough that no tokens are refilled in between.
+	tests := []struct {
+		name        string
+		messageType string
+		allowed     bool
+		disconnect  bool
+	}{
+		{"burst", "topicmessagesend", true, false},
+		{"burst", "topicmessagesend", true, false},
+		{"other types are not limited", "storagewrite", true, false},
+		{"over the limit", "topicmessagesend", false, false},
+		{"over the limit again", "topicmessagesend", false, false},
+		{"too many rejections", "topicmessagesend", false, true},
+	}
+	for i, tt := range tests {
+		allowed, disconnect := l.allow(tt.messageType)
+		if allowed != tt.allowed || disconnect != tt.disconnect {
+			t.Fatalf("%v %v: allow() = %v, %v, expected %v, %v", i, tt.name, allowed, disconnect, tt.allowed, tt.disconnect)
+		}
+	}
+
+	// A second later one token has been refilled.
+	l.buckets["topicmessagesend"].updatedMs -= 1000
+	if allowed, _ := l.allow("topicmessagesend"); !allowed {
+		t.Fatal("request rejected after tokens were refilled")
+	}
+	if allowed, _ := l.allow("topicmessagesend"); allowed {
+		t.Fatal("request allowed beyond the refilled tokens")
+	}
+}
+
+func TestRequestRateLimiterIdle(t *testing.T) {
+	config := &RequestRateLimitConfig{
+		Limits: map[string]*RequestRateLimitConfigLimit{
+			"StorageWrite": {RequestsPerSecond: 1, Burst: 2},
+		},
+	}
+	ts := nowMs()
+
+	tests := []struct {
+		name     string
+		requests int
+		elapsed  int64
+		idle     bool
+	}{
+		{"unused", 0, 0, true},
+		{"tokens taken", 1, 0, false},
+		{"tokens refilled", 2, 2500, true},
+		{"tokens partly refilled", 2, 1000, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := newRequestRateLimiter(config)
+			for i := 0; i < tt.requests; i++ {
+				l.allow("storagewrite")
+			}
+			if idle := l.idle(ts + tt.elapsed); idle != tt.idle {
+				t.Fatalf("idle() = %v, expected %v", idle, tt.idle)
+			}
+		})
+	}
+}
+
+func TestRequestRateLimiters(t *testing.T) {
+	limiters := newRequestRateLimiters(&RequestRateLimitConfig{
+		Limits: map[string]*RequestRateLimitConfigLimit{
+			"StorageWrite": {RequestsPerSecond: 1, Burst: 1},
+		},
+	})
+	defer limiters.Stop()
+
+	userID := uuid.NewV4()
+	l := limiters.get(userID)
+	if l == nil || limiters.get(userID) != l {
+		t.Fatal("requests of the same user do not share a limiter")
+	}
+	if limiters.get(uuid.NewV4()) == l {
+		t.Fatal("users share a limiter")
+	}
+
+	// Limiters in use are kept, so their limits carry over between requests.
+	l.allow("storagewrite")
+	limiters.removeIdle()
+	if limiters.get(userID) != l {
+		t.Fatal("limiter in use was removed")
+	}
+	if allowed, _ := limiters.get(userID).allow("storagewrite"); allowed {
+		t.Fatal("request allowed over the limit")
+	}
+
+	unlimited := newRequestRateLimiters(&RequestRateLimitConfig{})
+	defer unlimited.Stop()
+	if unlimited.get(userID) != nil {
+		t.Fatal("limiter created without any limits")
+	}
+}
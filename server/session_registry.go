@@ -15,7 +15,10 @@
 package server
 
 import (
+	"context"
+	"fmt"
 	"sync"
+	"time"
 
 	"github.com/gorilla/websocket"
 	"github.com/satori/go.uuid"
@@ -25,32 +28,84 @@ import (
 // SessionRegistry maintains a list of sessions to their IDs. This is thread-safe.
 type SessionRegistry struct {
 	sync.RWMutex
-	logger   *zap.Logger
-	config   Config
-	tracker  Tracker
-	sessions map[uuid.UUID]*session
+	logger       *zap.Logger
+	config       Config
+	tracker      Tracker
+	sessions     map[uuid.UUID]*session
+	resumable    map[string]*session
+	queueMetrics *sessionQueueMetrics
+	stopped      bool
 }
 
 // NewSessionRegistry creates a new SessionRegistry
 func NewSessionRegistry(logger *zap.Logger, config Config, tracker Tracker) *SessionRegistry {
 	return &SessionRegistry{
-		logger:   logger,
-		config:   config,
-		tracker:  tracker,
-		sessions: make(map[uuid.UUID]*session),
+		logger:       logger,
+		config:       config,
+		tracker:      tracker,
+		sessions:     make(map[uuid.UUID]*session),
+		resumable:    make(map[string]*session),
+		queueMetrics: newSessionQueueMetrics(),
 	}
 }
 
-func (a *SessionRegistry) stop() {
+// stop refuses new sessions and tells connected clients the server is shutting down. Requests in progress are given
+// until the deadline to finish, then every session is closed and its remaining messages written out.
+func (a *SessionRegistry) stop(deadline time.Time) {
+	reason := fmt.Sprintf("Server shutting down, reconnect in %v ms", a.config.GetTransport().ShutdownReconnectMs)
+
 	a.Lock()
-	for _, session := range a.sessions {
-		if a.sessions[session.id] != nil {
-			delete(a.sessions, session.id)
-			go a.tracker.UntrackAll(session.id) // Drop all tracked presences for this session.
+	a.stopped = true
+	sessions := make([]*session, 0, len(a.sessions))
+	for _, s := range a.sessions {
+		sessions = append(sessions, s)
+	}
+	a.Unlock()
+
+	for _, s := range sessions {
+		s.drain(reason)
+	}
+	if !waitUntil(deadline, func() {
+		for _, s := range sessions {
+			s.inFlight.Wait()
 		}
-		session.close()
+	}) {
+		a.logger.Warn("Realtime requests still in progress at shutdown deadline")
+	}
+
+	closeMessage := websocket.FormatCloseMessage(websocket.CloseServiceRestart, reason)
+	a.Lock()
+	for _, s := range sessions {
+		if a.sessions[s.id] != nil {
+			delete(a.sessions, s.id)
+			delete(a.resumable, s.resumeToken)
+			go a.tracker.UntrackAll(s.id) // Drop all tracked presences for this session.
+		}
+		s.closeWithMessage(closeMessage)
 	}
 	a.Unlock()
+
+	// Writers flush queued messages within the write wait, even if the deadline has passed.
+	waitUntil(time.Now().Add(time.Duration(a.config.GetTransport().WriteWaitMs)*time.Millisecond), func() {
+		for _, s := range sessions {
+			s.writers.Wait()
+		}
+	})
+}
+
+// waitUntil runs fn and waits for it to return until the deadline. Returns false if the deadline passed first.
+func waitUntil(deadline time.Time, fn func()) bool {
+	done := make(chan struct{})
+	go func() {
+		fn()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(deadline.Sub(time.Now())):
+		return false
+	}
 }
 
 // Get returns a session matching the sessionID
@@ -62,18 +117,101 @@ func (a *SessionRegistry) Get(sessionID uuid.UUID) *session {
 	return s
 }
 
-func (a *SessionRegistry) add(userID uuid.UUID, handle string, lang string, conn *websocket.Conn, processRequest func(logger *zap.Logger, session *session, envelope *Envelope)) {
-	s := NewSession(a.logger, a.config, userID, handle, lang, conn, a.remove)
+// add serves a new connection. If the resume token belongs to a session of the same user, app and format the
+// connection continues that session, otherwise a new session is created.
+func (a *SessionRegistry) add(token *sessionToken, lang string, format string, resumeToken string, conn *websocket.Conn, processRequest func(ctx context.Context, logger *zap.Logger, session *session, envelope *Envelope)) {
+	// Sessions are not resumed once shutdown has started, they would only be closed again.
+	a.RLock()
+	stopped := a.stopped
+	var s *session
+	if resumeToken != "" {
+		s = a.resumable[resumeToken]
+	}
+	a.RUnlock()
+	if stopped {
+		a.refuse(conn)
+		return
+	}
+	if s != nil && s.userID == token.UserID && s.appID == token.AppID && s.format == format && s.resume(token, conn) {
+		s.logger.Info("Session resumed", zap.String("remoteAddress", conn.RemoteAddr().String()))
+		s.Consume(true, processRequest)
+		return
+	}
+
 	a.Lock()
+	if a.stopped {
+		a.Unlock()
+		a.refuse(conn)
+		return
+	}
+	s = NewSession(a.logger, a.config, token, lang, format, conn, a.queueMetrics, a.remove)
 	a.sessions[s.id] = s
+	if s.resumeToken != "" {
+		a.resumable[s.resumeToken] = s
+	}
 	a.Unlock()
-	s.Consume(processRequest)
+	s.Consume(false, processRequest)
+}
+
+// refuse closes a connection the registry will not serve, telling the client the server is shutting down.
+func (a *SessionRegistry) refuse(conn *websocket.Conn) {
+	conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseServiceRestart, "Server shutting down"), time.Now().Add(time.Duration(a.config.GetTransport().WriteWaitMs)*time.Millisecond))
+	conn.Close()
+}
+
+// disconnectUser closes all sessions belonging to the user on this node, with the reason sent to each client first.
+func (a *SessionRegistry) disconnectUser(userID uuid.UUID, code Error_Code, reason string) {
+	sessions := make([]*session, 0)
+	a.RLock()
+	for _, s := range a.sessions {
+		if s.userID == userID {
+			sessions = append(sessions, s)
+		}
+	}
+	a.RUnlock()
+
+	for _, s := range sessions {
+		a.remove(s)
+		s.kick(code, reason)
+	}
+}
+
+// Stats reports the depth of outgoing message queues across connected sessions, and how many messages were dropped or
+// clients disconnected since startup because their queue was full.
+func (a *SessionRegistry) Stats() map[string]interface{} {
+	sessionCount := 0
+	detachedCount := 0
+	queued := 0
+	maxQueued := 0
+	a.RLock()
+	for _, s := range a.sessions {
+		sessionCount++
+		if s.isDetached() {
+			detachedCount++
+		}
+		length := s.queueLength()
+		queued += length
+		if length > maxQueued {
+			maxQueued = length
+		}
+	}
+	a.RUnlock()
+
+	return map[string]interface{}{
+		"session_count":       sessionCount,
+		"detached_count":      detachedCount,
+		"queued_messages":     queued,
+		"max_queue_depth":     maxQueued,
+		"dropped_messages":    a.queueMetrics.dropped.Load(),
+		"slow_disconnections": a.queueMetrics.disconnected.Load(),
+	}
 }
 
 func (a *SessionRegistry) remove(c *session) {
 	a.Lock()
 	if a.sessions[c.id] != nil {
 		delete(a.sessions, c.id)
+		delete(a.resumable, c.resumeToken)
 		go a.tracker.UntrackAll(c.id) // Drop all tracked presences for this session.
 	}
 	a.Unlock()
@@ -0,0 +1,176 @@
+// Copyright 2017 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/gorilla/websocket"
+	"github.com/satori/go.uuid"
+	"go.uber.org/zap"
+)
+
+// readSessionResume reads messages from the client connection until the session resume message arrives.
+func readSessionResume(t *testing.T, conn *websocket.Conn) *SessionResume {
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("could not read session resume message: %v", err)
+		}
+		envelope := &Envelope{}
+		if err := proto.Unmarshal(data, envelope); err != nil {
+			t.Fatal(err)
+		}
+		if resume := envelope.GetSessionResume(); resume != nil {
+			return resume
+		}
+	}
+}
+
+func TestSessionRegistryResume(t *testing.T) {
+	tests := []struct {
+		name   string
+		detach bool
+	}{
+		{"detached session", true},
+		{"session still attached to a lost connection", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := NewConfig()
+			config.Transport.ResumeGraceMs = 10000
+			registry := NewSessionRegistry(zap.NewNop(), config, NewTrackerService(config.GetName()))
+			defer registry.stop(time.Now())
+
+			token := &sessionToken{ID: "token", UserID: uuid.NewV4(), Handle: "handle"}
+			upgrader := &websocket.Upgrader{}
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				conn, err := upgrader.Upgrade(w, r, nil)
+				if err != nil {
+					return
+				}
+				registry.add(token, "en", sessionFormatProtobuf, r.URL.Query().Get("resume"), conn, func(context.Context, *zap.Logger, *session, *Envelope) {})
+			}))
+			defer server.Close()
+			url := "ws" + strings.TrimPrefix(server.URL, "http")
+
+			first, _, err := websocket.DefaultDialer.Dial(url, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer first.Close()
+			firstResume := readSessionResume(t, first)
+			if firstResume.Resumed {
+				t.Fatal("new session reported as resumed")
+			}
+
+			if tt.detach {
+				first.Close()
+				sessionID, _ := uuid.FromBytes(firstResume.SessionId)
+				for i := 0; !registry.Get(sessionID).isDetached(); i++ {
+					if i == 100 {
+						t.Fatal("session was not detached")
+					}
+					time.Sleep(10 * time.Millisecond)
+				}
+			}
+
+			second, _, err := websocket.DefaultDialer.Dial(url+"?resume="+firstResume.ResumeToken, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer second.Close()
+			secondResume := readSessionResume(t, second)
+			if !secondResume.Resumed {
+				t.Fatal("session not resumed")
+			}
+			if !uuid.Equal(uuid.FromBytesOrNil(secondResume.SessionId), uuid.FromBytesOrNil(firstResume.SessionId)) {
+				t.Fatal("resumed a different session")
+			}
+
+			if !tt.detach {
+				// The previous connection is closed by the server.
+				first.SetReadDeadline(time.Now().Add(5 * time.Second))
+				for {
+					if _, _, err := first.ReadMessage(); err != nil {
+						if netErr, ok := err.(interface{ Timeout() bool }); ok && netErr.Timeout() {
+							t.Fatal("previous connection was not closed")
+						}
+						break
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestSessionRegistryResumeWhileStopping(t *testing.T) {
+	config := NewConfig()
+	config.Transport.ResumeGraceMs = 10000
+	registry := NewSessionRegistry(zap.NewNop(), config, NewTrackerService(config.GetName()))
+	defer registry.stop(time.Now())
+
+	token := &sessionToken{ID: "token", UserID: uuid.NewV4(), Handle: "handle"}
+	upgrader := &websocket.Upgrader{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		registry.add(token, "en", sessionFormatProtobuf, r.URL.Query().Get("resume"), conn, func(context.Context, *zap.Logger, *session, *Envelope) {})
+	}))
+	defer server.Close()
+	url := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	first, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	firstResume := readSessionResume(t, first)
+	first.Close()
+	sessionID, _ := uuid.FromBytes(firstResume.SessionId)
+	for i := 0; !registry.Get(sessionID).isDetached(); i++ {
+		if i == 100 {
+			t.Fatal("session was not detached")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Shutdown has started, but the session is still waiting for requests in progress to finish.
+	registry.Lock()
+	registry.stopped = true
+	registry.Unlock()
+
+	second, _, err := websocket.DefaultDialer.Dial(url+"?resume="+firstResume.ResumeToken, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+	second.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, _, err = second.ReadMessage()
+	if !websocket.IsCloseError(err, websocket.CloseServiceRestart) {
+		t.Fatalf("expected the connection to be refused, got %v", err)
+	}
+	if !registry.Get(sessionID).isDetached() {
+		t.Fatal("session was resumed")
+	}
+}
@@ -0,0 +1,73 @@
+// Copyright 2017 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"testing"
+
+	"go.uber.org/atomic"
+)
+
+func TestSessionRequestWorker(t *testing.T) {
+	tests := []struct {
+		name  string
+		first *Envelope
+		then  *Envelope
+	}{
+		{"topic", &Envelope{Payload: &Envelope_TopicJoin{}}, &Envelope{Payload: &Envelope_TopicMessageSend{}}},
+		{"match", &Envelope{Payload: &Envelope_MatchCreate{}}, &Envelope{Payload: &Envelope_MatchLeave{}}},
+		{"group", &Envelope{Payload: &Envelope_GroupCreate{}}, &Envelope{Payload: &Envelope_GroupsSelfList{}}},
+		{"storage", &Envelope{Payload: &Envelope_StorageWrite{}}, &Envelope{Payload: &Envelope_StorageFetch{}}},
+		{"friend", &Envelope{Payload: &Envelope_FriendAdd{}}, &Envelope{Payload: &Envelope_FriendsList{}}},
+		{"leaderboard", &Envelope{Payload: &Envelope_LeaderboardRecordWrite{}}, &Envelope{Payload: &Envelope_LeaderboardRecordsList{}}},
+		{"account", &Envelope{Payload: &Envelope_SelfUpdate{}}, &Envelope{Payload: &Envelope_SelfFetch{}}},
+		{"account links", &Envelope{Payload: &Envelope_Link{}}, &Envelope{Payload: &Envelope_Unlink{}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for workers := 1; workers <= 8; workers++ {
+				first := sessionRequestWorker(tt.first, workers)
+				if first < 0 || first >= workers {
+					t.Fatalf("worker %v out of range for %v workers", first, workers)
+				}
+				if then := sessionRequestWorker(tt.then, workers); then != first {
+					t.Fatalf("related requests on workers %v and %v of %v", first, then, workers)
+				}
+			}
+		})
+	}
+}
+
+func TestSessionBypassWorkers(t *testing.T) {
+	s := &session{pendingMatchRequests: atomic.NewInt32(0)}
+	matchData := &Envelope{Payload: &Envelope_MatchDataSend{}}
+	if !s.bypassWorkers(matchData) {
+		t.Fatal("match data queued with no match request pending")
+	}
+	if s.bypassWorkers(&Envelope{Payload: &Envelope_MatchJoin{}}) {
+		t.Fatal("match join skipped the queue")
+	}
+
+	s.pendingMatchRequests.Inc()
+	if s.bypassWorkers(matchData) {
+		t.Fatal("match data skipped the queue while a match request was pending")
+	}
+	if !s.bypassWorkers(&Envelope{Payload: &Envelope_Heartbeat{}}) {
+		t.Fatal("heartbeat queued")
+	}
+	if sessionRequestWorker(matchData, 8) != sessionRequestWorker(&Envelope{Payload: &Envelope_MatchJoin{}}, 8) {
+		t.Fatal("match data and match join on different workers")
+	}
+}
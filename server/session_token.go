@@ -0,0 +1,221 @@
+// Copyright 2017 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+	"time"
+
+	"github.com/satori/go.uuid"
+	"go.uber.org/zap"
+)
+
+const (
+	tokenTypeSession = "session"
+	tokenTypeRefresh = "refresh"
+
+	tokenTypeEmailVerification = "email_verification"
+	tokenTypePasswordReset     = "password_reset"
+)
+
+// sessionToken is the verified content of a session or refresh token.
+type sessionToken struct {
+	ID        string
+	UserID    uuid.UUID
+	Handle    string
+	ExpiresAt int64 // Unix time in seconds, as in the token's "exp" claim.
+	IssuedAt  int64 // Unix time in milliseconds, 0 for tokens issued before it was recorded.
+	AppID     string
+	Vars      map[string]string
+	// FamilyID is shared by the session and refresh token issued together, so both can be revoked at once.
+	FamilyID string
+}
+
+// Revocations made on other nodes are loaded this often, with some overlap in case of clock differences between nodes
+// or revocations committed while the previous load ran.
+const (
+	tokenRevocationSyncInterval = 2 * time.Second
+	tokenRevocationSyncOverlap  = 1 * time.Minute
+)
+
+// TokenRevocationStore remembers revoked tokens until they would have expired anyway. Revocations are stored in the
+// database so they survive restarts and apply to all nodes, and are loaded into memory in the background so checks
+// don't need to query the database. This is thread-safe.
+type TokenRevocationStore struct {
+	sync.RWMutex
+	logger   *zap.Logger
+	db       *sql.DB
+	tokens   map[string]int64
+	syncedAt time.Time
+	stopCh   chan struct{}
+}
+
+// NewTokenRevocationStore creates a new TokenRevocationStore. Revocations are only kept in memory if db is nil.
+func NewTokenRevocationStore(logger *zap.Logger, db *sql.DB) *TokenRevocationStore {
+	s := &TokenRevocationStore{
+		logger: logger,
+		db:     db,
+		tokens: make(map[string]int64),
+		stopCh: make(chan struct{}),
+	}
+
+	go func() {
+		syncTicker := time.NewTicker(tokenRevocationSyncInterval)
+		expiryTicker := time.NewTicker(1 * time.Minute)
+		s.sync()
+		for {
+			select {
+			case <-s.stopCh:
+				syncTicker.Stop()
+				expiryTicker.Stop()
+				return
+			case <-syncTicker.C:
+				s.sync()
+			case <-expiryTicker.C:
+				s.removeExpired()
+			}
+		}
+	}()
+
+	return s
+}
+
+// Revoke rejects the token or token family with the given ID until its expiry time. Returns false if it was already
+// revoked, or the revocation could not be stored.
+func (s *TokenRevocationStore) Revoke(tokenID string, expiresAt int64) bool {
+	if tokenID == "" {
+		return false
+	}
+	if s.db != nil {
+		// Only one of any concurrent revocations, on any node, inserts the row.
+		res, err := s.db.Exec(`
+INSERT INTO token_revocation (id, expires_at, revoked_at) VALUES ($1, $2, $3)
+ON CONFLICT (id) DO NOTHING`,
+			tokenID, expiresAt, now().Unix())
+		if err != nil {
+			s.logger.Error("Could not store token revocation", zap.Error(err))
+			return false
+		}
+		rowsAffected, _ := res.RowsAffected()
+		s.cache(tokenID, expiresAt)
+		return rowsAffected == 1
+	}
+	s.Lock()
+	_, revoked := s.tokens[tokenID]
+	s.tokens[tokenID] = expiresAt
+	s.Unlock()
+	return !revoked
+}
+
+// IsRevoked checks if the token or token family with the given ID has been revoked. Revocations made on other nodes
+// are seen once they have been loaded, unless loading has fallen behind in which case the database is checked
+// directly. Tokens are treated as revoked if the database can't be checked.
+func (s *TokenRevocationStore) IsRevoked(ctx context.Context, tokenID string) bool {
+	s.RLock()
+	_, ok := s.tokens[tokenID]
+	syncedAt := s.syncedAt
+	s.RUnlock()
+	if ok || s.db == nil {
+		return ok
+	}
+	if now().Sub(syncedAt) < 3*tokenRevocationSyncInterval {
+		return false
+	}
+
+	var expiresAt int64
+	err := s.db.QueryRowContext(ctx, "SELECT expires_at FROM token_revocation WHERE id = $1", tokenID).Scan(&expiresAt)
+	if err == sql.ErrNoRows {
+		return false
+	} else if err != nil {
+		s.logger.Error("Could not check token revocation", zap.Error(err))
+		return true
+	}
+	s.cache(tokenID, expiresAt)
+	return true
+}
+
+func (s *TokenRevocationStore) Stop() {
+	close(s.stopCh)
+}
+
+func (s *TokenRevocationStore) cache(tokenID string, expiresAt int64) {
+	s.Lock()
+	s.tokens[tokenID] = expiresAt
+	s.Unlock()
+}
+
+// sync loads revocations made since the last load, or all current revocations the first time.
+func (s *TokenRevocationStore) sync() {
+	if s.db == nil {
+		return
+	}
+
+	ts := now()
+	s.RLock()
+	var since int64
+	if !s.syncedAt.IsZero() {
+		since = s.syncedAt.Add(-tokenRevocationSyncOverlap).Unix()
+	}
+	s.RUnlock()
+
+	rows, err := s.db.Query("SELECT id, expires_at FROM token_revocation WHERE revoked_at >= $1 AND expires_at >= $2",
+		since, ts.Unix())
+	if err != nil {
+		s.logger.Warn("Could not load token revocations", zap.Error(err))
+		return
+	}
+	defer rows.Close()
+
+	tokens := make(map[string]int64)
+	for rows.Next() {
+		var tokenID string
+		var expiresAt int64
+		if err = rows.Scan(&tokenID, &expiresAt); err != nil {
+			s.logger.Warn("Could not load token revocations", zap.Error(err))
+			return
+		}
+		tokens[tokenID] = expiresAt
+	}
+	if err = rows.Err(); err != nil {
+		s.logger.Warn("Could not load token revocations", zap.Error(err))
+		return
+	}
+
+	s.Lock()
+	for tokenID, expiresAt := range tokens {
+		s.tokens[tokenID] = expiresAt
+	}
+	s.syncedAt = ts
+	s.Unlock()
+}
+
+func (s *TokenRevocationStore) removeExpired() {
+	ts := now().Unix()
+	s.Lock()
+	for tokenID, expiresAt := range s.tokens {
+		if expiresAt < ts {
+			delete(s.tokens, tokenID)
+		}
+	}
+	s.Unlock()
+
+	if s.db != nil {
+		if _, err := s.db.Exec("DELETE FROM token_revocation WHERE expires_at < $1", ts); err != nil {
+			s.logger.Warn("Could not remove expired token revocations", zap.Error(err))
+		}
+	}
+}
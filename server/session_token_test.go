@@ -0,0 +1,96 @@
+// Copyright 2017 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"testing"
+
+	"github.com/satori/go.uuid"
+	"go.uber.org/zap"
+)
+
+func TestTokenRevocationStore(t *testing.T) {
+	store := NewTokenRevocationStore(zap.NewNop(), nil)
+	defer store.Stop()
+
+	ts := now().Unix()
+	tests := []struct {
+		name      string
+		tokenID   string
+		expiresAt int64
+		revoke    bool
+		revoked   bool
+	}{
+		{"first revocation", "a", ts + 60, true, true},
+		{"second revocation", "a", ts + 60, false, true},
+		{"other token", "b", ts + 60, true, true},
+		{"empty ID", "", ts + 60, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if revoke := store.Revoke(tt.tokenID, tt.expiresAt); revoke != tt.revoke {
+				t.Fatalf("Revoke() = %v, expected %v", revoke, tt.revoke)
+			}
+			if revoked := store.IsRevoked(context.Background(), tt.tokenID); revoked != tt.revoked {
+				t.Fatalf("IsRevoked() = %v, expected %v", revoked, tt.revoked)
+			}
+		})
+	}
+
+	if store.IsRevoked(context.Background(), "c") {
+		t.Fatal("token that was never revoked is revoked")
+	}
+}
+
+func TestTokenRevocationStoreRemoveExpired(t *testing.T) {
+	store := NewTokenRevocationStore(zap.NewNop(), nil)
+	defer store.Stop()
+
+	ts := now().Unix()
+	store.Revoke("expired", ts-1)
+	store.Revoke("current", ts+60)
+	store.removeExpired()
+
+	if store.IsRevoked(context.Background(), "expired") {
+		t.Error("expired revocation was kept")
+	}
+	if !store.IsRevoked(context.Background(), "current") {
+		t.Error("current revocation was removed")
+	}
+}
+
+func TestTokenIssuedAtPrecision(t *testing.T) {
+	store := NewTokenRevocationStore(zap.NewNop(), nil)
+	defer store.Stop()
+	keyring, err := NewSessionKeyring(NewConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := &authenticationService{logger: zap.NewNop(), keyring: keyring, revocationStore: store}
+
+	before := nowMs()
+	tokenString := a.generateToken(uuid.NewV4(), "handle", "", nil, "family", tokenTypeSession, 60000)
+	after := nowMs()
+
+	token, ok := a.parseToken(context.Background(), tokenString, tokenTypeSession)
+	if !ok {
+		t.Fatal("token was not accepted")
+	}
+	// Tokens issued in the same second as a password change must still be told apart from it.
+	if token.IssuedAt < before || token.IssuedAt > after {
+		t.Fatalf("IssuedAt = %v, expected between %v and %v", token.IssuedAt, before, after)
+	}
+}
@@ -0,0 +1,136 @@
+// Copyright 2017 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"crypto/tls"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// certReloader holds the certificate of a TLS listener, and optionally reloads it when the certificate or key file
+// changes on disk. A certificate that fails to load is logged and the previous one is kept. This is thread-safe.
+type certReloader struct {
+	sync.RWMutex
+	logger   *zap.Logger
+	certFile string
+	keyFile  string
+	cert     *tls.Certificate
+	modTime  time.Time
+	stopCh   chan struct{}
+}
+
+func newCertReloader(logger *zap.Logger, listenerConfig *TLSConfigListener) (*certReloader, error) {
+	r := &certReloader{
+		logger:   logger,
+		certFile: listenerConfig.CertFile,
+		keyFile:  listenerConfig.KeyFile,
+		stopCh:   make(chan struct{}),
+	}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+
+	if listenerConfig.ReloadIntervalMs > 0 {
+		go func() {
+			ticker := time.NewTicker(time.Duration(listenerConfig.ReloadIntervalMs) * time.Millisecond)
+			for {
+				select {
+				case <-r.stopCh:
+					ticker.Stop()
+					return
+				case <-ticker.C:
+				}
+				if !r.changed() {
+					continue
+				}
+				if err := r.load(); err != nil {
+					r.logger.Error("Could not reload TLS certificate, keeping the previous one", zap.String("cert_file", r.certFile), zap.Error(err))
+				} else {
+					r.logger.Info("Reloaded TLS certificate", zap.String("cert_file", r.certFile))
+				}
+			}
+		}()
+	}
+
+	return r, nil
+}
+
+// GetCertificate is used as the tls.Config callback, so new connections always get the latest certificate.
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.RLock()
+	defer r.RUnlock()
+	return r.cert, nil
+}
+
+// Stop ends certificate reloading.
+func (r *certReloader) Stop() {
+	close(r.stopCh)
+}
+
+func (r *certReloader) load() error {
+	modTime := r.lastModified()
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	r.Lock()
+	r.cert = &cert
+	r.modTime = modTime
+	r.Unlock()
+	return nil
+}
+
+func (r *certReloader) changed() bool {
+	modTime := r.lastModified()
+	r.RLock()
+	defer r.RUnlock()
+	return !modTime.Equal(r.modTime)
+}
+
+// lastModified gives the latest modification time of the certificate and key files, which may be replaced separately.
+func (r *certReloader) lastModified() time.Time {
+	var modTime time.Time
+	for _, file := range []string{r.certFile, r.keyFile} {
+		if info, err := os.Stat(file); err == nil && info.ModTime().After(modTime) {
+			modTime = info.ModTime()
+		}
+	}
+	return modTime
+}
+
+// listenAndServe runs the HTTP server, over TLS if a certificate is configured for the listener.
+func listenAndServe(logger *zap.Logger, server *http.Server, listenerConfig *TLSConfigListener) error {
+	if listenerConfig.CertFile == "" {
+		return server.ListenAndServe()
+	}
+
+	reloader, err := newCertReloader(logger, listenerConfig)
+	if err != nil {
+		return err
+	}
+	server.TLSConfig = &tls.Config{
+		GetCertificate: reloader.GetCertificate,
+		MinVersion:     tls.VersionTLS12,
+	}
+	// This only returns once the server has stopped, after which the certificate is no longer needed.
+	err = server.ListenAndServeTLS("", "")
+	reloader.Stop()
+	return err
+}
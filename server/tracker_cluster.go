@@ -0,0 +1,927 @@
+// Copyright 2017 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/hashicorp/memberlist"
+	"github.com/satori/go.uuid"
+	"go.uber.org/zap"
+)
+
+const (
+	// Gossiped presence changes of one node.
+	clusterMessageDiff byte = iota
+	// All presences of one node, sent to nodes that join and exchanged periodically to repair lost changes.
+	clusterMessageState
+	// A message for sessions connected to the receiving node.
+	clusterMessageRoute
+	// Asks the node hosting an authoritative match if a presence may join it.
+	clusterMessageMatchJoinAttempt
+	// The answer to a match join attempt, sent back to the node that asked.
+	clusterMessageMatchJoinResult
+	// Client input for an authoritative match hosted by the receiving node.
+	clusterMessageMatchInput
+	// Presences on the receiving node removed from a match hosted by another node.
+	clusterMessageMatchKick
+)
+
+// Updates are split so each gossip message fits in a single UDP packet.
+const clusterTrackerBroadcastSize = 1000
+
+// Outgoing routed messages waiting to be sent to one node. Messages beyond this are dropped.
+const clusterTrackerPeerQueueSize = 256
+
+// Diffs of a node this many older than its latest are ignored, the next full state exchange repairs anything they held.
+const clusterTrackerSeqWindow = 1024
+
+const clusterTrackerLeaveTimeout = 5 * time.Second
+
+type clusterPresence struct {
+	SessionID uuid.UUID    `json:"s"`
+	Topic     string       `json:"t"`
+	UserID    uuid.UUID    `json:"u"`
+	Meta      PresenceMeta `json:"m"`
+}
+
+// clusterTrackerUpdate is a diff or the full state of the presences of one node. Each node numbers its updates, so
+// gossip retransmissions and changes older than the ones already applied are ignored, whatever order they arrive in.
+type clusterTrackerUpdate struct {
+	Node   string            `json:"n"`
+	Epoch  int64             `json:"e"`
+	Seq    int64             `json:"q"`
+	Joins  []clusterPresence `json:"j,omitempty"`
+	Leaves []clusterPresence `json:"l,omitempty"`
+}
+
+type clusterRoute struct {
+	Node       string      `json:"n"`
+	SessionIDs []uuid.UUID `json:"s"`
+	Envelope   []byte      `json:"e"`
+}
+
+type clusterMatchJoinAttempt struct {
+	Node     string          `json:"n"`
+	ID       uuid.UUID       `json:"i"`
+	MatchID  uuid.UUID       `json:"mid"`
+	Presence clusterPresence `json:"p"`
+}
+
+type clusterMatchJoinResult struct {
+	Node   string    `json:"n"`
+	ID     uuid.UUID `json:"i"`
+	Allow  bool      `json:"a"`
+	Reason string    `json:"r"`
+}
+
+type clusterMatchInput struct {
+	Node     string          `json:"n"`
+	MatchID  uuid.UUID       `json:"mid"`
+	Presence clusterPresence `json:"p"`
+	OpCode   int64           `json:"o"`
+	Data     []byte          `json:"d"`
+}
+
+type clusterMatchKick struct {
+	Node      string            `json:"n"`
+	Topic     string            `json:"t"`
+	Presences []clusterPresence `json:"p"`
+}
+
+// clusterTrackerPeer is another node in the cluster, and the versions of its presences applied. Presences in the last
+// full state are at stateSeq, and diffs since are applied once each, skipping changes to presences that a newer diff
+// already changed.
+type clusterTrackerPeer struct {
+	node     *memberlist.Node
+	epoch    int64
+	stateSeq int64
+	maxSeq   int64
+	diffs    map[int64]struct{}
+	versions map[presenceCompact]int64
+	routeCh  chan []byte
+}
+
+func newClusterTrackerPeer(node *memberlist.Node) *clusterTrackerPeer {
+	return &clusterTrackerPeer{
+		node:     node,
+		diffs:    make(map[int64]struct{}),
+		versions: make(map[presenceCompact]int64),
+		routeCh:  make(chan []byte, clusterTrackerPeerQueueSize),
+	}
+}
+
+// reset forgets the versions applied, when the node restarts with a new epoch.
+func (p *clusterTrackerPeer) reset(epoch int64) {
+	p.epoch = epoch
+	p.stateSeq = 0
+	p.maxSeq = 0
+	p.diffs = make(map[int64]struct{})
+	p.versions = make(map[presenceCompact]int64)
+}
+
+// prune forgets the versions no later update can be older than.
+func (p *clusterTrackerPeer) prune() {
+	min := p.stateSeq
+	if p.maxSeq-clusterTrackerSeqWindow > min {
+		min = p.maxSeq - clusterTrackerSeqWindow
+	}
+	for seq := range p.diffs {
+		if seq <= min {
+			delete(p.diffs, seq)
+		}
+	}
+	for pc, seq := range p.versions {
+		if seq <= min {
+			delete(p.versions, pc)
+		}
+	}
+}
+
+type clusterTrackerBroadcast []byte
+
+func (b clusterTrackerBroadcast) Invalidates(memberlist.Broadcast) bool {
+	return false
+}
+
+func (b clusterTrackerBroadcast) Message() []byte {
+	return b
+}
+
+func (b clusterTrackerBroadcast) Finished() {}
+
+// ClusterTracker is a Tracker shared by a cluster of nodes. Presences on this node are gossiped to the other nodes
+// as they change, and the presences of a node that leaves or fails are removed. Listing a topic gives the presences on
+// all nodes, and diff listeners are notified of changes on all nodes.
+type ClusterTracker struct {
+	sync.RWMutex
+	logger        *zap.Logger
+	name          string
+	joinAddrs     []string
+	joinTimeout   time.Duration
+	epoch         int64
+	seq           int64
+	diffListeners []func([]Presence, []Presence)
+	values        map[presenceCompact]PresenceMeta
+	peers         map[string]*clusterTrackerPeer
+	joinAttempts  map[uuid.UUID]chan *clusterMatchJoinResult
+	messageRouter MessageRouter
+	matchRegistry *MatchRegistry
+	memberlist    *memberlist.Memberlist
+	broadcasts    *memberlist.TransmitLimitedQueue
+}
+
+// NewClusterTracker starts listening for gossip from other nodes. Join must be called once the tracker is set up, to
+// join the cluster.
+func NewClusterTracker(logger *zap.Logger, config Config) (*ClusterTracker, error) {
+	clusterConfig := config.GetCluster()
+	// Allows for the match on the other node to time out a forwarded join attempt itself.
+	joinTimeout := 2 * time.Duration(config.GetMatch().JoinAttemptTimeoutMs) * time.Millisecond
+	t := &ClusterTracker{
+		logger:        logger,
+		name:          config.GetName(),
+		joinAddrs:     clusterConfig.GossipJoin,
+		joinTimeout:   joinTimeout,
+		epoch:         time.Now().UnixNano(),
+		diffListeners: make([]func([]Presence, []Presence), 0),
+		values:        make(map[presenceCompact]PresenceMeta),
+		peers:         make(map[string]*clusterTrackerPeer),
+		joinAttempts:  make(map[uuid.UUID]chan *clusterMatchJoinResult),
+	}
+
+	mlConfig := memberlist.DefaultLANConfig()
+	mlConfig.Name = t.name
+	mlConfig.Delegate = t
+	mlConfig.Events = t
+	mlConfig.PushPullInterval = time.Duration(clusterConfig.SyncIntervalMs) * time.Millisecond
+	mlConfig.Logger = zap.NewStdLog(logger)
+	// Gossip messages name the node they come from, so only nodes holding the key may be allowed to send them.
+	switch len(clusterConfig.GossipSecretKey) {
+	case 16, 24, 32:
+		mlConfig.SecretKey = []byte(clusterConfig.GossipSecretKey)
+	case 0:
+		return nil, errors.New("gossip secret key is required to run a cluster")
+	default:
+		return nil, errors.New("gossip secret key must be 16, 24 or 32 bytes")
+	}
+
+	var err error
+	if mlConfig.BindAddr, mlConfig.BindPort, err = splitHostPort(clusterConfig.GossipBindAddr); err != nil {
+		return nil, errors.New("invalid gossip bind address: " + err.Error())
+	}
+	if clusterConfig.GossipAdvertiseAddr != "" {
+		if mlConfig.AdvertiseAddr, mlConfig.AdvertisePort, err = splitHostPort(clusterConfig.GossipAdvertiseAddr); err != nil {
+			return nil, errors.New("invalid gossip advertise address: " + err.Error())
+		}
+	} else {
+		mlConfig.AdvertisePort = mlConfig.BindPort
+	}
+
+	t.broadcasts = &memberlist.TransmitLimitedQueue{
+		NumNodes: func() int {
+			return t.memberlist.NumMembers()
+		},
+		RetransmitMult: mlConfig.RetransmitMult,
+	}
+	// Nothing is gossiped or received until other nodes know of this one, so the tracker is ready to use.
+	if t.memberlist, err = memberlist.Create(mlConfig); err != nil {
+		return nil, err
+	}
+
+	return t, nil
+}
+
+// SetMessageRouter sets the router used to deliver messages sent from other nodes to sessions on this node.
+func (t *ClusterTracker) SetMessageRouter(messageRouter MessageRouter) {
+	t.Lock()
+	t.messageRouter = messageRouter
+	t.Unlock()
+}
+
+// SetMatchRegistry sets the registry of authoritative matches on this node, which other nodes forward requests to.
+func (t *ClusterTracker) SetMatchRegistry(matchRegistry *MatchRegistry) {
+	t.Lock()
+	t.matchRegistry = matchRegistry
+	t.Unlock()
+}
+
+// Join contacts the configured nodes to join their cluster. Nodes that can't be reached are logged, and the node
+// keeps running on its own until other nodes join it.
+func (t *ClusterTracker) Join() {
+	if len(t.joinAddrs) == 0 {
+		t.logger.Info("Started new cluster", zap.String("node", t.name))
+		return
+	}
+	count, err := t.memberlist.Join(t.joinAddrs)
+	if err != nil {
+		t.logger.Warn("Could not join cluster, running alone until other nodes join", zap.Strings("join", t.joinAddrs), zap.Error(err))
+		return
+	}
+	t.logger.Info("Joined cluster", zap.Int("contacted", count), zap.Int("members", t.memberlist.NumMembers()))
+}
+
+func (t *ClusterTracker) AddDiffListener(f func([]Presence, []Presence)) {
+	t.Lock()
+	t.diffListeners = append(t.diffListeners, f)
+	t.Unlock()
+}
+
+// Stop leaves the cluster, so other nodes remove the presences of this node straight away.
+func (t *ClusterTracker) Stop() {
+	if err := t.memberlist.Leave(clusterTrackerLeaveTimeout); err != nil {
+		t.logger.Warn("Could not leave cluster", zap.Error(err))
+	}
+	if err := t.memberlist.Shutdown(); err != nil {
+		t.logger.Warn("Could not stop gossip", zap.Error(err))
+	}
+
+	t.Lock()
+	for name, peer := range t.peers {
+		close(peer.routeCh)
+		delete(t.peers, name)
+	}
+	t.Unlock()
+}
+
+func (t *ClusterTracker) Track(sessionID uuid.UUID, topic string, userID uuid.UUID, meta PresenceMeta) {
+	pc := presenceCompact{ID: PresenceID{Node: t.name, SessionID: sessionID}, Topic: topic, UserID: userID}
+	t.Lock()
+	if _, ok := t.values[pc]; !ok {
+		t.values[pc] = meta
+		t.applied(
+			[]Presence{
+				Presence{ID: pc.ID, Topic: topic, UserID: userID, Meta: meta},
+			},
+			[]Presence{},
+		)
+	}
+	t.Unlock()
+}
+
+func (t *ClusterTracker) Untrack(sessionID uuid.UUID, topic string, userID uuid.UUID) {
+	pc := presenceCompact{ID: PresenceID{Node: t.name, SessionID: sessionID}, Topic: topic, UserID: userID}
+	t.Lock()
+	if meta, ok := t.values[pc]; ok {
+		delete(t.values, pc)
+		t.applied(
+			[]Presence{},
+			[]Presence{
+				Presence{ID: pc.ID, Topic: topic, UserID: userID, Meta: meta},
+			},
+		)
+	}
+	t.Unlock()
+}
+
+func (t *ClusterTracker) UntrackAll(sessionID uuid.UUID) {
+	ps := make([]Presence, 0)
+	t.Lock()
+	for pc, m := range t.values {
+		if pc.ID.SessionID == sessionID && pc.ID.Node == t.name {
+			ps = append(ps, Presence{ID: pc.ID, Topic: pc.Topic, UserID: pc.UserID, Meta: m})
+		}
+	}
+	if len(ps) != 0 {
+		for _, p := range ps {
+			delete(t.values, presenceCompact{ID: p.ID, Topic: p.Topic, UserID: p.UserID})
+		}
+		t.applied([]Presence{}, ps)
+	}
+	t.Unlock()
+}
+
+func (t *ClusterTracker) Update(sessionID uuid.UUID, topic string, userID uuid.UUID, meta PresenceMeta) error {
+	pc := presenceCompact{ID: PresenceID{Node: t.name, SessionID: sessionID}, Topic: topic, UserID: userID}
+	var e error
+	t.Lock()
+	if m, ok := t.values[pc]; ok {
+		t.values[pc] = meta
+		t.applied(
+			[]Presence{
+				Presence{ID: pc.ID, Topic: topic, UserID: userID, Meta: meta},
+			},
+			[]Presence{
+				Presence{ID: pc.ID, Topic: topic, UserID: userID, Meta: m},
+			},
+		)
+	} else {
+		e = errors.New("no existing presence")
+	}
+	t.Unlock()
+	return e
+}
+
+func (t *ClusterTracker) UpdateAll(sessionID uuid.UUID, meta PresenceMeta) {
+	joins := make([]Presence, 0)
+	leaves := make([]Presence, 0)
+	t.Lock()
+	for pc, m := range t.values {
+		if pc.ID.SessionID == sessionID && pc.ID.Node == t.name {
+			joins = append(joins, Presence{ID: pc.ID, Topic: pc.Topic, UserID: pc.UserID, Meta: meta})
+			leaves = append(leaves, Presence{ID: pc.ID, Topic: pc.Topic, UserID: pc.UserID, Meta: m})
+		}
+	}
+	if len(joins) != 0 {
+		for _, p := range joins {
+			t.values[presenceCompact{ID: p.ID, Topic: p.Topic, UserID: p.UserID}] = p.Meta
+		}
+		t.applied(joins, leaves)
+	}
+	t.Unlock()
+}
+
+// Count gives the number of presences on all nodes.
+func (t *ClusterTracker) Count() int {
+	t.RLock()
+	count := len(t.values)
+	t.RUnlock()
+	return count
+}
+
+func (t *ClusterTracker) CheckLocalByIDTopicUser(sessionID uuid.UUID, topic string, userID uuid.UUID) bool {
+	pc := presenceCompact{ID: PresenceID{Node: t.name, SessionID: sessionID}, Topic: topic, UserID: userID}
+	t.RLock()
+	_, ok := t.values[pc]
+	t.RUnlock()
+	return ok
+}
+
+// ListByTopic gives the presences in the topic on all nodes.
+func (t *ClusterTracker) ListByTopic(topic string) []Presence {
+	ps := make([]Presence, 0)
+	t.RLock()
+	for pc, m := range t.values {
+		if pc.Topic == topic {
+			ps = append(ps, Presence{ID: pc.ID, Topic: topic, UserID: pc.UserID, Meta: m})
+		}
+	}
+	t.RUnlock()
+	return ps
+}
+
+func (t *ClusterTracker) ListLocalByTopic(topic string) []Presence {
+	ps := make([]Presence, 0)
+	t.RLock()
+	for pc, m := range t.values {
+		if pc.Topic == topic && pc.ID.Node == t.name {
+			ps = append(ps, Presence{ID: pc.ID, Topic: topic, UserID: pc.UserID, Meta: m})
+		}
+	}
+	t.RUnlock()
+	return ps
+}
+
+// Forward queues a message for sessions connected to another node. Messages to the same node are sent in order.
+func (t *ClusterTracker) Forward(node string, sessionIDs []uuid.UUID, msg proto.Message) error {
+	envelope, err := proto.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	return t.send(node, clusterMessageRoute, &clusterRoute{Node: t.name, SessionIDs: sessionIDs, Envelope: envelope})
+}
+
+// ForwardMatchJoinAttempt asks the node hosting an authoritative match if the presence may join it.
+func (t *ClusterTracker) ForwardMatchJoinAttempt(node string, matchID uuid.UUID, presence Presence) (bool, string) {
+	attempt := &clusterMatchJoinAttempt{
+		Node:     t.name,
+		ID:       uuid.NewV4(),
+		MatchID:  matchID,
+		Presence: clusterPresence{SessionID: presence.ID.SessionID, Topic: presence.Topic, UserID: presence.UserID, Meta: presence.Meta},
+	}
+	resultCh := make(chan *clusterMatchJoinResult, 1)
+	t.Lock()
+	t.joinAttempts[attempt.ID] = resultCh
+	t.Unlock()
+	defer func() {
+		t.Lock()
+		delete(t.joinAttempts, attempt.ID)
+		t.Unlock()
+	}()
+
+	if err := t.send(node, clusterMessageMatchJoinAttempt, attempt); err != nil {
+		t.logger.Warn("Could not forward match join attempt", zap.String("node", node), zap.Error(err))
+		return false, "Match did not respond"
+	}
+	select {
+	case result := <-resultCh:
+		return result.Allow, result.Reason
+	case <-time.After(t.joinTimeout):
+		return false, "Match did not respond"
+	}
+}
+
+// ForwardMatchInput queues client input for an authoritative match hosted by another node.
+func (t *ClusterTracker) ForwardMatchInput(node string, matchID uuid.UUID, message *MatchMessage) error {
+	p := message.Presence
+	return t.send(node, clusterMessageMatchInput, &clusterMatchInput{
+		Node:     t.name,
+		MatchID:  matchID,
+		Presence: clusterPresence{SessionID: p.ID.SessionID, Topic: p.Topic, UserID: p.UserID, Meta: p.Meta},
+		OpCode:   message.OpCode,
+		Data:     message.Data,
+	})
+}
+
+// ForwardMatchKick removes presences on another node from a match topic.
+func (t *ClusterTracker) ForwardMatchKick(node string, topic string, presences []Presence) error {
+	kick := &clusterMatchKick{Node: t.name, Topic: topic, Presences: make([]clusterPresence, len(presences))}
+	for i, p := range presences {
+		kick.Presences[i] = clusterPresence{SessionID: p.ID.SessionID, Topic: topic, UserID: p.UserID}
+	}
+	return t.send(node, clusterMessageMatchKick, kick)
+}
+
+// send queues a message for another node. Messages to the same node are sent in order.
+func (t *ClusterTracker) send(node string, messageType byte, message interface{}) error {
+	payload, err := encodeClusterMessage(messageType, message)
+	if err != nil {
+		return err
+	}
+
+	t.RLock()
+	defer t.RUnlock()
+	peer, ok := t.peers[node]
+	if !ok {
+		return errors.New("node is not in the cluster")
+	}
+	select {
+	case peer.routeCh <- payload:
+		return nil
+	default:
+		return errors.New("node queue full")
+	}
+}
+
+// NodeMeta is part of memberlist.Delegate, no metadata is gossiped.
+func (t *ClusterTracker) NodeMeta(limit int) []byte {
+	return []byte{}
+}
+
+// NotifyMsg is part of memberlist.Delegate, and handles gossiped diffs and messages sent directly to this node.
+// Messages from nodes not in the cluster are dropped.
+func (t *ClusterTracker) NotifyMsg(buf []byte) {
+	if len(buf) == 0 {
+		return
+	}
+	switch buf[0] {
+	case clusterMessageDiff, clusterMessageState:
+		update := &clusterTrackerUpdate{}
+		if err := json.Unmarshal(buf[1:], update); err != nil {
+			t.logger.Warn("Could not decode cluster presences", zap.Error(err))
+			return
+		}
+		t.merge(update, buf[0] == clusterMessageState)
+	case clusterMessageRoute:
+		route := &clusterRoute{}
+		if t.decode(buf, route) && t.isPeer(route.Node) {
+			t.deliver(route)
+		}
+	case clusterMessageMatchJoinAttempt:
+		attempt := &clusterMatchJoinAttempt{}
+		if t.decode(buf, attempt) && t.isPeer(attempt.Node) {
+			// The match may take until its join attempt timeout to answer, gossip is not held up meanwhile.
+			go t.matchJoinAttempt(attempt)
+		}
+	case clusterMessageMatchJoinResult:
+		result := &clusterMatchJoinResult{}
+		if t.decode(buf, result) && t.isPeer(result.Node) {
+			t.RLock()
+			if resultCh, ok := t.joinAttempts[result.ID]; ok {
+				select {
+				case resultCh <- result:
+				default:
+				}
+			}
+			t.RUnlock()
+		}
+	case clusterMessageMatchInput:
+		input := &clusterMatchInput{}
+		if t.decode(buf, input) && t.isPeer(input.Node) {
+			t.matchInput(input)
+		}
+	case clusterMessageMatchKick:
+		kick := &clusterMatchKick{}
+		if t.decode(buf, kick) && t.isPeer(kick.Node) {
+			for _, cp := range kick.Presences {
+				t.Untrack(cp.SessionID, kick.Topic, cp.UserID)
+			}
+		}
+	default:
+		t.logger.Warn("Unrecognized cluster message", zap.Int("type", int(buf[0])))
+	}
+}
+
+// GetBroadcasts is part of memberlist.Delegate, and gives the queued diffs to gossip.
+func (t *ClusterTracker) GetBroadcasts(overhead, limit int) [][]byte {
+	return t.broadcasts.GetBroadcasts(overhead, limit)
+}
+
+// LocalState is part of memberlist.Delegate, and gives the presences on this node for a full state exchange.
+func (t *ClusterTracker) LocalState(join bool) []byte {
+	t.RLock()
+	buf, err := t.encodeState()
+	t.RUnlock()
+	if err != nil {
+		t.logger.Error("Could not encode cluster presences", zap.Error(err))
+		return []byte{}
+	}
+	return buf[1:]
+}
+
+// MergeRemoteState is part of memberlist.Delegate, and applies the presences of another node from a full state
+// exchange.
+func (t *ClusterTracker) MergeRemoteState(buf []byte, join bool) {
+	if len(buf) == 0 {
+		return
+	}
+	update := &clusterTrackerUpdate{}
+	if err := json.Unmarshal(buf, update); err != nil {
+		t.logger.Warn("Could not decode cluster presences", zap.Error(err))
+		return
+	}
+	t.merge(update, true)
+}
+
+// NotifyJoin is part of memberlist.EventDelegate. The new node is sent the presences on this node, rather than waiting
+// for the next full state exchange.
+func (t *ClusterTracker) NotifyJoin(node *memberlist.Node) {
+	if node.Name == t.name {
+		return
+	}
+
+	t.Lock()
+	defer t.Unlock()
+	if _, ok := t.peers[node.Name]; ok {
+		return
+	}
+	peer := newClusterTrackerPeer(node)
+	t.peers[node.Name] = peer
+	go t.processRoutes(peer)
+
+	if state, err := t.encodeState(); err != nil {
+		t.logger.Error("Could not encode cluster presences", zap.Error(err))
+	} else {
+		peer.routeCh <- state
+	}
+	t.logger.Info("Node joined cluster", zap.String("node", node.Name), zap.String("addr", node.Address()))
+}
+
+// NotifyLeave is part of memberlist.EventDelegate, and removes the presences of a node that left or failed.
+func (t *ClusterTracker) NotifyLeave(node *memberlist.Node) {
+	if node.Name == t.name {
+		return
+	}
+
+	leaves := make([]Presence, 0)
+	t.Lock()
+	if peer, ok := t.peers[node.Name]; ok {
+		close(peer.routeCh)
+		delete(t.peers, node.Name)
+	}
+	for pc, m := range t.values {
+		if pc.ID.Node == node.Name {
+			delete(t.values, pc)
+			leaves = append(leaves, Presence{ID: pc.ID, Topic: pc.Topic, UserID: pc.UserID, Meta: m})
+		}
+	}
+	if len(leaves) != 0 {
+		t.notifyDiffListeners([]Presence{}, leaves)
+	}
+	t.Unlock()
+	t.logger.Info("Node left cluster", zap.String("node", node.Name), zap.Int("presences", len(leaves)))
+}
+
+// NotifyUpdate is part of memberlist.EventDelegate, node metadata is not used.
+func (t *ClusterTracker) NotifyUpdate(node *memberlist.Node) {}
+
+// applied gossips a change to presences on this node and notifies diff listeners. It must be called with the lock held.
+func (t *ClusterTracker) applied(joins, leaves []Presence) {
+	t.notifyDiffListeners(joins, leaves)
+
+	update := &clusterTrackerUpdate{Node: t.name, Epoch: t.epoch}
+	size := 0
+	queue := func() {
+		t.seq++
+		update.Seq = t.seq
+		if buf, err := encodeClusterMessage(clusterMessageDiff, update); err != nil {
+			t.logger.Error("Could not encode cluster presences", zap.Error(err))
+		} else {
+			t.broadcasts.QueueBroadcast(clusterTrackerBroadcast(buf))
+		}
+		update = &clusterTrackerUpdate{Node: t.name, Epoch: t.epoch}
+		size = 0
+	}
+	add := func(ps []Presence, join bool) {
+		for _, p := range ps {
+			// Estimated from the fixed size fields of an encoded presence.
+			presenceSize := len(p.Topic) + len(p.Meta.Handle) + 100
+			if size != 0 && size+presenceSize > clusterTrackerBroadcastSize {
+				queue()
+			}
+			cp := clusterPresence{SessionID: p.ID.SessionID, Topic: p.Topic, UserID: p.UserID, Meta: p.Meta}
+			if join {
+				update.Joins = append(update.Joins, cp)
+			} else {
+				update.Leaves = append(update.Leaves, cp)
+			}
+			size += presenceSize
+		}
+	}
+	// Leaves go first, so an update is applied as the leave of the old presence and the join of the new one.
+	add(leaves, false)
+	add(joins, true)
+	if size != 0 {
+		queue()
+	}
+}
+
+// merge applies a diff or the full state of another node's presences, and notifies diff listeners of the changes.
+func (t *ClusterTracker) merge(update *clusterTrackerUpdate, state bool) {
+	if update.Node == t.name {
+		return
+	}
+
+	t.Lock()
+	defer t.Unlock()
+
+	// Presences of nodes not in the cluster would never be removed.
+	peer, ok := t.peers[update.Node]
+	if !ok {
+		return
+	}
+	if update.Epoch < peer.epoch {
+		// From before the node restarted.
+		return
+	}
+	if update.Epoch > peer.epoch {
+		peer.reset(update.Epoch)
+		// Anything kept from the previous run of the node is replaced by the next state exchange.
+	}
+
+	joins := make([]Presence, 0)
+	leaves := make([]Presence, 0)
+	leave := func(pc presenceCompact) {
+		if m, ok := t.values[pc]; ok {
+			delete(t.values, pc)
+			leaves = append(leaves, Presence{ID: pc.ID, Topic: pc.Topic, UserID: pc.UserID, Meta: m})
+		}
+	}
+	join := func(pc presenceCompact, m PresenceMeta) {
+		t.values[pc] = m
+		joins = append(joins, Presence{ID: pc.ID, Topic: pc.Topic, UserID: pc.UserID, Meta: m})
+	}
+
+	if state {
+		if update.Seq < peer.stateSeq {
+			return
+		}
+		// Presences changed by diffs newer than the state are left as they are.
+		current := make(map[presenceCompact]PresenceMeta, len(update.Joins))
+		for _, cp := range update.Joins {
+			current[presenceCompact{ID: PresenceID{Node: update.Node, SessionID: cp.SessionID}, Topic: cp.Topic, UserID: cp.UserID}] = cp.Meta
+		}
+		for pc, m := range t.values {
+			if pc.ID.Node != update.Node || peer.versions[pc] > update.Seq {
+				continue
+			}
+			if cm, ok := current[pc]; !ok || cm != m {
+				leave(pc)
+			}
+		}
+		for pc, m := range current {
+			if peer.versions[pc] > update.Seq {
+				continue
+			}
+			if _, ok := t.values[pc]; !ok {
+				join(pc, m)
+			}
+		}
+		peer.stateSeq = update.Seq
+		peer.prune()
+	} else {
+		if update.Seq <= peer.stateSeq || update.Seq <= peer.maxSeq-clusterTrackerSeqWindow {
+			return
+		}
+		if _, ok := peer.diffs[update.Seq]; ok {
+			return
+		}
+		peer.diffs[update.Seq] = struct{}{}
+		if update.Seq > peer.maxSeq {
+			peer.maxSeq = update.Seq
+		}
+		// Leaves go first, a diff holding both the leave and join of a presence updates it.
+		for _, cp := range update.Leaves {
+			pc := presenceCompact{ID: PresenceID{Node: update.Node, SessionID: cp.SessionID}, Topic: cp.Topic, UserID: cp.UserID}
+			if peer.versions[pc] > update.Seq {
+				continue
+			}
+			peer.versions[pc] = update.Seq
+			leave(pc)
+		}
+		for _, cp := range update.Joins {
+			pc := presenceCompact{ID: PresenceID{Node: update.Node, SessionID: cp.SessionID}, Topic: cp.Topic, UserID: cp.UserID}
+			if peer.versions[pc] > update.Seq {
+				continue
+			}
+			peer.versions[pc] = update.Seq
+			if m, ok := t.values[pc]; ok && m == cp.Meta {
+				continue
+			}
+			leave(pc)
+			join(pc, cp.Meta)
+		}
+		if len(peer.diffs) > 2*clusterTrackerSeqWindow {
+			peer.prune()
+		}
+	}
+
+	if len(joins) != 0 || len(leaves) != 0 {
+		t.notifyDiffListeners(joins, leaves)
+	}
+}
+
+// deliver sends a message forwarded by another node to sessions on this node.
+func (t *ClusterTracker) deliver(route *clusterRoute) {
+	t.RLock()
+	messageRouter := t.messageRouter
+	t.RUnlock()
+	if messageRouter == nil {
+		return
+	}
+
+	envelope := &Envelope{}
+	if err := proto.Unmarshal(route.Envelope, envelope); err != nil {
+		t.logger.Warn("Could not decode cluster message", zap.Error(err))
+		return
+	}
+	ps := make([]Presence, len(route.SessionIDs))
+	for i, sessionID := range route.SessionIDs {
+		ps[i] = Presence{ID: PresenceID{Node: t.name, SessionID: sessionID}}
+	}
+	messageRouter.Send(t.logger, ps, envelope)
+}
+
+// matchJoinAttempt asks an authoritative match on this node if a presence on another node may join, and sends the
+// answer back.
+func (t *ClusterTracker) matchJoinAttempt(attempt *clusterMatchJoinAttempt) {
+	t.RLock()
+	matchRegistry := t.matchRegistry
+	t.RUnlock()
+
+	result := &clusterMatchJoinResult{Node: t.name, ID: attempt.ID, Reason: "Match not found"}
+	if matchRegistry != nil {
+		if m := matchRegistry.Get(attempt.MatchID); m != nil {
+			cp := attempt.Presence
+			result.Allow, result.Reason = m.JoinAttempt(Presence{
+				ID:     PresenceID{Node: attempt.Node, SessionID: cp.SessionID},
+				Topic:  cp.Topic,
+				UserID: cp.UserID,
+				Meta:   cp.Meta,
+			})
+		}
+	}
+	if err := t.send(attempt.Node, clusterMessageMatchJoinResult, result); err != nil {
+		t.logger.Warn("Could not answer match join attempt", zap.String("node", attempt.Node), zap.Error(err))
+	}
+}
+
+// matchInput queues client input from another node for an authoritative match on this node.
+func (t *ClusterTracker) matchInput(input *clusterMatchInput) {
+	t.RLock()
+	matchRegistry := t.matchRegistry
+	t.RUnlock()
+	if matchRegistry == nil {
+		return
+	}
+
+	if m := matchRegistry.Get(input.MatchID); m != nil {
+		cp := input.Presence
+		m.Input(&MatchMessage{
+			Presence: Presence{ID: PresenceID{Node: input.Node, SessionID: cp.SessionID}, Topic: cp.Topic, UserID: cp.UserID, Meta: cp.Meta},
+			OpCode:   input.OpCode,
+			Data:     input.Data,
+		})
+	}
+}
+
+// processRoutes sends queued messages to one node, until the node leaves the cluster.
+func (t *ClusterTracker) processRoutes(peer *clusterTrackerPeer) {
+	for payload := range peer.routeCh {
+		if err := t.memberlist.SendReliable(peer.node, payload); err != nil {
+			t.logger.Warn("Could not send to node", zap.String("node", peer.node.Name), zap.Error(err))
+		}
+	}
+}
+
+// encodeState encodes the presences on this node. It must be called with the lock held.
+func (t *ClusterTracker) encodeState() ([]byte, error) {
+	update := &clusterTrackerUpdate{Node: t.name, Epoch: t.epoch, Seq: t.seq}
+	for pc, m := range t.values {
+		if pc.ID.Node == t.name {
+			update.Joins = append(update.Joins, clusterPresence{SessionID: pc.ID.SessionID, Topic: pc.Topic, UserID: pc.UserID, Meta: m})
+		}
+	}
+	return encodeClusterMessage(clusterMessageState, update)
+}
+
+// decode decodes a message sent directly to this node, logging it if it can't be decoded.
+func (t *ClusterTracker) decode(buf []byte, message interface{}) bool {
+	if err := json.Unmarshal(buf[1:], message); err != nil {
+		t.logger.Warn("Could not decode cluster message", zap.Error(err))
+		return false
+	}
+	return true
+}
+
+func (t *ClusterTracker) isPeer(node string) bool {
+	t.RLock()
+	_, ok := t.peers[node]
+	t.RUnlock()
+	return ok
+}
+
+func (t *ClusterTracker) notifyDiffListeners(joins, leaves []Presence) {
+	go func() {
+		for _, f := range t.diffListeners {
+			f(joins, leaves)
+		}
+	}()
+}
+
+func encodeClusterMessage(messageType byte, message interface{}) ([]byte, error) {
+	buf, err := json.Marshal(message)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte{messageType}, buf...), nil
+}
+
+func splitHostPort(addr string) (string, int, error) {
+	host, portString, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", 0, err
+	}
+	port, err := strconv.Atoi(portString)
+	if err != nil {
+		return "", 0, err
+	}
+	return host, port, nil
+}
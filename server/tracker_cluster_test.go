@@ -0,0 +1,131 @@
+// Copyright 2017 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"testing"
+
+	"github.com/hashicorp/memberlist"
+	"github.com/satori/go.uuid"
+	"go.uber.org/zap"
+)
+
+func TestClusterTrackerMerge(t *testing.T) {
+	s1 := uuid.NewV4()
+	s2 := uuid.NewV4()
+	presence := func(sessionID uuid.UUID, handle string) clusterPresence {
+		return clusterPresence{SessionID: sessionID, Topic: "room:test", UserID: sessionID, Meta: PresenceMeta{Handle: handle}}
+	}
+	diff := func(node string, epoch, seq int64, joins, leaves []clusterPresence) *clusterTrackerUpdate {
+		return &clusterTrackerUpdate{Node: node, Epoch: epoch, Seq: seq, Joins: joins, Leaves: leaves}
+	}
+	type update struct {
+		update *clusterTrackerUpdate
+		state  bool
+	}
+
+	tests := []struct {
+		name     string
+		updates  []update
+		expected map[uuid.UUID]string
+	}{
+		{"diffs in order", []update{
+			{diff("b", 1, 1, []clusterPresence{presence(s1, "a")}, nil), false},
+			{diff("b", 1, 2, nil, []clusterPresence{presence(s1, "a")}), false},
+		}, map[uuid.UUID]string{}},
+		{"leave before its join", []update{
+			{diff("b", 1, 2, nil, []clusterPresence{presence(s1, "a")}), false},
+			{diff("b", 1, 1, []clusterPresence{presence(s1, "a")}, nil), false},
+		}, map[uuid.UUID]string{}},
+		{"reordered joins", []update{
+			{diff("b", 1, 2, []clusterPresence{presence(s2, "b")}, nil), false},
+			{diff("b", 1, 1, []clusterPresence{presence(s1, "a")}, nil), false},
+		}, map[uuid.UUID]string{s1: "a", s2: "b"}},
+		{"retransmitted diff", []update{
+			{diff("b", 1, 1, []clusterPresence{presence(s1, "a")}, nil), false},
+			{diff("b", 1, 2, nil, []clusterPresence{presence(s1, "a")}), false},
+			{diff("b", 1, 1, []clusterPresence{presence(s1, "a")}, nil), false},
+		}, map[uuid.UUID]string{}},
+		{"update", []update{
+			{diff("b", 1, 1, []clusterPresence{presence(s1, "a")}, nil), false},
+			{diff("b", 1, 2, []clusterPresence{presence(s1, "b")}, []clusterPresence{presence(s1, "a")}), false},
+		}, map[uuid.UUID]string{s1: "b"}},
+		{"diff included in state", []update{
+			{diff("b", 1, 2, []clusterPresence{presence(s1, "a")}, nil), true},
+			{diff("b", 1, 1, nil, []clusterPresence{presence(s1, "a")}), false},
+		}, map[uuid.UUID]string{s1: "a"}},
+		{"state keeps newer diffs", []update{
+			{diff("b", 1, 3, []clusterPresence{presence(s2, "b")}, nil), false},
+			{diff("b", 1, 4, nil, []clusterPresence{presence(s1, "a")}), false},
+			{diff("b", 1, 2, []clusterPresence{presence(s1, "a")}, nil), true},
+		}, map[uuid.UUID]string{s2: "b"}},
+		{"state replaces older presences", []update{
+			{diff("b", 1, 1, []clusterPresence{presence(s1, "a")}, nil), false},
+			{diff("b", 1, 2, []clusterPresence{presence(s2, "b")}, nil), true},
+		}, map[uuid.UUID]string{s2: "b"}},
+		{"older state", []update{
+			{diff("b", 1, 3, []clusterPresence{presence(s1, "a")}, nil), true},
+			{diff("b", 1, 2, nil, nil), true},
+		}, map[uuid.UUID]string{s1: "a"}},
+		{"diff outside the window", []update{
+			{diff("b", 1, clusterTrackerSeqWindow+2, []clusterPresence{presence(s1, "a")}, nil), false},
+			{diff("b", 1, 1, []clusterPresence{presence(s2, "b")}, nil), false},
+		}, map[uuid.UUID]string{s1: "a"}},
+		{"new epoch", []update{
+			{diff("b", 1, 5, []clusterPresence{presence(s1, "a")}, nil), false},
+			{diff("b", 2, 1, []clusterPresence{presence(s2, "b")}, nil), false},
+		}, map[uuid.UUID]string{s1: "a", s2: "b"}},
+		{"state of new epoch", []update{
+			{diff("b", 1, 5, []clusterPresence{presence(s1, "a")}, nil), false},
+			{diff("b", 2, 1, []clusterPresence{presence(s2, "b")}, nil), true},
+		}, map[uuid.UUID]string{s2: "b"}},
+		{"old epoch", []update{
+			{diff("b", 2, 1, []clusterPresence{presence(s1, "a")}, nil), false},
+			{diff("b", 1, 9, []clusterPresence{presence(s2, "b")}, nil), false},
+		}, map[uuid.UUID]string{s1: "a"}},
+		{"node not in the cluster", []update{
+			{diff("c", 1, 1, []clusterPresence{presence(s1, "a")}, nil), false},
+			{diff("c", 1, 2, []clusterPresence{presence(s2, "b")}, nil), true},
+		}, map[uuid.UUID]string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tracker := &ClusterTracker{
+				logger: zap.NewNop(),
+				name:   "a",
+				values: make(map[presenceCompact]PresenceMeta),
+				peers: map[string]*clusterTrackerPeer{
+					"b": newClusterTrackerPeer(&memberlist.Node{Name: "b"}),
+				},
+			}
+			for _, u := range tt.updates {
+				tracker.merge(u.update, u.state)
+			}
+
+			presences := make(map[uuid.UUID]string)
+			for pc, m := range tracker.values {
+				presences[pc.ID.SessionID] = m.Handle
+			}
+			if len(presences) != len(tt.expected) {
+				t.Fatalf("presences %v, expected %v", presences, tt.expected)
+			}
+			for sessionID, handle := range tt.expected {
+				if presences[sessionID] != handle {
+					t.Fatalf("presences %v, expected %v", presences, tt.expected)
+				}
+			}
+		})
+	}
+}